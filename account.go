@@ -2,6 +2,7 @@ package mup
 
 import (
 	"fmt"
+	"net/url"
 	"time"
 
 	"gopkg.in/mgo.v2"
@@ -19,6 +20,9 @@ type accountManager struct {
 	clients  map[string]accountClient
 	requests chan interface{}
 	incoming chan *Message
+	proxy    *url.URL
+	mirror   *mirror
+	audit    *auditor
 }
 
 type accountClient interface {
@@ -32,6 +36,13 @@ type accountClient interface {
 	UpdateInfo(info *accountInfo)
 }
 
+// noReconnecter is implemented by account clients that may be told by
+// their server to not come back. NoReconnect is only called after the
+// client is stopped, and returns the reason for not reconnecting, if any.
+type noReconnecter interface {
+	NoReconnect() string
+}
+
 type accountInfo struct {
 	Name        string `bson:"_id"`
 	Kind        string
@@ -39,10 +50,78 @@ type accountInfo struct {
 	Host        string
 	TLS         bool
 	TLSInsecure bool
+	TLSCert     string
+	TLSKey      string
+	SASL        string
+	SASLRequire bool
 	Nick        string
+	Username    string
+	Realname    string
 	Password    string
 	Channels    []channelInfo
 	LastId      bson.ObjectId
+	NoReconnect []string
+	Blocked     string
+	Locale      string
+	ReplyPrefix *string
+	Wallops     bool
+	Admins      []string
+	Invites     string
+	KeepInvites bool
+
+	// Charset defines the encoding of text exchanged with IRC servers, for
+	// older networks that expect something other than UTF-8. Supported
+	// values are "utf-8" (the default), "iso-8859-1" ("latin1"),
+	// "iso-8859-15" ("latin9"), and "windows-1252" ("cp1252"). Characters
+	// that cannot be encoded are sent as question marks.
+	Charset string
+
+	// ConfirmEvery and ConfirmDelay define how delivery of outgoing
+	// messages is confirmed with the server. By default every message
+	// is followed by a PING, and the respective PONG advances the last
+	// confirmed message id. When ConfirmEvery is above one, a single
+	// PING confirms that many messages at once, or whatever was sent
+	// after ConfirmDelay elapses (or after the next keep-alive PING, if
+	// unset). Unconfirmed messages are sent again on reconnections.
+	ConfirmEvery int
+	ConfirmDelay DurationString
+
+	// OnRegister holds raw IRC commands sent once registration completes,
+	// before channels are joined (e.g. "MODE mup +B"). Registration
+	// completes on the welcome notice, or at the end of the MOTD for
+	// servers and bouncers that skip it. With JoinAfterMOTD set, the end
+	// of the MOTD is always waited for.
+	OnRegister    []string
+	JoinAfterMOTD bool
+
+	// CTCPReplies enables automatic replies to the CTCP VERSION, PING, TIME,
+	// and CLIENTINFO requests received, which are queued as outgoing
+	// NOTICEs. Only a few requests per minute are answered from each sender,
+	// and a few more overall. CTCPVersion defines the reply to VERSION
+	// requests, "mup" by default. Requests are delivered to plugins either
+	// way, and may be parsed via ParseCTCP.
+	CTCPReplies bool
+	CTCPVersion string
+
+	// JoinDelay defines how long to wait between the JOIN commands sent
+	// when many channels are joined at once and they do not fit in a
+	// single line, so that servers enforcing join rate limits are not
+	// tripped. Channels pending confirmation are retried with the same
+	// spacing. Other messages keep flowing while later JOIN commands wait,
+	// and JOIN commands still waiting when the channels change are replaced
+	// by those for the new channels. By default all JOIN commands are sent
+	// at once.
+	JoinDelay DurationString
+
+	// RegainNick enables switching back to the configured nick as soon
+	// as whoever held it while the bot was registered under an alternative
+	// nick quits or changes nick, rather than waiting for the next
+	// periodic attempt. If RegainNickServ is also set to a NickServ
+	// command such as "GHOST" or "REGAIN", that command is sent to
+	// NickServ with the configured nick once registration completes, so
+	// that the nick is freed when the bot is identified via SASL.
+	RegainNick     bool
+	RegainNickServ string
 }
 
 // NetworkTimeout's value is used as a timeout in a number of network-related activities.
@@ -52,45 +131,90 @@ var NetworkTimeout = 15 * time.Second
 type channelInfo struct {
 	Name string
 	Key  string
+
+	// Nicks or nick!user@host masks granted operator or voice
+	// status when joining the channel, if the bot is an operator.
+	Op    []string
+	Voice []string
 }
 
 func startAccountManager(config Config) (*accountManager, error) {
 	logf("Starting account manager...")
+	proxy, err := parseProxy(config.Proxy)
+	if err != nil {
+		logf("Cannot use configured proxy: %v", err)
+		return nil, err
+	}
 	am := &accountManager{
 		config:   config,
 		clients:  make(map[string]accountClient),
 		requests: make(chan interface{}),
 		incoming: make(chan *Message),
+		proxy:    proxy,
 	}
 	am.session = config.Database.Session.Copy()
 	am.database = config.Database.With(am.session)
-	if err := createCollections(am.database); err != nil {
+	if err := createCollections(am.database, config.IncomingMaxBytes, config.OutgoingMaxBytes); err != nil {
 		logf("Cannot create collections: %v", err)
 		return nil, fmt.Errorf("cannot create collections: %v", err)
 	}
+	if config.MirrorURL != "" {
+		am.mirror = startMirror(config)
+	}
+	if config.Audit {
+		if err := createCapped(am.database, "audit", config.AuditMaxBytes); err != nil {
+			logf("Cannot create audit collection: %v", err)
+			return nil, fmt.Errorf("cannot create audit collection: %v", err)
+		}
+		am.audit = startAuditor(am.database)
+	}
 	am.tomb.Go(am.loop)
 	return am, nil
 }
 
 const mb = 1024 * 1024
 
-func createCollections(db *mgo.Database) error {
-	capped := mgo.CollectionInfo{
-		Capped:   true,
-		MaxBytes: 4 * mb,
+// defaultCappedBytes is the default size of the incoming, outgoing,
+// and audit capped collections.
+const defaultCappedBytes = 4 * mb
+
+// createCollections creates the capped incoming and outgoing collections
+// with the provided sizes in bytes, or the default size if zero.
+func createCollections(db *mgo.Database, incomingMaxBytes, outgoingMaxBytes int) error {
+	sizes := map[string]int{
+		"incoming": incomingMaxBytes,
+		"outgoing": outgoingMaxBytes,
 	}
 	for _, name := range []string{"incoming", "outgoing"} {
-		coll := db.C(name)
-		err := coll.Create(&capped)
-		if err != nil {
-			if err.Error() == "collection already exists" {
-				err = db.C("system.namespaces").Find(bson.M{"name": coll.FullName, "options.capped": true}).One(nil)
-				if err == mgo.ErrNotFound {
-					return fmt.Errorf("MongoDB collection %q already exists but is not capped", coll.FullName)
-				}
-			} else {
-				return err
+		if err := createCapped(db, name, sizes[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createCapped creates the named capped collection with maxBytes in size,
+// or the default size if zero, unless it already exists.
+func createCapped(db *mgo.Database, name string, maxBytes int) error {
+	if maxBytes == 0 {
+		maxBytes = defaultCappedBytes
+	}
+	coll := db.C(name)
+	err := coll.Create(&mgo.CollectionInfo{Capped: true, MaxBytes: maxBytes})
+	if err != nil {
+		if err.Error() == "collection already exists" {
+			var ns struct {
+				Options struct{ Size int }
+			}
+			err = db.C("system.namespaces").Find(bson.M{"name": coll.FullName, "options.capped": true}).One(&ns)
+			if err == mgo.ErrNotFound {
+				return fmt.Errorf("MongoDB collection %q already exists but is not capped", coll.FullName)
+			}
+			if err == nil && ns.Options.Size != maxBytes {
+				logf("MongoDB collection %q already exists with %d bytes rather than the configured %d bytes.", coll.FullName, ns.Options.Size, maxBytes)
 			}
+		} else {
+			return err
 		}
 	}
 	return nil
@@ -100,6 +224,12 @@ func (am *accountManager) Stop() error {
 	logf("Account manager stop requested. Waiting...")
 	am.tomb.Kill(errStop)
 	err := am.tomb.Wait()
+	if am.mirror != nil {
+		am.mirror.Stop()
+	}
+	if am.audit != nil {
+		am.audit.Stop()
+	}
 	am.session.Close()
 	logf("Account manager stopped (%v).", err)
 	if err != errStop {
@@ -128,6 +258,77 @@ func (am *accountManager) die() {
 		}()
 	}
 	wg.Wait()
+	for name := range am.clients {
+		am.setConnected(name, false)
+	}
+}
+
+// connectedText is the text of the internal PONG message that account
+// clients deliver to the account manager once they are ready to deliver
+// outgoing messages.
+const connectedText = "<connected>"
+
+// invitedText is the text of the internal PONG message that account
+// clients deliver to the account manager when they join a channel they
+// were invited to, and the account is setup to keep such channels.
+const invitedText = "<invited>"
+
+// addChannel adds channel to the list of channels of the named account,
+// if not yet there.
+func (am *accountManager) addChannel(name, channel string) {
+	err := am.database.C("accounts").Update(
+		bson.D{{"_id", name}, {"channels.name", bson.D{{"$ne", channel}}}},
+		bson.D{{"$push", bson.D{{"channels", bson.D{{"name", channel}}}}}},
+	)
+	if err == mgo.ErrNotFound {
+		return
+	}
+	if err != nil {
+		logf("[%s] Cannot add channel %q to the account: %v", name, channel, err)
+		return
+	}
+	logf("[%s] Added channel %q to the account.", name, channel)
+}
+
+// confirmSent records the outgoing message with the provided hex id as
+// the last one the named account confirmed as sent, so that delivery
+// resumes after it on reconnections. Confirmations are ignored unless
+// the id refers to an outgoing message of that same account that is
+// newer than the last one recorded, so that malformed, misattributed,
+// or stale confirmations never move the account's last id.
+func (am *accountManager) confirmSent(name, hexId string) error {
+	if !bson.IsObjectIdHex(hexId) {
+		logf("[%s] Ignoring confirmation with an invalid message id: %q", name, hexId)
+		return nil
+	}
+	id := bson.ObjectIdHex(hexId)
+	n, err := am.database.C("outgoing").Find(bson.D{{"_id", id}, {"account", name}}).Count()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		logf("[%s] Ignoring confirmation of message %s not known to be sent by the account.", name, hexId)
+		return nil
+	}
+	err = am.database.C("accounts").Update(
+		bson.D{{"_id", name}, {"$or", []bson.D{{{"lastid", nil}}, {{"lastid", bson.D{{"$lt", id}}}}}}},
+		bson.D{{"$set", bson.D{{"lastid", id}}}},
+	)
+	if err == mgo.ErrNotFound {
+		debugf("[%s] Ignoring confirmation of message %s older than the last one confirmed.", name, hexId)
+		return nil
+	}
+	return err
+}
+
+// setConnected records in the account information whether the account is
+// currently connected, so that plugins may tell whether their messages
+// are being delivered or are waiting for the connection.
+func (am *accountManager) setConnected(name string, connected bool) {
+	err := am.database.C("accounts").UpdateId(name, bson.D{{"$set", bson.D{{"connected", connected}}}})
+	if err != nil && err != mgo.ErrNotFound {
+		logf("[%s] Cannot record account connection status: %v", name, err)
+	}
 }
 
 func (am *accountManager) loop() error {
@@ -146,26 +347,29 @@ func (am *accountManager) loop() error {
 		refresh = ticker.C
 	}
 	var incoming = am.database.C("incoming")
-	var accounts = am.database.C("accounts")
-	for am.tomb.Alive() {
+	for {
 		am.session.Refresh()
 		select {
 		case msg := <-am.incoming:
 			if msg.Command == cmdPong {
 				if strings.HasPrefix(msg.Text, "sent:") {
-					// TODO Ensure it's a valid ObjectId.
-					lastId := bson.ObjectIdHex(msg.Text[5:])
-					err := accounts.UpdateId(msg.Account, bson.D{{"$set", bson.D{{"lastid", lastId}}}})
+					err := am.confirmSent(msg.Account, msg.Text[5:])
 					if err != nil {
 						logf("Cannot update account with last sent message id: %v", err)
 						am.tomb.Kill(err)
 					}
+				} else if msg.Text == connectedText {
+					am.setConnected(msg.Account, true)
+				} else if msg.Text == invitedText {
+					am.addChannel(msg.Account, msg.Channel)
 				}
 			} else {
 				err := incoming.Insert(msg)
 				if err != nil {
 					logf("Cannot insert incoming message: %v", err)
 					am.tomb.Kill(err)
+				} else {
+					am.mirror.Send(mirrorIncoming, msg)
 				}
 			}
 		case req := <-am.requests:
@@ -179,10 +383,9 @@ func (am *accountManager) loop() error {
 		case <-refresh:
 			am.handleRefresh()
 		case <-am.tomb.Dying():
+			return nil
 		}
 	}
-
-	return nil
 }
 
 func (m *accountManager) accountOn(name string) bool {
@@ -209,7 +412,7 @@ func (am *accountManager) handleRefresh() {
 	good := make(map[string]bool)
 	for i := range infos {
 		info := &infos[i]
-		if am.accountOn(info.Name) {
+		if am.accountOn(info.Name) && info.Blocked == "" {
 			good[info.Name] = true
 		}
 	}
@@ -225,6 +428,13 @@ func (am *accountManager) handleRefresh() {
 		}
 		client.Stop()
 		delete(am.clients, client.AccountName())
+		am.setConnected(client.AccountName(), false)
+		if nr, ok := client.(noReconnecter); ok {
+			if reason := nr.NoReconnect(); reason != "" {
+				am.block(client.AccountName(), reason)
+				good[client.AccountName()] = false
+			}
+		}
 	}
 
 	// Bring new clients up and update existing ones.
@@ -239,11 +449,13 @@ func (am *accountManager) handleRefresh() {
 		if client, ok := am.clients[info.Name]; !ok {
 			switch info.Kind {
 			case "irc", "":
-				client = startIrcClient(info, am.incoming)
+				client = startIrcClient(info, am.incoming, am.proxy, am.database, am.audit)
 			case "telegram":
 				client = startTgClient(info, am.incoming)
+				am.setConnected(info.Name, true)
 			case "webhook":
 				client = startWebHookClient(info, am.incoming)
+				am.setConnected(info.Name, true)
 			default:
 				continue
 			}
@@ -255,6 +467,145 @@ func (am *accountManager) handleRefresh() {
 	}
 }
 
+// block records in the account information that the account must not
+// be reconnected, until the blocked field is manually unset.
+func (am *accountManager) block(name, reason string) {
+	logf("[%s] Server dropped the connection with %q. Not reconnecting until the account is unblocked.", name, reason)
+	err := am.database.C("accounts").UpdateId(name, bson.D{{"$set", bson.D{{"blocked", reason}}}})
+	if err != nil {
+		logf("[%s] Cannot record account as blocked: %v", name, err)
+	}
+}
+
+// priorityCheckDelay and priorityCheckMaxDelay define how often the
+// outgoing collection is checked for messages with a higher priority while
+// the client is busy. The delay doubles up to the maximum while none are
+// found, so that a client stuck for long is not polled for so often.
+var (
+	priorityCheckDelay    = 100 * time.Millisecond
+	priorityCheckMaxDelay = 3 * time.Second
+)
+
+// earlyMessage is the document queued in the outgoing collection for
+// messages with a priority. It reserves room for the mark set when the
+// message is delivered ahead of its turn, as documents in capped
+// collections cannot grow.
+type earlyMessage struct {
+	Message `bson:",inline"`
+	Early   bool
+}
+
+// insertOutgoing queues msg in the outgoing collection.
+func insertOutgoing(outgoing *mgo.Collection, msg *Message) error {
+	if msg.Priority == 0 {
+		return outgoing.Insert(msg)
+	}
+	return outgoing.Insert(&earlyMessage{Message: *msg})
+}
+
+// deliver hands msg to client. While the client is not ready to take it,
+// messages queued after msg with a higher priority are delivered first.
+// Those are delivered without their ids, so that confirming them does not
+// move the account's last id past msg, and are marked via markEarly.
+// It returns false if the client died before taking msg.
+func (am *accountManager) deliver(client accountClient, outgoing, incoming *mgo.Collection, msg *Message, early map[bson.ObjectId]bool) bool {
+	select {
+	case client.Outgoing() <- msg:
+		am.delivered(incoming, msg)
+		return true
+	case <-client.Dying():
+		return false
+	default:
+	}
+	var urgent *Message
+	delay := priorityCheckDelay
+	for {
+		if urgent == nil {
+			urgent = am.urgent(client, outgoing, msg, early)
+		}
+		next := msg
+		if urgent != nil {
+			copy := *urgent
+			copy.Id = ""
+			next = &copy
+		}
+		select {
+		case client.Outgoing() <- next:
+			am.delivered(incoming, next)
+			if next == msg {
+				return true
+			}
+			am.markEarly(client, outgoing, urgent.Id, early)
+			urgent = nil
+			delay = priorityCheckDelay
+		case <-time.After(delay):
+			if delay *= 2; delay > priorityCheckMaxDelay {
+				delay = priorityCheckMaxDelay
+			}
+		case <-client.Dying():
+			return false
+		}
+	}
+}
+
+// urgent returns the first message queued after msg with the highest
+// priority above that of msg, or nil if there's none. Expired messages
+// found meanwhile are dropped.
+func (am *accountManager) urgent(client accountClient, outgoing *mgo.Collection, msg *Message, early map[bson.ObjectId]bool) *Message {
+	for {
+		skip := make([]bson.ObjectId, 0, len(early))
+		for id := range early {
+			skip = append(skip, id)
+		}
+		var urgent Message
+		err := outgoing.Find(bson.D{
+			{"_id", bson.D{{"$gt", msg.Id}, {"$nin", skip}}},
+			{"account", client.AccountName()},
+			{"priority", bson.D{{"$gt", msg.Priority}}},
+			{"early", bson.D{{"$ne", true}}},
+		}).Sort("-priority", "$natural").One(&urgent)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			logf("[%s] Cannot look for outgoing messages with a higher priority: %v", client.AccountName(), err)
+			return nil
+		}
+		if !urgent.Expires.IsZero() && time.Now().After(urgent.Expires) {
+			logf("[%s] Dropping outgoing message that expired before being sent: %s", urgent.Account, urgent.String())
+			am.markEarly(client, outgoing, urgent.Id, early)
+			continue
+		}
+		debugf("[%s] Delivering outgoing message ahead of its turn: %s", urgent.Account, urgent.String())
+		urgent.Time = urgent.Time.UTC()
+		return &urgent
+	}
+}
+
+// markEarly records that the outgoing message with the given id was
+// handled ahead of its turn, so that it's skipped once its turn comes.
+// The mark is recorded in early for the messages the tail iterator has
+// already fetched, and on the message document so that it's also skipped
+// after the account is restarted.
+func (am *accountManager) markEarly(client accountClient, outgoing *mgo.Collection, id bson.ObjectId, early map[bson.ObjectId]bool) {
+	early[id] = true
+	err := outgoing.Update(bson.D{{"_id", id}, {"early", false}}, bson.D{{"$set", bson.D{{"early", true}}}})
+	if err != nil && err != mgo.ErrNotFound {
+		logf("[%s] Cannot mark outgoing message as delivered ahead of its turn: %v", client.AccountName(), err)
+	}
+}
+
+// delivered hands msg, just delivered by an account client, back to
+// plugins for outgoing message handling, and mirrors it if enabled.
+func (am *accountManager) delivered(incoming *mgo.Collection, msg *Message) {
+	msg.Time = time.Now().UTC()
+	err := incoming.Insert(msg)
+	if err != nil && !mgo.IsDup(err) {
+		logf("[%s] Cannot insert outgoing message for plugin handling: %v", msg.Account, err)
+	}
+	am.mirror.Send(mirrorOutgoing, msg)
+}
+
 func (am *accountManager) tail(client accountClient) error {
 	session := am.session.Copy()
 	defer session.Close()
@@ -278,11 +629,15 @@ func (am *accountManager) tail(client accountClient) error {
 		lastId = bson.ObjectId("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
 	}
 
+	// early holds the ids of messages delivered ahead of their turn
+	// due to their priority, to be skipped once the tail reaches them.
+	early := make(map[bson.ObjectId]bool)
+
 	for am.tomb.Alive() && client.Alive() {
 
 		// Prepare a new tailing iterator.
 		session.Refresh()
-		query := outgoing.Find(bson.D{{"_id", bson.D{{"$gt", lastId}}}, {"account", client.AccountName()}})
+		query := outgoing.Find(bson.D{{"_id", bson.D{{"$gt", lastId}}}, {"account", client.AccountName()}, {"early", bson.D{{"$ne", true}}}})
 		iter := query.Sort("$natural").Tail(2 * time.Second)
 
 		// Loop while iterator remains valid.
@@ -290,20 +645,33 @@ func (am *accountManager) tail(client accountClient) error {
 			var msg *Message
 			for iter.Next(&msg) {
 				debugf("[%s] Tail iterator got outgoing message: %s", msg.Account, msg.String())
-				select {
-				case client.Outgoing() <- msg:
-					// Send back to plugins for outgoing message handling.
-					msg.Time = time.Now()
-					err := incoming.Insert(msg)
-					if err != nil && !mgo.IsDup(err) {
-						logf("[%s] Cannot insert outgoing message for plugin handling: %v", msg.Account, err)
-					}
+				msg.Time = msg.Time.UTC()
+				if early[msg.Id] {
+					delete(early, msg.Id)
 					lastId = msg.Id
 					msg = nil
-				case <-client.Dying():
+					continue
+				}
+				if !msg.Expires.IsZero() && time.Now().After(msg.Expires) {
+					logf("[%s] Dropping outgoing message that expired before being sent: %s", msg.Account, msg.String())
+					lastId = msg.Id
+					msg = nil
+					continue
+				}
+				if !am.deliver(client, outgoing, incoming, msg, early) {
 					iter.Close()
 					return nil
 				}
+				lastId = msg.Id
+				msg = nil
+
+				// Marked messages that the iterator skipped are
+				// behind now, so stop tracking them.
+				for id := range early {
+					if id <= lastId {
+						delete(early, id)
+					}
+				}
 			}
 			if !iter.Timeout() {
 				break
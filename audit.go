@@ -0,0 +1,128 @@
+package mup
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/tomb.v2"
+)
+
+// auditBufferSize defines how many lines may be waiting to be recorded
+// in the audit collection before further lines start being dropped.
+const auditBufferSize = 1000
+
+// auditRecord is the document recorded in the audit collection for
+// every line written to a server.
+type auditRecord struct {
+	Time    time.Time
+	Account string
+	Line    string
+}
+
+// An auditor records the lines written to IRC servers in the audit
+// collection, as enabled by the Audit server setting. Lines are buffered
+// so that a slow database never blocks their delivery.
+type auditor struct {
+	tomb    tomb.Tomb
+	session *mgo.Session
+	audit   *mgo.Collection
+	records chan *auditRecord
+
+	mutex   sync.Mutex
+	dropped int
+}
+
+func startAuditor(db *mgo.Database) *auditor {
+	session := db.Session.Copy()
+	a := &auditor{
+		session: session,
+		audit:   db.C("audit").With(session),
+		records: make(chan *auditRecord, auditBufferSize),
+	}
+	a.tomb.Go(a.loop)
+	return a
+}
+
+// Stop stops the auditor once all pending lines are recorded.
+func (a *auditor) Stop() error {
+	a.tomb.Kill(nil)
+	err := a.tomb.Wait()
+	a.session.Close()
+	return err
+}
+
+// Record queues line, just written to the server of the named account,
+// to be recorded. Payloads that may carry credentials are redacted, as
+// done by redactedLine, and so is the whole payload if secret is true.
+func (a *auditor) Record(account, line string, secret bool) {
+	if a == nil {
+		return
+	}
+	if secret {
+		line = strings.SplitN(line, " ", 2)[0] + " <redacted>"
+	} else {
+		line = redactedLine(line)
+	}
+	select {
+	case a.records <- &auditRecord{Time: time.Now().UTC(), Account: account, Line: line}:
+	default:
+		a.mutex.Lock()
+		if a.dropped == 0 {
+			logf("Audit buffer is full. Dropping lines.")
+		}
+		a.dropped++
+		a.mutex.Unlock()
+	}
+}
+
+// redactedLine returns line with its payload redacted if it may carry
+// credentials: the parameters of PASS, AUTHENTICATE, and OPER, and of
+// the NICKSERV and NS aliases, and the text of messages sent to NickServ.
+func redactedLine(line string) string {
+	fields := strings.SplitN(line, " ", 3)
+	switch strings.ToUpper(fields[0]) {
+	case "PASS", "AUTHENTICATE", "OPER", "NICKSERV", "NS":
+		return fields[0] + " <redacted>"
+	case cmdPrivMsg, cmdNotice:
+		if len(fields) < 3 {
+			break
+		}
+		target := strings.ToLower(fields[1])
+		if target == "nickserv" || strings.HasPrefix(target, "nickserv@") {
+			return fields[0] + " " + fields[1] + " :<redacted>"
+		}
+	}
+	return line
+}
+
+func (a *auditor) loop() error {
+	for {
+		select {
+		case record := <-a.records:
+			a.insert(record)
+		case <-a.tomb.Dying():
+			for {
+				select {
+				case record := <-a.records:
+					a.insert(record)
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func (a *auditor) insert(record *auditRecord) {
+	if err := a.audit.Insert(record); err != nil {
+		logf("[%s] Cannot record line in audit collection: %v", record.Account, err)
+	}
+	a.mutex.Lock()
+	if a.dropped > 0 && len(a.records) == 0 {
+		logf("Audit dropped %d lines while its buffer was full.", a.dropped)
+		a.dropped = 0
+	}
+	a.mutex.Unlock()
+}
@@ -0,0 +1,180 @@
+package mup
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+var (
+	bulkFlushSize  = 1000
+	bulkFlushDelay = 1 * time.Second
+
+	// bulkMaxPending defines how many documents that failed to be written
+	// may be kept for writing again later. The oldest ones are dropped
+	// past that point.
+	bulkMaxPending = 10000
+)
+
+// BulkCollection buffers documents inserted into a plugin collection so
+// they are written to the database in batches rather than one at a time.
+//
+// Buffered documents are written once enough of them are pending, a short
+// while after the first one was buffered, when Flush is called, or when
+// the plugin that owns the collection is stopped. Documents that fail to
+// be written are kept and written again a short while later, except for
+// the ones rejected as duplicates.
+type BulkCollection struct {
+	plugger *Plugger
+	suffix  string
+	kind    CollKind
+
+	mu       sync.Mutex
+	docs     []interface{}
+	timer    *time.Timer
+	retrying bool
+	closed   bool
+}
+
+type bulkKey struct {
+	suffix string
+	kind   CollKind
+}
+
+// BulkCollection returns a collection that buffers inserted documents.
+// The suffix and kind arguments select the underlying collection in
+// the same way they do for the Collection method. Calls with the same
+// arguments return the same collection, sharing its buffer.
+func (p *Plugger) BulkCollection(suffix string, kind CollKind) *BulkCollection {
+	p.bulksMutex.Lock()
+	defer p.bulksMutex.Unlock()
+	key := bulkKey{suffix, kind}
+	if c, ok := p.bulks[key]; ok {
+		return c
+	}
+	if p.bulks == nil {
+		p.bulks = make(map[bulkKey]*BulkCollection)
+	}
+	c := &BulkCollection{plugger: p, suffix: suffix, kind: kind}
+	p.bulks[key] = c
+	return c
+}
+
+// Insert buffers docs for insertion into the collection. Errors are only
+// reported when the insertion causes the buffer to be flushed.
+func (c *BulkCollection) Insert(docs ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.docs = append(c.docs, docs...)
+	if len(c.docs) >= bulkFlushSize && !c.retrying {
+		return c.flush()
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(bulkFlushDelay, c.delayedFlush)
+	}
+	return nil
+}
+
+// Pending returns the number of documents buffered but not yet written.
+func (c *BulkCollection) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.docs)
+}
+
+// Flush writes all buffered documents into the collection.
+func (c *BulkCollection) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flush()
+}
+
+func (c *BulkCollection) delayedFlush() {
+	err := c.Flush()
+	if err != nil {
+		c.plugger.Logf("Cannot flush buffered documents: %v", err)
+	}
+}
+
+func (c *BulkCollection) flush() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.docs) == 0 {
+		return nil
+	}
+	session, coll := c.plugger.Collection(c.suffix, c.kind)
+	defer session.Close()
+	bulk := coll.Bulk()
+	bulk.Unordered()
+	bulk.Insert(c.docs...)
+	_, err := bulk.Run()
+	c.docs = unwritten(c.docs, err)
+	if dropped := len(c.docs) - bulkMaxPending; dropped > 0 {
+		c.plugger.Logf("Too many documents failed to be written. Dropping the %d oldest ones.", dropped)
+		c.docs = append([]interface{}(nil), c.docs[dropped:]...)
+	}
+	// Retry after a while rather than on every insertion.
+	c.retrying = len(c.docs) > 0
+	if c.retrying && !c.closed {
+		c.timer = time.AfterFunc(bulkFlushDelay, c.delayedFlush)
+	}
+	return err
+}
+
+// close writes the buffered documents for the last time, as the plugin
+// that owns the collection is being stopped.
+func (c *BulkCollection) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	err := c.flush()
+	if len(c.docs) > 0 {
+		c.plugger.Logf("Dropping %d documents that could not be written.", len(c.docs))
+		c.docs = nil
+	}
+	return err
+}
+
+// unwritten returns the documents in docs that were not written by the
+// bulk insertion that returned err. Documents rejected as duplicates are
+// not returned, as they will never be written, and were possibly written
+// already by an earlier insertion that failed midway.
+func unwritten(docs []interface{}, err error) []interface{} {
+	if err == nil {
+		return nil
+	}
+	berr, ok := err.(*mgo.BulkError)
+	if !ok {
+		return docs
+	}
+	var failed []interface{}
+	for _, ecase := range berr.Cases() {
+		if ecase.Index < 0 || ecase.Index >= len(docs) {
+			return docs
+		}
+		if !mgo.IsDup(ecase.Err) {
+			failed = append(failed, docs[ecase.Index])
+		}
+	}
+	return failed
+}
+
+// flushBulk writes the documents buffered in all of the plugger's
+// bulk collections, as the plugin is being stopped.
+func (p *Plugger) flushBulk() {
+	p.bulksMutex.Lock()
+	bulks := make([]*BulkCollection, 0, len(p.bulks))
+	for _, c := range p.bulks {
+		bulks = append(bulks, c)
+	}
+	p.bulksMutex.Unlock()
+	for _, c := range bulks {
+		err := c.close()
+		if err != nil {
+			p.Logf("Cannot flush buffered documents: %v", err)
+		}
+	}
+}
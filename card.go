@@ -0,0 +1,71 @@
+package mup
+
+import (
+	"bytes"
+	"html"
+	"strings"
+)
+
+// A Card holds a structured reply made of a title, named fields, and a
+// link, so that a single plugin may serve protocols with different
+// capabilities. Cards are sent via Plugger.SendCard, and are rendered as
+// formatted text on IRC and as richer messages on Telegram.
+type Card struct {
+	Title  string
+	Fields []CardField `bson:",omitempty"`
+	Link   string      `bson:",omitempty"`
+}
+
+// CardField holds a named value displayed in a Card.
+type CardField struct {
+	Name  string
+	Value string
+}
+
+// String returns the card rendered as the text of a single IRC message,
+// such as "Title <Name: Value> <https://example.com>", with the title in bold.
+func (card *Card) String() string {
+	var buf bytes.Buffer
+	if card.Title != "" {
+		buf.WriteString(Bold(card.Title))
+	}
+	for _, field := range card.Fields {
+		if buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteByte('<')
+		if field.Name != "" {
+			buf.WriteString(field.Name)
+			buf.WriteString(": ")
+		}
+		buf.WriteString(field.Value)
+		buf.WriteByte('>')
+	}
+	if card.Link != "" {
+		if buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString("<" + card.Link + ">")
+	}
+	return buf.String()
+}
+
+// html returns the card rendered as HTML text, with one line per field.
+func (card *Card) html() string {
+	var lines []string
+	if card.Title != "" {
+		lines = append(lines, "<b>"+html.EscapeString(card.Title)+"</b>")
+	}
+	for _, field := range card.Fields {
+		line := html.EscapeString(field.Value)
+		if field.Name != "" {
+			line = "<b>" + html.EscapeString(field.Name) + ":</b> " + line
+		}
+		lines = append(lines, line)
+	}
+	if card.Link != "" {
+		link := html.EscapeString(card.Link)
+		lines = append(lines, `<a href="`+link+`">`+link+`</a>`)
+	}
+	return strings.Join(lines, "\n")
+}
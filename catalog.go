@@ -0,0 +1,53 @@
+package mup
+
+import (
+	"strings"
+	"sync"
+)
+
+var (
+	catalogsMutex sync.Mutex
+	catalogs      = make(map[string]map[string]string)
+)
+
+// RegisterCatalog registers translations for the given locale, such as
+// "pt" or "pt_BR". The catalog maps the original English text emitted by
+// mup or by plugins, usually a format string as provided to Plugger.Sendf,
+// into its translated form. Registering multiple catalogs for the same
+// locale merges their translations.
+func RegisterCatalog(locale string, catalog map[string]string) {
+	catalogsMutex.Lock()
+	defer catalogsMutex.Unlock()
+	translations := catalogs[locale]
+	if translations == nil {
+		translations = make(map[string]string)
+		catalogs[locale] = translations
+	}
+	for text, translation := range catalog {
+		translations[text] = translation
+	}
+}
+
+// Translate returns text translated into the given locale, or text itself
+// if no translation is known. Translations for a locale with a region, such
+// as "pt_BR", fall back to the ones registered for the language alone ("pt").
+//
+// The locale configured for the account an incoming message was received
+// from is available in the message's Locale field.
+func Translate(locale, text string) string {
+	if locale == "" {
+		return text
+	}
+	catalogsMutex.Lock()
+	defer catalogsMutex.Unlock()
+	for {
+		if translation, ok := catalogs[locale][text]; ok {
+			return translation
+		}
+		i := strings.LastIndexAny(locale, "_-")
+		if i < 0 {
+			return text
+		}
+		locale = locale[:i]
+	}
+}
@@ -0,0 +1,23 @@
+package mup_test
+
+import (
+	. "gopkg.in/check.v1"
+	"gopkg.in/mup.v0"
+)
+
+var _ = Suite(&CatalogSuite{})
+
+type CatalogSuite struct{}
+
+func (s *CatalogSuite) TestTranslate(c *C) {
+	mup.RegisterCatalog("xx", map[string]string{"Hello.": "Xello.", "Bye.": "Xye."})
+	mup.RegisterCatalog("xx_YY", map[string]string{"Hello.": "Yello."})
+
+	c.Assert(mup.Translate("", "Hello."), Equals, "Hello.")
+	c.Assert(mup.Translate("zz", "Hello."), Equals, "Hello.")
+	c.Assert(mup.Translate("xx", "Hello."), Equals, "Xello.")
+	c.Assert(mup.Translate("xx", "Unknown."), Equals, "Unknown.")
+	c.Assert(mup.Translate("xx_YY", "Hello."), Equals, "Yello.")
+	c.Assert(mup.Translate("xx_YY", "Bye."), Equals, "Xye.")
+	c.Assert(mup.Translate("xx-ZZ", "Bye."), Equals, "Xye.")
+}
@@ -0,0 +1,98 @@
+package mup
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// A charset converts between UTF-8 text and one of the single-byte
+// encodings still expected by some older IRC networks.
+type charset struct {
+	decode [256]rune
+	encode map[rune]byte
+}
+
+// charsetOverrides holds the code points that differ from ISO-8859-1 in
+// each of the supported charsets.
+var charsetOverrides = map[string]map[byte]rune{
+	"iso-8859-1": {},
+	"iso-8859-15": {
+		0xA4: '€', 0xA6: 'Š', 0xA8: 'š', 0xB4: 'Ž',
+		0xB8: 'ž', 0xBC: 'Œ', 0xBD: 'œ', 0xBE: 'Ÿ',
+	},
+	"windows-1252": {
+		0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„', 0x85: '…', 0x86: '†', 0x87: '‡',
+		0x88: 'ˆ', 0x89: '‰', 0x8A: 'Š', 0x8B: '‹', 0x8C: 'Œ', 0x8E: 'Ž',
+		0x91: '‘', 0x92: '’', 0x93: '“', 0x94: '”', 0x95: '•', 0x96: '–', 0x97: '—',
+		0x98: '˜', 0x99: '™', 0x9A: 'š', 0x9B: '›', 0x9C: 'œ', 0x9E: 'ž', 0x9F: 'Ÿ',
+	},
+}
+
+var charsetAliases = map[string]string{
+	"latin1":      "iso-8859-1",
+	"iso88591":    "iso-8859-1",
+	"latin9":      "iso-8859-15",
+	"iso885915":   "iso-8859-15",
+	"cp1252":      "windows-1252",
+	"windows1252": "windows-1252",
+}
+
+// lookupCharset returns the charset with the given name, or nil for UTF-8,
+// in which case no conversion is necessary.
+func lookupCharset(name string) (*charset, error) {
+	key := strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(name))
+	if key == "" || key == "utf8" {
+		return nil, nil
+	}
+	overrides, ok := charsetOverrides[charsetAliases[key]]
+	if !ok {
+		return nil, fmt.Errorf("unsupported charset: %q", name)
+	}
+	cs := &charset{encode: make(map[rune]byte)}
+	for i := range cs.decode {
+		r, ok := overrides[byte(i)]
+		if !ok {
+			r = rune(i)
+		}
+		cs.decode[i] = r
+		cs.encode[r] = byte(i)
+	}
+	return cs, nil
+}
+
+// Decode returns data converted from the charset into UTF-8.
+func (cs *charset) Decode(data []byte) string {
+	if cs == nil {
+		return string(data)
+	}
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = cs.decode[b]
+	}
+	return string(runes)
+}
+
+// Encode returns text converted from UTF-8 into the charset. Characters
+// that have no representation in the charset and invalid UTF-8 sequences
+// are replaced by a question mark.
+func (cs *charset) Encode(text string) string {
+	if cs == nil {
+		return text
+	}
+	data := make([]byte, 0, len(text))
+	for i, r := range text {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(text[i:]); size == 1 {
+				data = append(data, '?')
+				continue
+			}
+		}
+		b, ok := cs.encode[r]
+		if !ok {
+			b = '?'
+		}
+		data = append(data, b)
+	}
+	return string(data)
+}
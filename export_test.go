@@ -1,10 +1,99 @@
 package mup
 
 import (
+	"time"
+
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mup.v0/ldap"
 )
 
+// SetAccounts makes the plugger use the provided account documents
+// as the known account information.
+func (p *Plugger) SetAccounts(accounts interface{}) {
+	var infos []accountInfo
+	err := marshalRaw(accounts).Unmarshal(&infos)
+	if err != nil {
+		panic("cannot unmarshal test accounts: " + err.Error())
+	}
+	byName := make(map[string]*accountInfo)
+	for i := range infos {
+		byName[infos[i].Name] = &infos[i]
+	}
+	p.setAccounts(func() map[string]*accountInfo { return byName })
+}
+
+// SetBulkFlush changes the buffer size and delay that cause documents
+// in bulk collections to be flushed, and returns a function that restores
+// the original values.
+func SetBulkFlush(size int, delay time.Duration) (restore func()) {
+	oldSize, oldDelay := bulkFlushSize, bulkFlushDelay
+	bulkFlushSize, bulkFlushDelay = size, delay
+	return func() {
+		bulkFlushSize, bulkFlushDelay = oldSize, oldDelay
+	}
+}
+
+// SaveRegistry saves the plugins and command prefixes registered so far,
+// and returns a function that restores them, dropping any registered since.
+func SaveRegistry() (restore func()) {
+	plugins := make(map[string]*PluginSpec)
+	for name, spec := range registeredPlugins {
+		plugins[name] = spec
+	}
+	prefixes := make(map[string]string)
+	for prefix, name := range registeredPrefixes {
+		prefixes[prefix] = name
+	}
+	from := make(map[string]string)
+	for name, location := range registeredFrom {
+		from[name] = location
+	}
+	return func() {
+		registeredPlugins, registeredPrefixes, registeredFrom = plugins, prefixes, from
+	}
+}
+
+// SetBulkMaxPending changes how many documents that failed to be written
+// may be kept, and returns a function that restores the original value.
+func SetBulkMaxPending(max int) (restore func()) {
+	old := bulkMaxPending
+	bulkMaxPending = max
+	return func() {
+		bulkMaxPending = old
+	}
+}
+
+// SetSASLTimeout changes how long to wait for SASL authentication to
+// complete, and returns a function that restores the original value.
+func SetSASLTimeout(timeout time.Duration) (restore func()) {
+	old := saslTimeout
+	saslTimeout = timeout
+	return func() {
+		saslTimeout = old
+	}
+}
+
+// IngestAddr returns the address the ingest endpoint is listening on.
+func (st *Server) IngestAddr() string {
+	return st.ingestServer.Addr()
+}
+
+// HTTPAddr returns the address the plugin HTTP server is listening on.
+func (st *Server) HTTPAddr() string {
+	return st.pluginManager.http.Addr()
+}
+
+// SetMirrorRetry changes how many times and how often posting messages
+// to the mirror URL is retried, and returns a function that restores the
+// original values.
+func SetMirrorRetry(retries int, backoff time.Duration) (restore func()) {
+	oldRetries, oldBackoff := mirrorRetries, mirrorBackoff
+	mirrorRetries, mirrorBackoff = retries, backoff
+	return func() {
+		mirrorRetries, mirrorBackoff = oldRetries, oldBackoff
+	}
+}
+
 func NewPlugger(name string, db *mgo.Database, send, handle func(msg *Message) error, ldap func(name string) (ldap.Conn, error), config, targets interface{}) *Plugger {
 	p := newPlugger(name, send, handle, ldap)
 	p.setDatabase(db)
@@ -12,3 +101,106 @@ func NewPlugger(name string, db *mgo.Database, send, handle func(msg *Message) e
 	p.setTargets(marshalRaw(targets))
 	return p
 }
+
+// ResolveConfig resolves the environment and secret references in the
+// plugger configuration, as done before plugins are started.
+func (p *Plugger) ResolveConfig() error {
+	return p.resolveConfig()
+}
+
+// SetLogCapture makes the plugger keep up to lines of the most recent
+// messages logged, as done when the server has PluginLogLines set.
+func (p *Plugger) SetLogCapture(lines int) {
+	p.setLogCapture(newLogCapture(lines))
+}
+
+// SetPrivileged makes the plugger act as that of a plugin registered
+// as Privileged.
+func (p *Plugger) SetPrivileged(privileged bool) {
+	p.setPrivileged(privileged)
+}
+
+// ShareManager makes the plugger share the log capture and scheduler of
+// other, as done for plugins run by the same plugin manager.
+func (p *Plugger) ShareManager(other *Plugger) {
+	p.setLogCapture(other.logs)
+	p.setScheduler(other.tasks)
+}
+
+// InsertOutgoing queues msgs in the outgoing collection as done for the
+// messages sent by plugins.
+func InsertOutgoing(outgoing *mgo.Collection, msgs ...*Message) error {
+	for _, msg := range msgs {
+		if err := insertOutgoing(outgoing, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartHTTP makes the plugger register its HTTP handlers in a new plugin
+// HTTP server listening on a local port, and returns a function that
+// stops the server.
+func (p *Plugger) StartHTTP() (stop func()) {
+	server, err := startPluginHTTP("127.0.0.1:0", nil)
+	if err != nil {
+		panic(err)
+	}
+	p.setHTTP(server)
+	return func() { server.Stop() }
+}
+
+// SetFetchRetry changes how many times and how often requests sent via
+// Plugger.Fetch are retried, and returns a function that restores the
+// original values.
+func SetFetchRetry(retries int, backoff time.Duration) (restore func()) {
+	oldRetries, oldBackoff := fetchRetries, fetchBackoff
+	fetchRetries, fetchBackoff = retries, backoff
+	return func() {
+		fetchRetries, fetchBackoff = oldRetries, oldBackoff
+	}
+}
+
+// SetMore makes the plugger hold back the lines of long texts beyond the
+// first lines, as done when the server has MoreLines set.
+func (p *Plugger) SetMore(lines int, timeout time.Duration) {
+	p.setPager(newPager(Config{MoreLines: lines, MoreTimeout: timeout}))
+}
+
+// More sends the next page of text held back for the sender of msg, as
+// done by the plugin manager, and reports whether there was any.
+func (p *Plugger) More(msg *Message) bool {
+	msgs := p.pager.more(msg)
+	for _, more := range msgs {
+		p.send(more)
+	}
+	return len(msgs) > 0
+}
+
+// SetPasteTimeout changes how long uploads to the paste service may take,
+// and returns a function that restores the original value.
+func SetPasteTimeout(timeout time.Duration) (restore func()) {
+	old := pasteTimeout
+	pasteTimeout = timeout
+	return func() {
+		pasteTimeout = old
+	}
+}
+
+// Deliver delivers msg to the plugin being tested as the plugin manager
+// would, including messages that cannot be sent via Sendf such as events.
+func (t *PluginTester) Deliver(msg *Message) {
+	t.state.handle(msg, "")
+}
+
+// CancelTasks cancels the tasks scheduled by the plugin, and waits for
+// the running ones, as done when the plugin is stopped.
+func (p *Plugger) CancelTasks() {
+	p.tasks.cancelAll(p.name)
+}
+
+// SetPaste makes the plugger upload long message texts to the paste
+// service at url, as done when the server has a paste service configured.
+func (p *Plugger) SetPaste(url, token string, lines int) {
+	p.setPaster(newPaster(Config{PasteURL: url, PasteToken: token, PasteLines: lines}))
+}
@@ -0,0 +1,109 @@
+package mup
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Reset is the control sequence that turns off all formatting
+// applied so far to the text of an IRC message.
+const Reset = "\x0f"
+
+const (
+	fmtBold      = '\x02'
+	fmtColor     = '\x03'
+	fmtItalic    = '\x1d'
+	fmtUnderline = '\x1f'
+	fmtReverse   = '\x16'
+	fmtMonospace = '\x11'
+	fmtStrike    = '\x1e'
+	fmtReset     = '\x0f'
+)
+
+// The standard IRC colors that may be provided to Color.
+const (
+	NoColor    = -1
+	White      = 0
+	Black      = 1
+	Blue       = 2
+	Green      = 3
+	Red        = 4
+	Brown      = 5
+	Purple     = 6
+	Orange     = 7
+	Yellow     = 8
+	LightGreen = 9
+	Cyan       = 10
+	LightCyan  = 11
+	LightBlue  = 12
+	Pink       = 13
+	Grey       = 14
+	LightGrey  = 15
+)
+
+// Bold returns s wrapped in the control sequences that render it as
+// bold text on IRC.
+func Bold(s string) string {
+	return string(fmtBold) + s + string(fmtBold)
+}
+
+// Color returns s wrapped in the control sequences that render it with
+// the fg foreground and bg background colors on IRC. Use NoColor as bg
+// to leave the background untouched.
+func Color(s string, fg, bg int) string {
+	if bg == NoColor {
+		return fmt.Sprintf("%c%02d%s%c", fmtColor, fg, s, fmtColor)
+	}
+	return fmt.Sprintf("%c%02d,%02d%s%c", fmtColor, fg, bg, s, fmtColor)
+}
+
+// StripFormatting returns text with all IRC formatting control sequences
+// removed, including the color codes that follow a color control byte.
+// Messages sent to accounts that do not support such sequences have
+// their text stripped automatically.
+func StripFormatting(text string) string {
+	if strings.IndexFunc(text, isFormatting) < 0 {
+		return text
+	}
+	buf := make([]byte, 0, len(text))
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if c == fmtColor {
+			i += colorCodeLen(text[i+1:])
+			continue
+		}
+		if isFormatting(rune(c)) {
+			continue
+		}
+		buf = append(buf, c)
+	}
+	return string(buf)
+}
+
+func isFormatting(r rune) bool {
+	switch r {
+	case fmtBold, fmtColor, fmtItalic, fmtUnderline, fmtReverse, fmtMonospace, fmtStrike, fmtReset:
+		return true
+	}
+	return false
+}
+
+// colorCodeLen returns the length of the "fg[,bg]" color code at the
+// start of s, where each color has up to two digits.
+func colorCodeLen(s string) int {
+	n := digitsLen(s)
+	if n > 0 && n < len(s) && s[n] == ',' {
+		if m := digitsLen(s[n+1:]); m > 0 {
+			n += 1 + m
+		}
+	}
+	return n
+}
+
+func digitsLen(s string) int {
+	n := 0
+	for n < 2 && n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
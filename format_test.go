@@ -0,0 +1,39 @@
+package mup_test
+
+import (
+	. "gopkg.in/check.v1"
+	"gopkg.in/mup.v0"
+)
+
+var _ = Suite(&FormatSuite{})
+
+type FormatSuite struct{}
+
+func (s *FormatSuite) TestBold(c *C) {
+	c.Assert(mup.Bold("text"), Equals, "\x02text\x02")
+}
+
+func (s *FormatSuite) TestColor(c *C) {
+	c.Assert(mup.Color("text", mup.Red, mup.NoColor), Equals, "\x0304text\x03")
+	c.Assert(mup.Color("1st", mup.Red, mup.LightBlue), Equals, "\x0304,121st\x03")
+	c.Assert("a"+mup.Reset+"b", Equals, "a\x0fb")
+}
+
+var stripTests = []struct {
+	text, stripped string
+}{
+	{"plain text", "plain text"},
+	{mup.Bold("bold"), "bold"},
+	{mup.Color("red", mup.Red, mup.NoColor), "red"},
+	{mup.Color("1st", mup.Red, mup.LightBlue), "1st"},
+	{"\x033red\x03, \x03,comma", "red, ,comma"},
+	{"\x0312,4x\x03 \x1ditalic\x1d \x1funder\x1f " + mup.Reset + "end", "x italic under end"},
+	{"trailing\x03", "trailing"},
+	{"trailing\x0312,", "trailing,"},
+}
+
+func (s *FormatSuite) TestStripFormatting(c *C) {
+	for _, test := range stripTests {
+		c.Assert(mup.StripFormatting(test.text), Equals, test.stripped, Commentf("Text: %q", test.text))
+	}
+}
@@ -0,0 +1,131 @@
+package mup
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	pathpkg "path"
+	"strings"
+	"sync"
+
+	"gopkg.in/tomb.v2"
+)
+
+// pluginHTTP serves the HTTP handlers registered by plugins via
+// Plugger.HandleHTTP, each under paths prefixed by "/<plugin name>/",
+// and the plugin metrics under "/metrics".
+type pluginHTTP struct {
+	tomb     tomb.Tomb
+	listener net.Listener
+	metrics  *pluginMetrics
+
+	mu       sync.Mutex
+	mux      *http.ServeMux
+	handlers map[string]pluginHandler
+}
+
+type pluginHandler struct {
+	plugin  string
+	handler http.Handler
+}
+
+func startPluginHTTP(addr string, metrics *pluginMetrics) (*pluginHTTP, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen for plugin HTTP requests: %v", err)
+	}
+	logf("Listening for plugin HTTP requests on %s", listener.Addr())
+	s := &pluginHTTP{
+		listener: listener,
+		metrics:  metrics,
+		handlers: make(map[string]pluginHandler),
+	}
+	s.rebuild()
+	s.tomb.Go(func() error {
+		err := http.Serve(listener, s)
+		if s.tomb.Alive() {
+			return err
+		}
+		return nil
+	})
+	return s, nil
+}
+
+func (s *pluginHTTP) Stop() error {
+	s.tomb.Kill(nil)
+	s.listener.Close()
+	return s.tomb.Wait()
+}
+
+func (s *pluginHTTP) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *pluginHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	mux := s.mux
+	s.mu.Unlock()
+	mux.ServeHTTP(w, req)
+}
+
+// handle registers handler for path under the namespace of the named plugin.
+func (s *pluginHTTP) handle(plugin, path string, handler http.Handler) error {
+	if handler == nil {
+		return fmt.Errorf("cannot register a nil HTTP handler")
+	}
+	pattern := "/" + plugin + "/" + strings.TrimPrefix(path, "/")
+	if !validPattern(pattern) {
+		return fmt.Errorf("invalid HTTP handler path: %q", pattern)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.handlers[pattern]; ok {
+		return fmt.Errorf("HTTP handler already registered for %s", pattern)
+	}
+	s.handlers[pattern] = pluginHandler{plugin, handler}
+	s.rebuild()
+	return nil
+}
+
+// validPattern returns whether pattern is a plain path that http.ServeMux
+// accepts as is, so that registering it cannot panic. Clean paths only,
+// without spaces or the wildcard braces of the newer pattern syntax.
+func validPattern(pattern string) bool {
+	if strings.ContainsAny(pattern, " \t\r\n{}") {
+		return false
+	}
+	clean := pathpkg.Clean(pattern)
+	if strings.HasSuffix(pattern, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean == pattern
+}
+
+// remove drops all handlers registered by the named plugin.
+func (s *pluginHTTP) remove(plugin string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := false
+	for pattern, h := range s.handlers {
+		if h.plugin == plugin {
+			delete(s.handlers, pattern)
+			removed = true
+		}
+	}
+	if removed {
+		s.rebuild()
+	}
+}
+
+// rebuild replaces the mux serving requests, as handlers cannot be
+// removed from an http.ServeMux. It must be called with mu held.
+func (s *pluginHTTP) rebuild() {
+	mux := http.NewServeMux()
+	if s.metrics != nil {
+		mux.Handle("/metrics", s.metrics)
+	}
+	for pattern, h := range s.handlers {
+		mux.Handle(pattern, h.handler)
+	}
+	s.mux = mux
+}
@@ -0,0 +1,178 @@
+package mup
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/tomb.v2"
+)
+
+// ingestMaxBytes is the maximum size of payloads accepted by the ingest endpoint.
+const ingestMaxBytes = 64 * 1024
+
+// ingestSignatureHeader holds the HMAC-SHA256 of the request timestamp and
+// body joined by a dot, computed with the configured ingest secret and
+// formatted as "sha256=<hex digest>".
+const ingestSignatureHeader = "X-Mup-Signature"
+
+// ingestTimestampHeader holds the time the request was signed at, in
+// seconds since the Unix epoch. Requests signed more than ingestMaxSkew
+// away from the current time are rejected, so that captured requests
+// cannot be replayed later.
+const ingestTimestampHeader = "X-Mup-Timestamp"
+
+const ingestMaxSkew = 5 * time.Minute
+
+// ingestPayload is the JSON document accepted by the ingest endpoint.
+type ingestPayload struct {
+	Account string `json:"account"`
+	Channel string `json:"channel"`
+	Nick    string `json:"nick"`
+	Text    string `json:"text"`
+}
+
+// ingestServer serves the HTTP endpoint that injects messages from
+// external systems into the incoming collection, so that plugins may
+// observe them as if they were sent by someone in the respective account.
+type ingestServer struct {
+	tomb     tomb.Tomb
+	session  *mgo.Session
+	database *mgo.Database
+	secret   []byte
+	listener net.Listener
+}
+
+func startIngestServer(config Config) (*ingestServer, error) {
+	if config.IngestSecret == "" {
+		return nil, fmt.Errorf("ingest endpoint requires a secret")
+	}
+	listener, err := net.Listen("tcp", config.IngestAddr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen for ingested messages: %v", err)
+	}
+	logf("Listening for ingested messages on %s", listener.Addr())
+	s := &ingestServer{
+		session:  config.Database.Session.Copy(),
+		secret:   []byte(config.IngestSecret),
+		listener: listener,
+	}
+	s.database = config.Database.With(s.session)
+	s.tomb.Go(func() error {
+		err := http.Serve(listener, s)
+		if s.tomb.Alive() {
+			return err
+		}
+		return nil
+	})
+	return s, nil
+}
+
+func (s *ingestServer) Stop() error {
+	s.tomb.Kill(nil)
+	s.listener.Close()
+	err := s.tomb.Wait()
+	s.session.Close()
+	return err
+}
+
+func (s *ingestServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *ingestServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, ingestMaxBytes))
+	if err != nil {
+		http.Error(w, "cannot read request body", http.StatusBadRequest)
+		return
+	}
+	if !s.validSignature(req.Header.Get(ingestSignatureHeader), req.Header.Get(ingestTimestampHeader), body) {
+		logf("Rejecting ingested message with an invalid signature from %s", req.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var payload ingestPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "invalid JSON payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if payload.Account == "" || payload.Nick == "" || payload.Text == "" {
+		http.Error(w, "payload must provide account, nick, and text", http.StatusBadRequest)
+		return
+	}
+	if (payload.Channel != "" && !isChannel(payload.Channel)) || strings.ContainsAny(payload.Channel, " \r\n,") || strings.ContainsAny(payload.Nick, " \r\n!@:") {
+		http.Error(w, "invalid channel or nick", http.StatusBadRequest)
+		return
+	}
+
+	session := s.session.Copy()
+	defer session.Close()
+	database := s.database.With(session)
+
+	var info accountInfo
+	err = database.C("accounts").FindId(payload.Account).One(&info)
+	if err == mgo.ErrNotFound {
+		http.Error(w, fmt.Sprintf("account %q not found", payload.Account), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logf("Cannot fetch account %q for ingested message: %v", payload.Account, err)
+		http.Error(w, "cannot fetch account", http.StatusInternalServerError)
+		return
+	}
+	nick := info.Nick
+	if nick == "" {
+		nick = "mup"
+	}
+	target := payload.Channel
+	if target == "" {
+		target = nick
+	}
+	text := strings.NewReplacer("\r", "", "\n", " ").Replace(payload.Text)
+	line := ":" + payload.Nick + "!ingest@ingest PRIVMSG " + target + " :" + text
+	msg := ParseIncoming(payload.Account, nick, "!", line)
+	msg.Locale = info.Locale
+	err = database.C("incoming").Insert(msg)
+	if err != nil {
+		logf("Cannot insert ingested message: %v", err)
+		http.Error(w, "cannot insert message", http.StatusInternalServerError)
+		return
+	}
+	logf("[%s] Ingested message: %s", payload.Account, msg.String())
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *ingestServer) validSignature(signature, timestamp string, body []byte) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > ingestMaxSkew || skew < -ingestMaxSkew {
+		return false
+	}
+	got, err := hex.DecodeString(signature[len("sha256="):])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
@@ -4,9 +4,12 @@ import (
 	"bufio"
 	"crypto/tls"
 	"fmt"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/tomb.v2"
+	"io/ioutil"
 	"net"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -14,6 +17,10 @@ import (
 
 const nickChangeDelay = 30 * time.Second
 
+// ircLineLen is the maximum length of an IRC line, including the
+// trailing CRLF, unless the server advertises a LINELEN in ISUPPORT.
+const ircLineLen = 512
+
 type ircClient struct {
 	info accountInfo
 	conn net.Conn
@@ -22,13 +29,36 @@ type ircClient struct {
 	ircW *ircWriter
 
 	activeChannels []string
+	invited        []string
+	internal       []*Message
 	activeNick     string
 	nextNickChange time.Time
+	noReconnect    string
+	lineLen        int
+	wallops        bool
+	channelOps     map[string]map[string]bool
+	namesOps       map[string]map[string]bool
+	caps           []string
+	lastError      string
+
+	// joinLines holds the JOIN lines waiting to be sent once joinDelay
+	// fires, spaced by the JoinDelay setting.
+	joinLines []string
+	joinDelay <-chan time.Time
+
+	// ctcpStart, ctcpReplies, and ctcpSenders track the CTCP requests
+	// answered since the start of the current rate limiting window.
+	ctcpStart   time.Time
+	ctcpReplies int
+	ctcpSenders map[string]int
 
 	requests chan interface{}
 	stopAuth chan bool
 
 	accountName string
+	proxy       *url.URL
+	database    *mgo.Database
+	audit       *auditor
 	dying       <-chan struct{}
 	incoming    chan *Message
 	outgoing    chan *Message
@@ -39,16 +69,23 @@ func (c *ircClient) AccountName() string     { return c.accountName }
 func (c *ircClient) Dying() <-chan struct{}  { return c.dying }
 func (c *ircClient) Outgoing() chan *Message { return c.outgoing }
 func (c *ircClient) LastId() bson.ObjectId   { return c.lastId }
+func (c *ircClient) NoReconnect() string     { return c.noReconnect }
 
-func startIrcClient(info *accountInfo, incoming chan *Message) accountClient {
+func startIrcClient(info *accountInfo, incoming chan *Message, proxy *url.URL, database *mgo.Database, audit *auditor) accountClient {
 	c := &ircClient{
 		accountName: info.Name,
+		proxy:       proxy,
+		database:    database,
+		audit:       audit,
 
-		info:     *info,
-		requests: make(chan interface{}, 1),
-		stopAuth: make(chan bool),
-		incoming: incoming,
-		outgoing: make(chan *Message),
+		info:       *info,
+		lineLen:    ircLineLen,
+		channelOps: make(map[string]map[string]bool),
+		namesOps:   make(map[string]map[string]bool),
+		requests:   make(chan interface{}, 1),
+		stopAuth:   make(chan bool),
+		incoming:   incoming,
+		outgoing:   make(chan *Message),
 	}
 	c.lastId = c.info.LastId
 	c.dying = c.tomb.Dying()
@@ -106,6 +143,7 @@ func (c *ircClient) run() error {
 		c.tomb.Killf("%s: cannot connect to IRC server: %v", c.accountName, err)
 		return nil
 	}
+	c.updateStatus(statusConnected)
 
 	err = c.auth()
 	if err != nil {
@@ -151,23 +189,87 @@ func (c *ircClient) die() {
 		if err != nil {
 			logf("[%s] IRC reader failure: %s", c.accountName, err)
 		}
+		// The reader may have died before the ERROR was handled.
+		if c.ircR.lastError != "" {
+			c.handleError(c.ircR.lastError)
+		}
 	}
 
 	c.tomb.Kill(nil)
+	if err := c.tomb.Err(); err != nil && err != errStop {
+		c.lastError = err.Error()
+	}
+	c.updateStatus(statusDisconnected)
 	logf("[%s] IRC client terminated (%v)", c.accountName, c.tomb.Err())
 }
 
+const (
+	statusConnected    = "connected"
+	statusRegistered   = "registered"
+	statusDisconnected = "disconnected"
+)
+
+// statusTimeout defines how long to wait for the account status to be
+// recorded in the database.
+const statusTimeout = 2 * time.Second
+
+// updateStatus records in the accountstatus collection the state of the
+// connection along with the current nick, acknowledged capabilities,
+// joined channels, and last error observed, so that the connection may
+// be inspected from elsewhere (see the "status" command of the admin plugin).
+// The last error is preserved across connections until a new one is observed.
+// The update gives up after statusTimeout so that a slow database does not
+// hold the connection back.
+func (c *ircClient) updateStatus(state string) {
+	set := bson.D{
+		{"state", state},
+		{"nick", c.activeNick},
+		{"caps", c.caps},
+		{"channels", c.activeChannels},
+		{"updated", time.Now().UTC()},
+	}
+	if c.lastError != "" {
+		set = append(set, bson.DocElem{"lasterror", c.lastError})
+	}
+	session := c.database.Session.Copy()
+	defer session.Close()
+	session.SetSyncTimeout(statusTimeout)
+	session.SetSocketTimeout(statusTimeout)
+	_, err := c.database.C("accountstatus").With(session).UpsertId(c.accountName, bson.D{{"$set", set}})
+	if err != nil {
+		logf("[%s] Cannot update account status: %v", c.accountName, err)
+	}
+}
+
+// TestDialIRC, if set, is called with the host setting of IRC accounts
+// to obtain the connection to their server, instead of dialing the network.
+// It allows tests to exercise the IRC client over arbitrary connections.
+// It must be nil in production.
+var TestDialIRC func(addr string) (net.Conn, error)
+
 func (c *ircClient) connect() (err error) {
 	logf("[%s] Connecting with nick %q to IRC server %q (tls=%v)", c.accountName, c.info.Nick, c.info.Host, c.info.TLS)
-	dialer := &net.Dialer{Timeout: NetworkTimeout}
-	if c.info.TLS {
-		var config tls.Config
-		if c.info.TLSInsecure {
-			config.InsecureSkipVerify = true
-		}
-		c.conn, err = tls.DialWithDialer(dialer, "tcp", c.info.Host, &config)
+	if TestDialIRC != nil {
+		c.conn, err = TestDialIRC(c.info.Host)
+	} else if c.proxy != nil {
+		logf("[%s] Connecting through proxy %q", c.accountName, c.proxy.Host)
+		c.conn, err = dialProxy(c.proxy, c.info.Host, NetworkTimeout)
 	} else {
-		c.conn, err = dialer.Dial("tcp", c.info.Host)
+		c.conn, err = net.DialTimeout("tcp", c.info.Host, NetworkTimeout)
+	}
+	if err == nil && c.info.TLS {
+		var certs []tls.Certificate
+		if c.info.TLSCert != "" {
+			var cert tls.Certificate
+			cert, err = loadCertificate(c.info.TLSCert, c.info.TLSKey)
+			if err != nil {
+				c.conn.Close()
+				c.conn = nil
+				return err
+			}
+			certs = append(certs, cert)
+		}
+		c.conn, err = tlsHandshake(c.conn, c.info.Host, c.info.TLSInsecure, certs)
 	}
 	if err != nil {
 		c.conn = nil
@@ -175,14 +277,113 @@ func (c *ircClient) connect() (err error) {
 	}
 	logf("[%s] Connected to %q", c.accountName, c.info.Host)
 
-	c.ircR = startIrcReader(c.accountName, c.conn)
-	c.ircW = startIrcWriter(c.accountName, c.conn)
+	cs, err := lookupCharset(c.info.Charset)
+	if err != nil {
+		logf("[%s] Cannot use configured charset, using UTF-8: %v", c.accountName, err)
+	}
+	c.ircR = startIrcReader(c.accountName, c.conn, cs)
+	c.ircW = startIrcWriter(c.accountName, c.conn, cs)
+	c.ircW.confirmEvery = c.info.ConfirmEvery
+	c.ircW.confirmDelay = c.info.ConfirmDelay.Duration
+	c.ircW.audit = c.audit
+	if c.audit != nil && len(c.info.OnRegister) > 0 {
+		c.ircW.secret = make(map[string]bool)
+		for _, line := range c.info.OnRegister {
+			c.ircW.secret[ParseOutgoing(c.accountName, line).String()] = true
+		}
+	}
 	return nil
 }
 
+// loadCertificate loads the client certificate and key used in the TLS
+// handshake. Each of cert and key may hold either PEM data or the path
+// of a file with PEM data. When key is empty, cert must hold both.
+func loadCertificate(cert, key string) (tls.Certificate, error) {
+	if key == "" {
+		key = cert
+	}
+	var certPEM, keyPEM []byte
+	for _, item := range []struct {
+		value string
+		data  *[]byte
+	}{{cert, &certPEM}, {key, &keyPEM}} {
+		if strings.Contains(item.value, "-----BEGIN ") {
+			*item.data = []byte(item.value)
+			continue
+		}
+		data, err := ioutil.ReadFile(item.value)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("cannot read TLS client certificate: %v", err)
+		}
+		*item.data = data
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid TLS client certificate: %v", err)
+	}
+	return pair, nil
+}
+
+// tlsHandshake performs a TLS handshake as a client of the server at
+// addr over conn, presenting certs if any, and returns the resulting
+// TLS connection. The provided connection is closed if the handshake fails.
+func tlsHandshake(conn net.Conn, addr string, insecure bool, certs []tls.Certificate) (net.Conn, error) {
+	config := tls.Config{InsecureSkipVerify: insecure, Certificates: certs}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		config.ServerName = host
+	} else {
+		config.ServerName = addr
+	}
+	tlsConn := tls.Client(conn, &config)
+	tlsConn.SetDeadline(time.Now().Add(NetworkTimeout))
+	err := tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// saslTimeout defines how long to wait for SASL authentication to
+// complete, once the server acknowledges the capability, before
+// aborting it.
+var saslTimeout = NetworkTimeout
+
+// saslAuth holds the progress of SASL authentication during registration.
+type saslAuth struct {
+	mechanism string
+	done      bool
+	timeout   <-chan time.Time
+}
+
 func (c *ircClient) auth() (err error) {
+	var sasl *saslAuth
+	mechanism := strings.ToUpper(c.info.SASL)
+	switch mechanism {
+	case "":
+	case "EXTERNAL":
+		if c.info.TLSCert == "" {
+			logf("[%s] SASL EXTERNAL requires a TLS client certificate. Not using SASL.", c.accountName)
+		} else {
+			sasl = &saslAuth{mechanism: mechanism}
+		}
+	default:
+		logf("[%s] Unsupported SASL mechanism %q. Not using SASL.", c.accountName, c.info.SASL)
+	}
+	if sasl != nil {
+		err = c.ircW.Sendf("CAP REQ :sasl")
+		if err != nil {
+			return err
+		}
+	}
 	if c.info.Password != "" {
-		err = c.ircW.Sendf("PASS %s", c.info.Password)
+		var password string
+		password, err = resolveRef(c.database, c.info.Password, true)
+		if err != nil {
+			return fmt.Errorf("cannot resolve server password: %v", err)
+		}
+		err = c.ircW.Sendf("PASS %s", password)
 		if err != nil {
 			return err
 		}
@@ -191,15 +392,35 @@ func (c *ircClient) auth() (err error) {
 	if err != nil {
 		return err
 	}
-	err = c.ircW.Sendf("USER mup 0 0 :Mup Pet")
+	username := c.info.Username
+	if username == "" {
+		username = "mup"
+	}
+	realname := c.info.Realname
+	if realname == "" {
+		realname = "Mup Pet"
+	}
+	err = c.ircW.Sendf("USER %s 0 0 :%s", username, realname)
 	if err != nil {
 		return err
 	}
 	nick := c.info.Nick
 	for {
+		var saslTimer <-chan time.Time
+		if sasl != nil && !sasl.done {
+			saslTimer = sasl.timeout
+		}
 		var msg *Message
 		select {
 		case msg = <-c.ircR.Incoming:
+		case <-saslTimer:
+			if err = c.ircW.Sendf("AUTHENTICATE *"); err != nil {
+				return err
+			}
+			if err = c.saslFailed(sasl, "timed out"); err != nil {
+				return err
+			}
+			continue
 		case <-c.dying:
 			return c.tomb.Err()
 		case <-c.ircR.Dying:
@@ -226,15 +447,113 @@ func (c *ircClient) auth() (err error) {
 			}
 			continue
 		}
+		if msg.Command == cmdError {
+			c.handleError(msg.Text)
+			continue
+		}
+		endOfMOTD := msg.Command == cmdEndOfMOTD || msg.Command == cmdNoMOTD
+		if sasl != nil && !sasl.done {
+			if msg.Command == cmdWelcome || endOfMOTD {
+				sasl.done = true
+				logf("[%s] Registered before SASL authentication completed.", c.accountName)
+				if c.info.SASLRequire {
+					return fmt.Errorf("SASL authentication did not complete")
+				}
+			} else if err = c.handleSASL(msg, sasl); err != nil {
+				return err
+			}
+		}
 		if msg.Command == cmdWelcome {
 			c.activeNick = msg.AsNick
 			logf("[%s] Got welcome notice.", c.accountName)
+			if !c.info.JoinAfterMOTD {
+				break
+			}
+		}
+		if endOfMOTD {
+			c.activeNick = msg.AsNick
+			logf("[%s] Got end of MOTD.", c.accountName)
 			break
 		}
 	}
+	c.updateStatus(statusRegistered)
+
+	for _, line := range c.info.OnRegister {
+		err = c.ircW.Sendf("%s", line)
+		if err != nil {
+			return err
+		}
+	}
+	if c.info.RegainNick && c.info.RegainNickServ != "" && c.activeNick != c.info.Nick {
+		logf("[%s] Asking NickServ to %s nick %q.", c.accountName, c.info.RegainNickServ, c.info.Nick)
+		err = c.ircW.Sendf("PRIVMSG NickServ :%s %s", c.info.RegainNickServ, c.info.Nick)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Let the account manager know messages may now be delivered.
+	select {
+	case c.incoming <- &Message{Account: c.accountName, Command: cmdPong, Text: connectedText}:
+	case <-c.dying:
+		return c.tomb.Err()
+	case <-c.stopAuth:
+		return errStop
+	}
 	return nil
 }
 
+// handleSASL handles msg as part of the SASL authentication in progress
+// during registration. Unrelated messages, which servers may interleave
+// with the authentication, are ignored.
+func (c *ircClient) handleSASL(msg *Message, sasl *saslAuth) error {
+	switch msg.Command {
+	case cmdCap:
+		if len(msg.Params) < 2 {
+			return nil
+		}
+		caps := msg.Text
+		if caps == "" && len(msg.Params) > 2 {
+			caps = msg.Params[2]
+		}
+		if strings.TrimSpace(caps) != "sasl" {
+			return nil
+		}
+		switch msg.Params[1] {
+		case "ACK":
+			c.caps = append(c.caps, "sasl")
+			sasl.timeout = time.After(saslTimeout)
+			return c.ircW.Sendf("AUTHENTICATE %s", sasl.mechanism)
+		case "NAK":
+			return c.saslFailed(sasl, "server does not support SASL")
+		}
+	case cmdAuth:
+		if (len(msg.Params) > 0 && msg.Params[0] == "+") || msg.Text == "+" {
+			// With EXTERNAL the identity comes from the client certificate.
+			return c.ircW.Sendf("AUTHENTICATE +")
+		}
+	case cmdSASLOk, cmdSASLAgain:
+		sasl.done = true
+		logf("[%s] SASL authentication succeeded.", c.accountName)
+		return c.ircW.Sendf("CAP END")
+	case cmdSASLFail, cmdSASLLong, cmdSASLAbort:
+		return c.saslFailed(sasl, msg.Text)
+	}
+	return nil
+}
+
+// saslFailed terminates the SASL authentication in progress due to reason.
+// Registration proceeds unauthenticated, unless the account requires SASL.
+func (c *ircClient) saslFailed(sasl *saslAuth, reason string) error {
+	sasl.done = true
+	logf("[%s] SASL authentication failed: %s", c.accountName, reason)
+	if c.info.SASLRequire {
+		return fmt.Errorf("SASL authentication failed: %s", reason)
+	}
+	logf("[%s] Proceeding without SASL authentication.", c.accountName)
+	return c.ircW.Sendf("CAP END")
+}
+
 func (c *ircClient) forward() error {
 	// Join initial channels before forwarding any outgoing messages.
 	if err := c.handleUpdateInfo(&c.info); err != nil {
@@ -260,11 +579,16 @@ func (c *ircClient) forward() error {
 				inMsg = nil
 				continue
 			}
+			inMsg.Locale = c.info.Locale
 			inRecv = nil
 			inSend = c.incoming
 
 		case inSend <- inMsg:
 			inMsg = nil
+			if len(c.internal) > 0 {
+				inMsg, c.internal = c.internal[0], c.internal[1:]
+				break
+			}
 			inRecv = c.ircR.Incoming
 			inSend = nil
 
@@ -289,6 +613,12 @@ func (c *ircClient) forward() error {
 				}
 			}
 
+		case <-c.joinDelay:
+			c.joinDelay = nil
+			if err := c.sendJoins(); err != nil {
+				return err
+			}
+
 		case <-c.dying:
 			return c.tomb.Err()
 		case <-c.ircR.Dying:
@@ -303,7 +633,24 @@ func (c *ircClient) forward() error {
 			return c.ircW.Err()
 		}
 	}
-	panic("unreachable")
+}
+
+// sendJoins sends the pending JOIN lines, or just the first of them if a
+// JoinDelay is set, scheduling the next one to be sent by the forward
+// loop after the delay so that the client is not blocked meanwhile.
+func (c *ircClient) sendJoins() error {
+	for len(c.joinLines) > 0 {
+		line := c.joinLines[0]
+		c.joinLines = c.joinLines[1:]
+		if err := c.ircW.Sendf("%s", line); err != nil {
+			return err
+		}
+		if c.info.JoinDelay.Duration > 0 && len(c.joinLines) > 0 {
+			c.joinDelay = time.After(c.info.JoinDelay.Duration)
+			break
+		}
+	}
+	return nil
 }
 
 func changedChannel(msg *Message) string {
@@ -319,78 +666,552 @@ func changedChannel(msg *Message) string {
 func (c *ircClient) handleMessage(msg *Message) (skip bool, err error) {
 	switch msg.Command {
 	case cmdNick:
-		c.activeNick = msg.AsNick
+		if c.activeNick != msg.AsNick {
+			c.activeNick = msg.AsNick
+			c.updateStatus(statusRegistered)
+		}
+		newNick := msg.Text
+		if len(msg.Params) > 0 {
+			newNick = msg.Params[0]
+		}
+		for _, channel := range c.opChannels() {
+			nick := strings.ToLower(msg.Nick)
+			if c.channelOps[channel][nick] || c.namesOps[channel][nick] {
+				c.setOp(channel, msg.Nick, false)
+				c.setOp(channel, newNick, true)
+			}
+		}
+		// Renames of the bot itself, even if forced, are left alone.
+		if newNick != msg.AsNick && !strings.EqualFold(newNick, msg.Nick) {
+			err = c.regainNick(msg.Nick)
+		}
+	case cmdQuit:
+		for _, channel := range c.opChannels() {
+			c.setOp(channel, msg.Nick, false)
+		}
+		err = c.regainNick(msg.Nick)
+	case cmdKick:
+		if len(msg.Params) > 1 {
+			c.setOp(strings.ToLower(msg.Params[0]), msg.Params[1], false)
+		}
+	case cmdPrivMsg, cmdNotice:
+		if msg.Channel != "" {
+			msg.ChannelOp = c.isOp(strings.ToLower(msg.Channel), msg.Nick)
+		}
+		if msg.Command == cmdPrivMsg && c.info.CTCPReplies {
+			c.handleCTCP(msg)
+		}
 	case cmdPing:
 		err = c.ircW.Sendf("PONG :%s", msg.Text)
 		if err != nil {
 			return false, err
 		}
 		return true, nil
+	case cmdError:
+		c.handleError(msg.Text)
+	case cmdISupport:
+		for _, param := range msg.Params {
+			if strings.HasPrefix(param, "LINELEN=") {
+				n, err := strconv.Atoi(param[len("LINELEN="):])
+				if err == nil && n > 0 {
+					c.lineLen = n
+				}
+			}
+		}
+	case cmdNames:
+		if len(msg.Params) > 0 {
+			channel := strings.ToLower(msg.Params[len(msg.Params)-1])
+			// Bouncers report the channels still joined via names replies
+			// when reconnecting, which saves joining them again.
+			if namesInclude(msg.Text, c.activeNick) {
+				c.setJoined(channel, true)
+			}
+			c.handleNames(channel, msg.Text)
+		}
+	case cmdEndOfNames:
+		if len(msg.Params) > 1 {
+			c.handleEndOfNames(strings.ToLower(msg.Params[len(msg.Params)-1]))
+		}
+	case cmdMode:
+		c.handleMode(msg)
+	case cmdInvite:
+		err = c.handleInvite(msg)
 	case cmdJoin, cmdPart:
+		channel := changedChannel(msg)
+		if channel == "" {
+			break
+		}
 		if msg.Nick != c.activeNick {
+			c.setOp(channel, msg.Nick, false)
+			if msg.Command == cmdJoin {
+				err = c.autoMode(channel, msg)
+			}
 			break
 		}
-		channel := changedChannel(msg)
-		if channel == "" {
+		c.setJoined(channel, msg.Command == cmdJoin)
+	}
+	if err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// regainNick switches back to the configured nick right away if it was
+// just released by nick, as enabled by the RegainNick account setting.
+func (c *ircClient) regainNick(nick string) error {
+	if !c.info.RegainNick || c.activeNick == c.info.Nick || !strings.EqualFold(nick, c.info.Nick) {
+		return nil
+	}
+	logf("[%s] Nick %q was released. Regaining it.", c.accountName, c.info.Nick)
+	c.nextNickChange = time.Now().Add(nickChangeDelay)
+	return c.ircW.Sendf("NICK %s", c.info.Nick)
+}
+
+// handleInvite joins the channel the bot was invited to, if the account's
+// "invites" setting allows invitations from the inviter: "admin" (the
+// default) accepts invitations from the account admins only, matched by
+// their "nick!user@host" masks as for commands, "any" accepts
+// all invitations, and "none" ignores them. The channel is added to the
+// account channels if the "keepinvites" setting is true, so it is joined
+// again on reconnections.
+func (c *ircClient) handleInvite(msg *Message) error {
+	channel := msg.Text
+	if len(msg.Params) > 1 {
+		channel = msg.Params[1]
+	}
+	channel = strings.ToLower(channel)
+	if !isChannel(channel) {
+		return nil
+	}
+	switch c.info.Invites {
+	case "", "admin":
+		if !matchesHost(c.info.Admins, msg) {
+			logf("[%s] Ignoring invitation to %q from %q, who is not an admin.", c.accountName, channel, msg.Nick)
+			return nil
+		}
+	case "any":
+	case "none":
+		return nil
+	default:
+		logf("[%s] Ignoring invitation to %q: unknown invites setting %q.", c.accountName, channel, c.info.Invites)
+		return nil
+	}
+	if c.wantsChannel(channel) {
+		return nil
+	}
+	logf("[%s] Invited to %q by %q. Joining.", c.accountName, channel, msg.Nick)
+	c.invited = append(c.invited, channel)
+	if c.info.KeepInvites {
+		c.internal = append(c.internal, &Message{Account: c.accountName, Channel: channel, Command: cmdPong, Text: invitedText})
+	}
+	return c.ircW.Sendf("JOIN %s", channel)
+}
+
+// ctcpClientInfo lists the CTCP requests understood when replying to them.
+const ctcpClientInfo = "ACTION CLIENTINFO PING TIME VERSION"
+
+// ctcpWindow, ctcpSenderReplies, and ctcpAccountReplies define how many
+// CTCP requests are answered within each window, from a single sender and
+// overall, so that requests cannot get the bot to flood itself off the
+// network.
+var (
+	ctcpWindow         = time.Minute
+	ctcpSenderReplies  = 3
+	ctcpAccountReplies = 10
+)
+
+// handleCTCP queues a reply to msg if it holds a CTCP request that is
+// automatically answered, as enabled by the CTCPReplies account setting.
+// Replies are queued as notices in the outgoing collection, so they are
+// delivered and recorded like any other message sent by the bot.
+func (c *ircClient) handleCTCP(msg *Message) {
+	command, args, ok := ParseCTCP(msg.Text)
+	if !ok || msg.Nick == "" {
+		return
+	}
+	var reply string
+	switch command {
+	case "VERSION":
+		reply = c.info.CTCPVersion
+		if reply == "" {
+			reply = "mup"
+		}
+	case "PING":
+		reply = args
+	case "TIME":
+		reply = time.Now().UTC().Format(time.RFC1123Z)
+	case "CLIENTINFO":
+		reply = ctcpClientInfo
+	default:
+		return
+	}
+	if !c.allowCTCP(msg.Nick) {
+		debugf("[%s] Ignoring CTCP %s request from %q beyond the rate limit.", c.accountName, command, msg.Nick)
+		return
+	}
+	debugf("[%s] Replying to CTCP %s request from %q.", c.accountName, command, msg.Nick)
+	text := "\x01" + command
+	if reply != "" {
+		text += " " + reply
+	}
+	text += "\x01"
+	err := insertOutgoing(c.database.C("outgoing"), &Message{
+		Account: c.accountName,
+		Nick:    msg.Nick,
+		Command: cmdNotice,
+		Text:    text,
+		Time:    time.Now().UTC(),
+	})
+	if err != nil {
+		logf("[%s] Cannot queue reply to CTCP %s request: %v", c.accountName, command, err)
+	}
+}
+
+// allowCTCP returns whether a CTCP request from nick may be answered
+// without going over the limits defined by ctcpSenderReplies and
+// ctcpAccountReplies, and if so counts the reply.
+func (c *ircClient) allowCTCP(nick string) bool {
+	now := time.Now()
+	if c.ctcpSenders == nil || now.Sub(c.ctcpStart) > ctcpWindow {
+		c.ctcpStart = now
+		c.ctcpReplies = 0
+		c.ctcpSenders = make(map[string]int)
+	}
+	nick = strings.ToLower(nick)
+	if c.ctcpReplies >= ctcpAccountReplies || c.ctcpSenders[nick] >= ctcpSenderReplies {
+		return false
+	}
+	c.ctcpReplies++
+	c.ctcpSenders[nick]++
+	return true
+}
+
+// wantsChannel returns whether channel is one of the account channels,
+// or one the bot was invited to.
+func (c *ircClient) wantsChannel(channel string) bool {
+	for _, ci := range c.info.Channels {
+		if strings.EqualFold(ci.Name, channel) {
+			return true
+		}
+	}
+	for _, name := range c.invited {
+		if name == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// setOp records whether nick has operator status in channel, both in
+// the known operators and in those of a names reply still being listed.
+func (c *ircClient) setOp(channel, nick string, op bool) {
+	nick = strings.ToLower(nick)
+	ops := c.channelOps[channel]
+	if op {
+		if ops == nil {
+			ops = make(map[string]bool)
+			c.channelOps[channel] = ops
+		}
+		ops[nick] = true
+	} else if ops != nil {
+		delete(ops, nick)
+	}
+	if ops, ok := c.namesOps[channel]; ok {
+		if op {
+			ops[nick] = true
+		} else {
+			delete(ops, nick)
+		}
+	}
+}
+
+// opChannels returns the channels with known operators or with a names
+// reply still being listed.
+func (c *ircClient) opChannels() []string {
+	var channels []string
+	for channel := range c.channelOps {
+		channels = append(channels, channel)
+	}
+	for channel := range c.namesOps {
+		if _, ok := c.channelOps[channel]; !ok {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// isOp returns whether nick is known to have operator status in channel.
+func (c *ircClient) isOp(channel, nick string) bool {
+	return c.channelOps[channel][strings.ToLower(nick)]
+}
+
+// setJoined records whether the bot is in channel.
+func (c *ircClient) setJoined(channel string, joined bool) {
+	pos := -1
+	for i, ichannel := range c.activeChannels {
+		if ichannel == channel {
+			pos = i
 			break
 		}
-		pos := -1
-		for i, ichannel := range c.activeChannels {
-			if ichannel == channel {
-				pos = i
-				break
+	}
+	if joined {
+		if pos == -1 {
+			c.activeChannels = append(c.activeChannels, channel)
+			delete(c.channelOps, channel)
+			delete(c.namesOps, channel)
+			logf("[%s] Joined channel %q.", c.accountName, channel)
+			c.updateStatus(statusRegistered)
+		}
+	} else {
+		if pos != -1 {
+			copy(c.activeChannels[pos:], c.activeChannels[pos+1:])
+			c.activeChannels = c.activeChannels[:len(c.activeChannels)-1]
+			delete(c.channelOps, channel)
+			delete(c.namesOps, channel)
+			logf("[%s] Left channel %q.", c.accountName, channel)
+			c.updateStatus(statusRegistered)
+		}
+	}
+}
+
+// handleNames accumulates the operators listed in a names reply for
+// channel. Names replies may span several messages, so the known operators
+// are left untouched until handleEndOfNames replaces them with the complete
+// listing, and changes seen meanwhile are applied to both.
+func (c *ircClient) handleNames(channel, names string) {
+	ops := c.namesOps[channel]
+	if ops == nil {
+		ops = make(map[string]bool)
+		c.namesOps[channel] = ops
+	}
+	for _, name := range strings.Fields(names) {
+		nick := strings.TrimLeft(name, "~&@%+")
+		prefixes := name[:len(name)-len(nick)]
+		if strings.ContainsAny(prefixes, "~&@") {
+			ops[strings.ToLower(nick)] = true
+		}
+	}
+}
+
+// namesInclude returns whether nick is listed in the names of a names reply.
+func namesInclude(names, nick string) bool {
+	for _, name := range strings.Fields(names) {
+		if strings.EqualFold(strings.TrimLeft(name, "~&@%+"), nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleEndOfNames handles RPL_ENDOFNAMES for channel, which completes the
+// names reply, so that operators known from before but not listed anymore
+// are forgotten.
+func (c *ircClient) handleEndOfNames(channel string) {
+	ops, ok := c.namesOps[channel]
+	if !ok {
+		return
+	}
+	delete(c.namesOps, channel)
+	if len(ops) == 0 {
+		delete(c.channelOps, channel)
+	} else {
+		c.channelOps[channel] = ops
+	}
+}
+
+// handleMode records changes to the operator status of nicks in channels.
+func (c *ircClient) handleMode(msg *Message) {
+	if len(msg.Params) < 2 || !isChannel(msg.Params[0]) {
+		return
+	}
+	channel := strings.ToLower(msg.Params[0])
+	args := msg.Params[2:]
+	if msg.Text != "" {
+		args = append(args, msg.Text)
+	}
+	adding := true
+	for _, mode := range msg.Params[1] {
+		switch mode {
+		case '+':
+			adding = true
+		case '-':
+			adding = false
+		case 'o', 'v', 'h', 'b', 'e', 'I', 'k', 'l':
+			if mode == 'l' && !adding || len(args) == 0 {
+				continue
 			}
+			arg := args[0]
+			args = args[1:]
+			if mode == 'o' {
+				c.setOp(channel, arg, adding)
+			}
+		}
+	}
+}
+
+// autoMode grants operator or voice status to the nick that joined the
+// channel via msg if it matches the respective lists in the channel
+// settings. Nothing is done while the bot has no operator status there.
+func (c *ircClient) autoMode(channel string, msg *Message) error {
+	if !c.isOp(channel, c.activeNick) {
+		return nil
+	}
+	for _, ci := range c.info.Channels {
+		if strings.ToLower(ci.Name) != channel {
+			continue
+		}
+		if matchesAny(ci.Op, msg) {
+			return c.ircW.Sendf("MODE %s +o %s", channel, msg.Nick)
 		}
-		if msg.Command == cmdJoin {
-			if pos == -1 {
-				c.activeChannels = append(c.activeChannels, channel)
-				logf("[%s] Joined channel %q.", c.accountName, channel)
+		if matchesAny(ci.Voice, msg) {
+			return c.ircW.Sendf("MODE %s +v %s", channel, msg.Nick)
+		}
+	}
+	return nil
+}
+
+// matchesAny returns whether the sender of msg matches any of the masks.
+// Masks holding a '!' or '@' are matched against the full "nick!user@host"
+// address and may use the * and ? wildcards. Other masks are nicks.
+func matchesAny(masks []string, msg *Message) bool {
+	full := strings.ToLower(msg.Nick + "!" + msg.User + "@" + msg.Host)
+	for _, mask := range masks {
+		mask = strings.ToLower(mask)
+		if strings.ContainsAny(mask, "!@") {
+			if wildcardMatch(mask, full) {
+				return true
 			}
-		} else {
-			if pos != -1 {
-				copy(c.activeChannels[pos:], c.activeChannels[pos+1:])
-				c.activeChannels = c.activeChannels[:len(c.activeChannels)-1]
-				logf("[%s] Left channel %q.", c.accountName, channel)
+		} else if mask == strings.ToLower(msg.Nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesHost is like matchesAny, but ignores masks that are plain nicks,
+// as anyone may take a nick not in use. It's used where matching grants
+// authority, such as for the account admins.
+func matchesHost(masks []string, msg *Message) bool {
+	for _, mask := range masks {
+		if strings.ContainsAny(mask, "!@") && matchesAny([]string{mask}, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func wildcardMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
 			}
 		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+// handleError records whether the text of an ERROR message sent by the
+// server matches one of the reasons configured for not reconnecting.
+func (c *ircClient) handleError(text string) {
+	c.lastError = text
+	if c.noReconnect != "" {
+		return
+	}
+	lower := strings.ToLower(text)
+	for _, reason := range c.info.NoReconnect {
+		if reason != "" && strings.Contains(lower, strings.ToLower(reason)) {
+			c.noReconnect = text
+			return
+		}
 	}
-	return false, nil
 }
 
 func (c *ircClient) handleUpdateInfo(info *accountInfo) error {
 	var joins []string
 	var parts []string
+	var invited []string
+Outer0:
+	for _, ci := range c.invited {
+		for _, cj := range info.Channels {
+			if strings.EqualFold(ci, cj.Name) {
+				continue Outer0
+			}
+		}
+		invited = append(invited, ci)
+	}
+	c.invited = invited
+	// Channel names are case insensitive, and confirmed channels are
+	// recorded in lower case, so compare them accordingly to avoid
+	// parting and joining channels configured with upper case letters.
 Outer1:
 	for _, ci := range c.activeChannels {
 		for _, cj := range info.Channels {
-			if ci == cj.Name {
+			if strings.EqualFold(ci, cj.Name) {
+				continue Outer1
+			}
+		}
+		for _, cj := range c.invited {
+			if strings.EqualFold(ci, cj) {
 				continue Outer1
 			}
 		}
 		parts = append(parts, ci)
 	}
-Outer2:
+	wanted := make([]string, 0, len(info.Channels)+len(c.invited))
 	for _, ci := range info.Channels {
+		wanted = append(wanted, ci.Name)
+	}
+	wanted = append(wanted, c.invited...)
+Outer2:
+	for _, ci := range wanted {
 		for _, cj := range c.activeChannels {
-			if ci.Name == cj {
+			if strings.EqualFold(ci, cj) {
 				continue Outer2
 			}
 		}
-		joins = append(joins, ci.Name)
+		joins = append(joins, ci)
 	}
 	c.info = *info
-	if len(joins) > 0 {
-		// TODO Handle channel keys.
-		err := c.ircW.Sendf("JOIN %s", strings.Join(joins, ","))
+	// TODO Handle channel keys.
+	// Lines still waiting from an earlier update are superseded, as
+	// the channels in them are joined again if still wanted.
+	c.joinLines = c.batchLines("JOIN ", joins)
+	if c.joinDelay == nil {
+		if err := c.sendJoins(); err != nil {
+			return err
+		}
+	}
+	for _, line := range c.batchLines("PART ", parts) {
+		err := c.ircW.Sendf("%s", line)
 		if err != nil {
 			return err
 		}
 	}
-	if len(parts) > 0 {
-		err := c.ircW.Sendf("PART %s", strings.Join(parts, ","))
+	if c.wallops != c.info.Wallops {
+		mode := "-w"
+		if c.info.Wallops {
+			mode = "+w"
+		}
+		err := c.ircW.Sendf("MODE %s %s", c.activeNick, mode)
 		if err != nil {
 			return err
 		}
+		c.wallops = c.info.Wallops
 	}
 	if c.activeNick != c.info.Nick {
 		now := time.Now()
@@ -405,6 +1226,29 @@ Outer2:
 	return nil
 }
 
+// batchLines returns the lines formed by the command prefix followed by
+// the comma-separated names, split so that no line exceeds the maximum
+// line length supported by the server.
+func (c *ircClient) batchLines(prefix string, names []string) []string {
+	var lines []string
+	max := c.lineLen - len("\r\n")
+	line := prefix
+	for _, name := range names {
+		if line != prefix && len(line)+1+len(name) > max {
+			lines = append(lines, line)
+			line = prefix
+		}
+		if line != prefix {
+			line += ","
+		}
+		line += name
+	}
+	if line != prefix {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
 // ---------------------------------------------------------------------------
 // ircWriter
 
@@ -412,17 +1256,30 @@ Outer2:
 type ircWriter struct {
 	accountName string
 	conn        net.Conn
+	charset     *charset
 	buf         *bufio.Writer
 	tomb        tomb.Tomb
 
+	// Sent messages are confirmed in batches of confirmEvery messages,
+	// or after confirmDelay. See accountInfo for details.
+	confirmEvery int
+	confirmDelay time.Duration
+
+	// Lines written for outgoing messages are recorded by audit, if set,
+	// with the whole payload of those in secret redacted, as done for the
+	// OnRegister commands that may carry credentials.
+	audit  *auditor
+	secret map[string]bool
+
 	Dying    <-chan struct{}
 	Outgoing chan *Message
 }
 
-func startIrcWriter(accountName string, conn net.Conn) *ircWriter {
+func startIrcWriter(accountName string, conn net.Conn, cs *charset) *ircWriter {
 	w := &ircWriter{
 		accountName: accountName,
 		conn:        conn,
+		charset:     cs,
 		buf:         bufio.NewWriter(conn),
 		Outgoing:    make(chan *Message, 1),
 	}
@@ -469,32 +1326,58 @@ func (w *ircWriter) loop() error {
 	pinger := time.NewTicker(pingDelay)
 	defer pinger.Stop()
 	lastPing := time.Now()
+
+	// The last sent message pending confirmation, how many
+	// messages it covers, and when it must be confirmed.
+	var unconfirmedId bson.ObjectId
+	var unconfirmed int
+	var confirmTimer <-chan time.Time
 loop:
 	for {
 		var send []string
+		var audit string
 		select {
 		case msg := <-w.Outgoing:
 			line := msg.String()
 			if msg.Command != cmdPong {
 				logf("[%s] Sending: %s", w.accountName, line)
+				audit = line
 			}
 			if (msg.Command == cmdPrivMsg || msg.Command == cmdNotice || msg.Command == "") && msg.Id != "" {
-				send = []string{line, "\r\nPING :sent:", msg.Id.Hex(), "\r\n"}
-				lastPing = time.Now()
+				unconfirmedId = msg.Id
+				unconfirmed++
+				if unconfirmed >= w.confirmEvery {
+					send = []string{line, "\r\nPING :sent:", msg.Id.Hex(), "\r\n"}
+					lastPing = time.Now()
+					unconfirmedId, unconfirmed, confirmTimer = "", 0, nil
+				} else {
+					send = []string{line, "\r\n"}
+					if confirmTimer == nil && w.confirmDelay > 0 {
+						confirmTimer = time.After(w.confirmDelay)
+					}
+				}
 			} else {
 				send = []string{line, "\r\n"}
 			}
+		case <-confirmTimer:
+			send = []string{"PING :sent:", unconfirmedId.Hex(), "\r\n"}
+			lastPing = time.Now()
+			unconfirmedId, unconfirmed, confirmTimer = "", 0, nil
 		case t := <-pinger.C:
-			if t.Before(lastPing.Add(pingDelay)) {
+			if unconfirmedId != "" {
+				send = []string{"PING :sent:", unconfirmedId.Hex(), "\r\n"}
+				unconfirmedId, unconfirmed, confirmTimer = "", 0, nil
+			} else if t.Before(lastPing.Add(pingDelay)) {
 				continue
+			} else {
+				send = []string{"PING :", strconv.FormatInt(t.Unix(), 10), "\r\n"}
 			}
 			lastPing = t
-			send = []string{"PING :", strconv.FormatInt(t.Unix(), 10), "\r\n"}
 		case <-w.Dying:
 			break loop
 		}
 		for _, s := range send {
-			_, err := w.buf.WriteString(s)
+			_, err := w.buf.WriteString(w.charset.Encode(s))
 			if err != nil {
 				w.tomb.Kill(err)
 				break
@@ -505,6 +1388,9 @@ loop:
 			w.tomb.Kill(err)
 			break
 		}
+		if audit != "" {
+			w.audit.Record(w.accountName, audit, w.secret[audit])
+		}
 	}
 
 	return nil
@@ -518,6 +1404,8 @@ type ircReader struct {
 	accountName string
 	conn        net.Conn
 	activeNick  string
+	lastError   string
+	charset     *charset
 	buf         *bufio.Reader
 	tomb        tomb.Tomb
 
@@ -525,10 +1413,11 @@ type ircReader struct {
 	Incoming chan *Message
 }
 
-func startIrcReader(accountName string, conn net.Conn) *ircReader {
+func startIrcReader(accountName string, conn net.Conn, cs *charset) *ircReader {
 	r := &ircReader{
 		accountName: accountName,
 		conn:        conn,
+		charset:     cs,
 		buf:         bufio.NewReader(conn),
 		Incoming:    make(chan *Message, 1),
 	}
@@ -571,13 +1460,15 @@ func (r *ircReader) loop() error {
 			r.tomb.Killf("line is too long")
 			break
 		}
-		msg := ParseIncoming(r.accountName, r.activeNick, "!", string(line))
+		msg := ParseIncoming(r.accountName, r.activeNick, "!", r.charset.Decode(line))
 		if msg.Command != cmdPong && msg.Command != cmdPing {
 			logf("[%s] Received: %s", r.accountName, line)
 		}
 		switch msg.Command {
 		case cmdNick:
-			if r.activeNick == "" || r.activeNick == msg.Nick {
+			// Nicks are case insensitive, and servers forcing a rename
+			// may not preserve the case the nick was registered with.
+			if r.activeNick == "" || strings.EqualFold(r.activeNick, msg.Nick) {
 				if len(msg.Params) > 0 {
 					r.activeNick = msg.Params[0]
 				} else if msg.Text != "" {
@@ -592,6 +1483,15 @@ func (r *ircReader) loop() error {
 				msg.AsNick = r.activeNick
 				logf("[%s] Nick %q accepted.", r.accountName, r.activeNick)
 			}
+		case cmdEndOfMOTD, cmdNoMOTD:
+			// Some servers and bouncers skip the welcome notice.
+			if r.activeNick == "" && len(msg.Params) > 0 {
+				r.activeNick = msg.Params[0]
+				msg.AsNick = r.activeNick
+				logf("[%s] Nick %q accepted.", r.accountName, r.activeNick)
+			}
+		case cmdError:
+			r.lastError = msg.Text
 		}
 		select {
 		case r.Incoming <- msg:
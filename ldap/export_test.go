@@ -0,0 +1,11 @@
+package ldap
+
+import (
+	"gopkg.in/ldap.v0"
+)
+
+// ConvertEntries converts the provided entries as done with the
+// entries found by Search.
+func ConvertEntries(entries []*ldap.Entry) []Result {
+	return convertEntries(entries)
+}
@@ -1,9 +1,13 @@
 package ldap
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
 	"strings"
+	"time"
 
+	ber "gopkg.in/asn1-ber.v1"
 	"gopkg.in/ldap.v0"
 )
 
@@ -17,6 +21,13 @@ type Config struct {
 type Conn interface {
 	Close() error
 	Search(search *Search) ([]Result, error)
+
+	// WhoAmI verifies that the connection is still able to authenticate
+	// against the server with its configured credentials, and returns the
+	// authorization identity the server reports for them via the "Who am
+	// I?" extended operation (RFC 4532), such as "dn:cn=mup,dc=example".
+	// The identity is empty for anonymous binds.
+	WhoAmI() (authzId string, err error)
 }
 
 type Search struct {
@@ -32,6 +43,10 @@ type Result struct {
 type Attr struct {
 	Name   string
 	Values []string
+
+	// RawValues holds the attribute values exactly as provided by the
+	// server, for binary attributes such as jpegPhoto or userCertificate.
+	RawValues [][]byte
 }
 
 func (r *Result) Values(name string) []string {
@@ -51,9 +66,41 @@ func (r *Result) Value(name string) string {
 	return ""
 }
 
+// RawValues returns the values of the named attribute exactly as provided
+// by the server. It should be used for binary attributes.
+func (r *Result) RawValues(name string) [][]byte {
+	for _, attr := range r.Attrs {
+		if attr.Name != name {
+			continue
+		}
+		if attr.RawValues != nil {
+			return attr.RawValues
+		}
+		raw := make([][]byte, len(attr.Values))
+		for i, value := range attr.Values {
+			raw[i] = []byte(value)
+		}
+		return raw
+	}
+	return nil
+}
+
+// RawValue returns the first value of the named attribute exactly as
+// provided by the server, or nil if the attribute has no values.
+func (r *Result) RawValue(name string) []byte {
+	values := r.RawValues(name)
+	if len(values) > 0 {
+		return values[0]
+	}
+	return nil
+}
+
 type ldapConn struct {
-	conn   *ldap.Conn
-	baseDN string
+	conn     *ldap.Conn
+	url      string
+	baseDN   string
+	bindDN   string
+	bindPass string
 }
 
 var TestDial func(*Config) (Conn, error)
@@ -64,22 +111,39 @@ func Dial(config *Config) (Conn, error) {
 	}
 	var conn *ldap.Conn
 	var err error
-	if strings.HasPrefix(config.URL, "ldaps://") {
-		conn, err = ldap.DialTLS("tcp", config.URL[8:], nil)
-	} else if strings.HasPrefix(config.URL, "ldap://") {
-		conn, err = ldap.Dial("tcp", config.URL[7:])
+	if addr, useTLS := splitURL(config.URL); useTLS {
+		conn, err = ldap.DialTLS("tcp", addr, nil)
 	} else {
-		conn, err = ldap.Dial("tcp", config.URL)
+		conn, err = ldap.Dial("tcp", addr)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("cannot dial LDAP server: %v", err)
 	}
 	if err := conn.Bind(config.BindDN, config.BindPass); err != nil {
 		conn.Close()
-		s := strings.Replace(err.Error(), config.BindPass, "********", -1)
-		return nil, fmt.Errorf("cannot bind to LDAP server: %s", s)
+		return nil, bindError(err, config.BindPass)
+	}
+	return &ldapConn{conn, config.URL, config.BaseDN, config.BindDN, config.BindPass}, nil
+}
+
+// splitURL returns the server address in url, and whether TLS is used.
+func splitURL(url string) (addr string, useTLS bool) {
+	if strings.HasPrefix(url, "ldaps://") {
+		return url[8:], true
 	}
-	return &ldapConn{conn, config.BaseDN}, nil
+	if strings.HasPrefix(url, "ldap://") {
+		return url[7:], false
+	}
+	return url, false
+}
+
+// bindError returns err with any occurrences of the bind password hidden.
+func bindError(err error, bindPass string) error {
+	s := err.Error()
+	if bindPass != "" {
+		s = strings.Replace(s, bindPass, "********", -1)
+	}
+	return fmt.Errorf("cannot bind to LDAP server: %s", s)
 }
 
 func (c *ldapConn) Close() error {
@@ -87,6 +151,76 @@ func (c *ldapConn) Close() error {
 	return nil
 }
 
+// whoAmIOID identifies the "Who am I?" extended operation of RFC 4532.
+const whoAmIOID = "1.3.6.1.4.1.4203.1.11.3"
+
+func (c *ldapConn) WhoAmI() (string, error) {
+	if err := c.conn.Bind(c.bindDN, c.bindPass); err != nil {
+		return "", bindError(err, c.bindPass)
+	}
+
+	// The LDAP package offers no way to issue arbitrary extended
+	// operations, so the request goes through a short-lived connection
+	// of its own, bound with the same credentials.
+	addr, useTLS := splitURL(c.url)
+	conn, err := net.DialTimeout("tcp", addr, ldap.DefaultTimeout)
+	if err != nil {
+		return "", fmt.Errorf("cannot dial LDAP server: %v", err)
+	}
+	if useTLS {
+		host, _, _ := net.SplitHostPort(addr)
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ldap.DefaultTimeout))
+
+	bind := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindRequest, nil, "Bind Request")
+	bind.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	bind.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, c.bindDN, "User Name"))
+	bind.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, c.bindPass, "Password"))
+	if _, err := roundtrip(conn, 1, bind, ldap.ApplicationBindResponse); err != nil {
+		return "", bindError(err, c.bindPass)
+	}
+
+	whoAmI := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedRequest, nil, "Who Am I Request")
+	whoAmI.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, whoAmIOID, "Request Name"))
+	response, err := roundtrip(conn, 2, whoAmI, ldap.ApplicationExtendedResponse)
+	if err != nil {
+		return "", fmt.Errorf("cannot obtain LDAP authorization identity: %v", err)
+	}
+	for _, child := range response.Children[3:] {
+		if child.ClassType == ber.ClassContext && child.Tag == 11 {
+			return child.Data.String(), nil
+		}
+	}
+	return "", nil
+}
+
+// roundtrip sends the request operation with the given message id over
+// conn, and returns the response operation with the expected tag if it
+// reports success.
+func roundtrip(conn net.Conn, id int64, op *ber.Packet, tag ber.Tag) (*ber.Packet, error) {
+	request := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	request.AppendChild(op)
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		return nil, err
+	}
+	packet, err := ber.ReadPacket(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(packet.Children) < 2 || packet.Children[1].Tag != tag || len(packet.Children[1].Children) < 3 {
+		return nil, fmt.Errorf("unexpected response from LDAP server")
+	}
+	response := packet.Children[1]
+	if code, _ := response.Children[0].Value.(int64); code != 0 {
+		message, _ := response.Children[2].Value.(string)
+		return nil, ldap.NewError(uint8(code), fmt.Errorf("%s", message))
+	}
+	return response, nil
+}
+
 func (c *ldapConn) Search(s *Search) ([]Result, error) {
 	search := ldap.NewSearchRequest(
 		c.baseDN,
@@ -101,16 +235,20 @@ func (c *ldapConn) Search(s *Search) ([]Result, error) {
 	if err != nil {
 		return nil, err
 	}
-	r := make([]Result, len(result.Entries))
-	for ei, entry := range result.Entries {
+	return convertEntries(result.Entries), nil
+}
+
+func convertEntries(entries []*ldap.Entry) []Result {
+	r := make([]Result, len(entries))
+	for ei, entry := range entries {
 		ri := &r[ei]
 		ri.DN = entry.DN
 		ri.Attrs = make([]Attr, len(entry.Attributes))
 		for ai, attr := range entry.Attributes {
-			ri.Attrs[ai] = Attr{attr.Name, attr.Values}
+			ri.Attrs[ai] = Attr{Name: attr.Name, Values: attr.Values, RawValues: attr.ByteValues}
 		}
 	}
-	return r, nil
+	return r
 }
 
 var hex = "0123456789abcdef"
@@ -2,9 +2,13 @@ package ldap_test
 
 import (
 	"fmt"
+	"net"
 	"testing"
+	"time"
 
+	ber "gopkg.in/asn1-ber.v1"
 	. "gopkg.in/check.v1"
+	goldap "gopkg.in/ldap.v0"
 	"gopkg.in/mup.v0/ldap"
 )
 
@@ -58,6 +62,33 @@ func (s *S) TestSearch(c *C) {
 	c.Assert(conn.Close(), IsNil)
 }
 
+func (s *S) TestRawValues(c *C) {
+	photo := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10, 0x80, 0xfe}
+	results := ldap.ConvertEntries([]*goldap.Entry{{
+		DN: "uid=einstein,dc=example,dc=com",
+		Attributes: []*goldap.EntryAttribute{{
+			Name:       "jpegPhoto",
+			Values:     []string{string(photo)},
+			ByteValues: [][]byte{photo},
+		}, {
+			Name:       "cn",
+			Values:     []string{"Albert Einstein"},
+			ByteValues: [][]byte{[]byte("Albert Einstein")},
+		}},
+	}})
+	c.Assert(results, HasLen, 1)
+	result := results[0]
+	c.Assert(result.DN, Equals, "uid=einstein,dc=example,dc=com")
+	c.Assert(result.RawValues("jpegPhoto"), DeepEquals, [][]byte{photo})
+	c.Assert(result.RawValue("jpegPhoto"), DeepEquals, photo)
+	c.Assert(result.Value("cn"), Equals, "Albert Einstein")
+	c.Assert(result.RawValue("missing"), IsNil)
+
+	// Raw values are derived from the string ones when unset.
+	result = ldap.Result{Attrs: []ldap.Attr{{Name: "cn", Values: []string{"one", "two"}}}}
+	c.Assert(result.RawValues("cn"), DeepEquals, [][]byte{[]byte("one"), []byte("two")})
+}
+
 type ldapConn struct {
 	config *ldap.Config
 	search *ldap.Search
@@ -73,6 +104,13 @@ func (c *ldapConn) Search(s *ldap.Search) ([]ldap.Result, error) {
 	return []ldap.Result{{DN: "test-dn"}}, nil
 }
 
+func (c *ldapConn) WhoAmI() (string, error) {
+	if c.fail {
+		return "", fmt.Errorf("test-error")
+	}
+	return c.config.BindDN, nil
+}
+
 func (c *ldapConn) Close() error {
 	if c.closed {
 		panic("closed twice")
@@ -138,6 +176,167 @@ func (s *S) TestManaged(c *C) {
 	c.Assert(conns[1].search.Filter, Equals, "test-filter2")
 }
 
+func (s *S) TestManagedHealth(c *C) {
+	dials := 0
+	ldap.TestDial = func(c *ldap.Config) (ldap.Conn, error) {
+		dials++
+		if dials == 1 {
+			return nil, fmt.Errorf("temporary error")
+		}
+		return &ldapConn{config: c}, nil
+	}
+	defer func() {
+		ldap.TestDial = nil
+	}()
+
+	mconn := ldap.DialManaged(config)
+	defer mconn.Close()
+
+	var connected bool
+	var err error
+	for i := 0; i < 100; i++ {
+		connected, err = mconn.Health()
+		if err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(connected, Equals, false)
+	c.Assert(err, ErrorMatches, "temporary error")
+
+	// Requesting a connection redials right away.
+	conn := mconn.Conn()
+	defer conn.Close()
+	_, err = conn.WhoAmI()
+	c.Assert(err, IsNil)
+
+	connected, err = mconn.Health()
+	c.Assert(connected, Equals, true)
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestManagedWhoAmI(c *C) {
+	dials := 0
+	ldap.TestDial = func(c *ldap.Config) (ldap.Conn, error) {
+		dials++
+		return &ldapConn{config: c, fail: dials == 1}, nil
+	}
+	defer func() {
+		ldap.TestDial = nil
+	}()
+
+	mconn := ldap.DialManaged(config)
+	defer mconn.Close()
+
+	conn := mconn.Conn()
+	defer conn.Close()
+
+	dn, err := conn.WhoAmI()
+	c.Assert(err, ErrorMatches, "test-error")
+	c.Assert(dn, Equals, "")
+
+	// The failure drops the connection, and the next request redials.
+	dn, err = conn.WhoAmI()
+	c.Assert(err, IsNil)
+	c.Assert(dn, Equals, "cn=read-only-admin,dc=example,dc=com")
+	c.Assert(dials, Equals, 2)
+}
+
+// whoAmIServer is a minimal LDAP server that accepts anonymous binds and
+// simple binds with the "secret" password, and answers "Who am I?" extended operations with
+// the DN of the last bind on the connection.
+type whoAmIServer struct {
+	l        net.Listener
+	requests []string
+}
+
+func (s *whoAmIServer) Start() {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s.l = l
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+}
+
+func (s *whoAmIServer) Stop() {
+	s.l.Close()
+}
+
+func (s *whoAmIServer) serve(conn net.Conn) {
+	defer conn.Close()
+	var bound string
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		var code int64
+		var response *ber.Packet
+		switch op.Tag {
+		case goldap.ApplicationBindRequest:
+			bound = op.Children[1].Value.(string)
+			if password := op.Children[2].Data.String(); password != "secret" && (bound != "" || password != "") {
+				code = goldap.LDAPResultInvalidCredentials
+			}
+			response = ber.Encode(ber.ClassApplication, ber.TypeConstructed, goldap.ApplicationBindResponse, nil, "Bind Response")
+		case goldap.ApplicationExtendedRequest:
+			s.requests = append(s.requests, op.Children[0].Data.String())
+			response = ber.Encode(ber.ClassApplication, ber.TypeConstructed, goldap.ApplicationExtendedResponse, nil, "Extended Response")
+		default:
+			return
+		}
+		response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+		response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+		response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+		if op.Tag == goldap.ApplicationExtendedRequest && bound != "" {
+			response.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 11, "dn:"+bound, "Response Value"))
+		}
+		message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+		message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+		message.AppendChild(response)
+		if _, err := conn.Write(message.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func (s *S) TestWhoAmI(c *C) {
+	server := &whoAmIServer{}
+	server.Start()
+	defer server.Stop()
+
+	conn, err := ldap.Dial(&ldap.Config{URL: "ldap://" + server.l.Addr().String(), BindDN: "cn=mup,dc=example", BindPass: "secret"})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	authzId, err := conn.WhoAmI()
+	c.Assert(err, IsNil)
+	c.Assert(authzId, Equals, "dn:cn=mup,dc=example")
+	c.Assert(server.requests, DeepEquals, []string{"1.3.6.1.4.1.4203.1.11.3"})
+
+	conn, err = ldap.Dial(&ldap.Config{URL: server.l.Addr().String()})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	authzId, err = conn.WhoAmI()
+	c.Assert(err, IsNil)
+	c.Assert(authzId, Equals, "")
+
+	_, err = ldap.Dial(&ldap.Config{URL: server.l.Addr().String(), BindDN: "cn=mup,dc=example", BindPass: "wrong"})
+	c.Assert(err, ErrorMatches, "cannot bind to LDAP server: .*Invalid Credentials.*")
+}
+
 func (s *S) TestEscapeFilter(c *C) {
 	c.Assert(ldap.EscapeFilter("a\x00b(c)d*e\\f"), Equals, `a\00b\28c\29d\2ae\5cf`)
 	c.Assert(ldap.EscapeFilter("Lučić"), Equals, `Lu\c4\8di\c4\87`)
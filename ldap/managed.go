@@ -11,25 +11,33 @@ import (
 type ManagedConn struct {
 	tomb     tomb.Tomb
 	config   Config
-	searches chan *Search
+	requests chan managedRequest
 	results  chan managedResults
 	open     chan bool
 	close    chan bool
 
-	mu     sync.Mutex
-	err    error
-	closed bool
+	mu        sync.Mutex
+	err       error
+	connected bool
+	closed    bool
+}
+
+// managedRequest holds either a search to perform or, if search is nil,
+// a WhoAmI request.
+type managedRequest struct {
+	search *Search
 }
 
 type managedResults struct {
 	results []Result
+	dn      string
 	err     error
 }
 
 func DialManaged(config *Config) *ManagedConn {
 	mconn := &ManagedConn{
 		config:   *config,
-		searches: make(chan *Search),
+		requests: make(chan managedRequest),
 		results:  make(chan managedResults),
 		open:     make(chan bool),
 		close:    make(chan bool),
@@ -49,12 +57,22 @@ func (mconn *ManagedConn) Close() error {
 	return nil
 }
 
-func (mconn *ManagedConn) setError(err error) {
+func (mconn *ManagedConn) setState(connected bool, err error) {
 	mconn.mu.Lock()
+	mconn.connected = connected
 	mconn.err = err
 	mconn.mu.Unlock()
 }
 
+// Health reports whether the managed connection is currently established
+// with the LDAP server, and the error that caused it to be dropped or that
+// prevented it from being established, if any.
+func (mconn *ManagedConn) Health() (connected bool, err error) {
+	mconn.mu.Lock()
+	defer mconn.mu.Unlock()
+	return mconn.connected, mconn.err
+}
+
 var pingSearch = Search{
 	Filter: "(unknownAttr=this-query-is-just-a-ping)",
 	Attrs:  []string{"unknownAttr"},
@@ -69,7 +87,7 @@ func (mconn *ManagedConn) loop() error {
 	for refs > 0 {
 		conn, err := Dial(&mconn.config)
 		if err != nil {
-			mconn.setError(err)
+			mconn.setState(false, err)
 			select {
 			case <-time.After(managedTimeout):
 			case <-mconn.open:
@@ -79,15 +97,20 @@ func (mconn *ManagedConn) loop() error {
 			}
 			continue
 		}
-		mconn.setError(nil)
+		mconn.setState(true, nil)
 
-		var results []Result
 		for refs > 0 && err == nil {
 			select {
-			case s := <-mconn.searches:
-				results, err = conn.Search(s)
+			case req := <-mconn.requests:
+				var r managedResults
+				if req.search != nil {
+					r.results, r.err = conn.Search(req.search)
+				} else {
+					r.dn, r.err = conn.WhoAmI()
+				}
+				err = r.err
 				select {
-				case mconn.results <- managedResults{results, err}:
+				case mconn.results <- r:
 				case <-time.After(500 * time.Millisecond):
 				}
 			case <-ticker.C:
@@ -98,7 +121,7 @@ func (mconn *ManagedConn) loop() error {
 				refs--
 			}
 		}
-		mconn.setError(err)
+		mconn.setState(false, err)
 		conn.Close()
 	}
 	return nil
@@ -131,18 +154,28 @@ func (conn *managedConn) Close() error {
 }
 
 func (conn *managedConn) Search(s *Search) ([]Result, error) {
+	r := conn.do(managedRequest{search: s})
+	return r.results, r.err
+}
+
+func (conn *managedConn) WhoAmI() (string, error) {
+	r := conn.do(managedRequest{})
+	return r.dn, r.err
+}
+
+func (conn *managedConn) do(req managedRequest) managedResults {
 	conn.mu.Lock()
 	closed := conn.closed
 	conn.mu.Unlock()
 	if closed {
-		return nil, fmt.Errorf("LDAP connection already closed")
+		return managedResults{err: fmt.Errorf("LDAP connection already closed")}
 	}
 	timeout := time.After(managedTimeout)
 	select {
-	case conn.mconn.searches <- s:
+	case conn.mconn.requests <- req:
 		select {
 		case r := <-conn.mconn.results:
-			return r.results, r.err
+			return r
 		case <-timeout:
 		}
 	case <-timeout:
@@ -153,5 +186,5 @@ func (conn *managedConn) Search(s *Search) ([]Result, error) {
 	if err == nil {
 		err = fmt.Errorf("LDAP server is a big sluggish right now. Please try again soon.")
 	}
-	return nil, err
+	return managedResults{err: err}
 }
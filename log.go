@@ -2,6 +2,8 @@ package mup
 
 import (
 	"fmt"
+	"sync"
+	"time"
 )
 
 // ---------------------------------------------------------------------------
@@ -44,3 +46,41 @@ func debugf(format string, args ...interface{}) {
 		globalLogger.Output(2, fmt.Sprintf(format, args...))
 	}
 }
+
+// A logCapture holds the most recent log messages of each plugin, so that
+// they may be inspected from chat without access to the server logs.
+type logCapture struct {
+	mu    sync.Mutex
+	size  int
+	lines map[string][]string
+}
+
+func newLogCapture(size int) *logCapture {
+	if size <= 0 {
+		return nil
+	}
+	return &logCapture{size: size, lines: make(map[string][]string)}
+}
+
+// add records line as logged by the named plugin, dropping the oldest
+// line recorded for it if the buffer is full.
+func (lc *logCapture) add(plugin, line string) {
+	line = time.Now().UTC().Format("15:04:05 ") + line
+	lc.mu.Lock()
+	lines := lc.lines[plugin]
+	if len(lines) == lc.size {
+		copy(lines, lines[1:])
+		lines[len(lines)-1] = line
+	} else {
+		lines = append(lines, line)
+	}
+	lc.lines[plugin] = lines
+	lc.mu.Unlock()
+}
+
+// recent returns the lines recorded for the named plugin, oldest first.
+func (lc *logCapture) recent(plugin string) []string {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return append([]string(nil), lc.lines[plugin]...)
+}
@@ -0,0 +1,101 @@
+package mup
+
+import (
+	"regexp"
+	"strings"
+)
+
+// A Matcher holds conditions that messages must all satisfy, built by
+// chaining its methods:
+//
+//	mup.Match().Command("PRIVMSG").Channel("#mup").TextContains("foo")
+//
+// A Matcher registered via Plugger.SetMatcher pre-filters the messages
+// delivered to the plugin, so it need not check these conditions itself.
+type Matcher struct {
+	conds []func(msg *Message) bool
+}
+
+// Match returns a new Matcher that matches all messages until further
+// conditions are added to it.
+func Match() *Matcher {
+	return &Matcher{}
+}
+
+func (m *Matcher) add(cond func(msg *Message) bool) *Matcher {
+	m.conds = append(m.conds, cond)
+	return m
+}
+
+// Command adds a condition that the message command is one of cmds.
+func (m *Matcher) Command(cmds ...string) *Matcher {
+	return m.add(func(msg *Message) bool {
+		for _, cmd := range cmds {
+			if msg.Command == cmd {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Account adds a condition that the message was received from or sent
+// to the named account.
+func (m *Matcher) Account(name string) *Matcher {
+	return m.add(func(msg *Message) bool { return msg.Account == name })
+}
+
+// Channel adds a condition that the message channel is the provided one.
+// As with plugin targets, name may also be a pattern such as "#mup-*".
+func (m *Matcher) Channel(name string) *Matcher {
+	addr := Address{Channel: name}
+	return m.add(func(msg *Message) bool { return name != "" && addr.Contains(msg.Address()) })
+}
+
+// Private adds a condition that the message was not sent to a channel.
+func (m *Matcher) Private() *Matcher {
+	return m.add(func(msg *Message) bool { return msg.Channel == "" })
+}
+
+// Nick adds a condition that the message was sent by or to nick.
+func (m *Matcher) Nick(nick string) *Matcher {
+	return m.add(func(msg *Message) bool { return msg.Nick == nick })
+}
+
+// Sender adds a condition that the sender address matches one of the
+// "nick!user@host" masks, which may use the * and ? wildcards. Masks that
+// are plain nicks never match, as anyone may take a nick not in use, so
+// this is suitable for deciding who may run privileged commands.
+func (m *Matcher) Sender(masks ...string) *Matcher {
+	return m.add(func(msg *Message) bool { return matchesHost(masks, msg) })
+}
+
+// TextContains adds a condition that the message text contains substr.
+func (m *Matcher) TextContains(substr string) *Matcher {
+	return m.add(func(msg *Message) bool { return strings.Contains(msg.Text, substr) })
+}
+
+// TextMatches adds a condition that the message text matches re.
+func (m *Matcher) TextMatches(re *regexp.Regexp) *Matcher {
+	return m.add(func(msg *Message) bool { return re.MatchString(msg.Text) })
+}
+
+// Func adds a condition that f returns true for the message, for the
+// cases not covered by the other methods.
+func (m *Matcher) Func(f func(msg *Message) bool) *Matcher {
+	return m.add(f)
+}
+
+// Matches returns whether msg satisfies all of the matcher conditions.
+// A nil Matcher matches all messages.
+func (m *Matcher) Matches(msg *Message) bool {
+	if m == nil {
+		return true
+	}
+	for _, cond := range m.conds {
+		if !cond(msg) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,6 +1,7 @@
 package mup
 
 import (
+	"context"
 	"gopkg.in/mgo.v2/bson"
 	"strings"
 	"sync"
@@ -9,24 +10,50 @@ import (
 )
 
 const (
-	cmdWelcome   = "001"
-	cmdNickInUse = "433"
-	cmdPrivMsg   = "PRIVMSG"
-	cmdNotice    = "NOTICE"
-	cmdNick      = "NICK"
-	cmdPing      = "PING"
-	cmdPong      = "PONG"
-	cmdJoin      = "JOIN"
-	cmdPart      = "PART"
-	cmdQuit      = "QUIT"
+	cmdWelcome    = "001"
+	cmdISupport   = "005"
+	cmdNames      = "353"
+	cmdEndOfNames = "366"
+	cmdEndOfMOTD  = "376"
+	cmdNoMOTD     = "422"
+	cmdNickInUse  = "433"
+	cmdSASLOk     = "903"
+	cmdSASLFail   = "904"
+	cmdSASLLong   = "905"
+	cmdSASLAbort  = "906"
+	cmdSASLAgain  = "907"
+	cmdCap        = "CAP"
+	cmdAuth       = "AUTHENTICATE"
+	cmdPrivMsg    = "PRIVMSG"
+	cmdNotice     = "NOTICE"
+	cmdNick       = "NICK"
+	cmdPing       = "PING"
+	cmdPong       = "PONG"
+	cmdJoin       = "JOIN"
+	cmdPart       = "PART"
+	cmdMode       = "MODE"
+	cmdKick       = "KICK"
+	cmdInvite     = "INVITE"
+	cmdQuit       = "QUIT"
+	cmdError      = "ERROR"
 )
 
 type Message struct {
 	Id bson.ObjectId `bson:"_id,omitempty"`
 
-	// When the message was received or queued out.
+	// When the message was received or queued out, in UTC.
 	Time time.Time
 
+	// When set on outgoing messages, the time after which the message is
+	// dropped rather than delivered, if the account was not connected.
+	Expires time.Time `bson:",omitempty"`
+
+	// When set on outgoing messages, allows the message to be delivered
+	// ahead of earlier ones with a lower priority that are waiting for the
+	// account to take them, such as command replies queued after bulk
+	// announcements. Messages are delivered in order by default.
+	Priority int `bson:",omitempty"`
+
 	// These fields form the message Address.
 	Account string `bson:",omitempty"`
 	Channel string `bson:",omitempty"`
@@ -54,8 +81,65 @@ type Message struct {
 
 	// The bot nick that was in place when the message was received.
 	AsNick string `bson:",omitempty"`
+
+	// The locale configured for the account when the message was received.
+	Locale string `bson:",omitempty"`
+
+	// Whether the sender was known to have operator status in the
+	// channel when the message was received.
+	ChannelOp bool `bson:",omitempty"`
+
+	// The kind of event, for messages that report a change to an earlier
+	// message on protocols that support it (EditEvent or DeleteEvent),
+	// and the protocol-specific id of the message changed. Such messages
+	// are only delivered to plugins that set Events in their PluginSpec.
+	// Outgoing messages may also carry a ReactEvent, with the Text holding
+	// the emoji to react with to the message with the given EventId.
+	Event   string `bson:",omitempty"`
+	EventId string `bson:",omitempty"`
+
+	// The protocol-specific id of the message, on protocols that have one.
+	ProtoId string `bson:",omitempty"`
+
+	// The protocol-specific ids of the thread the message was posted in,
+	// and of the message it replies to, on protocols that support them.
+	ThreadId string `bson:",omitempty"`
+	ReplyTo  string `bson:",omitempty"`
+
+	// The structured reply the Text was rendered from, on outgoing
+	// messages sent via Plugger.SendCard.
+	Card *Card `bson:",omitempty"`
+
+	// The context in which the message is being handled by a plugin.
+	ctx context.Context
+
+	// When the incoming message was taken from the queue by the plugin
+	// manager, to tell how long it waited for plugins to be done with
+	// earlier messages.
+	dequeued time.Time
+
+	// Whether the incoming message was already handled by the server
+	// before the plugin receiving it started, and is only delivered to
+	// it now because the server rolled back to consider older messages.
+	// Plugins that must not act twice on the same message, such as when
+	// counting events across restarts, may ignore replayed messages.
+	Replay bool `bson:"-"`
 }
 
+// Event kinds reported in the Event field of incoming messages.
+// Commands are not run for messages that report events.
+//
+// Telegram only reports deletions of messages in chats of business
+// accounts connected to the bot, so other bots never observe DeleteEvent.
+const (
+	EditEvent   = "edit"
+	DeleteEvent = "delete"
+)
+
+// ReactEvent is set in the Event field of outgoing messages that react
+// to an earlier message rather than sending new text. See Plugger.React.
+const ReactEvent = "react"
+
 // Address holds the fully qualified address of an incoming or outgoing message.
 type Address struct {
 	Account string `bson:",omitempty"`
@@ -72,11 +156,25 @@ func (a Address) Address() Address {
 
 // Contains returns whether address a contains address b.
 // For containment purposes an empty value on address a is considered
-// as a wildcard, and User and Host are both ignored.
+// as a wildcard, and User and Host are both ignored. The Channel of
+// address a may also be a pattern where * matches any sequence of
+// characters and ? matches any single one, such as "#team-*", in which
+// case the Channel of address b must match it. Other characters, such
+// as brackets, match only themselves.
 func (a Address) Contains(b Address) bool {
 	return (a.Account == "" || a.Account == b.Account) &&
 		(a.Nick == "" || a.Nick == b.Nick) &&
-		(a.Channel == "" || a.Channel == b.Channel)
+		(a.Channel == "" || a.Channel == b.Channel || a.channelPattern() && matchChannel(a.Channel, b.Channel))
+}
+
+// channelPattern returns whether the address Channel is a pattern
+// rather than a channel name.
+func (a Address) channelPattern() bool {
+	return strings.ContainsAny(a.Channel, "*?")
+}
+
+func matchChannel(pattern, channel string) bool {
+	return channel != "" && wildcardMatch(pattern, channel)
 }
 
 // Addressable is implemented by types that have a meaningful message address.
@@ -95,6 +193,19 @@ func (m *Message) Address() Address {
 	}
 }
 
+// Context returns the context in which the message is being handled by a
+// plugin. The context is cancelled when the handling of the message
+// completes, when the server's HandlerTimeout elapses, or when the plugin
+// is stopped, so that resources acquired while handling the message may be
+// released by selecting on its Done channel. Messages not being handled
+// by a plugin have a context that is never cancelled.
+func (m *Message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
 var linePool = sync.Pool{New: func() interface{} { return make([]byte, 0, 512) }}
 
 // String returns the message as an IRC protocol line.
@@ -154,6 +265,25 @@ func (m *Message) String() string {
 	return linestr
 }
 
+// ParseCTCP parses text as a CTCP request or reply, such as "\x01VERSION\x01"
+// or "\x01ACTION waves\x01", and returns its command in upper case and its
+// arguments. The ok result is false if text is not in the CTCP format.
+func ParseCTCP(text string) (command, args string, ok bool) {
+	if len(text) < 2 || text[0] != '\x01' {
+		return "", "", false
+	}
+	text = strings.TrimSuffix(text[1:], "\x01")
+	if i := strings.IndexByte(text, ' '); i >= 0 {
+		command, args = text[:i], text[i+1:]
+	} else {
+		command = text
+	}
+	if command == "" {
+		return "", "", false
+	}
+	return strings.ToUpper(command), args, true
+}
+
 func isChannel(name string) bool {
 	// @ is a mup extension to handle the chat id concept from Telegram.
 	return name != "" && (name[0] == '#' || name[0] == '&' || name[0] == '@') && !strings.ContainsAny(name, " ,\x07")
@@ -174,7 +304,7 @@ func ParseOutgoing(account, line string) *Message {
 }
 
 func parse(account, asnick, bang, line string) *Message {
-	m := &Message{Account: account, AsNick: asnick, Bang: bang, Time: time.Now()}
+	m := &Message{Account: account, AsNick: asnick, Bang: bang, Time: time.Now().UTC()}
 	i := 0
 	l := len(line)
 	for i < l && line[i] == ' ' {
@@ -295,6 +425,15 @@ func parse(account, asnick, bang, line string) *Message {
 				i++
 			}
 		}
+
+		// Channel joined or left by someone, for targeting plugins.
+		if asnick != "" && (m.Command == cmdJoin || m.Command == cmdPart) {
+			if len(m.Params) > 0 && isChannel(m.Params[0]) {
+				m.Channel = m.Params[0]
+			} else if len(m.Params) == 0 && isChannel(m.Text) {
+				m.Channel = m.Text
+			}
+		}
 	}
 
 	return m
@@ -3,6 +3,7 @@ package mup_test
 import (
 	. "gopkg.in/check.v1"
 	"gopkg.in/mup.v0"
+	"regexp"
 	"time"
 )
 
@@ -48,6 +49,28 @@ var parseIncomingTests = []parseTest{
 			Command: "NOTICE",
 			Text:    "Some text",
 		},
+	}, {
+		"JOIN #channel",
+		mup.Message{
+			Channel: "#channel",
+			Command: "JOIN",
+			Params:  []string{"#channel"},
+		},
+	}, {
+		"JOIN :#channel",
+		mup.Message{
+			Channel: "#channel",
+			Command: "JOIN",
+			Text:    "#channel",
+		},
+	}, {
+		"PART #channel :Some text",
+		mup.Message{
+			Channel: "#channel",
+			Command: "PART",
+			Params:  []string{"#channel"},
+			Text:    "Some text",
+		},
 	}, {
 		"CMD some:param :Some text",
 		mup.Message{
@@ -300,6 +323,7 @@ func (s *MessageSuite) TestParseIncoming(c *C) {
 		after := time.Now().Add(1 * time.Second)
 		c.Assert(msg.Time.After(before), Equals, true)
 		c.Assert(msg.Time.Before(after), Equals, true)
+		c.Assert(msg.Time.Location(), Equals, time.UTC)
 		msg.Time = time.Time{}
 		test.msg.AsNick = "mup"
 		test.msg.Bang = "!"
@@ -315,6 +339,7 @@ func (s *MessageSuite) TestParseOutgoing(c *C) {
 		after := time.Now().Add(1 * time.Second)
 		c.Assert(msg.Time.After(before), Equals, true)
 		c.Assert(msg.Time.Before(after), Equals, true)
+		c.Assert(msg.Time.Location(), Equals, time.UTC)
 		msg.Time = time.Time{}
 		c.Assert(msg, DeepEquals, &test.msg)
 	}
@@ -484,8 +509,61 @@ var addrContainsTests = []struct {
 	mup.Address{Account: "one", Channel: "#one", Nick: "nicktwo"},
 	mup.Address{Account: "one", Channel: "#one", Nick: "nickone"},
 	false,
+}, {
+	mup.Address{Account: "one", Channel: "#team-*"},
+	mup.Address{Account: "one", Channel: "#team-core", Nick: "nickone"},
+	true,
+}, {
+	mup.Address{Account: "one", Channel: "#team-?"},
+	mup.Address{Account: "one", Channel: "#team-a", Nick: "nickone"},
+	true,
+}, {
+	mup.Address{Account: "one", Channel: "#team-*"},
+	mup.Address{Account: "one", Channel: "#other", Nick: "nickone"},
+	false,
+}, {
+	mup.Address{Account: "one", Channel: "#team-*"},
+	mup.Address{Account: "one", Nick: "nickone"},
+	false,
+}, {
+	mup.Address{Account: "one", Channel: "#team-["},
+	mup.Address{Account: "one", Channel: "#team-[", Nick: "nickone"},
+	true,
+}, {
+	mup.Address{Account: "one", Channel: "#team-[ab]"},
+	mup.Address{Account: "one", Channel: "#team-a", Nick: "nickone"},
+	false,
+}, {
+	mup.Address{Account: "one", Channel: "#team-[*"},
+	mup.Address{Account: "one", Channel: "#team-[core]", Nick: "nickone"},
+	true,
+}, {
+	mup.Address{Account: "one", Channel: "#team/*"},
+	mup.Address{Account: "one", Channel: "#team/a/b", Nick: "nickone"},
+	true,
 }}
 
+func (s *MessageSuite) TestParseCTCP(c *C) {
+	tests := []struct {
+		text          string
+		command, args string
+		ok            bool
+	}{
+		{"\x01VERSION\x01", "VERSION", "", true},
+		{"\x01ping 123 456\x01", "PING", "123 456", true},
+		{"\x01ACTION waves", "ACTION", "waves", true},
+		{"\x01\x01", "", "", false},
+		{"VERSION", "", "", false},
+		{"", "", "", false},
+	}
+	for _, test := range tests {
+		command, args, ok := mup.ParseCTCP(test.text)
+		c.Assert(command, Equals, test.command, Commentf("Text: %q", test.text))
+		c.Assert(args, Equals, test.args, Commentf("Text: %q", test.text))
+		c.Assert(ok, Equals, test.ok, Commentf("Text: %q", test.text))
+	}
+}
+
 func (s *MessageSuite) TestAddressContains(c *C) {
 	for _, test := range addrContainsTests {
 		if test.contains.Contains(test.contained) != test.result {
@@ -494,3 +572,61 @@ func (s *MessageSuite) TestAddressContains(c *C) {
 		c.Assert(test.contains.Contains(test.contained), Equals, test.result)
 	}
 }
+
+var matcherTests = []struct {
+	matcher *mup.Matcher
+	line    string
+	result  bool
+}{
+	{mup.Match(), ":nick!~user@host PRIVMSG mup :Hello", true},
+	{nil, ":nick!~user@host PRIVMSG mup :Hello", true},
+	{mup.Match().Command("PRIVMSG"), ":nick!~user@host PRIVMSG mup :Hello", true},
+	{mup.Match().Command("NOTICE", "PRIVMSG"), ":nick!~user@host PRIVMSG mup :Hello", true},
+	{mup.Match().Command("NOTICE"), ":nick!~user@host PRIVMSG mup :Hello", false},
+	{mup.Match().Channel("#x"), ":nick!~user@host PRIVMSG #x :Hello", true},
+	{mup.Match().Channel("#x"), ":nick!~user@host PRIVMSG #y :Hello", false},
+	{mup.Match().Channel("#x"), ":nick!~user@host PRIVMSG mup :Hello", false},
+	{mup.Match().Channel("#x-*"), ":nick!~user@host PRIVMSG #x-dev :Hello", true},
+	{mup.Match().Private(), ":nick!~user@host PRIVMSG mup :Hello", true},
+	{mup.Match().Private(), ":nick!~user@host PRIVMSG #x :Hello", false},
+	{mup.Match().Account("test"), ":nick!~user@host PRIVMSG mup :Hello", true},
+	{mup.Match().Account("other"), ":nick!~user@host PRIVMSG mup :Hello", false},
+	{mup.Match().Nick("nick"), ":nick!~user@host PRIVMSG mup :Hello", true},
+	{mup.Match().Nick("other"), ":nick!~user@host PRIVMSG mup :Hello", false},
+	{mup.Match().Sender("nick!*@host"), ":nick!~user@host PRIVMSG mup :Hello", true},
+	{mup.Match().Sender("other!*@*", "*!~user@host"), ":nick!~user@host PRIVMSG mup :Hello", true},
+	{mup.Match().Sender("nick!*@other"), ":nick!~user@host PRIVMSG mup :Hello", false},
+	{mup.Match().Sender("nick"), ":nick!~user@host PRIVMSG mup :Hello", false},
+	{mup.Match().TextContains("foo"), ":nick!~user@host PRIVMSG mup :a foo b", true},
+	{mup.Match().TextContains("foo"), ":nick!~user@host PRIVMSG mup :a bar b", false},
+	{mup.Match().TextMatches(regexp.MustCompile(`^\d+$`)), ":nick!~user@host PRIVMSG mup :123", true},
+	{mup.Match().TextMatches(regexp.MustCompile(`^\d+$`)), ":nick!~user@host PRIVMSG mup :12a", false},
+	{
+		mup.Match().Command("PRIVMSG").Channel("#x").TextContains("foo"),
+		":nick!~user@host PRIVMSG #x :foo bar",
+		true,
+	}, {
+		mup.Match().Command("PRIVMSG").Channel("#x").TextContains("foo"),
+		":nick!~user@host NOTICE #x :foo bar",
+		false,
+	}, {
+		mup.Match().Command("PRIVMSG").Channel("#x").TextContains("foo"),
+		":nick!~user@host PRIVMSG #y :foo bar",
+		false,
+	}, {
+		mup.Match().Command("PRIVMSG").Channel("#x").TextContains("foo"),
+		":nick!~user@host PRIVMSG #x :bar",
+		false,
+	}, {
+		mup.Match().Channel("#x").Func(func(msg *mup.Message) bool { return msg.Nick != "bot" }),
+		":bot!~user@host PRIVMSG #x :foo",
+		false,
+	},
+}
+
+func (s *MessageSuite) TestMatcher(c *C) {
+	for _, test := range matcherTests {
+		msg := mup.ParseIncoming("test", "mup", "!", test.line)
+		c.Assert(test.matcher.Matches(msg), Equals, test.result, Commentf("Line: %q", test.line))
+	}
+}
@@ -0,0 +1,97 @@
+package mup
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pluginMetrics holds the counters and timers updated by plugins via
+// Plugger.Count and Plugger.Time, and serves them over HTTP in the
+// Prometheus text format, namespaced by plugin name.
+type pluginMetrics struct {
+	mu       sync.Mutex
+	counters map[metricKey]int64
+	timers   map[metricKey]*metricTimer
+}
+
+type metricKey struct {
+	plugin string
+	name   string
+}
+
+type metricTimer struct {
+	count int64
+	total time.Duration
+}
+
+func newPluginMetrics() *pluginMetrics {
+	return &pluginMetrics{
+		counters: make(map[metricKey]int64),
+		timers:   make(map[metricKey]*metricTimer),
+	}
+}
+
+func (m *pluginMetrics) count(plugin, name string, n int64) {
+	m.mu.Lock()
+	m.counters[metricKey{plugin, name}] += n
+	m.mu.Unlock()
+}
+
+func (m *pluginMetrics) time(plugin, name string, d time.Duration) {
+	key := metricKey{plugin, name}
+	m.mu.Lock()
+	timer, ok := m.timers[key]
+	if !ok {
+		timer = &metricTimer{}
+		m.timers[key] = timer
+	}
+	timer.count++
+	timer.total += d
+	m.mu.Unlock()
+}
+
+func (m *pluginMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	m.mu.Lock()
+	counters := make(metricKeys, 0, len(m.counters))
+	for key := range m.counters {
+		counters = append(counters, key)
+	}
+	sort.Sort(counters)
+	for _, key := range counters {
+		fmt.Fprintf(&buf, "mup_plugin_count{%s} %d\n", key.labels(), m.counters[key])
+	}
+	timers := make(metricKeys, 0, len(m.timers))
+	for key := range m.timers {
+		timers = append(timers, key)
+	}
+	sort.Sort(timers)
+	for _, key := range timers {
+		timer := m.timers[key]
+		fmt.Fprintf(&buf, "mup_plugin_time_count{%s} %d\n", key.labels(), timer.count)
+		fmt.Fprintf(&buf, "mup_plugin_time_seconds_total{%s} %g\n", key.labels(), timer.total.Seconds())
+	}
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func (key metricKey) labels() string {
+	return "plugin=" + strconv.Quote(key.plugin) + ",name=" + strconv.Quote(key.name)
+}
+
+type metricKeys []metricKey
+
+func (keys metricKeys) Len() int      { return len(keys) }
+func (keys metricKeys) Swap(i, j int) { keys[i], keys[j] = keys[j], keys[i] }
+func (keys metricKeys) Less(i, j int) bool {
+	if keys[i].plugin != keys[j].plugin {
+		return keys[i].plugin < keys[j].plugin
+	}
+	return keys[i].name < keys[j].name
+}
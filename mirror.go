@@ -0,0 +1,199 @@
+package mup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// mirrorBufferSize defines how many messages may be waiting to be posted
+// to the mirror URL before the oldest ones start being dropped.
+var mirrorBufferSize = 1000
+
+// mirrorRetries and mirrorBackoff define how many times posting a message
+// to the mirror URL is retried, and the initial delay between attempts,
+// which doubles on every failure.
+var (
+	mirrorRetries = 5
+	mirrorBackoff = 500 * time.Millisecond
+)
+
+const (
+	mirrorIncoming = "incoming"
+	mirrorOutgoing = "outgoing"
+)
+
+// mirrorPayload is the JSON document posted to the mirror URL.
+type mirrorPayload struct {
+	Direction string    `json:"direction"`
+	Time      time.Time `json:"time"`
+	Account   string    `json:"account"`
+	Channel   string    `json:"channel,omitempty"`
+	Nick      string    `json:"nick,omitempty"`
+	Command   string    `json:"command"`
+	Text      string    `json:"text"`
+}
+
+// A mirror posts the messages exchanged by accounts to an external URL.
+// Messages are buffered so that a slow endpoint never blocks their delivery.
+type mirror struct {
+	tomb     tomb.Tomb
+	url      string
+	secret   []byte
+	incoming bool
+	outgoing bool
+	client   http.Client
+	wake     chan struct{}
+	mutex    sync.Mutex
+	queue    []*mirrorPayload
+	dropped  int
+}
+
+func startMirror(config Config) *mirror {
+	m := &mirror{
+		url:      config.MirrorURL,
+		secret:   []byte(config.MirrorSecret),
+		incoming: config.MirrorIncoming,
+		outgoing: config.MirrorOutgoing,
+		client:   http.Client{Timeout: NetworkTimeout},
+		wake:     make(chan struct{}, 1),
+	}
+	if !m.incoming && !m.outgoing {
+		m.incoming = true
+		m.outgoing = true
+	}
+	m.tomb.Go(m.loop)
+	return m
+}
+
+func (m *mirror) Stop() error {
+	m.tomb.Kill(nil)
+	return m.tomb.Wait()
+}
+
+// Send queues msg to be posted to the mirror URL, if messages going
+// in the given direction are being mirrored. Only PRIVMSG and NOTICE
+// messages are mirrored.
+func (m *mirror) Send(direction string, msg *Message) {
+	if m == nil || (direction == mirrorIncoming && !m.incoming) || (direction == mirrorOutgoing && !m.outgoing) {
+		return
+	}
+	command := msg.Command
+	if command == "" {
+		command = cmdPrivMsg
+	}
+	if command != cmdPrivMsg && command != cmdNotice {
+		return
+	}
+	payload := &mirrorPayload{
+		Direction: direction,
+		Time:      msg.Time,
+		Account:   msg.Account,
+		Channel:   msg.Channel,
+		Nick:      msg.Nick,
+		Command:   command,
+		Text:      msg.Text,
+	}
+	m.mutex.Lock()
+	if len(m.queue) >= mirrorBufferSize {
+		m.queue = m.queue[1:]
+		if m.dropped == 0 {
+			logf("Mirror buffer is full. Dropping oldest messages.")
+		}
+		m.dropped++
+	}
+	m.queue = append(m.queue, payload)
+	m.mutex.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *mirror) next() *mirrorPayload {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.queue) == 0 {
+		if m.dropped > 0 {
+			logf("Mirror dropped %d messages while its buffer was full.", m.dropped)
+			m.dropped = 0
+		}
+		return nil
+	}
+	payload := m.queue[0]
+	m.queue = m.queue[1:]
+	return payload
+}
+
+func (m *mirror) loop() error {
+	for {
+		select {
+		case <-m.wake:
+		case <-m.tomb.Dying():
+			return nil
+		}
+		for payload := m.next(); payload != nil; payload = m.next() {
+			if !m.post(payload) {
+				return nil
+			}
+		}
+	}
+}
+
+// post posts payload to the mirror URL, retrying with an increasing delay
+// on failures. It returns false if the mirror was stopped meanwhile.
+func (m *mirror) post(payload *mirrorPayload) bool {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logf("Cannot marshal message for mirroring: %v", err)
+		return true
+	}
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	delay := mirrorBackoff
+	for attempt := 0; ; attempt++ {
+		err = m.postOnce(body, signature)
+		if err == nil {
+			return true
+		}
+		if attempt == mirrorRetries {
+			logf("Cannot mirror message after %d attempts, dropping it: %v", attempt+1, err)
+			return true
+		}
+		debugf("Cannot mirror message (retrying in %v): %v", delay, err)
+		select {
+		case <-time.After(delay):
+		case <-m.tomb.Dying():
+			return false
+		}
+		delay *= 2
+	}
+}
+
+func (m *mirror) postOnce(body []byte, signature string) error {
+	req, err := http.NewRequest("POST", m.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ingestSignatureHeader, signature)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("mirror URL replied with %s", resp.Status)
+	}
+	return nil
+}
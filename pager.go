@@ -0,0 +1,119 @@
+package mup
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// A pager holds back the lines of long texts sent to a nick in a channel
+// beyond the first few, so that busy channels are not flooded with them.
+// The remaining lines are sent a page at a time when the nick says "more"
+// in the same channel, until they expire.
+type pager struct {
+	lines   int
+	timeout time.Duration
+
+	mu      sync.Mutex
+	pending map[pagerKey]*pagerEntry
+}
+
+type pagerKey struct {
+	account string
+	channel string
+	nick    string
+}
+
+type pagerEntry struct {
+	msg     Message
+	lines   []string
+	locale  string
+	expires time.Time
+}
+
+// morePrompt follows the lines of a page when more of them remain. It's
+// translated into the locale of the account the text is sent to.
+const morePrompt = `Say "more" for the rest.`
+
+func newPager(config Config) *pager {
+	if config.MoreLines <= 0 {
+		return nil
+	}
+	timeout := config.MoreTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+	return &pager{
+		lines:   config.MoreLines,
+		timeout: timeout,
+		pending: make(map[pagerKey]*pagerEntry),
+	}
+}
+
+// page returns the lines of msg that should be sent right away, holding
+// back the rest until more of it is requested. Any text held back from
+// earlier messages to the same nick and channel is dropped. The prompt
+// for more is translated into locale.
+func (pg *pager) page(msg *Message, lines []string, locale string) []string {
+	if msg.Channel == "" || msg.Nick == "" || len(lines) <= pg.lines {
+		return lines
+	}
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	now := time.Now()
+	pg.expire(now)
+	key := pagerKey{msg.Account, msg.Channel, msg.Nick}
+	entry := &pagerEntry{msg: *msg, lines: lines, locale: locale, expires: now.Add(pg.timeout)}
+	entry.msg.Text = ""
+	pg.pending[key] = entry
+	return pg.next(key, entry)
+}
+
+// more returns the messages holding the next page of text held back for
+// the sender of msg, if msg asks for more of it.
+func (pg *pager) more(msg *Message) []*Message {
+	if msg.Command != cmdPrivMsg || msg.Channel == "" {
+		return nil
+	}
+	if !strings.EqualFold(strings.TrimSpace(msg.BotText), "more") && !strings.EqualFold(strings.TrimSpace(msg.Text), "more") {
+		return nil
+	}
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	pg.expire(time.Now())
+	key := pagerKey{msg.Account, msg.Channel, msg.Nick}
+	entry, ok := pg.pending[key]
+	if !ok {
+		return nil
+	}
+	var msgs []*Message
+	for _, line := range pg.next(key, entry) {
+		copy := entry.msg
+		copy.Time = time.Now().UTC()
+		copy.Text = line
+		msgs = append(msgs, &copy)
+	}
+	return msgs
+}
+
+// expire drops the text held back that expired by now.
+// It must be called with mu held.
+func (pg *pager) expire(now time.Time) {
+	for key, entry := range pg.pending {
+		if entry.expires.Before(now) {
+			delete(pg.pending, key)
+		}
+	}
+}
+
+// next returns the next page of lines from entry, followed by a prompt
+// if any lines remain. It must be called with mu held.
+func (pg *pager) next(key pagerKey, entry *pagerEntry) []string {
+	if len(entry.lines) <= pg.lines {
+		delete(pg.pending, key)
+		return entry.lines
+	}
+	page := append([]string(nil), entry.lines[:pg.lines]...)
+	entry.lines = entry.lines[pg.lines:]
+	return append(page, Translate(entry.locale, morePrompt))
+}
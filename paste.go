@@ -0,0 +1,72 @@
+package mup
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A paster uploads long message texts to a paste service, so that a link
+// to the full text may be sent instead of flooding the conversation.
+//
+// The text is POSTed as the plain text body of the request, carrying the
+// configured token in a bearer Authorization header, and the first line
+// of the response body must hold the URL of the uploaded text.
+// pasteTimeout defines how long uploading a text may take before it is
+// given up on and the text is sent in full instead. It's shorter than
+// NetworkTimeout as the plugin sending the text waits for the upload.
+var pasteTimeout = 5 * time.Second
+
+type paster struct {
+	url    string
+	token  string
+	lines  int
+	client http.Client
+}
+
+func newPaster(config Config) *paster {
+	if config.PasteURL == "" {
+		return nil
+	}
+	lines := config.PasteLines
+	if lines == 0 {
+		lines = 5
+	}
+	return &paster{
+		url:    config.PasteURL,
+		token:  config.PasteToken,
+		lines:  lines,
+		client: http.Client{Timeout: pasteTimeout},
+	}
+}
+
+// upload uploads text to the paste service and returns its URL.
+func (ps *paster) upload(text string) (string, error) {
+	req, err := http.NewRequest("POST", ps.url, strings.NewReader(text))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if ps.token != "" {
+		req.Header.Set("Authorization", "Bearer "+ps.token)
+	}
+	resp, err := ps.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("paste service replied with %s", resp.Status)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	line = strings.TrimSpace(line)
+	if line == "" {
+		if err != nil {
+			return "", fmt.Errorf("cannot read paste service response: %v", err)
+		}
+		return "", fmt.Errorf("paste service replied without a URL")
+	}
+	return line, nil
+}
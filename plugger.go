@@ -1,30 +1,76 @@
 package mup
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/mup.v0/ldap"
+	"sort"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // Plugger provides the interface between a plugin and the bot infrastructure.
 type Plugger struct {
-	name    string
-	send    func(msg *Message) error
-	handle  func(msg *Message) error
-	ldap    func(name string) (ldap.Conn, error)
-	config  bson.Raw
-	targets []PluginTarget
-	db      *mgo.Database
+	name     string
+	send     func(msg *Message) error
+	handle   func(msg *Message) error
+	ldap     func(name string) (ldap.Conn, error)
+	accounts func() map[string]*accountInfo
+	targets  []PluginTarget
+	db       *mgo.Database
+	paste    *paster
+	pager    *pager
+	logs     *logCapture
+	noPrefix bool
+	scope    []string
+	fetches  fetchCache
+	http     *pluginHTTP
+	metrics  *pluginMetrics
+	memState *memoryState
+	memStore *memoryStores
+	tasks    *scheduler
+	restart  func(name string, abort <-chan struct{}) error
+	ldapInfo func() []LDAPStatus
+
+	privileged bool
+
+	// config, dbname, and dryRun may change when the plugin is
+	// reloaded, so they're guarded by configMutex.
+	config       bson.Raw
+	dbname       string
+	dryRun       bool
+	serverDryRun bool
+	configMutex  sync.Mutex
+
+	ctx           context.Context
+	cancel        context.CancelFunc
+	handleTimeout time.Duration
+
+	stats      PluginStats
+	statsMutex sync.Mutex
+
+	bulks      map[bulkKey]*BulkCollection
+	bulksMutex sync.Mutex
+
+	matcher      *Matcher
+	matcherMutex sync.Mutex
 }
 
 // PluginTarget defines an Account, Channel, and/or Nick that the
 // plugin will observe messages from, and may choose to broadcast
 // messages to. Empty fields are ignored when deciding whether a
-// message matches the plugin target.
+// message matches the plugin target. The Channel may also be a
+// pattern such as "#team-*", as documented in Address.Contains,
+// so that a single target covers many channels.
 //
 // A PluginTarget may also define per-target configuration options.
 type PluginTarget struct {
@@ -43,9 +89,10 @@ func (t *PluginTarget) Config(result interface{}) {
 }
 
 // CanSend returns whether the plugin target may have messages sent to it.
-// For that, it must have an Account set, and at least one of Channel and Nick.
+// For that, it must have an Account set, and at least one of Channel and Nick,
+// and its Channel must not be a pattern.
 func (t *PluginTarget) CanSend() bool {
-	return t.address.Account != "" && (t.address.Nick != "" || t.address.Channel != "")
+	return t.address.Account != "" && (t.address.Nick != "" || t.address.Channel != "") && !t.address.channelPattern()
 }
 
 // String returns a string representation of the plugin target suitable for log messages.
@@ -65,11 +112,15 @@ func (t *PluginTarget) String() string {
 var emptyDoc = bson.Raw{3, []byte("\x05\x00\x00\x00\x00")}
 
 func newPlugger(name string, send, handle func(msg *Message) error, ldap func(name string) (ldap.Conn, error)) *Plugger {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Plugger{
 		name:   name,
 		send:   send,
 		handle: handle,
 		ldap:   ldap,
+		ctx:    ctx,
+		cancel: cancel,
+		tasks:  newScheduler(),
 	}
 }
 
@@ -77,12 +128,145 @@ func (p *Plugger) setDatabase(db *mgo.Database) {
 	p.db = db
 }
 
+func (p *Plugger) setAccounts(accounts func() map[string]*accountInfo) {
+	p.accounts = accounts
+}
+
+// accountInfo returns the known information for the named account, or nil.
+func (p *Plugger) accountInfo(name string) *accountInfo {
+	if p.accounts == nil {
+		return nil
+	}
+	return p.accounts()[name]
+}
+
+func (p *Plugger) setStats(stats PluginStats) {
+	p.statsMutex.Lock()
+	p.stats = stats
+	p.statsMutex.Unlock()
+}
+
+// handleTimeWeight is the weight of past samples in the moving
+// average of the time spent handling each message.
+const handleTimeWeight = 7
+
+// addHandleTime accounts for d being spent handling a message, and returns
+// the updated moving average. The plugin is flagged as slow when that
+// average exceeds limit, if limit is positive.
+func (p *Plugger) addHandleTime(d, limit time.Duration) (avg time.Duration, slow, changed bool) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+	stats := &p.stats
+	if stats.Handled == 0 {
+		stats.HandleTime = d
+	} else {
+		stats.HandleTime = (stats.HandleTime*handleTimeWeight + d) / (handleTimeWeight + 1)
+	}
+	stats.Handled++
+	slow = limit > 0 && stats.HandleTime > limit
+	changed = slow != stats.Slow
+	stats.Slow = slow
+	return stats.HandleTime, slow, changed
+}
+
 func (p *Plugger) setConfig(config bson.Raw) {
 	if config.Kind == 0 {
-		p.config = emptyDoc
+		config = emptyDoc
+	}
+	var dbconfig struct {
+		Database string
+		DryRun   bool
+	}
+	config.Unmarshal(&dbconfig)
+	p.configMutex.Lock()
+	p.config = config
+	p.dbname = dbconfig.Database
+	p.dryRun = dbconfig.DryRun || p.serverDryRun
+	p.configMutex.Unlock()
+}
+
+// setDryRun puts the plugin in dry run mode irrespective of its
+// configuration, as done when the server has DryRun set.
+func (p *Plugger) setDryRun(dryRun bool) {
+	p.configMutex.Lock()
+	p.serverDryRun = dryRun
+	p.dryRun = dryRun
+	p.configMutex.Unlock()
+}
+
+// settings returns the database name and dry run mode in effect for the
+// plugin, which may change along with its configuration.
+func (p *Plugger) settings() (dbname string, dryRun bool) {
+	p.configMutex.Lock()
+	defer p.configMutex.Unlock()
+	return p.dbname, p.dryRun
+}
+
+func (p *Plugger) setPaster(paste *paster) {
+	p.paste = paste
+}
+
+func (p *Plugger) setPager(pager *pager) {
+	p.pager = pager
+}
+
+func (p *Plugger) setHTTP(server *pluginHTTP) {
+	p.http = server
+}
+
+func (p *Plugger) setMetrics(metrics *pluginMetrics) {
+	p.metrics = metrics
+}
+
+func (p *Plugger) setScheduler(tasks *scheduler) {
+	p.tasks = tasks
+}
+
+func (p *Plugger) setLDAPInfo(ldapInfo func() []LDAPStatus) {
+	p.ldapInfo = ldapInfo
+}
+
+func (p *Plugger) setRestart(restart func(name string, abort <-chan struct{}) error) {
+	p.restart = restart
+}
+
+func (p *Plugger) setPrivileged(privileged bool) {
+	p.privileged = privileged
+}
+
+// mayControl returns whether the plugin may act on the named plugin.
+func (p *Plugger) mayControl(name string) bool {
+	return p.privileged || name == p.name
+}
+
+func (p *Plugger) removeHTTP() {
+	if p.http != nil {
+		p.http.remove(p.name)
+	}
+}
+
+func (p *Plugger) setHandleTimeout(timeout time.Duration) {
+	p.handleTimeout = timeout
+}
+
+// beginHandle returns a copy of msg holding the context in which it is
+// handled, as returned by Message.Context, and the function that cancels
+// that context once the handling completes.
+func (p *Plugger) beginHandle(msg *Message) (hmsg *Message, done func()) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if p.handleTimeout > 0 {
+		ctx, cancel = context.WithTimeout(p.ctx, p.handleTimeout)
 	} else {
-		p.config = config
+		ctx, cancel = context.WithCancel(p.ctx)
 	}
+	copy := *msg
+	copy.ctx = ctx
+	return &copy, cancel
+}
+
+func (p *Plugger) setLogCapture(logs *logCapture) {
+	p.logs = logs
 }
 
 func (p *Plugger) setTargets(targets bson.Raw) {
@@ -106,14 +290,111 @@ func (p *Plugger) setTargets(targets bson.Raw) {
 	}
 }
 
+// setAccountScope restricts the plugin to the named accounts, dropping
+// targets for other accounts. A nil scope leaves the plugin unrestricted.
+func (p *Plugger) setAccountScope(accounts []string) {
+	p.scope = accounts
+	if accounts == nil {
+		return
+	}
+	var targets []PluginTarget
+	for _, target := range p.targets {
+		if target.address.Account == "" || p.inScope(target.address.Account) {
+			targets = append(targets, target)
+		}
+	}
+	p.targets = targets
+}
+
+// inScope returns whether the plugin may act on the named account.
+func (p *Plugger) inScope(account string) bool {
+	if p.scope == nil {
+		return true
+	}
+	for _, name := range p.scope {
+		if name == account {
+			return true
+		}
+	}
+	return false
+}
+
 // Name returns the plugin name including the label, if any ("name/label").
 func (p *Plugger) Name() string {
 	return p.name
 }
 
 // Logf logs a message assembled by providing format and args to fmt.Sprintf.
+// When the server has plugin log capture enabled, the message is also
+// recorded so it may be retrieved via PluginLogs.
 func (p *Plugger) Logf(format string, args ...interface{}) {
 	logf("["+p.name+"] "+format, args...)
+	if p.logs != nil {
+		p.logs.add(p.name, fmt.Sprintf(format, args...))
+	}
+}
+
+// PluginLogs returns the most recent messages logged via Logf by the
+// named plugin, oldest first. The ok result is false if the server does
+// not have plugin log capture enabled via its PluginLogLines setting.
+// Unless the plugin is registered as Privileged, no lines are returned
+// for plugins other than itself.
+func (p *Plugger) PluginLogs(name string) (lines []string, ok bool) {
+	if p.logs == nil {
+		return nil, false
+	}
+	if !p.mayControl(name) {
+		return nil, true
+	}
+	return p.logs.recent(name), true
+}
+
+// Schedule arranges for f to run in its own goroutine once delay elapses,
+// and returns an id that identifies the task until then. The description
+// is reported when tasks are listed via ScheduledTasks, such as by the
+// "tasks" command of the admin plugin. Pending tasks are canceled when
+// the plugin is stopped, and running ones are waited for before its Stop
+// method is called, so tasks must not wait for the plugin to stop.
+func (p *Plugger) Schedule(delay time.Duration, description string, f func()) (id string) {
+	return p.tasks.schedule(p.name, description, delay, f)
+}
+
+// ScheduledTasks returns the tasks scheduled via Schedule by the named
+// plugin that did not run yet, soonest first. Use Name for the tasks of
+// the plugin itself.
+func (p *Plugger) ScheduledTasks(name string) []ScheduledTask {
+	return p.tasks.list(name)
+}
+
+// CancelTask cancels the task with the given id scheduled by the named
+// plugin, and reports whether it was canceled before running. It's safe
+// to call CancelTask while the task is due, as the task either runs or
+// is canceled, but not both. Unless the plugin is registered as
+// Privileged, it may only cancel its own tasks.
+func (p *Plugger) CancelTask(name, id string) bool {
+	if !p.mayControl(name) {
+		return false
+	}
+	return p.tasks.cancel(name, id)
+}
+
+// RestartPlugin stops the named plugin and starts it again with its
+// configuration and targets reloaded from the database, without affecting
+// any other plugins. The named plugin must be running, and this plugin
+// must be registered as Privileged.
+//
+// RestartPlugin blocks until the plugin is restarted, which cannot happen
+// while a message is being handled, so it must be called from a goroutine
+// other than the one delivering messages to the plugin. If this plugin is
+// stopped before the restart starts, the request is abandoned.
+func (p *Plugger) RestartPlugin(name string) error {
+	if !p.privileged {
+		return fmt.Errorf("plugin %q is not privileged to restart plugins", p.name)
+	}
+	if p.restart == nil {
+		return fmt.Errorf("cannot restart plugins: no plugin manager available")
+	}
+	return p.restart(name, p.ctx.Done())
 }
 
 // Debugf logs a debug message assembled by providing format and args to fmt.Sprintf.
@@ -122,8 +403,118 @@ func (p *Plugger) Debugf(format string, args ...interface{}) {
 }
 
 // Config unmarshals into result the plugin configuration using the bson package.
+//
+// String values in the configuration of the form "${env:NAME}" are
+// replaced by the value of the NAME environment variable, and values
+// of the form "${secret:NAME}" are replaced by the value field of the
+// document with id NAME in the secrets collection, so that sensitive
+// settings need not be stored inline. Such references are resolved
+// before the plugin is started, and a reference that cannot be
+// resolved prevents the plugin from starting.
 func (p *Plugger) Config(result interface{}) {
-	p.config.Unmarshal(result)
+	p.configDoc().Unmarshal(result)
+}
+
+// configDoc returns the plugin configuration document, which may be
+// replaced while the plugin runs if it implements Reloader.
+func (p *Plugger) configDoc() bson.Raw {
+	p.configMutex.Lock()
+	defer p.configMutex.Unlock()
+	return p.config
+}
+
+// resolveConfig replaces the environment and secret references in
+// the plugin configuration by the values they refer to.
+func (p *Plugger) resolveConfig() error {
+	if p.config.Kind == 0 || !bytes.Contains(p.config.Data, []byte("${")) {
+		return nil
+	}
+	var config bson.D
+	err := p.config.Unmarshal(&config)
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal configuration: %v", err)
+	}
+	resolved, err := p.resolveValue(config)
+	if err != nil {
+		return err
+	}
+	p.config = marshalRaw(resolved)
+	return nil
+}
+
+func (p *Plugger) resolveValue(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		return resolveRef(p.db, value, false)
+	case bson.D:
+		for i := range value {
+			v, err := p.resolveValue(value[i].Value)
+			if err != nil {
+				return nil, err
+			}
+			value[i].Value = v
+		}
+	case []interface{}:
+		for i := range value {
+			v, err := p.resolveValue(value[i])
+			if err != nil {
+				return nil, err
+			}
+			value[i] = v
+		}
+	}
+	return value, nil
+}
+
+// resolveRef returns the value referred to by value if it is an
+// environment or secret reference as documented in Plugger.Config,
+// or value itself otherwise. If files is true, "${file:PATH}" references
+// are also replaced by the content of the file at PATH. That's only
+// enabled for account passwords, as plugins could otherwise read any
+// file the bot has access to.
+func resolveRef(db *mgo.Database, value string, files bool) (string, error) {
+	if !strings.HasPrefix(value, "${") || !strings.HasSuffix(value, "}") {
+		return value, nil
+	}
+	ref := value[2 : len(value)-1]
+	i := strings.Index(ref, ":")
+	if i < 0 {
+		return value, nil
+	}
+	kind, name := ref[:i], ref[i+1:]
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q referenced in configuration is not set", name)
+		}
+		return v, nil
+	case "file":
+		if !files {
+			return "", fmt.Errorf("file %q referenced in configuration: file references are only supported in account passwords", name)
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("cannot read file referenced in configuration: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case "secret":
+		if db == nil {
+			return "", fmt.Errorf("cannot resolve secret %q referenced in configuration: no database available", name)
+		}
+		session := db.Session.Copy()
+		defer session.Close()
+		var secret struct{ Value string }
+		err := db.C("secrets").With(session).FindId(name).One(&secret)
+		if err == mgo.ErrNotFound {
+			return "", fmt.Errorf("secret %q referenced in configuration not found", name)
+		}
+		if err != nil {
+			return "", fmt.Errorf("cannot resolve secret %q referenced in configuration: %v", name, err)
+		}
+		return secret.Value, nil
+	}
+	return value, nil
 }
 
 // CollKind flags tune the behavior of the Plugger.Collection method.
@@ -157,32 +548,241 @@ const (
 //       This should be used by plugins that intend to read or write a significant
 //       amount of data, to prevent fragmenting the main bot database.
 //
+// If the plugin configuration has a "database" option, all collections are
+// stored in the database with that name instead, irrespective of kind.
+//
 func (p *Plugger) Collection(suffix string, kind CollKind) (*mgo.Session, *mgo.Collection) {
 	if p.db == nil {
 		panic("plugger has no database available")
 	}
 	session := p.db.Session.Copy()
-	var name string
+	name := p.collectionName(suffix, kind)
+	var c *mgo.Collection
+	if dbname, _ := p.settings(); dbname != "" {
+		c = session.DB(dbname).C(name)
+	} else if kind&Bulk == Bulk {
+		c = session.DB(p.db.Name + "_bulk").C(name)
+	} else {
+		c = p.db.C(name).With(session)
+	}
+	return session, c
+}
+
+// collectionName returns the name of the collection obtained via
+// Collection for suffix and kind.
+func (p *Plugger) collectionName(suffix string, kind CollKind) string {
 	if kind&Shared == Shared {
 		if suffix == "" {
 			suffix = pluginKey(p.Name())
 		}
-		name = "shared." + suffix
-	} else {
-		name = strings.Replace(p.Name(), "/", "_", -1)
-		if suffix == "" {
-			name = "unique." + name
-		} else {
-			name = "unique." + name + "." + suffix
+		return "shared." + suffix
+	}
+	name := strings.Replace(p.Name(), "/", "_", -1)
+	if suffix == "" {
+		return "unique." + name
+	}
+	return "unique." + name + "." + suffix
+}
+
+// A Store holds plugin-specific documents, offering the subset of the
+// mgo.Collection API that most plugins need. Unlike collections obtained
+// via Collection, stores are kept in memory when the plugin is run by a
+// PluginTester without a database, so plugins using them may be tested
+// without MongoDB. The store must be closed after its use is finished.
+type Store interface {
+	// Insert inserts docs into the store.
+	Insert(docs ...interface{}) error
+
+	// Find prepares a query for the documents matching query.
+	Find(query interface{}) StoreQuery
+
+	// FindId prepares a query for the document with the given _id.
+	FindId(id interface{}) StoreQuery
+
+	// UpsertId updates the document with the given _id according to
+	// update, or inserts it if there's no such document.
+	UpsertId(id interface{}, update interface{}) (*mgo.ChangeInfo, error)
+
+	// Close releases the resources held by the store.
+	Close()
+}
+
+// A StoreQuery holds a query prepared via Store.Find or Store.FindId.
+type StoreQuery interface {
+	// One unmarshals into result the first document found, or
+	// returns mgo.ErrNotFound if there's none.
+	One(result interface{}) error
+
+	// All unmarshals into the slice pointed to by result all the
+	// documents found.
+	All(result interface{}) error
+
+	// Count returns how many documents were found.
+	Count() (int, error)
+}
+
+// Store returns a store for plugin-specific data held in the collection
+// that Collection would return for suffix and kind. When the plugin is
+// run by a PluginTester without a database, the documents are kept in
+// memory instead, as documented in PluginTester.SetDatabase.
+func (p *Plugger) Store(suffix string, kind CollKind) Store {
+	if p.db == nil && p.memStore != nil {
+		return p.memStore.store(p.collectionName(suffix, kind))
+	}
+	session, c := p.Collection(suffix, kind)
+	return &mgoStore{session, c}
+}
+
+type mgoStore struct {
+	session *mgo.Session
+	coll    *mgo.Collection
+}
+
+func (s *mgoStore) Insert(docs ...interface{}) error {
+	return s.coll.Insert(docs...)
+}
+
+func (s *mgoStore) Find(query interface{}) StoreQuery {
+	return s.coll.Find(query)
+}
+
+func (s *mgoStore) FindId(id interface{}) StoreQuery {
+	return s.coll.FindId(id)
+}
+
+func (s *mgoStore) UpsertId(id interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	return s.coll.UpsertId(id, update)
+}
+
+func (s *mgoStore) Close() {
+	s.session.Close()
+}
+
+// Fetch sends a GET request to url and unmarshals the JSON content
+// received into result. The content is cached for the ttl duration, so
+// further calls for the same url within that period unmarshal the cached
+// content instead of sending new requests. Failed requests and content
+// that cannot be unmarshaled are not cached.
+//
+// Requests are sent via a client that times out after NetworkTimeout, and
+// are retried a couple of times on network errors and server failures.
+// Plugins needing more control over requests should use their own client.
+func (p *Plugger) Fetch(url string, result interface{}, ttl time.Duration) error {
+	return p.fetches.fetch(url, result, ttl)
+}
+
+// Parallel calls f with each index from zero to count-1, running up to
+// limit calls concurrently, and returns once all calls are done. It eases
+// fanning out external calls without overloading the services involved.
+// Results may be aggregated by having f store them at index i of a slice
+// allocated beforehand. A limit of zero or less means no limit. All calls
+// are made even while the plugin is being stopped, so that work accepted
+// before that is completed; f may consult the plugger context to give up
+// early instead.
+func (p *Plugger) Parallel(limit, count int, f func(i int)) {
+	if limit <= 0 || limit > count {
+		limit = count
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, limit)
+	for i := 0; i < count; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// HandleHTTP registers handler to serve HTTP requests for path under the
+// "/<plugin name>/" prefix, so a plugin named "foo" registering "callback"
+// serves requests to "/foo/callback". As with http.ServeMux, paths ending
+// in a slash serve the whole subtree. Handlers are dropped when the plugin
+// is stopped. An error is returned if the server was not configured with
+// an HTTPAddr, if path is not clean or holds spaces or braces, or if path
+// was already registered.
+func (p *Plugger) HandleHTTP(path string, handler http.Handler) error {
+	if p.http == nil {
+		return fmt.Errorf("cannot handle HTTP requests: server has no HTTP address configured")
+	}
+	return p.http.handle(p.name, path, handler)
+}
+
+// Count increments by one the named counter of the plugin. Counters and
+// timers are served by the HTTP server at "/metrics", labeled with the
+// plugin name, when the server has an HTTPAddr configured.
+func (p *Plugger) Count(name string) {
+	if p.metrics != nil {
+		p.metrics.count(p.name, name, 1)
+	}
+}
+
+// Time starts timing an operation and returns a function that records
+// the elapsed time in the named timer of the plugin when called:
+//
+//	defer p.plugger.Time("request")()
+func (p *Plugger) Time(name string) (done func()) {
+	start := time.Now()
+	return func() {
+		if p.metrics != nil {
+			p.metrics.time(p.name, name, time.Since(start))
 		}
 	}
-	var c *mgo.Collection
-	if kind&Bulk == Bulk {
-		c = session.DB(p.db.Name + "_bulk").C(name)
-	} else {
-		c = p.db.C(name).With(session)
+}
+
+// LoadState unmarshals into result the plugin state last saved via
+// SaveState, so that plugins may resume their work after restarts.
+// The result is left untouched if no state was saved yet.
+func (p *Plugger) LoadState(result interface{}) error {
+	if p.db == nil && p.memState != nil {
+		return p.memState.load(result)
 	}
-	return session, c
+	if p.db == nil {
+		panic("plugger has no database available")
+	}
+	session := p.db.Session.Copy()
+	defer session.Close()
+
+	var info pluginInfo
+	err := p.db.C("plugins").With(session).FindId(p.name).Select(bson.M{"state": 1}).One(&info)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot load plugin state: %v", err)
+	}
+	if info.State.Kind == 0 {
+		return nil
+	}
+	if err := info.State.Unmarshal(result); err != nil {
+		return fmt.Errorf("cannot unmarshal plugin state: %v", err)
+	}
+	return nil
+}
+
+// SaveState saves value as the plugin state, replacing any state saved
+// before, so that it may be obtained via LoadState after the plugin is
+// restarted. The value is marshalled with the bson package.
+func (p *Plugger) SaveState(value interface{}) error {
+	if p.db == nil && p.memState != nil {
+		return p.memState.save(value)
+	}
+	if p.db == nil {
+		panic("plugger has no database available")
+	}
+	session := p.db.Session.Copy()
+	defer session.Close()
+
+	err := p.db.C("plugins").With(session).UpdateId(p.name, bson.D{{"$set", bson.D{{"state", value}}}})
+	if err != nil {
+		return fmt.Errorf("cannot save plugin state: %v", err)
+	}
+	return nil
 }
 
 // Handle inserts the provided message on the incoming queue for processing.
@@ -203,6 +803,26 @@ func (p *Plugger) Handle(msg *Message) error {
 	return nil
 }
 
+// SetMatcher restricts the messages delivered to the plugin, including
+// commands and outgoing messages, to the ones matched by m, in addition to
+// its targets. It is typically called when the plugin is started, and
+// may be called again concurrently with message handling, but m must not
+// have further conditions added to it once set. A nil matcher delivers
+// all messages again.
+func (p *Plugger) SetMatcher(m *Matcher) {
+	p.matcherMutex.Lock()
+	p.matcher = m
+	p.matcherMutex.Unlock()
+}
+
+// matches returns whether msg is matched by the plugin matcher.
+func (p *Plugger) matches(msg *Message) bool {
+	p.matcherMutex.Lock()
+	m := p.matcher
+	p.matcherMutex.Unlock()
+	return m.Matches(msg)
+}
+
 // Targets returns all targets enabled for the plugin.
 func (p *Plugger) Targets() []PluginTarget {
 	return p.targets
@@ -210,15 +830,149 @@ func (p *Plugger) Targets() []PluginTarget {
 
 // Target returns the plugin target that matches the provided message.
 // All messages provided to the plugin for handling are guaranteed
-// to have a matching target.
+// to have a matching target. Targets are considered in order, except
+// that a target naming the message channel exactly is preferred over
+// an earlier target matching it via a channel pattern.
 func (p *Plugger) Target(msg *Message) *PluginTarget {
+	if !p.inScope(msg.Account) {
+		return nil
+	}
 	addr := msg.Address()
+	var matched *PluginTarget
 	for i := range p.targets {
-		if p.targets[i].address.Contains(addr) {
-			return &p.targets[i]
+		target := &p.targets[i]
+		if !target.address.Contains(addr) {
+			continue
+		}
+		if matched == nil {
+			if !target.address.channelPattern() {
+				return target
+			}
+			matched = target
+		} else if target.address.Channel == addr.Channel {
+			return target
 		}
 	}
-	return nil
+	return matched
+}
+
+// TargetConfig unmarshals into result the plugin configuration with the
+// configuration of the plugin target that matches the provided message
+// merged over it. Fields set in the target configuration override the
+// respective fields in the plugin configuration, so a single plugin
+// instance may be tuned differently for each of its targets.
+func (p *Plugger) TargetConfig(msg *Message, result interface{}) {
+	target := p.Target(msg)
+	if target == nil || target.config.Kind == 0 {
+		p.Config(result)
+		return
+	}
+	var merged, override bson.D
+	p.configDoc().Unmarshal(&merged)
+	target.config.Unmarshal(&override)
+	for _, elem := range override {
+		found := false
+		for i := range merged {
+			if merged[i].Name == elem.Name {
+				merged[i].Value = elem.Value
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, elem)
+		}
+	}
+	marshalRaw(merged).Unmarshal(result)
+}
+
+// PluginStats holds diagnostic information about a running plugin.
+type PluginStats struct {
+	// Started holds when the plugin was last started, in UTC.
+	Started time.Time
+
+	// Restarts holds how many times the plugin was restarted due to
+	// changes in its configuration or targets. Frequent restarts
+	// often indicate a flapping configuration.
+	Restarts int
+
+	// Handled holds how many messages the plugin handled since started,
+	// and HandleTime the moving average of the time spent on each.
+	Handled    int
+	HandleTime time.Duration
+
+	// Slow reports whether HandleTime is above the limit defined
+	// in the SlowHandler server setting.
+	Slow bool
+}
+
+// Stats returns diagnostic information about the running plugin.
+func (p *Plugger) Stats() PluginStats {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+	return p.stats
+}
+
+// AccountInfo holds the details of an account known to the bot, as
+// returned by Plugger.Accounts. Secrets such as passwords, channel keys,
+// and endpoints are not included.
+type AccountInfo struct {
+	Name     string
+	Kind     string
+	Host     string
+	Nick     string
+	Channels []string
+	Locale   string
+}
+
+// Accounts returns the details of all accounts known to the bot,
+// sorted by name.
+func (p *Plugger) Accounts() []AccountInfo {
+	if p.accounts == nil {
+		return nil
+	}
+	infos := p.accounts()
+	accounts := make([]AccountInfo, 0, len(infos))
+	for _, info := range infos {
+		account := AccountInfo{
+			Name:   info.Name,
+			Kind:   info.Kind,
+			Host:   info.Host,
+			Nick:   info.Nick,
+			Locale: info.Locale,
+		}
+		if account.Kind == "" {
+			account.Kind = "irc"
+		}
+		if account.Nick == "" {
+			account.Nick = "mup"
+		}
+		for _, channel := range info.Channels {
+			account.Channels = append(account.Channels, channel.Name)
+		}
+		accounts = append(accounts, account)
+	}
+	sort.Sort(accountsByName(accounts))
+	return accounts
+}
+
+type accountsByName []AccountInfo
+
+func (s accountsByName) Len() int           { return len(s) }
+func (s accountsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s accountsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// BotNick returns the nick the bot is configured to use in the named
+// account, or the empty string if the account is unknown.
+func (p *Plugger) BotNick(account string) string {
+	info := p.accountInfo(account)
+	if info == nil {
+		return ""
+	}
+	if info.Nick == "" {
+		return "mup"
+	}
+	return info.Nick
 }
 
 // LDAP returns the LDAP connection with the given name from the pool.
@@ -227,20 +981,96 @@ func (p *Plugger) LDAP(name string) (ldap.Conn, error) {
 	return p.ldap(name)
 }
 
+// AccountStatus holds the state of an IRC account connection as last
+// recorded by the server, as returned by Plugger.AccountStatus.
+type AccountStatus struct {
+	Name      string `bson:"_id"`
+	State     string
+	Nick      string
+	Caps      []string
+	Channels  []string
+	LastError string
+	Updated   time.Time
+}
+
+// AccountStatus returns the connection status last recorded by the server
+// for the named account, or for all accounts ordered by name if name is
+// empty. The status is read from the server database even if the plugin
+// stores its own collections elsewhere.
+func (p *Plugger) AccountStatus(name string) ([]AccountStatus, error) {
+	if p.db == nil {
+		return nil, fmt.Errorf("plugger has no database available")
+	}
+	session := p.db.Session.Copy()
+	defer session.Close()
+	var query bson.M
+	if name != "" {
+		query = bson.M{"_id": name}
+	}
+	var statuses []AccountStatus
+	err := p.db.C("accountstatus").With(session).Find(query).Sort("_id").All(&statuses)
+	if err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// LDAPStatus holds the state of one of the LDAP connections configured
+// in the server.
+type LDAPStatus struct {
+	Name      string
+	Connected bool
+	LastError string
+}
+
+// LDAPStatus returns the state of all LDAP connections configured in the
+// server, ordered by name. The last error is only reported while the
+// connection is down.
+func (p *Plugger) LDAPStatus() []LDAPStatus {
+	if p.ldapInfo == nil {
+		return nil
+	}
+	return p.ldapInfo()
+}
+
 // Sendf sends a message to the address obtained from the provided addressable.
 // The message text is formed by providing format and args to fmt.Sprintf, and by
 // prefixing the result with "nick: " if the message is addressed to a nick in
-// a channel.
+// a channel. The prefix may be changed via the account's "replyprefix" setting,
+// where any "%s" is replaced by the nick, and disabled for the plugin via
+// SetReplyPrefix.
 func (p *Plugger) Sendf(to Addressable, format string, args ...interface{}) error {
 	text := fmt.Sprintf(format, args...)
 	a := to.Address()
-	msg := &Message{Account: a.Account, Channel: a.Channel, Nick: a.Nick, Text: replyText(a, text)}
+	msg := &Message{Account: a.Account, Channel: a.Channel, Nick: a.Nick, Text: p.replyText(a, text)}
 	return p.Send(msg)
 }
 
-func replyText(a Address, text string) string {
+// SendCard sends card to the address obtained from the provided addressable,
+// as done by Sendf. The message text holds the card rendered for IRC, and
+// accounts on protocols that support richer messages render it themselves.
+func (p *Plugger) SendCard(to Addressable, card *Card) error {
+	a := to.Address()
+	msg := &Message{Account: a.Account, Channel: a.Channel, Nick: a.Nick, Text: p.replyText(a, card.String()), Card: card}
+	return p.Send(msg)
+}
+
+// SetReplyPrefix defines whether messages sent by the plugin via Sendf to
+// a nick in a channel are prefixed with the nick, as done by default.
+// Plugins that want their channel replies to read as clean output may
+// disable it when started.
+func (p *Plugger) SetReplyPrefix(enabled bool) {
+	p.noPrefix = !enabled
+}
+
+func (p *Plugger) replyText(a Address, text string) string {
+	if p.noPrefix {
+		return text
+	}
 	if a.Channel != "" && a.Channel[0] != '@' && a.Nick != "" {
-		if a.Host == "telegram" || a.Host == "webhook" {
+		if info := p.accountInfo(a.Account); info != nil && info.ReplyPrefix != nil {
+			text = strings.Replace(*info.ReplyPrefix, "%s", a.Nick, -1) + text
+		} else if a.Host == "telegram" || a.Host == "webhook" {
 			text = "@" + a.Nick + " " + text
 		} else {
 			text = a.Nick + ": " + text
@@ -261,6 +1091,19 @@ func (p *Plugger) SendDirectf(to Addressable, format string, args ...interface{}
 	return p.Send(msg)
 }
 
+// UserAddress returns the address for sending direct messages to the user
+// with the provided protocol-specific id in account, even when the user is
+// not currently messaging the bot. On IRC the id is the user's nick. On
+// Telegram, which has no nicks to address, the id is the numeric user id,
+// and the address takes the "@user:<id>" channel form of private chats.
+// The address may be stored and used later with SendDirectf.
+func (p *Plugger) UserAddress(account, id string) Address {
+	if info := p.accountInfo(account); info != nil && info.Kind == "telegram" {
+		return Address{Account: account, Channel: "@user:" + id}
+	}
+	return Address{Account: account, Nick: id}
+}
+
 // SendChannelf sends a channel message to the address obtained from the provided addressable,
 // or privately to the Nick if the address Channel is unset.
 // The message text is formed by providing format and args to fmt.Sprintf.
@@ -273,7 +1116,115 @@ func (p *Plugger) SendChannelf(to Addressable, format string, args ...interface{
 	return p.Send(msg)
 }
 
-// Broadcastf sends a message to all configured plugin targets.
+// Replyf sends a direct message to the nick in the address obtained from the
+// provided addressable and, if the address is in a channel, acknowledges it
+// in the channel with the ack text, prefixed as done by Sendf. This allows
+// bulky results to be sent privately while keeping the channel informed.
+// The direct message text is formed by providing format and args to fmt.Sprintf.
+func (p *Plugger) Replyf(to Addressable, ack, format string, args ...interface{}) error {
+	a := to.Address()
+	if a.Nick == "" || a.Channel == "" || a.Channel[0] == '@' {
+		return p.SendDirectf(to, format, args...)
+	}
+	if err := p.Sendf(to, "%s", ack); err != nil {
+		return err
+	}
+	return p.SendDirectf(to, format, args...)
+}
+
+// SendTable sends the provided rows to the address obtained from the
+// provided addressable, one message per row and prefixed as done by Sendf.
+// On IRC accounts the columns are padded with spaces so that they are
+// aligned when rendered with a monospace font. Other accounts, such as
+// telegram ones, get a compact form with columns separated by " | ".
+// Rows longer than MaxTextLen are broken down as done by Send.
+func (p *Plugger) SendTable(to Addressable, rows [][]string) error {
+	a := to.Address()
+	sep := " | "
+	var widths []int
+	if p.monospace(a) {
+		sep = "  "
+		for _, row := range rows {
+			for i, cell := range row {
+				if i == len(widths) {
+					widths = append(widths, 0)
+				}
+				if n := utf8.RuneCountInString(StripFormatting(cell)); n > widths[i] {
+					widths[i] = n
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	for _, row := range rows {
+		buf.Reset()
+		for i, cell := range row {
+			if i > 0 {
+				buf.WriteString(sep)
+			}
+			buf.WriteString(cell)
+			if widths != nil && i < len(row)-1 {
+				pad := widths[i] - utf8.RuneCountInString(StripFormatting(cell))
+				buf.WriteString(strings.Repeat(" ", pad))
+			}
+		}
+		if err := p.Sendf(to, "%s", buf.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// React reacts to msg with the provided emoji on accounts that support
+// message reactions, such as telegram ones. On other accounts, or when the
+// protocol id of msg is unknown, the emoji is sent as a reply via Sendf.
+func (p *Plugger) React(msg *Message, emoji string) error {
+	if msg.ProtoId == "" || !p.canReact(msg.Address()) {
+		return p.Sendf(msg, "%s", emoji)
+	}
+	return p.Send(&Message{
+		Account: msg.Account,
+		Channel: msg.Channel,
+		Nick:    msg.Nick,
+		Event:   ReactEvent,
+		EventId: msg.ProtoId,
+		Text:    emoji,
+	})
+}
+
+// canReact returns whether messages received from the provided address
+// may be reacted to.
+func (p *Plugger) canReact(a Address) bool {
+	if a.Host == "telegram" {
+		return true
+	}
+	info := p.accountInfo(a.Account)
+	return info != nil && info.Kind == "telegram"
+}
+
+// rendersCards returns whether messages sent to the provided address
+// have their cards rendered by the remote side, so they are never split.
+func (p *Plugger) rendersCards(a Address) bool {
+	if a.Host == "telegram" {
+		return true
+	}
+	info := p.accountInfo(a.Account)
+	return info != nil && info.Kind == "telegram"
+}
+
+// monospace returns whether messages sent to the provided address are
+// likely rendered with a monospace font, as usual for IRC clients.
+func (p *Plugger) monospace(a Address) bool {
+	if a.Host == "telegram" || a.Host == "webhook" {
+		return false
+	}
+	if info := p.accountInfo(a.Account); info != nil {
+		return info.Kind == "" || info.Kind == "irc"
+	}
+	return true
+}
+
+// Broadcastf sends a message to all of the plugin's DefaultTargets.
 // The message text is formed by providing format and args to fmt.Sprintf, and by
 // prefixing the result with "nick: " if the message is addressed to a nick in
 // a channel.
@@ -282,21 +1233,36 @@ func (p *Plugger) Broadcastf(format string, args ...interface{}) error {
 	return p.Broadcast(msg)
 }
 
-// Broadcast sends a message to all configured plugin targets.
+// DefaultTargets returns the plugin targets that messages not originated
+// from any particular message, such as those produced when polling external
+// services, are sent to by Broadcast. These are all targets that CanSend.
+func (p *Plugger) DefaultTargets() []*PluginTarget {
+	var targets []*PluginTarget
+	for i := range p.targets {
+		if p.targets[i].CanSend() {
+			targets = append(targets, &p.targets[i])
+		}
+	}
+	return targets
+}
+
+// Broadcast sends a message to all of the plugin's DefaultTargets.
 // The message text is prefixed by "nick: " if the message is addressed to
-// a nick in a channel.
+// a nick in a channel. If there are no such targets, the message is dropped
+// and that fact is logged.
 func (p *Plugger) Broadcast(msg *Message) error {
+	targets := p.DefaultTargets()
+	if len(targets) == 0 {
+		p.Logf("No targets to broadcast to. Dropping message: %s", msg.String())
+		return nil
+	}
 	var first error
-	for i := range p.targets {
-		t := &p.targets[i]
-		if !t.CanSend() {
-			continue
-		}
+	for _, t := range targets {
 		copy := *msg
 		copy.Account = t.address.Account
 		copy.Channel = t.address.Channel
 		copy.Nick = t.address.Nick
-		copy.Text = replyText(t.address, copy.Text)
+		copy.Text = p.replyText(t.address, copy.Text)
 		err := p.Send(&copy)
 		if err != nil && first == nil {
 			first = err
@@ -305,6 +1271,26 @@ func (p *Plugger) Broadcast(msg *Message) error {
 	return first
 }
 
+// Connected returns whether the named account is currently connected
+// and thus able to deliver sent messages right away. It always returns
+// true when there's no database available, as in tests.
+func (p *Plugger) Connected(account string) bool {
+	if p.db == nil {
+		return true
+	}
+	session := p.db.Session.Copy()
+	defer session.Close()
+	var info struct{ Connected bool }
+	err := p.db.C("accounts").With(session).FindId(account).Select(bson.D{{"connected", 1}}).One(&info)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			logf("Cannot verify whether account %q is connected: %v", account, err)
+		}
+		return false
+	}
+	return info.Connected
+}
+
 // MaxTextLen is the maximum amount of text accepted on the Text field
 // of a message before the line is automatically broken down into
 // multiple messages. The line breaking algorithm attempts to break the
@@ -318,19 +1304,93 @@ const MaxTextLen = 300
 const minTextLen = 50
 
 // Send sends msg to its defined address.
+//
+// Messages sent to accounts that are not connected are queued and
+// delivered once the connection is established, unless msg.Expires
+// is reached first. Use Connected to tell whether that is the case.
+//
+// When the plugin runs in dry run mode, either due to the DryRun server
+// setting or to a "dryrun" plugin configuration option, messages are
+// logged rather than sent.
+//
+// When the server has a paste service configured, texts that would be
+// broken into more lines than the configured limit are uploaded to the
+// service, and only the first line is sent followed by a link to the
+// full text.
+//
+// When the server has MoreLines set, only that many lines of long texts
+// sent to a nick in a channel are sent at once, and the rest is sent as
+// the nick says "more" in the channel.
+//
+// Text messages must be addressed to an account and to a channel or nick,
+// as for targets that CanSend. Messages lacking those, such as replies
+// addressed to targets with just an account, are dropped and that fact
+// is logged in debug mode.
 func (p *Plugger) Send(msg *Message) error {
+	if !canSend(msg) {
+		p.Debugf("Message has no address to send it to (account %q, channel %q, nick %q). Dropping it: %q", msg.Account, msg.Channel, msg.Nick, msg.Text)
+		return nil
+	}
 	copy := *msg
-	copy.Time = time.Now()
+	copy.Time = time.Now().UTC()
 	copy.Text = strings.TrimRight(copy.Text, " \t")
-	if len(copy.Text) <= MaxTextLen {
-		if err := p.send(&copy); err != nil {
-			logf("Cannot put message in outgoing queue: %v", err)
-			return fmt.Errorf("cannot put message in outgoing queue: %v", err)
+	if len(copy.Text) <= MaxTextLen || copy.Card != nil && p.rendersCards(copy.Address()) {
+		return p.sendLine(&copy)
+	}
+	copy.Card = nil
+
+	lines := splitText(copy.Text)
+	_, dryRun := p.settings()
+	if p.paste != nil && len(lines) > p.paste.lines && !dryRun {
+		url, err := p.paste.upload(copy.Text)
+		if err != nil {
+			p.Logf("Cannot upload long message to paste service: %v", err)
+		} else {
+			lines = []string{lines[0], "Full text at " + url}
 		}
+	}
+	if p.pager != nil && !dryRun {
+		locale := copy.Locale
+		if info := p.accountInfo(copy.Account); locale == "" && info != nil {
+			locale = info.Locale
+		}
+		lines = p.pager.page(&copy, lines, locale)
+	}
+	for _, line := range lines {
+		copy.Text = line
+		if err := p.sendLine(&copy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canSend returns whether msg may be sent. Only text messages are checked,
+// as other commands carry their destination in parameters.
+func canSend(msg *Message) bool {
+	switch msg.Command {
+	case "", cmdPrivMsg, cmdNotice:
+		t := PluginTarget{address: msg.Address()}
+		return t.CanSend()
+	}
+	return true
+}
+
+func (p *Plugger) sendLine(msg *Message) error {
+	if _, dryRun := p.settings(); dryRun {
+		p.Logf("Dry run. Not sending to account %q: %s", msg.Account, msg.String())
 		return nil
 	}
+	if err := p.send(msg); err != nil {
+		logf("Cannot put message in outgoing queue: %v", err)
+		return fmt.Errorf("cannot put message in outgoing queue: %v", err)
+	}
+	return nil
+}
 
-	text := copy.Text
+// splitText breaks text down into lines of at most MaxTextLen bytes.
+func splitText(text string) []string {
+	var lines []string
 	for len(text) > MaxTextLen {
 		split := MaxTextLen
 		if i := strings.LastIndex(text[:split], " "); i > 0 {
@@ -344,15 +1404,11 @@ func (p *Plugger) Send(msg *Message) error {
 		} else if len(text)-MaxTextLen < minTextLen {
 			split = (len(text) + 1) / 2
 		}
-		copy.Text = strings.TrimRight(text[:split], " ")
+		lines = append(lines, strings.TrimRight(text[:split], " "))
 		text = strings.TrimLeft(text[split:], " ")
-		if err := p.Send(&copy); err != nil {
-			return err
-		}
 	}
 	if len(text) > 0 {
-		copy.Text = text
-		return p.Send(&copy)
+		lines = append(lines, text)
 	}
-	return nil
+	return lines
 }
@@ -2,7 +2,12 @@ package mup_test
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -75,6 +80,53 @@ func (s *PluggerSuite) TestLogf(c *C) {
 	c.Assert(c.GetTestLog(), Matches, `(?m).*\[theplugin/label\] <text>.*`)
 }
 
+func (s *PluggerSuite) TestLogCapture(c *C) {
+	p := s.plugger(nil, nil, nil)
+	_, ok := p.PluginLogs("theplugin/label")
+	c.Assert(ok, Equals, false)
+
+	p.SetLogCapture(2)
+	lines, ok := p.PluginLogs("theplugin/label")
+	c.Assert(ok, Equals, true)
+	c.Assert(lines, HasLen, 0)
+
+	for i := 1; i <= 3; i++ {
+		p.Logf("<%d>", i)
+	}
+	lines, _ = p.PluginLogs("theplugin/label")
+	c.Assert(lines, HasLen, 2)
+	c.Assert(lines[0], Matches, `\d\d:\d\d:\d\d <2>`)
+	c.Assert(lines[1], Matches, `\d\d:\d\d:\d\d <3>`)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*\[theplugin/label\] <1>.*`)
+
+	lines, _ = p.PluginLogs("other")
+	c.Assert(lines, HasLen, 0)
+}
+
+func (s *PluggerSuite) TestPrivileged(c *C) {
+	other := mup.NewPlugger("other", nil, nil, nil, nil, nil, nil)
+	other.SetLogCapture(2)
+	other.Logf("<other>")
+	id := other.Schedule(time.Hour, "Task", func() {})
+
+	p := mup.NewPlugger("unprivileged", nil, nil, nil, nil, nil, nil)
+	p.ShareManager(other)
+
+	lines, ok := p.PluginLogs("other")
+	c.Assert(ok, Equals, true)
+	c.Assert(lines, HasLen, 0)
+	c.Assert(p.CancelTask("other", id), Equals, false)
+	err := p.RestartPlugin("other")
+	c.Assert(err, ErrorMatches, `plugin "unprivileged" is not privileged to restart plugins`)
+
+	p.SetPrivileged(true)
+	lines, _ = p.PluginLogs("other")
+	c.Assert(lines, HasLen, 1)
+	c.Assert(p.CancelTask("other", id), Equals, true)
+	err = p.RestartPlugin("other")
+	c.Assert(err, ErrorMatches, "cannot restart plugins: no plugin manager available")
+}
+
 func (s *PluggerSuite) TestDebugf(c *C) {
 	p := s.plugger(nil, nil, nil)
 	mup.SetDebug(false)
@@ -137,6 +189,122 @@ func (s *PluggerSuite) TestCollection(c *C) {
 	}
 }
 
+func (s *PluggerSuite) TestCollectionDatabase(c *C) {
+	master := s.dbserver.Session()
+	defer master.Close()
+
+	p := s.plugger(master.DB(""), bson.M{"database": "other"}, nil)
+
+	for _, test := range collTests {
+		session, coll := p.Collection(test.suffix, test.kind)
+		defer session.Close()
+
+		c.Assert(coll.Name, Equals, test.name)
+		c.Assert(coll.Database.Name, Equals, "other")
+		c.Assert(coll.Database.Session, Equals, session)
+		c.Assert(coll.Database.Session, Not(Equals), master)
+	}
+}
+
+func (s *PluggerSuite) TestStore(c *C) {
+	session := s.dbserver.Session()
+	defer session.Close()
+
+	p := s.plugger(session.DB(""), nil, nil)
+
+	store := p.Store("notes", 0)
+	defer store.Close()
+	c.Assert(store.Insert(bson.M{"_id": 1, "text": "one"}, bson.M{"_id": 2, "text": "two"}), IsNil)
+	_, err := store.UpsertId(2, bson.M{"$set": bson.M{"text": "deux"}})
+	c.Assert(err, IsNil)
+
+	var docs []bson.M
+	err = session.DB("").C("unique.theplugin_label.notes").Find(nil).Sort("_id").All(&docs)
+	c.Assert(err, IsNil)
+	c.Assert(docs, DeepEquals, []bson.M{{"_id": 1, "text": "one"}, {"_id": 2, "text": "deux"}})
+
+	var doc struct{ Text string }
+	c.Assert(store.FindId(2).One(&doc), IsNil)
+	c.Assert(doc.Text, Equals, "deux")
+	n, err := store.Find(bson.M{"text": "one"}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+}
+
+func (s *PluggerSuite) TestBulkCollection(c *C) {
+	defer mup.SetBulkFlush(3, 100*time.Millisecond)()
+
+	session := s.dbserver.Session()
+	defer session.Close()
+
+	p := s.plugger(session.DB(""), nil, nil)
+	bulk := p.BulkCollection("mine", mup.Bulk)
+	coll := session.DB("test_bulk").C("unique.theplugin_label.mine")
+	c.Assert(p.BulkCollection("mine", mup.Bulk), Equals, bulk)
+	c.Assert(p.BulkCollection("other", mup.Bulk), Not(Equals), bulk)
+
+	count := func() int {
+		n, err := coll.Count()
+		c.Assert(err, IsNil)
+		return n
+	}
+
+	// Documents are buffered until flushed.
+	c.Assert(bulk.Insert(bson.M{"n": 1}, bson.M{"n": 2}), IsNil)
+	c.Assert(bulk.Pending(), Equals, 2)
+	c.Assert(count(), Equals, 0)
+	c.Assert(bulk.Flush(), IsNil)
+	c.Assert(bulk.Pending(), Equals, 0)
+	c.Assert(count(), Equals, 2)
+
+	// Reaching the buffer size flushes.
+	c.Assert(bulk.Insert(bson.M{"n": 3}, bson.M{"n": 4}), IsNil)
+	c.Assert(count(), Equals, 2)
+	c.Assert(bulk.Insert(bson.M{"n": 5}), IsNil)
+	c.Assert(bulk.Pending(), Equals, 0)
+	c.Assert(count(), Equals, 5)
+
+	// Pending documents are flushed after a delay.
+	c.Assert(bulk.Insert(bson.M{"n": 6}), IsNil)
+	c.Assert(count(), Equals, 5)
+	time.Sleep(300 * time.Millisecond)
+	c.Assert(bulk.Pending(), Equals, 0)
+	c.Assert(count(), Equals, 6)
+}
+
+func (s *PluggerSuite) TestBulkCollectionErrors(c *C) {
+	defer mup.SetBulkFlush(3, time.Hour)()
+	defer mup.SetBulkMaxPending(2)()
+
+	session := s.dbserver.Session()
+	defer session.Close()
+
+	p := s.plugger(session.DB(""), nil, nil)
+
+	// Documents rejected as duplicates are dropped, and the rest written.
+	bulk := p.BulkCollection("mine", mup.Bulk)
+	coll := session.DB("test_bulk").C("unique.theplugin_label.mine")
+	c.Assert(coll.Insert(bson.M{"_id": 1}), IsNil)
+	c.Assert(bulk.Insert(bson.M{"_id": 1}, bson.M{"_id": 2}), IsNil)
+	err := bulk.Flush()
+	c.Assert(mgo.IsDup(err), Equals, true)
+	c.Assert(bulk.Pending(), Equals, 0)
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	// Documents that fail otherwise are kept, up to a limit.
+	bulk = p.BulkCollection("bad$name", mup.Bulk)
+	c.Assert(bulk.Insert(bson.M{"n": 1}, bson.M{"n": 2}), IsNil)
+	c.Assert(bulk.Flush(), NotNil)
+	c.Assert(bulk.Pending(), Equals, 2)
+	c.Assert(bulk.Insert(bson.M{"n": 3}), IsNil)
+	c.Assert(bulk.Pending(), Equals, 3)
+	c.Assert(bulk.Flush(), NotNil)
+	c.Assert(bulk.Pending(), Equals, 2)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Too many documents failed to be written. Dropping the 1 oldest ones.*`)
+}
+
 func (s *PluggerSuite) TestHandle(c *C) {
 	p := s.plugger(nil, nil, []bson.M{
 		{"account": "one", "channel": "#chan"},
@@ -179,6 +347,19 @@ func (s *PluggerSuite) TestSendfChannelTelegram(c *C) {
 	c.Assert(s.sent, DeepEquals, []string{"[@origin] PRIVMSG #channel :@nick <reply>"})
 }
 
+func (s *PluggerSuite) TestSendCard(c *C) {
+	p := s.plugger(nil, nil, nil)
+	msg := mup.ParseIncoming("origin", "mup", "!", ":nick!~user@host PRIVMSG #channel :mup: query")
+	card := &mup.Card{
+		Title:  "Bug #1",
+		Fields: []mup.CardField{{Name: "Status", Value: "New"}, {Value: "tag"}},
+		Link:   "https://example.com/1",
+	}
+	p.SendCard(msg, card)
+	c.Assert(s.sent, DeepEquals, []string{"[@origin] PRIVMSG #channel :nick: \x02Bug #1\x02 <Status: New> <tag> <https://example.com/1>"})
+	c.Assert(s.msgs[0].Card, DeepEquals, card)
+}
+
 func (s *PluggerSuite) TestSendfNoNick(c *C) {
 	p := s.plugger(nil, nil, nil)
 	msg := mup.ParseIncoming("origin", "mup", "!", "PRIVMSG #channel :mup: query")
@@ -193,6 +374,92 @@ func (s *PluggerSuite) TestSendfUserChannel(c *C) {
 	c.Assert(s.sent, DeepEquals, []string{"[@origin] PRIVMSG @user:123 :<reply>"})
 }
 
+func (s *PluggerSuite) TestSendDirectfUserAddress(c *C) {
+	p := s.plugger(nil, nil, nil)
+	p.SetAccounts([]bson.M{
+		{"_id": "tg", "kind": "telegram"},
+		{"_id": "irc"},
+	})
+	c.Assert(p.UserAddress("tg", "123"), Equals, mup.Address{Account: "tg", Channel: "@user:123"})
+	c.Assert(p.UserAddress("irc", "nick"), Equals, mup.Address{Account: "irc", Nick: "nick"})
+
+	p.SendDirectf(p.UserAddress("tg", "123"), "<%s>", "reminder")
+	p.SendDirectf(p.UserAddress("irc", "nick"), "<%s>", "reminder")
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@tg] PRIVMSG @user:123 :<reminder>",
+		"[@irc] PRIVMSG nick :<reminder>",
+	})
+}
+
+func (s *PluggerSuite) TestSendfReplyPrefix(c *C) {
+	p := s.plugger(nil, nil, nil)
+	p.SetAccounts([]bson.M{
+		{"_id": "origin", "replyprefix": "@%s "},
+		{"_id": "other", "replyprefix": ""},
+	})
+	for _, account := range []string{"origin", "other", "unknown"} {
+		msg := mup.ParseIncoming(account, "mup", "!", ":nick!~user@host PRIVMSG #channel :mup: query")
+		p.Sendf(msg, "<%s>", "reply")
+	}
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@origin] PRIVMSG #channel :@nick <reply>",
+		"[@other] PRIVMSG #channel :<reply>",
+		"[@unknown] PRIVMSG #channel :nick: <reply>",
+	})
+}
+
+func (s *PluggerSuite) TestSendfNoReplyPrefix(c *C) {
+	p := s.plugger(nil, nil, nil)
+	p.SetReplyPrefix(false)
+	msg := mup.ParseIncoming("origin", "mup", "!", ":nick!~user@host PRIVMSG #channel :mup: query")
+	p.Sendf(msg, "<%s>", "reply")
+	p.Replyf(msg, "ack", "<%s>", "details")
+	p.SetReplyPrefix(true)
+	p.Sendf(msg, "<%s>", "prefixed")
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@origin] PRIVMSG #channel :<reply>",
+		"[@origin] PRIVMSG #channel :ack",
+		"[@origin] PRIVMSG nick :<details>",
+		"[@origin] PRIVMSG #channel :nick: <prefixed>",
+	})
+}
+
+func (s *PluggerSuite) TestAccounts(c *C) {
+	p := s.plugger(nil, nil, nil)
+	c.Assert(p.Accounts(), HasLen, 0)
+	c.Assert(p.BotNick("one"), Equals, "")
+
+	p.SetAccounts([]bson.M{{
+		"_id":      "two",
+		"kind":     "telegram",
+		"nick":     "mupbot",
+		"password": "secret",
+		"locale":   "pt_BR",
+	}, {
+		"_id":      "one",
+		"host":     "irc.example.com",
+		"password": "secret",
+		"channels": []bson.M{{"name": "#chan", "key": "secret"}},
+	}})
+	c.Assert(p.Accounts(), DeepEquals, []mup.AccountInfo{{
+		Name:     "one",
+		Kind:     "irc",
+		Host:     "irc.example.com",
+		Nick:     "mup",
+		Channels: []string{"#chan"},
+	}, {
+		Name:   "two",
+		Kind:   "telegram",
+		Nick:   "mupbot",
+		Locale: "pt_BR",
+	}})
+	c.Assert(fmt.Sprintf("%#v", p.Accounts()), Not(Matches), ".*secret.*")
+
+	c.Assert(p.BotNick("one"), Equals, "mup")
+	c.Assert(p.BotNick("two"), Equals, "mupbot")
+	c.Assert(p.BotNick("three"), Equals, "")
+}
+
 func (s *PluggerSuite) TestSend(c *C) {
 	p := s.plugger(nil, nil, nil)
 	msg := &mup.Message{Account: "myaccount", Command: "TEST", Params: []string{"some", "params"}}
@@ -203,6 +470,7 @@ func (s *PluggerSuite) TestSend(c *C) {
 	sent := s.msgs[0]
 	c.Assert(sent.Time.After(before), Equals, true)
 	c.Assert(sent.Time.Before(after), Equals, true)
+	c.Assert(sent.Time.Location(), Equals, time.UTC)
 	c.Assert(msg.Time.IsZero(), Equals, true)
 	sent.Time = time.Time{}
 	c.Assert(sent, DeepEquals, msg)
@@ -236,6 +504,23 @@ func (s *PluggerSuite) TestChannelfChannel(c *C) {
 	c.Assert(s.sent, DeepEquals, []string{"[@origin] PRIVMSG #channel :<reply>"})
 }
 
+func (s *PluggerSuite) TestReplyfPrivate(c *C) {
+	p := s.plugger(nil, nil, nil)
+	msg := mup.ParseIncoming("origin", "mup", "!", ":nick!~user@host PRIVMSG mup :query")
+	p.Replyf(msg, "Sent you the details.", "<%s>", "details")
+	c.Assert(s.sent, DeepEquals, []string{"[@origin] PRIVMSG nick :<details>"})
+}
+
+func (s *PluggerSuite) TestReplyfChannel(c *C) {
+	p := s.plugger(nil, nil, nil)
+	msg := mup.ParseIncoming("origin", "mup", "!", ":nick!~user@host PRIVMSG #channel :mup: query")
+	p.Replyf(msg, "Sent you the details.", "<%s>", "details")
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@origin] PRIVMSG #channel :nick: Sent you the details.",
+		"[@origin] PRIVMSG nick :<details>",
+	})
+}
+
 func (s *PluggerSuite) TestConfig(c *C) {
 	p := s.plugger(nil, bson.M{"key": "value"}, nil)
 	var config struct{ Key string }
@@ -243,6 +528,213 @@ func (s *PluggerSuite) TestConfig(c *C) {
 	c.Assert(config.Key, Equals, "value")
 }
 
+func (s *PluggerSuite) TestConfigEnvRef(c *C) {
+	os.Setenv("MUP_TEST_TOKEN", "s3cr3t")
+	defer os.Unsetenv("MUP_TEST_TOKEN")
+
+	p := s.plugger(nil, bson.M{"key": "value", "token": "${env:MUP_TEST_TOKEN}", "sub": bson.M{"tokens": []string{"${env:MUP_TEST_TOKEN}"}}}, nil)
+	c.Assert(p.ResolveConfig(), IsNil)
+	var config struct {
+		Key   string
+		Token string
+		Sub   struct{ Tokens []string }
+	}
+	p.Config(&config)
+	c.Assert(config.Key, Equals, "value")
+	c.Assert(config.Token, Equals, "s3cr3t")
+	c.Assert(config.Sub.Tokens, DeepEquals, []string{"s3cr3t"})
+}
+
+func (s *PluggerSuite) TestConfigFileRef(c *C) {
+	p := s.plugger(nil, bson.M{"token": "${file:/etc/passwd}"}, nil)
+	c.Assert(p.ResolveConfig(), ErrorMatches, `file "/etc/passwd" referenced in configuration: file references are only supported in account passwords`)
+}
+
+func (s *PluggerSuite) TestConfigSecretRef(c *C) {
+	session := s.dbserver.Session()
+	defer session.Close()
+	db := session.DB("")
+
+	err := db.C("secrets").Insert(bson.M{"_id": "lp", "value": "s3cr3t"})
+	c.Assert(err, IsNil)
+
+	p := s.plugger(db, bson.M{"token": "${secret:lp}"}, nil)
+	c.Assert(p.ResolveConfig(), IsNil)
+	var config struct{ Token string }
+	p.Config(&config)
+	c.Assert(config.Token, Equals, "s3cr3t")
+
+	p = s.plugger(db, bson.M{"token": "${secret:missing}"}, nil)
+	c.Assert(p.ResolveConfig(), ErrorMatches, `secret "missing" referenced in configuration not found`)
+
+	p = s.plugger(db, bson.M{"token": "${env:MUP_TEST_UNSET}"}, nil)
+	c.Assert(p.ResolveConfig(), ErrorMatches, `environment variable "MUP_TEST_UNSET" referenced in configuration is not set`)
+}
+
+func (s *PluggerSuite) TestFetch(c *C) {
+	defer mup.SetFetchRetry(2, 10*time.Millisecond)()
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.URL.Path)
+		switch req.URL.Path {
+		case "/missing":
+			http.NotFound(w, req)
+			return
+		case "/broken":
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		case "/garbage":
+			fmt.Fprintf(w, "not JSON")
+			return
+		case "/huge":
+			w.Write(make([]byte, 1024*1024+1))
+			return
+		}
+		fmt.Fprintf(w, `{"path": %q, "count": %d, "agent": %q}`, req.URL.Path, len(requests), req.UserAgent())
+	}))
+	defer server.Close()
+
+	type result struct {
+		Path  string
+		Count int
+		Agent string
+	}
+
+	p := s.plugger(nil, nil, nil)
+	fetch := func(path string, ttl time.Duration) result {
+		var r result
+		err := p.Fetch(server.URL+path, &r, ttl)
+		c.Assert(err, IsNil)
+		return r
+	}
+
+	// Miss.
+	c.Assert(fetch("/one", 100*time.Millisecond), Equals, result{"/one", 1, "mup"})
+
+	// Hit.
+	c.Assert(fetch("/one", 100*time.Millisecond), Equals, result{"/one", 1, "mup"})
+
+	// Cached per URL.
+	c.Assert(fetch("/two", 100*time.Millisecond), Equals, result{"/two", 2, "mup"})
+
+	// Expired.
+	time.Sleep(150 * time.Millisecond)
+	c.Assert(fetch("/one", 100*time.Millisecond), Equals, result{"/one", 3, "mup"})
+
+	// Errors are not cached.
+	var r result
+	for i := 0; i < 2; i++ {
+		err := p.Fetch(server.URL+"/missing", &r, time.Minute)
+		c.Assert(err, ErrorMatches, `cannot fetch .*/missing: 404 Not Found`)
+	}
+
+	// Server failures are retried a few times.
+	err := p.Fetch(server.URL+"/broken", &r, time.Minute)
+	c.Assert(err, ErrorMatches, `cannot fetch .*/broken: 500 Internal Server Error`)
+
+	// Content that cannot be decoded is not cached either.
+	for i := 0; i < 2; i++ {
+		err := p.Fetch(server.URL+"/garbage", &r, time.Minute)
+		c.Assert(err, ErrorMatches, `cannot decode content from .*/garbage: .*`)
+	}
+
+	// Content that is too large is not retried.
+	err = p.Fetch(server.URL+"/huge", &r, time.Minute)
+	c.Assert(err, ErrorMatches, `cannot fetch .*/huge: content too large`)
+
+	c.Assert(requests, DeepEquals, []string{
+		"/one", "/two", "/one", "/missing", "/missing",
+		"/broken", "/broken", "/broken", "/garbage", "/garbage", "/huge",
+	})
+}
+
+func (s *PluggerSuite) TestHandleHTTPInvalidPath(c *C) {
+	p := s.plugger(nil, nil, nil)
+	defer p.StartHTTP()()
+
+	for _, path := range []string{"a b", "{id}", "../other/", "a//b", "a/./b", "GET /a"} {
+		err := p.HandleHTTP(path, http.NotFoundHandler())
+		c.Assert(err, ErrorMatches, `invalid HTTP handler path: ".*"`, Commentf("Path: %q", path))
+	}
+	c.Assert(p.HandleHTTP("a", nil), ErrorMatches, "cannot register a nil HTTP handler")
+
+	c.Assert(p.HandleHTTP("", http.NotFoundHandler()), IsNil)
+	c.Assert(p.HandleHTTP("a/b/", http.NotFoundHandler()), IsNil)
+	c.Assert(p.HandleHTTP("/a/b/", http.NotFoundHandler()), ErrorMatches, "HTTP handler already registered for /theplugin/label/a/b/")
+}
+
+func (s *PluggerSuite) TestHandleHTTPDisabled(c *C) {
+	p := s.plugger(nil, nil, nil)
+	err := p.HandleHTTP("path", http.NotFoundHandler())
+	c.Assert(err, ErrorMatches, "cannot handle HTTP requests: server has no HTTP address configured")
+}
+
+func (s *PluggerSuite) TestParallel(c *C) {
+	p := s.plugger(nil, nil, nil)
+
+	for _, limit := range []int{1, 3, 0} {
+		var mu sync.Mutex
+		var running, maxRunning int
+		results := make([]int, 10)
+		p.Parallel(limit, len(results), func(i int) {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			results[i] = i * 2
+		})
+		if limit == 0 {
+			c.Assert(maxRunning > 3, Equals, true)
+		} else {
+			c.Assert(maxRunning, Equals, limit)
+		}
+		c.Assert(results, DeepEquals, []int{0, 2, 4, 6, 8, 10, 12, 14, 16, 18})
+	}
+}
+
+func (s *PluggerSuite) TestState(c *C) {
+	session := s.dbserver.Session()
+	defer session.Close()
+	db := session.DB("")
+
+	err := db.C("plugins").Insert(bson.M{"_id": "theplugin/label", "config": bson.M{"key": "value"}})
+	c.Assert(err, IsNil)
+
+	type state struct {
+		Seen []int
+		Last string
+	}
+
+	p := s.plugger(db, nil, nil)
+	var result state
+	c.Assert(p.LoadState(&result), IsNil)
+	c.Assert(result, DeepEquals, state{})
+
+	c.Assert(p.SaveState(state{Seen: []int{1, 2}, Last: "two"}), IsNil)
+	c.Assert(p.SaveState(state{Seen: []int{1, 2, 3}, Last: "three"}), IsNil)
+
+	// Simulate a restart with a new plugger.
+	p = s.plugger(db, nil, nil)
+	c.Assert(p.LoadState(&result), IsNil)
+	c.Assert(result, DeepEquals, state{Seen: []int{1, 2, 3}, Last: "three"})
+
+	// The rest of the plugin document is preserved.
+	var doc bson.M
+	err = db.C("plugins").FindId("theplugin/label").One(&doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc["config"], DeepEquals, bson.M{"key": "value"})
+
+	p = mup.NewPlugger("missing", db, nil, nil, nil, nil, nil)
+	c.Assert(p.SaveState(state{}), ErrorMatches, "cannot save plugin state: not found")
+}
+
 func (s *PluggerSuite) TestTargets(c *C) {
 	p := s.plugger(nil, nil, []bson.M{
 		{"account": "one", "channel": "#chan"},
@@ -279,6 +771,116 @@ func (s *PluggerSuite) TestTargets(c *C) {
 	c.Assert(targets[5].CanSend(), Equals, false)
 }
 
+func (s *PluggerSuite) TestTargetPatterns(c *C) {
+	p := s.plugger(nil, nil, []bson.M{
+		{"account": "one", "channel": "#team-*"},
+		{"account": "one", "channel": "#team-core"},
+		{"account": "two", "channel": "#dev-?"},
+	})
+	targets := p.Targets()
+	c.Assert(targets, HasLen, 3)
+
+	c.Assert(p.Target(&mup.Message{Account: "one", Channel: "#team-web"}), Equals, &targets[0])
+	c.Assert(p.Target(&mup.Message{Account: "one", Channel: "#team-core"}), Equals, &targets[1])
+	c.Assert(p.Target(&mup.Message{Account: "one", Channel: "#other"}), IsNil)
+	c.Assert(p.Target(&mup.Message{Account: "one", Nick: "nick"}), IsNil)
+	c.Assert(p.Target(&mup.Message{Account: "two", Channel: "#team-web"}), IsNil)
+	c.Assert(p.Target(&mup.Message{Account: "two", Channel: "#dev-a"}), Equals, &targets[2])
+	c.Assert(p.Target(&mup.Message{Account: "two", Channel: "#dev-ab"}), IsNil)
+
+	c.Assert(targets[0].CanSend(), Equals, false)
+	c.Assert(targets[1].CanSend(), Equals, true)
+	c.Assert(targets[2].CanSend(), Equals, false)
+}
+
+func (s *PluggerSuite) TestTargetConfig(c *C) {
+	p := s.plugger(nil, bson.M{"project": "mup", "prefix": "lp"}, []bson.M{
+		{"account": "one", "channel": "#chan", "config": bson.M{"project": "juju", "extra": 42}},
+		{"account": "one"},
+	})
+	type config struct {
+		Project string
+		Prefix  string
+		Extra   int
+	}
+
+	var result config
+	p.TargetConfig(&mup.Message{Account: "one", Channel: "#chan"}, &result)
+	c.Assert(result, Equals, config{Project: "juju", Prefix: "lp", Extra: 42})
+
+	result = config{}
+	p.TargetConfig(&mup.Message{Account: "one", Channel: "#other"}, &result)
+	c.Assert(result, Equals, config{Project: "mup", Prefix: "lp"})
+
+	result = config{}
+	p.TargetConfig(&mup.Message{Account: "two", Channel: "#chan"}, &result)
+	c.Assert(result, Equals, config{Project: "mup", Prefix: "lp"})
+}
+
+var tableRows = [][]string{
+	{"#", "Title", "Status"},
+	{"123", "Some bug", "New"},
+	{"45678", "Lučić's bug", "Fix Released"},
+}
+
+func (s *PluggerSuite) TestSendTable(c *C) {
+	p := s.plugger(nil, nil, nil)
+	err := p.SendTable(&mup.Message{Account: "one", Nick: "nick", Channel: "#chan"}, tableRows)
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@one] PRIVMSG #chan :nick: #      Title        Status",
+		"[@one] PRIVMSG #chan :nick: 123    Some bug     New",
+		"[@one] PRIVMSG #chan :nick: 45678  Lučić's bug  Fix Released",
+	})
+}
+
+func (s *PluggerSuite) TestSendTableTelegram(c *C) {
+	p := s.plugger(nil, nil, nil)
+	p.SetAccounts([]bson.M{{"_id": "one", "kind": "telegram"}})
+	err := p.SendTable(&mup.Message{Account: "one", Nick: "nick"}, tableRows)
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@one] PRIVMSG nick :# | Title | Status",
+		"[@one] PRIVMSG nick :123 | Some bug | New",
+		"[@one] PRIVMSG nick :45678 | Lučić's bug | Fix Released",
+	})
+}
+
+func (s *PluggerSuite) TestSendTableWrap(c *C) {
+	p := s.plugger(nil, nil, nil)
+	long := strings.Repeat("123456789 ", 30) + "A"
+	err := p.SendTable(&mup.Message{Account: "one", Nick: "nick"}, [][]string{{"a", long}, {"bb", "c"}})
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@one] PRIVMSG nick :a   " + strings.Repeat("123456789 ", 15)[:149],
+		"[@one] PRIVMSG nick :" + strings.Repeat("123456789 ", 15) + "A",
+		"[@one] PRIVMSG nick :bb  c",
+	})
+}
+
+func (s *PluggerSuite) TestReactTelegram(c *C) {
+	p := s.plugger(nil, nil, nil)
+	msg := mup.ParseIncoming("origin", "mup", "!", ":nick!~user@telegram PRIVMSG #channel :mup: query")
+	msg.ProtoId = "34"
+	err := p.React(msg, "👍")
+	c.Assert(err, IsNil)
+	c.Assert(s.msgs, HasLen, 1)
+	c.Assert(s.msgs[0].Channel, Equals, "#channel")
+	c.Assert(s.msgs[0].Event, Equals, mup.ReactEvent)
+	c.Assert(s.msgs[0].EventId, Equals, "34")
+	c.Assert(s.msgs[0].Text, Equals, "👍")
+}
+
+func (s *PluggerSuite) TestReactFallback(c *C) {
+	p := s.plugger(nil, nil, nil)
+	msg := mup.ParseIncoming("origin", "mup", "!", ":nick!~user@host PRIVMSG #channel :mup: query")
+	msg.ProtoId = "34"
+	err := p.React(msg, "👍")
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, DeepEquals, []string{"[@origin] PRIVMSG #channel :nick: 👍"})
+	c.Assert(s.msgs[0].Event, Equals, "")
+}
+
 func (s *PluggerSuite) TestBroadcastf(c *C) {
 	p := s.plugger(nil, nil, []bson.M{
 		{"account": "one", "channel": "#chan"},
@@ -304,6 +906,119 @@ func (s *PluggerSuite) TestBroadcast(c *C) {
 	c.Assert(s.sent, DeepEquals, []string{"[@one] TEST some params", "[@two] TEST some params"})
 }
 
+func (s *PluggerSuite) TestBroadcastDefaultTargets(c *C) {
+	p := s.plugger(nil, nil, []bson.M{
+		{"account": "one"},
+		{"account": "one", "channel": "#chan"},
+		{"channel": "#other"},
+		{"account": "two", "channel": "#team-*"},
+		{"account": "two", "nick": "nick"},
+	})
+	targets := p.DefaultTargets()
+	c.Assert(targets, HasLen, 2)
+	c.Assert(targets[0].Address(), Equals, mup.Address{Account: "one", Channel: "#chan"})
+	c.Assert(targets[1].Address(), Equals, mup.Address{Account: "two", Nick: "nick"})
+	c.Assert(targets[0], Equals, &p.Targets()[1])
+
+	p.Broadcastf("Poll result.")
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@one] PRIVMSG #chan :Poll result.",
+		"[@two] PRIVMSG nick :Poll result.",
+	})
+
+	p = s.plugger(nil, nil, []bson.M{{"account": "one"}, {"channel": "#chan"}})
+	c.Assert(p.DefaultTargets(), HasLen, 0)
+	c.Assert(p.Broadcastf("Poll result."), IsNil)
+	c.Assert(s.sent, IsNil)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*No targets to broadcast to\. Dropping message: .*Poll result\..*`)
+}
+
+func (s *PluggerSuite) TestSendCannotSend(c *C) {
+	p := s.plugger(nil, nil, []bson.M{
+		{"account": "one"},
+		{"channel": "#chan"},
+		{"account": "two", "channel": "#team-*"},
+	})
+	for _, target := range p.Targets() {
+		c.Assert(target.CanSend(), Equals, false)
+		err := p.Sendf(&target, "<%s>", "text")
+		c.Assert(err, IsNil)
+	}
+	err := p.Send(&mup.Message{Account: "one", Command: "MODE", Params: []string{"mup", "+B"}})
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, DeepEquals, []string{"[@one] MODE mup +B"})
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Message has no address to send it to \(account "one", channel "", nick ""\)\. Dropping it: "<text>".*`)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Message has no address to send it to \(account "", channel "#chan", nick ""\)\. Dropping it: "<text>".*`)
+}
+
+func (s *PluggerSuite) TestSchedule(c *C) {
+	p := s.plugger(nil, nil, nil)
+
+	fired := make(chan string, 2)
+	id1 := p.Schedule(50*time.Millisecond, "First task", func() { fired <- "first" })
+	id2 := p.Schedule(time.Hour, "Second task", func() { fired <- "second" })
+	id3 := p.Schedule(2*time.Hour, "Third task", func() { fired <- "third" })
+
+	tasks := p.ScheduledTasks(p.Name())
+	c.Assert(tasks, HasLen, 3)
+	for i, id := range []string{id1, id2, id3} {
+		c.Assert(tasks[i].Id, Equals, id)
+		c.Assert(tasks[i].Plugin, Equals, "theplugin/label")
+	}
+	c.Assert(tasks[1].Description, Equals, "Second task")
+	c.Assert(tasks[1].Due.After(time.Now().Add(59*time.Minute)), Equals, true)
+	c.Assert(p.ScheduledTasks("other"), HasLen, 0)
+
+	c.Assert(p.CancelTask("other", id2), Equals, false)
+	c.Assert(p.CancelTask(p.Name(), id2), Equals, true)
+	c.Assert(p.CancelTask(p.Name(), id2), Equals, false)
+
+	select {
+	case name := <-fired:
+		c.Assert(name, Equals, "first")
+	case <-time.After(5 * time.Second):
+		c.Fatalf("Scheduled task did not run.")
+	}
+	c.Assert(p.CancelTask(p.Name(), id1), Equals, false)
+
+	tasks = p.ScheduledTasks(p.Name())
+	c.Assert(tasks, HasLen, 1)
+	c.Assert(tasks[0].Id, Equals, id3)
+	c.Assert(p.CancelTask(p.Name(), id3), Equals, true)
+}
+
+func (s *PluggerSuite) TestScheduleStop(c *C) {
+	p := s.plugger(nil, nil, nil)
+
+	started := make(chan bool)
+	release := make(chan bool)
+	p.Schedule(0, "Running task", func() {
+		close(started)
+		<-release
+	})
+	p.Schedule(time.Hour, "Pending task", func() { c.Errorf("Pending task ran.") })
+	<-started
+
+	// Stopping cancels pending tasks and waits for the running ones.
+	canceled := make(chan bool)
+	go func() {
+		p.CancelTasks()
+		close(canceled)
+	}()
+	select {
+	case <-canceled:
+		c.Fatalf("Tasks canceled while a task was still running.")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("Tasks not canceled after the running task returned.")
+	}
+	c.Assert(p.ScheduledTasks(p.Name()), HasLen, 0)
+}
+
 func (s *PluggerSuite) TestLDAP(c *C) {
 	p := s.plugger(nil, nil, nil)
 	conn := &ldapConn{}
@@ -319,6 +1034,8 @@ type ldapConn struct{}
 
 func (c *ldapConn) Close() error { return nil }
 
+func (c *ldapConn) WhoAmI() (string, error) { return "test-dn", nil }
+
 func (c *ldapConn) Search(s *ldap.Search) ([]ldap.Result, error) {
 	return []ldap.Result{{DN: "test-dn"}}, nil
 }
@@ -360,3 +1077,126 @@ func (s *PluggerSuite) TestTextLineBreak(c *C) {
 		s.sent = nil
 	}
 }
+
+func (s *PluggerSuite) TestTextMore(c *C) {
+	p := s.plugger(nil, nil, nil)
+	p.SetMore(2, time.Minute)
+
+	line := strings.Repeat("123456789 ", 30)[:299]
+	text := strings.Repeat("123456789 ", 150)
+
+	// Private texts are sent in full.
+	err := p.Send(&mup.Message{Account: "one", Nick: "nick", Text: text})
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, HasLen, 5)
+	s.sent = nil
+
+	err = p.Send(&mup.Message{Account: "one", Channel: "#chan", Nick: "nick", Text: text})
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@one] PRIVMSG #chan :" + line,
+		"[@one] PRIVMSG #chan :" + line,
+		"[@one] PRIVMSG #chan :Say \"more\" for the rest.",
+	})
+	s.sent = nil
+
+	// Only the nick the text was sent to may ask for more of it.
+	c.Assert(p.More(mup.ParseIncoming("one", "mup", "!", ":other!~user@host PRIVMSG #chan :more")), Equals, false)
+	c.Assert(p.More(mup.ParseIncoming("one", "mup", "!", ":nick!~user@host PRIVMSG #other :more")), Equals, false)
+	c.Assert(p.More(mup.ParseIncoming("one", "mup", "!", ":nick!~user@host PRIVMSG #chan :more please")), Equals, false)
+	c.Assert(s.sent, HasLen, 0)
+
+	c.Assert(p.More(mup.ParseIncoming("one", "mup", "!", ":nick!~user@host PRIVMSG #chan :more")), Equals, true)
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@one] PRIVMSG #chan :" + line,
+		"[@one] PRIVMSG #chan :" + line,
+		"[@one] PRIVMSG #chan :Say \"more\" for the rest.",
+	})
+	s.sent = nil
+
+	c.Assert(p.More(mup.ParseIncoming("one", "mup", "!", ":nick!~user@host PRIVMSG #chan :mup: more")), Equals, true)
+	c.Assert(s.sent, DeepEquals, []string{"[@one] PRIVMSG #chan :" + line})
+	s.sent = nil
+
+	c.Assert(p.More(mup.ParseIncoming("one", "mup", "!", ":nick!~user@host PRIVMSG #chan :more")), Equals, false)
+	c.Assert(s.sent, HasLen, 0)
+
+	// The prompt is translated into the locale of the message.
+	mup.RegisterCatalog("xm", map[string]string{`Say "more" for the rest.`: `Diga "more" para o resto.`})
+	err = p.Send(&mup.Message{Account: "one", Channel: "#chan", Nick: "nick", Locale: "xm", Text: text})
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, HasLen, 3)
+	c.Assert(s.sent[2], Equals, "[@one] PRIVMSG #chan :Diga \"more\" para o resto.")
+	s.sent = nil
+
+	// Text held back expires.
+	p.SetMore(2, time.Millisecond)
+	err = p.Send(&mup.Message{Account: "one", Channel: "#chan", Nick: "nick", Text: text})
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, HasLen, 3)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(p.More(mup.ParseIncoming("one", "mup", "!", ":nick!~user@host PRIVMSG #chan :more")), Equals, false)
+}
+
+func (s *PluggerSuite) TestTextPaste(c *C) {
+	var pasted []string
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, err := ioutil.ReadAll(req.Body)
+		c.Check(err, IsNil)
+		pasted = append(pasted, string(data))
+		auth = req.Header.Get("Authorization")
+		fmt.Fprintf(w, "http://paste.example.com/%d\n", len(pasted))
+	}))
+	defer server.Close()
+
+	p := s.plugger(nil, nil, nil)
+	p.SetPaste(server.URL, "sometoken", 2)
+
+	// Texts broken into up to two lines are sent as usual.
+	text := strings.Repeat("123456789 ", 30) + "A"
+	err := p.Send(&mup.Message{Account: "one", Nick: "nick", Text: text})
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, HasLen, 2)
+	c.Assert(pasted, HasLen, 0)
+	s.sent = nil
+
+	// Longer texts are uploaded, and a link is sent after the first line.
+	text = strings.Repeat("123456789 ", 90)
+	err = p.Send(&mup.Message{Account: "one", Nick: "nick", Text: text})
+	c.Assert(err, IsNil)
+	c.Assert(pasted, DeepEquals, []string{strings.TrimSpace(text)})
+	c.Assert(auth, Equals, "Bearer sometoken")
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@one] PRIVMSG nick :" + strings.Repeat("123456789 ", 30)[:299],
+		"[@one] PRIVMSG nick :Full text at http://paste.example.com/1",
+	})
+	s.sent = nil
+
+	// When the upload fails, the text is sent in full.
+	server.Close()
+	err = p.Send(&mup.Message{Account: "one", Nick: "nick", Text: text})
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, HasLen, 3)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*\[theplugin/label\] Cannot upload long message to paste service: .*`)
+}
+
+func (s *PluggerSuite) TestTextPasteTimeout(c *C) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	defer mup.SetPasteTimeout(50 * time.Millisecond)()
+	p := s.plugger(nil, nil, nil)
+	p.SetPaste(server.URL, "", 2)
+
+	// A slow paste service does not hold the text back for long.
+	text := strings.Repeat("123456789 ", 90)
+	err := p.Send(&mup.Message{Account: "one", Nick: "nick", Text: text})
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, HasLen, 3)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*\[theplugin/label\] Cannot upload long message to paste service: .*`)
+}
@@ -3,9 +3,13 @@ package mup
 import (
 	"bytes"
 	"fmt"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -20,6 +24,38 @@ type PluginSpec struct {
 	Help     string
 	Start    func(p *Plugger) Stopper
 	Commands schema.Commands
+
+	// Requires holds the names of registered plugins that, when enabled,
+	// must be started before this plugin is.
+	Requires []string
+
+	// Prefixes holds additional sigils that trigger the plugin commands
+	// in channel messages, in addition to addressing the bot by nick or
+	// via the account bang string (for example, "?" for "?define word").
+	// Each prefix may only be registered by a single plugin.
+	Prefixes []string
+
+	// RequiredConfig holds the names of config fields that must be set
+	// to non-empty values for the plugin to be started.
+	RequiredConfig []string
+
+	// Validate, if set, is called with the plugin's Plugger before the
+	// plugin is started, and may inspect its configuration via the
+	// Plugger.Config method. A non-nil error prevents the plugin from
+	// being started.
+	Validate func(p *Plugger) error
+
+	// Privileged allows the plugin to act on other plugins via the
+	// Plugger PluginLogs, CancelTask, and RestartPlugin methods. Other
+	// plugins may only retrieve their own logs and cancel their own
+	// tasks, and may not restart plugins.
+	Privileged bool
+
+	// Events enables delivering to the plugin the incoming messages that
+	// report events, such as edits of earlier messages. Plugins that do
+	// not enable it never observe such messages, so that they don't act
+	// again on edited messages as if they were new.
+	Events bool
 }
 
 // Stopper is implemented by types that can run arbitrary background
@@ -29,18 +65,43 @@ type Stopper interface {
 }
 
 // MessageHandler is implemented by plugins that can handle raw messages.
+// Besides PRIVMSG and NOTICE, these include other commands sent by the
+// server, such as the WALLOPS received by IRC accounts configured with
+// the "wallops" option.
 //
 // See CommandHandler.
 type MessageHandler interface {
 	HandleMessage(msg *Message)
 }
 
+// MembershipHandler is implemented by plugins that want to observe other
+// users joining and leaving channels, for example to greet newcomers.
+// HandleMembership is called with the JOIN, PART, and QUIT messages
+// received by IRC accounts, except for those reporting changes to the
+// bot itself, in addition to any HandleMessage call. JOIN and PART
+// messages have their Channel set, while QUIT messages have none, so
+// they are only delivered to plugins targeting the whole account.
+type MembershipHandler interface {
+	HandleMembership(msg *Message)
+}
+
 // OutgoingHandler is implemented by plugins that want to observe
 // outgoing messages being sent out by the bot.
 type OutgoingHandler interface {
 	HandleOutgoing(msg *Message)
 }
 
+// Reloader is implemented by plugins that can apply changes to their
+// configuration without being restarted, so that in-flight work such as
+// pending requests and scheduled tasks is preserved. When only the plugin
+// configuration changes, Reload is called with the new configuration, as
+// resolved for Plugger.Config, after the Plugger is updated to report it.
+// If Reload returns an error the plugin is stopped and restarted as usual,
+// which is also what happens to plugins that do not implement Reloader.
+type Reloader interface {
+	Reload(config bson.Raw) error
+}
+
 // CommandHandler is implemented by plugins that can handle commands.
 type CommandHandler interface {
 	HandleCommand(cmd *Command)
@@ -65,6 +126,18 @@ func (c *Command) Schema() *schema.Command {
 	return c.schema
 }
 
+// Address returns the address replies to the command are sent to. That's
+// the message address, except for commands marked as Private in their
+// schema, which are replied to privately when run in a channel. Telegram
+// chats cannot be addressed by nick, so replies there stay in the chat.
+func (c *Command) Address() Address {
+	a := c.Message.Address()
+	if c.schema != nil && c.schema.Private && a.Nick != "" && a.Host != "telegram" {
+		a.Channel = ""
+	}
+	return a
+}
+
 // Args unmarshals into result the command arguments parsed.
 // The unmarshaling is performed by the bson package.
 func (c *Command) Args(result interface{}) {
@@ -73,16 +146,42 @@ func (c *Command) Args(result interface{}) {
 
 var registeredPlugins = make(map[string]*PluginSpec)
 
+// registeredPrefixes maps command prefixes to the plugin that registered them.
+var registeredPrefixes = make(map[string]string)
+
+// registeredFrom maps plugin names to the source location that registered them.
+var registeredFrom = make(map[string]string)
+
 // RegisterPlugin registers with mup the plugin defined via the provided
 // specification, so that it may be loaded when configured to be.
+//
+// Registering the same plugin name twice panics, reporting the source
+// location of both registrations. That often means the package defining
+// the plugin is being imported via multiple import paths.
 func RegisterPlugin(spec *PluginSpec) {
 	if spec.Name == "" {
 		panic("cannot register plugin with an empty name")
 	}
+	from := "unknown location"
+	if _, file, line, ok := runtime.Caller(1); ok {
+		from = fmt.Sprintf("%s:%d", file, line)
+	}
 	if _, ok := registeredPlugins[spec.Name]; ok {
-		panic("plugin already registered: " + spec.Name)
+		panic(fmt.Sprintf("plugin %s registered at %s was already registered at %s (is its package imported via multiple paths?)", spec.Name, from, registeredFrom[spec.Name]))
+	}
+	for _, prefix := range spec.Prefixes {
+		if prefix == "" {
+			panic("plugin " + spec.Name + " cannot register an empty command prefix")
+		}
+		if owner, ok := registeredPrefixes[prefix]; ok {
+			panic(fmt.Sprintf("plugin %s cannot register command prefix %q already registered by plugin %s", spec.Name, prefix, owner))
+		}
+	}
+	for _, prefix := range spec.Prefixes {
+		registeredPrefixes[prefix] = spec.Name
 	}
 	registeredPlugins[spec.Name] = spec
+	registeredFrom[spec.Name] = from
 }
 
 type pluginInfo struct {
@@ -91,6 +190,38 @@ type pluginInfo struct {
 	Config  bson.Raw
 	Targets bson.Raw
 	State   bson.Raw
+
+	// Accounts optionally restricts the plugin to the named accounts.
+	// Messages from other accounts are not observed by the plugin, and
+	// targets for other accounts are ignored.
+	Accounts pluginAccounts `bson:",omitempty"`
+}
+
+// pluginAccounts holds the account names a plugin is restricted to.
+// Unlike a plain slice, it fails to unmarshal values other than lists
+// of names, so that malformed documents don't leave plugins observing
+// every account.
+type pluginAccounts []string
+
+func (a *pluginAccounts) SetBSON(raw bson.Raw) error {
+	if raw.Kind == 0x0A {
+		*a = nil
+		return nil
+	}
+	var values []interface{}
+	if raw.Kind != 0x04 || raw.Unmarshal(&values) != nil {
+		return fmt.Errorf("accounts must be a list of account names")
+	}
+	names := make(pluginAccounts, len(values))
+	for i, value := range values {
+		name, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("accounts must be a list of account names")
+		}
+		names[i] = name
+	}
+	*a = names
+	return nil
 }
 
 type pluginState struct {
@@ -98,6 +229,23 @@ type pluginState struct {
 	spec    *PluginSpec
 	plugger *Plugger
 	plugin  Stopper
+	seq     int
+
+	// replayId is the id of the last message the plugin manager handled
+	// before the plugin started. Messages up to it that are delivered to
+	// the plugin after a rollback are flagged as replays.
+	replayId bson.ObjectId
+}
+
+// stop stops the plugin and writes any documents it left buffered
+// in bulk collections.
+func (state *pluginState) stop() error {
+	state.plugger.cancel()
+	state.plugger.tasks.cancelAll(state.plugger.name)
+	state.plugger.removeHTTP()
+	err := state.plugin.Stop()
+	state.plugger.flushBulk()
+	return err
 }
 
 type ldapInfo struct {
@@ -123,9 +271,52 @@ type pluginManager struct {
 	rollback chan bson.ObjectId
 	plugins  map[string]*pluginState
 	ldaps    map[string]*ldapState
+	startSeq int
+	paster   *paster
+	pager    *pager
+	logs     *logCapture
+	http     *pluginHTTP
+	metrics  *pluginMetrics
+	tasks    *scheduler
+
+	// failed holds the documents last seen for plugins that failed to
+	// start or are not registered, so that they are only reported once
+	// per change.
+	failed map[string]*pluginInfo
+
+	// malformed holds the raw documents last seen for plugins that
+	// could not be unmarshalled, by _id, so that they are only reported
+	// once per change.
+	malformed map[string][]byte
+
+	// pending holds plugin changes waiting to settle before the running
+	// plugin is restarted, as defined by the RefreshSettle setting.
+	pending map[string]*pendingChange
+
+	// lastCommand holds when each "<account> <nick>" last ran a
+	// command, for enforcing the CommandCooldown setting.
+	lastCommand map[string]time.Time
+
+	// commandNames holds the names of the commands of all plugins in
+	// the database, including those run by other servers, as of the
+	// last refresh.
+	commandNames map[string]bool
+
+	// lastHandled is the id of the most recent incoming message
+	// handled, so that plugins started afterwards know which of the
+	// messages delivered to them are replays.
+	lastHandled bson.ObjectId
+
+	// overruns counts how many times the incoming collection wrapped
+	// past the last message handled by the tail iterator.
+	overruns      int
+	overrunsMutex sync.Mutex
 
 	ldapConns      map[string]*ldap.ManagedConn
 	ldapConnsMutex sync.Mutex
+
+	accounts      map[string]*accountInfo
+	accountsMutex sync.Mutex
 }
 
 func startPluginManager(config Config) (*pluginManager, error) {
@@ -137,15 +328,33 @@ func startPluginManager(config Config) (*pluginManager, error) {
 		requests: make(chan interface{}),
 		incoming: make(chan *Message),
 		rollback: make(chan bson.ObjectId),
+		paster:   newPaster(config),
+		pager:    newPager(config),
+		logs:     newLogCapture(config.PluginLogLines),
+		metrics:  newPluginMetrics(),
+		tasks:    newScheduler(),
+
+		failed:      make(map[string]*pluginInfo),
+		malformed:   make(map[string][]byte),
+		lastCommand: make(map[string]time.Time),
+		pending:     make(map[string]*pendingChange),
 	}
 	m.session = config.Database.Session.Copy()
 	m.database = config.Database.With(m.session)
 	m.outgoing = m.database.C("outgoing")
 	m.incomcol = m.database.C("incoming")
-	if err := createCollections(m.database); err != nil {
+	if err := createCollections(m.database, config.IncomingMaxBytes, config.OutgoingMaxBytes); err != nil {
 		logf("Cannot create collections: %v", err)
 		return nil, fmt.Errorf("cannot create collections: %v", err)
 	}
+	if config.HTTPAddr != "" {
+		var err error
+		m.http, err = startPluginHTTP(config.HTTPAddr, m.metrics)
+		if err != nil {
+			m.session.Close()
+			return nil, err
+		}
+	}
 	m.tomb.Go(m.loop)
 	return m, nil
 }
@@ -184,15 +393,60 @@ func (m *pluginManager) Refresh() {
 	}
 }
 
+type pluginRequestRestart struct {
+	name string
+	done chan error
+}
+
+// restartPlugin stops the named plugin and starts it again with its
+// information reloaded from the database, leaving other plugins alone.
+// It must not be called from the goroutine delivering messages to plugins,
+// and gives up if abort is closed before the request is accepted, so that
+// requesting plugins being stopped do not block the plugin manager.
+func (m *pluginManager) restartPlugin(name string, abort <-chan struct{}) error {
+	req := pluginRequestRestart{name, make(chan error, 1)}
+	select {
+	case m.requests <- req:
+		return <-req.done
+	case <-abort:
+		return fmt.Errorf("plugin restart aborted")
+	case <-m.tomb.Dying():
+		return fmt.Errorf("plugin manager is stopping")
+	}
+}
+
 func (m *pluginManager) die() {
+	var errs []string
+	var errsMutex sync.Mutex
+	stopPlugin := func(state *pluginState) {
+		err := state.stop()
+		if err != nil {
+			logf("Plugin %q stopped with an error: %v", state.info.Name, err)
+			errsMutex.Lock()
+			errs = append(errs, fmt.Sprintf("%s: %v", state.info.Name, err))
+			errsMutex.Unlock()
+		}
+	}
+
 	var wg sync.WaitGroup
-	wg.Add(len(m.plugins))
-	for _, state := range m.plugins {
-		stop := state.plugin.Stop
-		go func() {
-			stop()
-			wg.Done()
-		}()
+	if m.config.OrderedStop {
+		states := make([]*pluginState, 0, len(m.plugins))
+		for _, state := range m.plugins {
+			states = append(states, state)
+		}
+		sort.Sort(pluginsByStart(states))
+		for i := len(states) - 1; i >= 0; i-- {
+			stopPlugin(states[i])
+		}
+	} else {
+		wg.Add(len(m.plugins))
+		for _, state := range m.plugins {
+			state := state
+			go func() {
+				stopPlugin(state)
+				wg.Done()
+			}()
+		}
 	}
 
 	// Clean this up first so m.ldapConn will never get a connection
@@ -210,9 +464,25 @@ func (m *pluginManager) die() {
 		}()
 	}
 	wg.Wait()
-	m.tomb.Kill(errStop)
+	if m.http != nil {
+		if err := m.http.Stop(); err != nil {
+			logf("Plugin HTTP server failure: %v", err)
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		m.tomb.Kill(fmt.Errorf("plugins stopped with errors: %s", strings.Join(errs, "; ")))
+	} else {
+		m.tomb.Kill(errStop)
+	}
 }
 
+type pluginsByStart []*pluginState
+
+func (s pluginsByStart) Len() int           { return len(s) }
+func (s pluginsByStart) Less(i, j int) bool { return s[i].seq < s[j].seq }
+func (s pluginsByStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 func (m *pluginManager) updateKnown() {
 	known := m.database.C("plugins.known")
 	for name, spec := range registeredPlugins {
@@ -226,6 +496,27 @@ func (m *pluginManager) updateKnown() {
 	}
 }
 
+// KnownPlugin holds the name of a plugin known to the servers of a
+// mup instance, and the schema of the commands it supports.
+type KnownPlugin struct {
+	Name     string `bson:"_id"`
+	Commands schema.Commands
+}
+
+// KnownCommands returns the plugins known to the servers of the mup
+// instance using db, sorted by name, along with the schema of their
+// commands, so that external clients may offer completion and validation
+// of commands and their arguments. Plugins are known once a server that
+// may run them has started, whether or not they are enabled.
+func KnownCommands(db *mgo.Database) ([]KnownPlugin, error) {
+	var known []KnownPlugin
+	err := db.C("plugins.known").Find(nil).Sort("_id").All(&known)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list known commands: %v", err)
+	}
+	return known, nil
+}
+
 func (m *pluginManager) loop() error {
 	defer m.die()
 
@@ -237,7 +528,7 @@ func (m *pluginManager) loop() error {
 	m.tomb.Go(m.tail)
 
 	m.updateKnown()
-	m.handleRefresh()
+	m.handleRefresh(true)
 	var refresh <-chan time.Time
 	if m.config.Refresh > 0 {
 		ticker := time.NewTicker(m.config.Refresh)
@@ -253,38 +544,93 @@ func (m *pluginManager) loop() error {
 				continue
 			}
 			cmdName := schema.CommandName(msg.BotText)
+			skip := false
+			if cmdName != "" && m.busy(msg, cmdName) {
+				m.replyBusy(msg)
+				skip = true
+			} else if cmdName != "" && m.coolingDown(msg, cmdName) {
+				skip = true
+			}
+			if skip {
+				cmdName = ""
+			}
+			// Messages delivered again after a rollback were already
+			// considered for paging.
+			paged := false
+			if msg.Id > m.lastHandled {
+				paged = m.sendMore(msg)
+				m.lastHandled = msg.Id
+			}
 			for name, state := range m.plugins {
 				if state.info.LastId >= msg.Id || state.plugger.Target(msg) == nil {
 					continue
 				}
 				state.info.LastId = msg.Id
-				state.handle(msg, cmdName)
+				start := time.Now()
+				smsg := state.replayed(msg)
+				if pmsg := state.prefixed(smsg); pmsg != nil && !skip {
+					state.handle(pmsg, schema.CommandName(pmsg.BotText))
+				} else {
+					state.handle(smsg, cmdName)
+				}
+				m.addHandleTime(state, time.Since(start))
 				err := plugins.UpdateId(name, bson.D{{"$set", bson.D{{"lastid", msg.Id}}}})
 				if err != nil {
 					logf("Cannot update last message id for plugin %q: %v", name, err)
 					// TODO How to recover properly from this?
 				}
 			}
+			if m.config.UnknownCommands && !paged {
+				m.handleUnknown(msg, cmdName)
+			}
 		case req := <-m.requests:
 			switch req := req.(type) {
 			case pluginRequestStop:
 				return nil
 			case pluginRequestRefresh:
-				m.handleRefresh()
+				m.handleRefresh(true)
 				close(req.done)
+			case pluginRequestRestart:
+				req.done <- m.handleRestart(req.name)
 			default:
 				panic("unknown request received by plugin manager")
 			}
 		case <-refresh:
-			m.handleRefresh()
+			m.handleRefresh(false)
 		}
 	}
-	return nil
 }
 
-func (m *pluginManager) handleRefresh() {
+// handleRefresh reloads all plugin information from the database. Unless
+// forced, changes to running plugins are only acted on once settled.
+func (m *pluginManager) handleRefresh(force bool) {
+	m.refreshAccounts()
 	m.refreshLdaps()
-	m.refreshPlugins()
+	m.refreshPlugins(force)
+}
+
+func (m *pluginManager) refreshAccounts() {
+	var infos []accountInfo
+	err := m.database.C("accounts").Find(nil).All(&infos)
+	if err != nil {
+		logf("Cannot fetch account information from the database: %v", err)
+		return
+	}
+	accounts := make(map[string]*accountInfo, len(infos))
+	for i := range infos {
+		accounts[infos[i].Name] = &infos[i]
+	}
+	m.accountsMutex.Lock()
+	m.accounts = accounts
+	m.accountsMutex.Unlock()
+}
+
+// accountInfos returns the account information last loaded from the
+// database, by account name. The returned map must not be modified.
+func (m *pluginManager) accountInfos() map[string]*accountInfo {
+	m.accountsMutex.Lock()
+	defer m.accountsMutex.Unlock()
+	return m.accounts
 }
 
 func (m *pluginManager) refreshLdaps() {
@@ -362,8 +708,41 @@ func (m *pluginManager) refreshLdaps() {
 	}
 }
 
+type pendingChange struct {
+	info  pluginInfo
+	since time.Time
+}
+
+// settled returns whether the changes in info to a running plugin were
+// observed unchanged for at least the RefreshSettle duration.
+func (m *pluginManager) settled(info *pluginInfo) bool {
+	now := time.Now()
+	pending, ok := m.pending[info.Name]
+	if !ok || pluginChanged(&pending.info, info) {
+		if ok {
+			debugf("Plugin %q changed again. Waiting for changes to settle.", info.Name)
+		}
+		pending = &pendingChange{*info, now}
+		m.pending[info.Name] = pending
+	}
+	return now.Sub(pending.since) >= m.config.RefreshSettle
+}
+
 func pluginChanged(a, b *pluginInfo) bool {
-	return !bytes.Equal(a.Config.Data, b.Config.Data) || !bytes.Equal(a.Targets.Data, b.Targets.Data)
+	return !bytes.Equal(a.Config.Data, b.Config.Data) || !sameSetup(a, b)
+}
+
+// sameSetup returns whether a and b have the same targets and accounts.
+func sameSetup(a, b *pluginInfo) bool {
+	if len(a.Accounts) != len(b.Accounts) {
+		return false
+	}
+	for i := range a.Accounts {
+		if a.Accounts[i] != b.Accounts[i] {
+			return false
+		}
+	}
+	return bytes.Equal(a.Targets.Data, b.Targets.Data)
 }
 
 func (m *pluginManager) pluginOn(name string) bool {
@@ -378,16 +757,69 @@ func (m *pluginManager) pluginOn(name string) bool {
 	return false
 }
 
-func (m *pluginManager) refreshPlugins() {
+func (m *pluginManager) refreshPlugins(force bool) {
 	plugins := m.database.C("plugins")
 
+	// Documents are unmarshalled one at a time so that a single malformed
+	// document does not prevent all other plugins from running. A plugin
+	// already running under the name of a malformed document is left
+	// alone until the document is fixed or removed.
 	var infos []pluginInfo
-	err := plugins.Find(nil).Select(bson.D{{"commands", 0}}).All(&infos)
-	if err != nil {
+	var malformed = make(map[string]bool)
+	var seenMalformed = make(map[string][]byte)
+	var raw bson.Raw
+	iter := plugins.Find(nil).Select(bson.D{{"commands", 0}}).Iter()
+	for iter.Next(&raw) {
+		var info pluginInfo
+		err := raw.Unmarshal(&info)
+		if err == nil && info.Name == "" {
+			err = fmt.Errorf("_id must be a non-empty string")
+		}
+		if err != nil {
+			var id struct {
+				Id interface{} `bson:"_id"`
+			}
+			raw.Unmarshal(&id)
+			key := fmt.Sprintf("%#v", id.Id)
+			if last, ok := m.malformed[key]; !ok || !bytes.Equal(last, raw.Data) {
+				logf("Cannot unmarshal plugin document with _id %s: %v", key, err)
+			}
+			seenMalformed[key] = raw.Data
+			if name, ok := id.Id.(string); ok && name != "" {
+				malformed[name] = true
+			}
+			continue
+		}
+		infos = append(infos, info)
+	}
+	if iter.Err() != nil {
 		// TODO Reduce frequency of logged messages if the database goes down.
-		logf("Cannot fetch server information from the database: %v", err)
+		logf("Cannot fetch server information from the database: %v", iter.Err())
 		return
 	}
+	m.malformed = seenMalformed
+
+	commandNames := make(map[string]bool)
+	for i := range infos {
+		if spec, ok := registeredPlugins[pluginKey(infos[i].Name)]; ok {
+			for _, cmd := range spec.Commands {
+				commandNames[cmd.Name] = true
+			}
+		}
+	}
+	m.commandNames = commandNames
+
+	var enabled []pluginInfo
+	for i := range infos {
+		if m.pluginOn(infos[i].Name) {
+			enabled = append(enabled, infos[i])
+		}
+	}
+	infos, cyclic := orderPlugins(enabled)
+	for i := range cyclic {
+		spec := registeredPlugins[pluginKey(cyclic[i].Name)]
+		m.handleStartError(&cyclic[i], fmt.Errorf("cyclic dependencies (requires %s)", strings.Join(spec.Requires, ", ")))
+	}
 
 	// Start new plugins, and stop/restart updated ones.
 	var known = len(m.plugins)
@@ -396,36 +828,40 @@ func (m *pluginManager) refreshPlugins() {
 	var rollbackId bson.ObjectId
 	for i := range infos {
 		info := &infos[i]
-		if !m.pluginOn(info.Name) {
+		seen[info.Name] = true
+		if _, ok := registeredPlugins[pluginKey(info.Name)]; !ok {
+			m.handleStartError(info, fmt.Errorf("plugin %q not registered", pluginKey(info.Name)))
 			continue
 		}
-		seen[info.Name] = true
+		restarts := 0
 		if state, ok := m.plugins[info.Name]; ok {
 			found++
 			if !pluginChanged(&state.info, info) {
+				delete(m.pending, info.Name)
+				continue
+			}
+			if !force && !m.settled(info) {
+				continue
+			}
+			delete(m.pending, info.Name)
+			if m.reloadPlugin(state, info) {
 				continue
 			}
-			logf("Plugin %q config or targets changed. Stopping and restarting it.", info.Name)
-			err := state.plugin.Stop()
+			restarts = state.plugger.stats.Restarts + 1
+			logf("Plugin %q config or targets changed. Stopping and restarting it (restart #%d).", info.Name, restarts)
+			err := state.stop()
 			if err != nil {
 				logf("Plugin %q stopped with an error: %v", info.Name, err)
 			}
 			delete(m.plugins, info.Name)
-		} else {
+		} else if !m.failedBefore(info) {
 			logf("Plugin %q starting.", info.Name)
 		}
 
-		state, err := m.startPlugin(info)
+		state, err := m.runPlugin(info, restarts)
 		if err != nil {
-			logf("Plugin %q failed to start: %v", info.Name, err)
 			continue
 		}
-
-		err = plugins.UpdateId(info.Name, bson.D{{"$set", bson.D{{"commands", state.spec.Commands}}}})
-		if err != nil {
-			logf("Cannot update commands schema for plugin %q: %v", info.Name, err)
-		}
-
 		m.plugins[info.Name] = state
 		if rollbackId == "" || rollbackId > state.info.LastId {
 			rollbackId = state.info.LastId
@@ -436,39 +872,173 @@ func (m *pluginManager) refreshPlugins() {
 	// set of plugins, they must be stopped and removed.
 	if known != found {
 		for name, state := range m.plugins {
-			if seen[name] {
+			if seen[name] || malformed[name] {
 				continue
 			}
 			logf("Plugin %q removed. Stopping it.", state.info.Name)
-			err := state.plugin.Stop()
+			err := state.stop()
 			if err != nil {
 				logf("Plugin %q stopped with an error: %v", state.info.Name, err)
 			}
 			delete(m.plugins, name)
+			delete(m.pending, name)
+		}
+	}
+	for name := range m.failed {
+		if !seen[name] && !isCyclic(cyclic, name) {
+			delete(m.failed, name)
 		}
 	}
 
-	// If the last id observed by a plugin is older than the current
-	// position of the tail iterator, the iterator must be restarted
-	// at a previous position to avoid losing messages, so that plugins
-	// may be restarted at any point without losing incoming messages.
 	if rollbackId != "" {
-		// Wake up tail iterator by injecting a dummy message. The iterator
-		// won't be able to deliver this message because incoming is
-		// consumed by this goroutine after this method returns.
-		err := m.database.C("incoming").Insert(&Message{Command: cmdPong, Account: rollbackAccount, Text: rollbackText})
-		if err != nil {
-			logf("Cannot insert wake up message in incoming queue: %v", err)
-			return
+		m.rollbackTail(rollbackId)
+	}
+}
+
+// handleRestart stops the named plugin and starts it again with its
+// information reloaded from the database.
+func (m *pluginManager) handleRestart(name string) error {
+	state, ok := m.plugins[name]
+	if !ok {
+		return fmt.Errorf("plugin %q is not running", name)
+	}
+	var info pluginInfo
+	err := m.database.C("plugins").FindId(name).Select(bson.D{{"commands", 0}}).One(&info)
+	if err == mgo.ErrNotFound {
+		return fmt.Errorf("plugin %q not found in the database", name)
+	}
+	if err != nil {
+		logf("Cannot fetch plugin %q from the database: %v", name, err)
+		return fmt.Errorf("cannot fetch plugin %q from the database: %v", name, err)
+	}
+
+	restarts := state.plugger.stats.Restarts + 1
+	logf("Plugin %q restart requested. Stopping and restarting it (restart #%d).", name, restarts)
+	err = state.stop()
+	if err != nil {
+		logf("Plugin %q stopped with an error: %v", name, err)
+	}
+	delete(m.plugins, name)
+	delete(m.pending, name)
+
+	state, err = m.runPlugin(&info, restarts)
+	if err != nil {
+		return err
+	}
+	m.plugins[name] = state
+	m.rollbackTail(state.info.LastId)
+	return nil
+}
+
+// runPlugin starts the plugin described by info and records in the
+// database either the error preventing it from starting or the commands
+// it supports.
+func (m *pluginManager) runPlugin(info *pluginInfo, restarts int) (*pluginState, error) {
+	plugins := m.database.C("plugins")
+	state, err := m.startPlugin(info, restarts)
+	if err != nil {
+		m.handleStartError(info, err)
+		return nil, err
+	}
+	delete(m.failed, info.Name)
+	err = plugins.UpdateId(info.Name, bson.D{{"$set", bson.D{{"commands", state.spec.Commands}}}, {"$unset", bson.D{{"error", 1}}}})
+	if err != nil {
+		logf("Cannot update commands schema for plugin %q: %v", info.Name, err)
+	}
+	return state, nil
+}
+
+// rollbackTail moves the tail iterator back to rollbackId if its current
+// position is past it. If the last id observed by a plugin is older than
+// the current position of the tail iterator, the iterator must be restarted
+// at a previous position to avoid losing messages, so that plugins may be
+// restarted at any point without losing incoming messages.
+func (m *pluginManager) rollbackTail(rollbackId bson.ObjectId) {
+	// Wake up tail iterator by injecting a dummy message. The iterator
+	// won't be able to deliver this message because incoming is
+	// consumed by this goroutine after this method returns.
+	err := m.database.C("incoming").Insert(&Message{Command: cmdPong, Account: rollbackAccount, Text: rollbackText})
+	if err != nil {
+		logf("Cannot insert wake up message in incoming queue: %v", err)
+		return
+	}
+
+	// Send oldest observed id to the tail loop for a potential rollback.
+	select {
+	case m.rollback <- rollbackId:
+	case <-m.tomb.Dying():
+	}
+}
+
+// handleStartError reports that the plugin described by info failed to
+// start with err, unless that was already done for the same document.
+func (m *pluginManager) handleStartError(info *pluginInfo, err error) {
+	if m.failedBefore(info) {
+		return
+	}
+	m.failed[info.Name] = info
+	logf("Plugin %q failed to start: %v", info.Name, err)
+	err = m.database.C("plugins").UpdateId(info.Name, bson.D{{"$set", bson.D{{"error", err.Error()}}}})
+	if err != nil {
+		logf("Cannot record start error for plugin %q: %v", info.Name, err)
+	}
+}
+
+// failedBefore returns whether the plugin described by info already
+// failed to start with the same document.
+func (m *pluginManager) failedBefore(info *pluginInfo) bool {
+	last, ok := m.failed[info.Name]
+	return ok && !pluginChanged(last, info)
+}
+
+// orderPlugins returns infos sorted so that every plugin comes after the
+// plugins it requires, preserving the original order otherwise. Plugins
+// with cyclic dependencies are left out, and returned separately.
+func orderPlugins(infos []pluginInfo) (ordered, cyclic []pluginInfo) {
+	pending := make(map[string]int)
+	for i := range infos {
+		pending[pluginKey(infos[i].Name)]++
+	}
+	ordered = make([]pluginInfo, 0, len(infos))
+	done := make([]bool, len(infos))
+	for progress := true; progress; {
+		progress = false
+	NextPlugin:
+		for i := range infos {
+			if done[i] {
+				continue
+			}
+			key := pluginKey(infos[i].Name)
+			if spec, ok := registeredPlugins[key]; ok {
+				for _, name := range spec.Requires {
+					if pending[name] > 0 {
+						continue NextPlugin
+					}
+				}
+			}
+			ordered = append(ordered, infos[i])
+			done[i] = true
+			pending[key]--
+			progress = true
+		}
+	}
+	for i := range infos {
+		if !done[i] {
+			cyclic = append(cyclic, infos[i])
 		}
+	}
+	return ordered, cyclic
+}
 
-		// Send oldest observed id to the tail loop for a potential rollback.
-		select {
-		case m.rollback <- rollbackId:
-		case <-m.tomb.Dying():
-			return
+// isCyclic returns whether the named plugin is among the ones with
+// cyclic dependencies.
+func isCyclic(cyclic []pluginInfo, name string) bool {
+	for i := range cyclic {
+		if cyclic[i].Name == name {
+			return true
 		}
 	}
+	return false
 }
 
 // rollbackLimit defines how long messages can be waiting in the
@@ -486,7 +1056,7 @@ func pluginKey(pluginName string) string {
 	return pluginName
 }
 
-func (m *pluginManager) startPlugin(info *pluginInfo) (*pluginState, error) {
+func (m *pluginManager) startPlugin(info *pluginInfo, restarts int) (*pluginState, error) {
 	spec, ok := registeredPlugins[pluginKey(info.Name)]
 	if !ok {
 		logf("Plugin is not registered: %s", pluginKey(info.Name))
@@ -494,14 +1064,40 @@ func (m *pluginManager) startPlugin(info *pluginInfo) (*pluginState, error) {
 	}
 	plugger := newPlugger(info.Name, m.sendMessage, m.handleMessage, m.ldapConn)
 	plugger.setDatabase(m.database)
+	plugger.setAccounts(m.accountInfos)
 	plugger.setConfig(info.Config)
+	if m.config.DryRun {
+		plugger.setDryRun(true)
+	}
+	plugger.setPaster(m.paster)
+	plugger.setPager(m.pager)
+	plugger.setHTTP(m.http)
+	plugger.setMetrics(m.metrics)
+	plugger.setScheduler(m.tasks)
+	plugger.setRestart(m.restartPlugin)
+	plugger.setPrivileged(spec.Privileged)
+	plugger.setLDAPInfo(m.ldapStatus)
+	plugger.setLogCapture(m.logs)
+	plugger.setHandleTimeout(m.config.HandlerTimeout)
 	plugger.setTargets(info.Targets)
+	plugger.setAccountScope(info.Accounts)
+	plugger.setStats(PluginStats{Started: time.Now().UTC(), Restarts: restarts})
+	if err := plugger.resolveConfig(); err != nil {
+		return nil, err
+	}
+	if err := spec.validate(plugger); err != nil {
+		return nil, err
+	}
 	plugin := spec.Start(plugger)
+	m.startSeq++
 	state := &pluginState{
 		info:    *info,
 		spec:    spec,
 		plugger: plugger,
 		plugin:  plugin,
+		seq:     m.startSeq,
+
+		replayId: m.lastHandled,
 	}
 
 	lastId := bson.NewObjectIdWithTime(time.Now().Add(-rollbackLimit))
@@ -511,11 +1107,97 @@ func (m *pluginManager) startPlugin(info *pluginInfo) (*pluginState, error) {
 	return state, nil
 }
 
+// reloadPlugin applies the configuration in info to the running plugin
+// if only its configuration changed and it implements Reloader. It returns
+// whether the plugin was reloaded, and must be restarted otherwise.
+func (m *pluginManager) reloadPlugin(state *pluginState, info *pluginInfo) bool {
+	reloader, ok := state.plugin.(Reloader)
+	if !ok || !sameSetup(&state.info, info) {
+		return false
+	}
+	// Check the new configuration before touching the running plugin.
+	check := newPlugger(info.Name, nil, nil, nil)
+	check.setDatabase(m.database)
+	check.setConfig(info.Config)
+	if err := check.resolveConfig(); err != nil {
+		logf("Plugin %q cannot be reloaded: %v", info.Name, err)
+		return false
+	}
+	if err := state.spec.validate(check); err != nil {
+		logf("Plugin %q cannot be reloaded: %v", info.Name, err)
+		return false
+	}
+	logf("Plugin %q config changed. Reloading it.", info.Name)
+	state.plugger.setConfig(check.config)
+	if err := reloader.Reload(check.config); err != nil {
+		logf("Plugin %q failed to reload: %v", info.Name, err)
+		return false
+	}
+	state.info.Config = info.Config
+	return true
+}
+
+// validate checks the configuration of the plugin against the
+// requirements declared in its spec.
+func (spec *PluginSpec) validate(p *Plugger) error {
+	if len(spec.RequiredConfig) > 0 {
+		var config bson.M
+		if p.config.Kind != 0 {
+			p.config.Unmarshal(&config)
+		}
+		var missing []string
+		for _, name := range spec.RequiredConfig {
+			if isEmptyConfig(config[name]) {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("invalid configuration: missing required fields: %s", strings.Join(missing, ", "))
+		}
+	}
+	if spec.Validate != nil {
+		if err := spec.Validate(p); err != nil {
+			return fmt.Errorf("invalid configuration: %v", err)
+		}
+	}
+	return nil
+}
+
+func isEmptyConfig(value interface{}) bool {
+	switch value := value.(type) {
+	case nil:
+		return true
+	case string:
+		return value == ""
+	case []interface{}:
+		return len(value) == 0
+	case bson.M:
+		return len(value) == 0
+	}
+	return false
+}
+
 func (m *pluginManager) sendMessage(msg *Message) error {
 	if !m.tomb.Alive() {
 		panic("plugin attempted to send message after its Stop method returned")
 	}
-	return m.outgoing.Insert(msg)
+	return insertOutgoing(m.outgoing, msg)
+}
+
+// sendMore sends the next page of text held back for the sender of msg,
+// if msg asks for more of it, and reports whether that was the case.
+func (m *pluginManager) sendMore(msg *Message) bool {
+	if m.pager == nil {
+		return false
+	}
+	msgs := m.pager.more(msg)
+	for _, more := range msgs {
+		if err := insertOutgoing(m.outgoing, more); err != nil {
+			logf("Cannot put message in outgoing queue: %v", err)
+			break
+		}
+	}
+	return len(msgs) > 0
 }
 
 func (m *pluginManager) handleMessage(msg *Message) error {
@@ -541,6 +1223,42 @@ func (m *pluginManager) ldapConn(name string) (ldap.Conn, error) {
 	return nil, fmt.Errorf("LDAP connection %q not found", name)
 }
 
+// ldapStatus returns the state of all known LDAP connections.
+func (m *pluginManager) ldapStatus() []LDAPStatus {
+	m.ldapConnsMutex.Lock()
+	defer m.ldapConnsMutex.Unlock()
+	statuses := make([]LDAPStatus, 0, len(m.ldapConns))
+	for name, mconn := range m.ldapConns {
+		statuses = append(statuses, newLDAPStatus(name, mconn))
+	}
+	sort.Sort(ldapStatuses(statuses))
+	return statuses
+}
+
+// ldapHealther is implemented by LDAP connections that report their health,
+// such as *ldap.ManagedConn.
+type ldapHealther interface {
+	Health() (connected bool, err error)
+}
+
+func newLDAPStatus(name string, conn interface{}) LDAPStatus {
+	status := LDAPStatus{Name: name, Connected: true}
+	if h, ok := conn.(ldapHealther); ok {
+		var err error
+		status.Connected, err = h.Health()
+		if err != nil && !status.Connected {
+			status.LastError = err.Error()
+		}
+	}
+	return status
+}
+
+type ldapStatuses []LDAPStatus
+
+func (s ldapStatuses) Len() int           { return len(s) }
+func (s ldapStatuses) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s ldapStatuses) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
 const zeroId = bson.ObjectId("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
 
 func (m *pluginManager) tail() error {
@@ -553,6 +1271,11 @@ func (m *pluginManager) tail() error {
 
 	lastId := bson.NewObjectIdWithTime(time.Now().Add(-rollbackLimit))
 
+	// lastSeen reports whether lastId is the id of a message that was
+	// actually in the collection, so that its disappearance means the
+	// capped collection wrapped around before the tail caught up.
+	lastSeen := false
+
 NextTail:
 	for m.tomb.Alive() {
 
@@ -563,12 +1286,16 @@ NextTail:
 			if rollbackId < lastId {
 				logf("Rolling back tail iterator to consider older incoming messages.")
 				lastId = rollbackId
+				lastSeen = false
 			}
 		default:
 		}
 
 		// Prepare a new tailing iterator.
 		session.Refresh()
+		if lastSeen {
+			m.checkOverrun(incoming, lastId)
+		}
 		query := incoming.Find(bson.D{{"_id", bson.D{{"$gt", lastId}}}})
 		iter := query.Sort("$natural").Tail(2 * time.Second)
 
@@ -577,15 +1304,20 @@ NextTail:
 			var msg *Message
 			for iter.Next(&msg) {
 				debugf("[%s] Tail iterator got incoming message: %s", msg.Account, msg.String())
+				// The database hands times back in the local timezone.
+				msg.Time = msg.Time.UTC()
+				msg.dequeued = time.Now()
 			DeliverMsg:
 				select {
 				case m.incoming <- msg:
 					lastId = msg.Id
+					lastSeen = true
 					msg = nil
 				case rollbackId := <-m.rollback:
 					if rollbackId < lastId {
 						logf("Rolling back tail iterator to consider older incoming messages.")
 						lastId = rollbackId
+						lastSeen = false
 						iter.Close()
 						continue NextTail
 					}
@@ -613,27 +1345,261 @@ NextTail:
 	return nil
 }
 
+// addHandleTime accounts for d being spent by the plugin handling a message,
+// and logs when the plugin starts or stops being considered slow.
+func (m *pluginManager) addHandleTime(state *pluginState, d time.Duration) {
+	avg, slow, changed := state.plugger.addHandleTime(d, m.config.SlowHandler)
+	if !changed {
+		return
+	}
+	if slow {
+		logf("Plugin %q is slow: it takes %v on average to handle each message (limit is %v).", state.info.Name, avg, m.config.SlowHandler)
+	} else {
+		logf("Plugin %q is no longer slow: it takes %v on average to handle each message.", state.info.Name, avg)
+	}
+}
+
+// checkOverrun verifies whether the message with lastId is still available
+// in the incoming collection, logging a warning and accounting for the
+// overrun if the capped collection already discarded it. Messages inserted
+// between lastId and the oldest surviving message were never handled.
+func (m *pluginManager) checkOverrun(incoming *mgo.Collection, lastId bson.ObjectId) {
+	var oldest struct {
+		Id bson.ObjectId `bson:"_id"`
+	}
+	err := incoming.Find(nil).Sort("$natural").Select(bson.D{{"_id", 1}}).One(&oldest)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			logf("Cannot verify oldest message in incoming collection: %v", err)
+		}
+		return
+	}
+	if oldest.Id <= lastId {
+		return
+	}
+	m.overrunsMutex.Lock()
+	m.overruns++
+	m.overrunsMutex.Unlock()
+	logf("Incoming collection wrapped before messages were handled. Messages after %s and before %s were dropped. Consider increasing IncomingMaxBytes.",
+		lastId.Time().UTC().Format(time.RFC3339), oldest.Id.Time().UTC().Format(time.RFC3339))
+}
+
+// handleUnknown replies to msg if it was addressed to the bot with
+// a command name that is not known by any of the plugins.
+func (m *pluginManager) handleUnknown(msg *Message, cmdName string) {
+	if cmdName == "" || msg.AsNick == "" || msg.Event != "" || msg.Command != cmdPrivMsg {
+		return
+	}
+	if !commandLike(msg.BotText, cmdName) || m.commandNames[cmdName] {
+		return
+	}
+	m.replyf(msg, Translate(msg.Locale, "Unknown command: %s. Try 'help'."), cmdName)
+}
+
+// commandLike returns whether text starts with the word cmdName on its
+// own, as commands do, rather than followed by punctuation as in chat
+// such as "thanks!" or "hi, how are you?".
+func commandLike(text, cmdName string) bool {
+	rest := strings.TrimPrefix(strings.TrimLeftFunc(text, unicode.IsSpace), cmdName)
+	return rest == "" || unicode.IsSpace(rune(rest[0]))
+}
+
+// defaultBusyReply is sent when commands wait longer than the
+// server's BusyDelay setting and no BusyReply is configured.
+const defaultBusyReply = "I'm overloaded right now. Please try again soon."
+
+// busy returns whether msg holds the command named cmdName, addressed to
+// the bot, and waited longer than the server's BusyDelay setting to be
+// dispatched since it was taken from the queue. Messages that were queued
+// while the bot was down are not delayed by plugins, and neither are
+// unknown commands that would not run anyway.
+func (m *pluginManager) busy(msg *Message, cmdName string) bool {
+	if m.config.BusyDelay <= 0 || msg.AsNick == "" || msg.Event != "" || msg.Command != cmdPrivMsg || msg.dequeued.IsZero() {
+		return false
+	}
+	return time.Since(msg.dequeued) > m.config.BusyDelay && m.knownCommand(cmdName)
+}
+
+// knownCommand returns whether cmdName is a command of any running plugin.
+func (m *pluginManager) knownCommand(cmdName string) bool {
+	for _, state := range m.plugins {
+		if state.spec.Commands.Command(cmdName) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// replyBusy tells the sender of msg that its command was not run
+// because the bot is overloaded.
+func (m *pluginManager) replyBusy(msg *Message) {
+	reply := m.config.BusyReply
+	if reply == "" {
+		reply = defaultBusyReply
+	}
+	logf("[%s] Command from %s waited %v to be handled. Replying that the bot is busy.", msg.Account, msg.Nick, time.Since(msg.dequeued))
+	m.replyf(msg, "%s", Translate(msg.Locale, reply))
+}
+
+// coolingDown returns whether the sender of msg ran a command less than
+// the server's CommandCooldown setting ago, in which case the command
+// named cmdName must not run. Only commands in the schema of a running
+// plugin are limited and count towards the limit, unless they are marked
+// as Exempt there.
+func (m *pluginManager) coolingDown(msg *Message, cmdName string) bool {
+	if m.config.CommandCooldown <= 0 || msg.AsNick == "" || msg.Event != "" || msg.Command != cmdPrivMsg {
+		return false
+	}
+	known := false
+	for _, state := range m.plugins {
+		if cmd := state.spec.Commands.Command(cmdName); cmd != nil {
+			if cmd.Exempt {
+				return false
+			}
+			known = true
+		}
+	}
+	if !known {
+		return false
+	}
+	now := time.Now()
+	key := msg.Account + " " + msg.Nick
+	if last, ok := m.lastCommand[key]; ok && now.Sub(last) < m.config.CommandCooldown {
+		debugf("[%s] Command %q from %s is within the cooldown period. Ignoring it.", msg.Account, cmdName, msg.Nick)
+		return true
+	}
+	if len(m.lastCommand) >= 1024 {
+		for k, last := range m.lastCommand {
+			if now.Sub(last) >= m.config.CommandCooldown {
+				delete(m.lastCommand, k)
+			}
+		}
+	}
+	m.lastCommand[key] = now
+	return false
+}
+
+// replyf replies to msg on behalf of the bot itself rather than of
+// any particular plugin.
+func (m *pluginManager) replyf(msg *Message, format string, args ...interface{}) {
+	plugger := newPlugger("mup", m.sendMessage, m.handleMessage, m.ldapConn)
+	plugger.setAccounts(m.accountInfos)
+	plugger.setDryRun(m.config.DryRun)
+	plugger.Sendf(msg, format, args...)
+}
+
+// Overruns returns how many times the incoming capped collection wrapped
+// around before the tail iterator handled all of its messages.
+func (m *pluginManager) Overruns() int {
+	m.overrunsMutex.Lock()
+	defer m.overrunsMutex.Unlock()
+	return m.overruns
+}
+
 func (state *pluginState) handle(msg *Message, cmdName string) {
+	if msg.AsNick != "" && msg.Event != "" && !state.spec.Events {
+		return
+	}
+	if !state.plugger.matches(msg) {
+		return
+	}
+	msg, done := state.plugger.beginHandle(msg)
+	defer done()
 	if msg.AsNick == "" {
 		state.handleOutgoing(msg)
 	} else {
-		state.handleCommand(msg, cmdName)
+		if msg.Event == "" {
+			state.handleCommand(msg, cmdName)
+		}
 		state.handleMessage(msg)
+		state.handleMembership(msg)
 	}
 }
 
+// replayed returns msg, or a copy of it flagged as a replay if it was
+// handled before the plugin started.
+func (state *pluginState) replayed(msg *Message) *Message {
+	if msg.Id == "" || msg.Id > state.replayId {
+		return msg
+	}
+	copy := *msg
+	copy.Replay = true
+	return &copy
+}
+
+// prefixed returns a copy of msg with BotText set to the text following
+// one of the command prefixes registered by the plugin, or nil if msg is
+// not a channel message starting with one of them.
+func (state *pluginState) prefixed(msg *Message) *Message {
+	if msg.AsNick == "" || msg.BotText != "" || msg.Command != cmdPrivMsg {
+		return nil
+	}
+	for _, prefix := range state.spec.Prefixes {
+		pl := len(prefix)
+		if len(msg.Text) <= pl || msg.Text[:pl] != prefix {
+			continue
+		}
+		if r, _ := utf8.DecodeRuneInString(msg.Text[pl:]); unicode.IsLetter(r) {
+			copy := *msg
+			copy.BotText = msg.Text[pl:]
+			return &copy
+		}
+	}
+	return nil
+}
+
 func (state *pluginState) handleMessage(msg *Message) {
 	if handler, ok := state.plugin.(MessageHandler); ok {
 		handler.HandleMessage(msg)
 	}
 }
 
+func (state *pluginState) handleMembership(msg *Message) {
+	switch msg.Command {
+	case cmdJoin, cmdPart, cmdQuit:
+	default:
+		return
+	}
+	if msg.Nick == "" || msg.Nick == msg.AsNick {
+		return
+	}
+	if handler, ok := state.plugin.(MembershipHandler); ok {
+		handler.HandleMembership(msg)
+	}
+}
+
 func (state *pluginState) handleOutgoing(msg *Message) {
 	if handler, ok := state.plugin.(OutgoingHandler); ok {
 		handler.HandleOutgoing(msg)
 	}
 }
 
+// permDenied returns the reply explaining why the sender of msg may not
+// run a command requiring the perm permission level, or the empty string
+// if the command may be run. Bot admins, whose address matches one of the
+// "nick!user@host" masks in the account's "admins" setting, may run
+// commands of any level.
+func (state *pluginState) permDenied(msg *Message, perm schema.Perm) string {
+	if perm == schema.Anyone || state.isAdmin(msg) {
+		return ""
+	}
+	if perm == schema.ChannelOp {
+		if msg.ChannelOp {
+			return ""
+		}
+		return "Must be a channel operator for that."
+	}
+	return "Must be a bot admin for that."
+}
+
+func (state *pluginState) isAdmin(msg *Message) bool {
+	info := state.plugger.accountInfo(msg.Account)
+	if info == nil {
+		return false
+	}
+	return matchesHost(info.Admins, msg)
+}
+
 func (state *pluginState) handleCommand(msg *Message, cmdName string) {
 	if cmdName == "" {
 		return
@@ -646,17 +1612,21 @@ func (state *pluginState) handleCommand(msg *Message, cmdName string) {
 	if cmdSchema == nil {
 		return
 	}
-	args, err := cmdSchema.Parse(msg.BotText)
-	if err != nil {
-		state.plugger.Sendf(msg, "Oops: %v", err)
-		return
-	}
 	cmd := &Command{
 		Message: msg,
 		name:    cmdName,
 		schema:  cmdSchema,
-		args:    marshalRaw(args),
 	}
+	if denied := state.permDenied(msg, cmdSchema.Perm); denied != "" {
+		state.plugger.Sendf(cmd, "%s", Translate(msg.Locale, denied))
+		return
+	}
+	args, err := cmdSchema.Parse(msg.BotText)
+	if err != nil {
+		state.plugger.Sendf(cmd, Translate(msg.Locale, "Oops: %v. Usage: %s"), err, cmdSchema.Usage())
+		return
+	}
+	cmd.args = marshalRaw(args)
 	handler.HandleCommand(cmd)
 }
 
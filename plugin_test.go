@@ -1,8 +1,10 @@
 package mup_test
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	. "gopkg.in/check.v1"
 	"gopkg.in/mgo.v2/bson"
@@ -46,7 +48,7 @@ var pluginTests = []pluginTest{
 		recv: "",
 	}, {
 		send: "echoAcmd",
-		recv: "PRIVMSG nick :Oops: missing input for argument: text",
+		recv: "PRIVMSG nick :Oops: missing input for argument: text. Usage: echoAcmd <text ...>",
 	}, {
 		send:   "echoAcmd repeat",
 		recv:   "PRIVMSG nick :[cmd] [prefix] repeat",
@@ -90,6 +92,27 @@ var pluginTests = []pluginTest{
 	},
 }
 
+func (s *PluginSuite) TestPluginEvents(c *C) {
+	edit := mup.ParseIncoming("test", "mup", "!", ":nick!~user@host PRIVMSG mup :echoAmsg edited")
+	edit.Event = mup.EditEvent
+	edit.EventId = "42"
+
+	// Plugins only observe events when they enable them.
+	tester := mup.NewPluginTester("echoA")
+	tester.Start()
+	tester.Deliver(edit)
+	tester.Stop()
+	c.Assert(tester.Recv(), Equals, "")
+
+	edit.Text = "echoEmsg edited"
+	edit.BotText = edit.Text
+	tester = mup.NewPluginTester("echoE")
+	tester.Start()
+	tester.Deliver(edit)
+	tester.Stop()
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :[msg] edited")
+}
+
 func (s *PluginSuite) TestPlugin(c *C) {
 	for i, test := range pluginTests {
 		c.Logf("Testing message #%d: %s", i, test.send)
@@ -129,6 +152,9 @@ func init() {
 	for _, c := range "ABCD" {
 		mup.RegisterPlugin(pluginSpec("echo" + string(c)))
 	}
+	spec := pluginSpec("echoE")
+	spec.Events = true
+	mup.RegisterPlugin(spec)
 }
 
 type testPlugin struct {
@@ -136,6 +162,7 @@ type testPlugin struct {
 	config  struct {
 		Prefix      string
 		ShowCmdName bool
+		ShowReplay  bool
 	}
 }
 
@@ -160,11 +187,14 @@ func (p *testPlugin) HandleMessage(msg *mup.Message) {
 func (p *testPlugin) HandleCommand(cmd *mup.Command) {
 	var args struct{ Text string }
 	cmd.Args(&args)
+	prefix := "[cmd] "
 	if p.config.ShowCmdName {
-		p.echo(cmd, fmt.Sprintf("[cmd:%s] ", cmd.Name()), args.Text)
-	} else {
-		p.echo(cmd, "[cmd] ", args.Text)
+		prefix = fmt.Sprintf("[cmd:%s] ", cmd.Name())
+	}
+	if p.config.ShowReplay && cmd.Replay {
+		prefix += "[replay] "
 	}
+	p.echo(cmd, prefix, args.Text)
 }
 
 func (p *testPlugin) HandleOutgoing(msg *mup.Message) {
@@ -177,3 +207,113 @@ func (p *testPlugin) echo(to mup.Addressable, prefix, text string) {
 	}
 	p.plugger.Sendf(to, "%s%s", prefix, text)
 }
+
+var testCtxSpec = mup.PluginSpec{
+	Name:  "testctx",
+	Start: testCtxStart,
+	Commands: schema.Commands{
+		{Name: "keep"},
+		{Name: "check"},
+		{Name: "wait"},
+	},
+}
+
+func init() {
+	mup.RegisterPlugin(&testCtxSpec)
+}
+
+// testCtxWaited receives the error of the context observed by the
+// "wait" command of the testctx plugin once it is done.
+var testCtxWaited = make(chan error, 1)
+
+type testCtxPlugin struct {
+	plugger *mup.Plugger
+	kept    context.Context
+}
+
+func testCtxStart(plugger *mup.Plugger) mup.Stopper {
+	return &testCtxPlugin{plugger: plugger}
+}
+
+func (p *testCtxPlugin) Stop() error {
+	return nil
+}
+
+func (p *testCtxPlugin) HandleCommand(cmd *mup.Command) {
+	ctx := cmd.Context()
+	switch cmd.Name() {
+	case "keep":
+		p.kept = ctx
+		p.plugger.Sendf(cmd, "Kept: %v", ctx.Err())
+	case "check":
+		p.plugger.Sendf(cmd, "Kept: %v", p.kept.Err())
+	case "wait":
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+		testCtxWaited <- ctx.Err()
+	}
+}
+
+var testPrefixSpec = mup.PluginSpec{
+	Name:     "testprefix",
+	Prefixes: []string{"~"},
+	Start: func(plugger *mup.Plugger) mup.Stopper {
+		return &testPrefixPlugin{plugger}
+	},
+}
+
+func init() {
+	mup.RegisterPlugin(&testPrefixSpec)
+}
+
+type testPrefixPlugin struct {
+	plugger *mup.Plugger
+}
+
+func (p *testPrefixPlugin) Stop() error {
+	return nil
+}
+
+func (p *testPrefixPlugin) HandleMessage(msg *mup.Message) {
+	if msg.BotText != "" {
+		p.plugger.Sendf(msg, "BotText: %s", msg.BotText)
+	}
+}
+
+func (s *PluginSuite) TestPrefixLetter(c *C) {
+	tester := mup.NewPluginTester("testprefix")
+	tester.Start()
+	tester.Sendf("[#chan] ~hello")
+	tester.Sendf("[#chan] ~שלום")
+	tester.Sendf("[#chan] ~€uro")
+	tester.Sendf("[#chan] ~ hello")
+	tester.Stop()
+	c.Assert(tester.RecvAll(), DeepEquals, []string{
+		"PRIVMSG #chan :nick: BotText: hello",
+		"PRIVMSG #chan :nick: BotText: שלום",
+	})
+}
+
+func (s *PluginSuite) TestHandleContext(c *C) {
+	tester := mup.NewPluginTester("testctx")
+	tester.Start()
+
+	// The context is cancelled once the message is handled.
+	tester.Sendf("keep")
+	tester.Sendf("check")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :Kept: <nil>")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :Kept: context canceled")
+
+	// The context is cancelled when the plugin is stopped mid-handle.
+	done := make(chan bool)
+	go func() {
+		tester.Sendf("wait")
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	tester.Stop()
+	<-done
+	c.Assert(<-testCtxWaited, Equals, context.Canceled)
+}
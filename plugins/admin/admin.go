@@ -3,6 +3,8 @@ package admin
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/mgo.v2"
@@ -18,6 +20,8 @@ var Plugin = mup.PluginSpec{
 	Help:     "Exposes the bot administration commands.",
 	Start:    start,
 	Commands: Commands,
+
+	Privileged: true,
 }
 
 var Commands = schema.Commands{{
@@ -49,6 +53,81 @@ var Commands = schema.Commands{{
 		Name: "text",
 		Flag: schema.Required | schema.Trailing,
 	}},
+}, {
+	Name: "ldapwhoami",
+	Help: `Verifies that the named LDAP connection is able to authenticate.
+
+	Reports the authorization identity the LDAP server holds for the
+	connection, such as "dn:cn=mup,dc=example,dc=com", or the error observed.
+	`,
+	Args: schema.Args{{
+		Name: "name",
+		Flag: schema.Required,
+	}},
+}, {
+	Name: "ldapstatus",
+	Help: `Reports the state of the configured LDAP connections.
+
+	Shows whether each connection is currently established with its LDAP
+	server and, if not, the last error observed, which helps diagnosing
+	directory outages.
+	`,
+}, {
+	Name: "logs",
+	Help: `Shows the most recent messages logged by the named plugin.
+
+	Log lines are only kept when the server has PluginLogLines set, and
+	are always sent privately.
+	`,
+	Args: schema.Args{{
+		Name: "plugin",
+		Flag: schema.Required,
+	}},
+}, {
+	Name: "reload",
+	Help: `Stops the named plugin and starts it again.
+
+	The plugin configuration and targets are read again from the database,
+	and no other plugins are affected.
+	`,
+	Args: schema.Args{{
+		Name: "plugin",
+		Flag: schema.Required,
+	}},
+}, {
+	Name: "tasks",
+	Help: `Lists the pending tasks scheduled by the named plugin.
+
+	Each task is reported with the id that may be provided to the
+	canceltask command, its description, and when it is due.
+	`,
+	Args: schema.Args{{
+		Name: "plugin",
+		Flag: schema.Required,
+	}},
+}, {
+	Name: "canceltask",
+	Help: "Cancels a pending task scheduled by the named plugin.",
+	Args: schema.Args{{
+		Name: "plugin",
+		Flag: schema.Required,
+	}, {
+		Name: "id",
+		Flag: schema.Required,
+	}},
+}, {
+	Name: "status",
+	Help: `Reports the state of the IRC connection of accounts.
+
+	Shows whether each account is connected, registered, or disconnected,
+	along with its current nick, acknowledged capabilities, joined channels,
+	and the last error observed. If an account name is not provided, all
+	known accounts are reported.
+	`,
+	Args: schema.Args{{
+		Name: "account",
+	}},
+	Exempt: true,
 }}
 
 func init() {
@@ -66,6 +145,7 @@ const (
 type adminPlugin struct {
 	plugger *mup.Plugger
 	logins  map[string]userKind
+	reloads sync.WaitGroup
 }
 
 func start(plugger *mup.Plugger) mup.Stopper {
@@ -76,6 +156,7 @@ func start(plugger *mup.Plugger) mup.Stopper {
 }
 
 func (p *adminPlugin) Stop() error {
+	p.reloads.Wait()
 	return nil
 }
 
@@ -94,6 +175,20 @@ func (p *adminPlugin) HandleCommand(cmd *mup.Command) {
 		p.login(cmd)
 	case "sendraw":
 		p.sendraw(cmd)
+	case "ldapwhoami":
+		p.ldapWhoAmI(cmd)
+	case "ldapstatus":
+		p.ldapStatus(cmd)
+	case "logs":
+		p.logs(cmd)
+	case "reload":
+		p.reload(cmd)
+	case "tasks":
+		p.tasks(cmd)
+	case "canceltask":
+		p.cancelTask(cmd)
+	case "status":
+		p.status(cmd)
 	default:
 		p.plugger.Sendf(cmd, "I have a bug. Command %q exists and I don't know how to handle it.", cmd.Name())
 	}
@@ -270,3 +365,174 @@ func (p *adminPlugin) sendraw(cmd *mup.Command) {
 	p.plugger.Send(mup.ParseOutgoing(args.Account, args.Text))
 	p.plugger.Sendf(cmd, "Done.")
 }
+
+func (p *adminPlugin) ldapWhoAmI(cmd *mup.Command) {
+	if !p.checkLogin(cmd, adminUser) {
+		return
+	}
+
+	var args struct{ Name string }
+	cmd.Args(&args)
+	conn, err := p.plugger.LDAP(args.Name)
+	if err != nil {
+		p.plugger.Sendf(cmd, "Cannot use LDAP connection %q: %v", args.Name, err)
+		return
+	}
+	defer conn.Close()
+	authzId, err := conn.WhoAmI()
+	if err != nil {
+		p.plugger.Sendf(cmd, "LDAP connection %q failed: %v", args.Name, err)
+	} else if authzId == "" {
+		p.plugger.Sendf(cmd, "LDAP connection %q is bound anonymously.", args.Name)
+	} else {
+		p.plugger.Sendf(cmd, "LDAP connection %q is bound as %s.", args.Name, authzId)
+	}
+}
+
+func (p *adminPlugin) ldapStatus(cmd *mup.Command) {
+	if !p.checkLogin(cmd, adminUser) {
+		return
+	}
+
+	statuses := p.plugger.LDAPStatus()
+	if len(statuses) == 0 {
+		p.plugger.Sendf(cmd, "No LDAP connections configured.")
+		return
+	}
+	for _, status := range statuses {
+		switch {
+		case status.Connected:
+			p.plugger.Sendf(cmd, "%s: connected", status.Name)
+		case status.LastError != "":
+			p.plugger.Sendf(cmd, "%s: disconnected, last error: %s", status.Name, status.LastError)
+		default:
+			p.plugger.Sendf(cmd, "%s: disconnected", status.Name)
+		}
+	}
+}
+
+func (p *adminPlugin) logs(cmd *mup.Command) {
+	if !p.checkLogin(cmd, adminUser) {
+		return
+	}
+
+	var args struct{ Plugin string }
+	cmd.Args(&args)
+	lines, ok := p.plugger.PluginLogs(args.Plugin)
+	if !ok {
+		p.plugger.Sendf(cmd, "Plugin log capture is disabled.")
+		return
+	}
+	if len(lines) == 0 {
+		p.plugger.SendDirectf(cmd, "No recent logs for plugin %q.", args.Plugin)
+		return
+	}
+	for _, line := range lines {
+		p.plugger.SendDirectf(cmd, "%s", line)
+	}
+}
+
+func (p *adminPlugin) reload(cmd *mup.Command) {
+	if !p.checkLogin(cmd, adminUser) {
+		return
+	}
+
+	var args struct{ Plugin string }
+	cmd.Args(&args)
+	if args.Plugin == p.plugger.Name() {
+		// Stopping this plugin waits for pending reloads.
+		p.plugger.Sendf(cmd, "Cannot reload plugin %q from itself.", args.Plugin)
+		return
+	}
+
+	// The plugin manager can only restart the plugin after this
+	// command is handled, so wait for it in the background.
+	p.reloads.Add(1)
+	go func() {
+		defer p.reloads.Done()
+		if err := p.plugger.RestartPlugin(args.Plugin); err != nil {
+			p.plugger.Sendf(cmd, "Cannot reload plugin %q: %v", args.Plugin, err)
+		} else {
+			p.plugger.Sendf(cmd, "Plugin %q reloaded.", args.Plugin)
+		}
+	}()
+}
+
+func (p *adminPlugin) tasks(cmd *mup.Command) {
+	if !p.checkLogin(cmd, adminUser) {
+		return
+	}
+
+	var args struct{ Plugin string }
+	cmd.Args(&args)
+	tasks := p.plugger.ScheduledTasks(args.Plugin)
+	if len(tasks) == 0 {
+		p.plugger.Sendf(cmd, "No scheduled tasks for plugin %q.", args.Plugin)
+		return
+	}
+	now := time.Now()
+	for _, task := range tasks {
+		due := (task.Due.Sub(now) + 30*time.Second) / time.Minute * time.Minute
+		p.plugger.Sendf(cmd, "%s: %s (in %s)", task.Id, task.Description, due)
+	}
+}
+
+func (p *adminPlugin) cancelTask(cmd *mup.Command) {
+	if !p.checkLogin(cmd, adminUser) {
+		return
+	}
+
+	var args struct{ Plugin, Id string }
+	cmd.Args(&args)
+	if p.plugger.CancelTask(args.Plugin, args.Id) {
+		p.plugger.Sendf(cmd, "Task %s of plugin %q canceled.", args.Id, args.Plugin)
+	} else {
+		p.plugger.Sendf(cmd, "Task %s of plugin %q not found.", args.Id, args.Plugin)
+	}
+}
+
+func (p *adminPlugin) status(cmd *mup.Command) {
+	if !p.checkLogin(cmd, adminUser) {
+		return
+	}
+
+	var args struct{ Account string }
+	cmd.Args(&args)
+
+	statuses, err := p.plugger.AccountStatus(args.Account)
+	if err != nil {
+		p.plugger.Logf("Cannot fetch account status: %v", err)
+		p.plugger.Sendf(cmd, "Oops: cannot fetch account status: %v", err)
+		return
+	}
+	if len(statuses) == 0 {
+		if args.Account != "" {
+			p.plugger.Sendf(cmd, "No status known for account %q.", args.Account)
+		} else {
+			p.plugger.Sendf(cmd, "No account status known.")
+		}
+		return
+	}
+	for _, status := range statuses {
+		p.plugger.Sendf(cmd, "%s", formatStatus(&status))
+	}
+}
+
+func formatStatus(status *mup.AccountStatus) string {
+	parts := []string{status.Name + ": " + status.State}
+	if status.State != "disconnected" {
+		if status.Nick != "" {
+			parts[0] += " as " + status.Nick
+		}
+		if len(status.Channels) > 0 {
+			parts = append(parts, "channels: "+strings.Join(status.Channels, " "))
+		}
+		if len(status.Caps) > 0 {
+			parts = append(parts, "caps: "+strings.Join(status.Caps, " "))
+		}
+	}
+	if status.LastError != "" {
+		parts = append(parts, "last error: "+status.LastError)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -8,6 +8,7 @@ import (
 	. "gopkg.in/check.v1"
 	"gopkg.in/mgo.v2/dbtest"
 	"gopkg.in/mup.v0"
+	"gopkg.in/mup.v0/ldap"
 	"gopkg.in/mup.v0/plugins/admin"
 )
 
@@ -43,7 +44,9 @@ type adminTest struct {
 	send    []string
 	recv    []string
 	users   []userInfo
+	status  []mup.AccountStatus
 	login   bool
+	tasks   []string
 }
 
 var adminTests = []adminTest{
@@ -212,7 +215,7 @@ var adminTests = []adminTest{
 
 	{
 		send: []string{"sendraw"},
-		recv: []string{"PRIVMSG nick :Oops: missing input for argument: text"},
+		recv: []string{"PRIVMSG nick :Oops: missing input for argument: text. Usage: sendraw [-account=<string>] <text ...>"},
 	}, {
 		send: []string{"sendraw PRIVMSG foo :text"},
 		recv: []string{"PRIVMSG nick :Must login for that."},
@@ -225,6 +228,142 @@ var adminTests = []adminTest{
 		send:  []string{"sendraw -account=other PRIVMSG bar :text"},
 		recv:  []string{"[@other] PRIVMSG bar :text", "PRIVMSG nick :Done."},
 	},
+
+	{
+		send: []string{"ldapwhoami test"},
+		recv: []string{"PRIVMSG nick :Must login for that."},
+	}, {
+		login: true,
+		send:  []string{"ldapwhoami test"},
+		recv:  []string{"PRIVMSG nick :LDAP connection \"test\" is bound as dn:cn=bot,dc=example,dc=com."},
+	}, {
+		login: true,
+		send:  []string{"ldapwhoami anon"},
+		recv:  []string{"PRIVMSG nick :LDAP connection \"anon\" is bound anonymously."},
+	}, {
+		login: true,
+		send:  []string{"ldapwhoami broken"},
+		recv:  []string{"PRIVMSG nick :LDAP connection \"broken\" failed: cannot bind to LDAP server: invalid credentials"},
+	}, {
+		login: true,
+		send:  []string{"ldapwhoami unknown"},
+		recv:  []string{"PRIVMSG nick :Cannot use LDAP connection \"unknown\": LDAP connection \"unknown\" not found"},
+	},
+
+	{
+		send: []string{"ldapstatus"},
+		recv: []string{"PRIVMSG nick :Must login for that."},
+	}, {
+		login: true,
+		send:  []string{"ldapstatus"},
+		recv: []string{
+			"PRIVMSG nick :anon: connected",
+			"PRIVMSG nick :broken: disconnected, last error: cannot bind to LDAP server: invalid credentials",
+			"PRIVMSG nick :test: connected",
+		},
+	},
+
+	{
+		send: []string{"logs echo"},
+		recv: []string{"PRIVMSG nick :Must login for that."},
+	}, {
+		login: true,
+		send:  []string{"logs echo"},
+		recv:  []string{"PRIVMSG nick :12:00:00 First line.", "PRIVMSG nick :12:00:01 Second line."},
+	}, {
+		login: true,
+		send:  []string{"logs other"},
+		recv:  []string{"PRIVMSG nick :No recent logs for plugin \"other\"."},
+	},
+
+	{
+		send: []string{"reload echo"},
+		recv: []string{"PRIVMSG nick :Must login for that."},
+	}, {
+		login: true,
+		send:  []string{"reload echo"},
+		recv:  []string{"PRIVMSG nick :Cannot reload plugin \"echo\": cannot restart plugins: no plugin manager available"},
+	}, {
+		login: true,
+		send:  []string{"reload admin"},
+		recv:  []string{"PRIVMSG nick :Cannot reload plugin \"admin\" from itself."},
+	},
+
+	{
+		send: []string{"tasks admin"},
+		recv: []string{"PRIVMSG nick :Must login for that."},
+	}, {
+		login: true,
+		send:  []string{"tasks admin"},
+		recv:  []string{"PRIVMSG nick :No scheduled tasks for plugin \"admin\"."},
+	}, {
+		login: true,
+		tasks: []string{"Remind alice", "Remind bob"},
+		send:  []string{"tasks admin", "tasks echo"},
+		recv: []string{
+			"PRIVMSG nick :1: Remind alice (in 1h0m0s)",
+			"PRIVMSG nick :2: Remind bob (in 2h0m0s)",
+			"PRIVMSG nick :No scheduled tasks for plugin \"echo\".",
+		},
+	}, {
+		send: []string{"canceltask admin 1"},
+		recv: []string{"PRIVMSG nick :Must login for that."},
+	}, {
+		login: true,
+		tasks: []string{"Remind alice", "Remind bob"},
+		send:  []string{"canceltask admin 1", "canceltask admin 1", "canceltask echo 2", "tasks admin"},
+		recv: []string{
+			"PRIVMSG nick :Task 1 of plugin \"admin\" canceled.",
+			"PRIVMSG nick :Task 1 of plugin \"admin\" not found.",
+			"PRIVMSG nick :Task 2 of plugin \"echo\" not found.",
+			"PRIVMSG nick :2: Remind bob (in 2h0m0s)",
+		},
+	},
+
+	{
+		send: []string{"status"},
+		recv: []string{"PRIVMSG nick :Must login for that."},
+	}, {
+		login: true,
+		send:  []string{"status"},
+		recv:  []string{"PRIVMSG nick :No account status known."},
+	}, {
+		login: true,
+		status: []mup.AccountStatus{{
+			Name:     "one",
+			State:    "registered",
+			Nick:     "mup",
+			Caps:     []string{"sasl"},
+			Channels: []string{"#one", "#two"},
+		}, {
+			Name:      "two",
+			State:     "disconnected",
+			Nick:      "mup_",
+			Channels:  []string{"#three"},
+			LastError: "Closing Link: mup (Banned)",
+		}},
+		send: []string{"status"},
+		recv: []string{
+			"PRIVMSG nick :one: registered as mup, channels: #one #two, caps: sasl",
+			"PRIVMSG nick :two: disconnected, last error: Closing Link: mup (Banned)",
+		},
+	}, {
+		login: true,
+		status: []mup.AccountStatus{{
+			Name:      "one",
+			State:     "connected",
+			LastError: "read: connection reset by peer",
+		}, {
+			Name:  "two",
+			State: "registered",
+			Nick:  "mup",
+		}},
+		send: []string{"status one", "status three"},
+		recv: []string{
+			"PRIVMSG nick :one: connected, last error: read: connection reset by peer",
+			"PRIVMSG nick :No status known for account \"three\".",
+		},
+	},
 }
 
 // Data for "thesecret"
@@ -266,6 +405,13 @@ func (s *AdminSuite) testAdmin(c *C, test *adminTest) {
 
 	tester := mup.NewPluginTester("admin")
 	tester.SetDatabase(db)
+	tester.SetLDAP("test", ldapConn{dn: "dn:cn=bot,dc=example,dc=com"})
+	tester.SetLDAP("anon", ldapConn{})
+	tester.SetLDAP("broken", ldapConn{err: fmt.Errorf("cannot bind to LDAP server: invalid credentials")})
+	tester.SetPluginLogs("echo", []string{"12:00:00 First line.", "12:00:01 Second line."})
+	for i, task := range test.tasks {
+		tester.Plugger().Schedule(time.Duration(i+1)*time.Hour, task, func() {})
+	}
 
 	now := time.Now()
 	for _, user := range test.users {
@@ -280,6 +426,10 @@ func (s *AdminSuite) testAdmin(c *C, test *adminTest) {
 		err := users.Insert(user)
 		c.Assert(err, IsNil)
 	}
+	for _, status := range test.status {
+		err := db.C("accountstatus").Insert(status)
+		c.Assert(err, IsNil)
+	}
 	if test.login && len(test.users) == 0 {
 		err := users.Insert(testUser)
 		c.Assert(err, IsNil)
@@ -296,3 +446,16 @@ func (s *AdminSuite) testAdmin(c *C, test *adminTest) {
 	tester.Stop()
 	c.Assert(tester.RecvAll(), DeepEquals, test.recv)
 }
+
+type ldapConn struct {
+	dn  string
+	err error
+}
+
+func (l ldapConn) Search(s *ldap.Search) ([]ldap.Result, error) { return nil, nil }
+
+func (l ldapConn) Close() error { return nil }
+
+func (l ldapConn) WhoAmI() (string, error) { return l.dn, l.err }
+
+func (l ldapConn) Health() (bool, error) { return l.err == nil, l.err }
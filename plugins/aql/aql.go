@@ -300,7 +300,6 @@ func (p *aqlPlugin) poll() error {
 			}
 		}
 	}
-	return nil
 }
 
 func (p *aqlPlugin) receiveSMS(conn ldap.Conn, sms *smsMessage) {
@@ -350,7 +349,7 @@ func (p *aqlPlugin) receiveSMS(conn ldap.Conn, sms *smsMessage) {
 			continue
 		}
 		msg.Account = a.Account
-		p.plugger.Logf("[%s] Delivering SMS from %s (%s) to %s: %s\n", msg.Account, sender, sms.Sender, target, text)
+		p.plugger.Logf("[%s] Delivering SMS from %s (%s) to %s: %s\n", msg.Account, sender, sms.Sender, &target, text)
 		err = p.plugger.Send(msg)
 		if err == nil && !strings.HasPrefix(sender, "+") {
 			p.plugger.Sendf(msg, "Answer with: !sms %s <your message>", sender)
@@ -369,7 +368,7 @@ func (p *aqlPlugin) deleteSMS(sms *smsMessage) error {
 	}
 	resp, err := httpClient.PostForm(p.config.AQLProxy+"/delete", form)
 	if err != nil {
-		p.plugger.Logf("Cannot delete SMS message %s: %v", sms.Key, err)
+		p.plugger.Logf("Cannot delete SMS message %d: %v", sms.Key, err)
 		return err
 	}
 	p.plugger.Logf("Delete accepted for %v.", sms.Key)
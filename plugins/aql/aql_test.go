@@ -116,6 +116,20 @@ func (s *S) TearDownTest(c *C) {
 	mup.SetDebug(false)
 }
 
+func (s *S) TestStopPromptly(c *C) {
+	tester := mup.NewPluginTester("aql")
+	tester.SetConfig(bson.M{"polldelay": "1h"})
+	tester.Start()
+	stopped := make(chan error)
+	go func() { stopped <- tester.Stop() }()
+	select {
+	case err := <-stopped:
+		c.Assert(err, IsNil)
+	case <-time.After(time.Second):
+		c.Fatalf("Plugin did not stop promptly")
+	}
+}
+
 func (s *S) TestSMS(c *C) {
 	for i, test := range smsTests {
 		c.Logf("Running test %d with messages: %v", i, test.send)
@@ -201,6 +215,8 @@ func (l ldapConn) Search(s *ldap.Search) ([]ldap.Result, error) {
 
 func (l ldapConn) Close() error { return nil }
 
+func (l ldapConn) WhoAmI() (string, error) { return "", nil }
+
 type aqlServer struct {
 	fail     bool
 	messages []aqlMessage
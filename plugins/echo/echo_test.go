@@ -26,7 +26,7 @@ var echoTests = []echoTest{{
 	recv: "PRIVMSG nick :repeat",
 }, {
 	send: "echo",
-	recv: "PRIVMSG nick :Oops: missing input for argument: text",
+	recv: "PRIVMSG nick :Oops: missing input for argument: text. Usage: echo <text ...>",
 }, {
 	send:   "echo repeat",
 	recv:   "PRIVMSG nick :[prefix]repeat",
@@ -618,7 +618,6 @@ func (p *ghPlugin) pollIssues() error {
 
 		oldIssues = newIssues
 	}
-	return nil
 }
 
 func (p *ghPlugin) showIssues(issues []*ghIssue, prefix string) {
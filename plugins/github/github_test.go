@@ -0,0 +1,34 @@
+package github_test
+
+import (
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mup.v0"
+	_ "gopkg.in/mup.v0/plugins/github"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+func (s *S) TestStopPromptly(c *C) {
+	for _, plugin := range []string{"ghissuedata", "ghissuewatch"} {
+		c.Logf("Testing plugin %s", plugin)
+		tester := mup.NewPluginTester(plugin)
+		tester.SetConfig(bson.M{"project": "some/project", "polldelay": "1h"})
+		tester.Start()
+		stopped := make(chan error)
+		go func() { stopped <- tester.Stop() }()
+		select {
+		case err := <-stopped:
+			c.Assert(err, IsNil)
+		case <-time.After(time.Second):
+			c.Fatalf("Plugin %s did not stop promptly", plugin)
+		}
+	}
+}
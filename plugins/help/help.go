@@ -24,10 +24,12 @@ var Commands = schema.Commands{{
 	Args: schema.Args{{
 		Name: "cmdname",
 	}},
+	Exempt: true,
 }, {
-	Name: "start",
-	Help: "Displays available commands.",
-	Hide: true,
+	Name:   "start",
+	Help:   "Displays available commands.",
+	Hide:   true,
+	Exempt: true,
 }}
 
 func init() {
@@ -160,7 +162,7 @@ func (p *helpPlugin) HandleCommand(cmd *mup.Command) {
 	command := infos[0].Command
 	var buf bytes.Buffer
 	buf.Grow(512)
-	formatUsage(&buf, command)
+	buf.WriteString(command.Usage())
 	if buf.Len() > 50 {
 		p.plugger.Sendf(cmd, "%s", buf.Bytes())
 		buf.Reset()
@@ -242,49 +244,6 @@ func (p *helpPlugin) cmdList() ([]string, error) {
 	return result, nil
 }
 
-func formatUsage(buf *bytes.Buffer, command *schema.Command) {
-	buf.WriteString(command.Name)
-	for _, arg := range command.Args {
-		buf.WriteByte(' ')
-		if arg.Flag&schema.Required == 0 {
-			buf.WriteByte('[')
-		}
-		formatArg(buf, &arg)
-		if arg.Flag&schema.Required == 0 {
-			buf.WriteByte(']')
-		}
-	}
-}
-
-func formatArg(buf *bytes.Buffer, arg *schema.Arg) {
-	if strings.HasPrefix(arg.Name, "-") {
-		buf.WriteString(arg.Name)
-		if t := valueType(arg); t != schema.Bool {
-			buf.WriteString("=<")
-			if arg.Hint != "" {
-				buf.WriteString(arg.Hint)
-			} else {
-				buf.WriteString(string(t))
-			}
-			buf.WriteByte('>')
-		}
-	} else {
-		buf.WriteByte('<')
-		buf.WriteString(arg.Name)
-		if arg.Flag&schema.Trailing != 0 {
-			buf.WriteString(" ...")
-		}
-		buf.WriteByte('>')
-	}
-}
-
-func valueType(arg *schema.Arg) schema.ValueType {
-	if arg.Type != "" {
-		return arg.Type
-	}
-	return schema.String
-}
-
 func helpLines(text string) []string {
 	buf := []byte(strings.TrimSpace(text))
 	first := true
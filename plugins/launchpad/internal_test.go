@@ -1,6 +1,8 @@
 package launchpad
 
 import (
+	"regexp"
+
 	. "gopkg.in/check.v1"
 )
 
@@ -32,8 +34,25 @@ var parseBugChatTests = []struct {
 	{[]int(nil), "#1000"},
 }
 
+func (s *LPBugsSuite) TestParseBugsCustomPattern(c *C) {
+	re := regexp.MustCompile(`(?i)\bLP#?([0-9]+)|bug ([0-9]+)`)
+	c.Assert(parseBugChat(re, "see LP12345 and lp#222"), DeepEquals, []int{12345, 222})
+	c.Assert(parseBugChat(re, "bug 123 and HELP123"), DeepEquals, []int{123})
+	c.Assert(parseBugChat(re, "#12345"), DeepEquals, []int(nil))
+}
+
+func (s *LPBugsSuite) TestParseBugsMinDigits(c *C) {
+	re := bugChatPattern(3)
+	c.Assert(parseBugChat(re, "#123 and #45"), DeepEquals, []int{123})
+	c.Assert(parseBugChat(re, "bug 7"), DeepEquals, []int{7})
+
+	re = bugChatPattern(7)
+	c.Assert(parseBugChat(re, "since #2016 or #123456"), DeepEquals, []int(nil))
+	c.Assert(parseBugChat(re, "#1234567 and bug 12"), DeepEquals, []int{1234567, 12})
+}
+
 func (s *LPBugsSuite) TestParseBugs(c *C) {
 	for _, test := range parseBugChatTests {
-		c.Assert(parseBugChat(test.line), DeepEquals, test.bugs, Commentf("Line: %s", test.line))
+		c.Assert(parseBugChat(bugChat, test.line), DeepEquals, test.bugs, Commentf("Line: %s", test.line))
 	}
 }
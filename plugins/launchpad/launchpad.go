@@ -28,7 +28,16 @@ var Plugins = []mup.PluginSpec{{
 	configuration option is true for the whole plugin or for a specific plugin target, the
 	bot will also search third-party conversations for text similar to "#12345", "bug 12",
 	or "/+bug/123". Entries such as "RT#123" or "#12" alone (no bug prefix and under 10000)
-	are ignored.
+	are ignored. The "mindigits" configuration option changes how many digits a number
+	such as "#12345" needs without a bug prefix (5 by default).
+
+	The "bugpattern" configuration option replaces the regular expression used to
+	recognize bugs mentioned in conversations. The bug number is taken from the
+	first non-empty group in the expression, so "\bLP#?([0-9]+)" recognizes text
+	such as "LP12345".
+
+	The "timeoutreply" configuration option defines the text sent back when the plugin
+	is too busy to handle a command.
 	`,
 	Start:    startBugData,
 	Commands: BugDataCommands,
@@ -107,16 +116,31 @@ type lpPlugin struct {
 		Options         string
 		PrefixNew       string
 		PrefixOld       string
+		TimeoutReply    string
+		BugPattern      string
+		MinDigits       int
 
 		JustShownTimeout mup.DurationString
 		PollDelay        mup.DurationString
+
+		// Concurrency limits how many bugs mentioned in a single message
+		// are fetched from the Launchpad server at once. Defaults to 4.
+		Concurrency int
+
+		// RequestsPerMinute limits how many requests are sent to the
+		// Launchpad server per minute, across all plugin instances using
+		// the same server. Zero means no limit.
+		RequestsPerMinute int
 	}
 
 	overhear map[*mup.PluginTarget]bool
+	polls    mup.ConditionalGetter
 
 	justShownList [30]justShownBug
 	justShownNext int
 
+	bugChat *regexp.Regexp
+
 	rand *rand.Rand
 }
 
@@ -133,6 +157,12 @@ const (
 	defaultJustShownTimeout = 1 * time.Minute
 	defaultPrefixNew        = "Bug #%v opened"
 	defaultPrefixOld        = "Bug #%v changed"
+	defaultTimeoutReply     = "The Launchpad server seems a bit sluggish right now. Please try again soon."
+	defaultConcurrency      = 4
+	defaultMinDigits        = 5
+
+	// maxMinDigits is the largest repeat count accepted by the regexp package.
+	maxMinDigits = 1000
 )
 
 func startBugData(plugger *mup.Plugger) mup.Stopper {
@@ -157,6 +187,8 @@ func startPlugin(mode pluginMode, plugger *mup.Plugger) mup.Stopper {
 		plugger:  plugger,
 		messages: make(chan *lpMessage, 10),
 		overhear: make(map[*mup.PluginTarget]bool),
+		polls:    mup.ConditionalGetter{Client: &httpClient},
+		bugChat:  bugChat,
 		rand:     rand.New(rand.NewSource(time.Now().Unix())),
 	}
 	plugger.Config(&p.config)
@@ -178,6 +210,29 @@ func startPlugin(mode pluginMode, plugger *mup.Plugger) mup.Stopper {
 	if p.config.PrefixOld == "" {
 		p.config.PrefixOld = defaultPrefixOld
 	}
+	if p.config.TimeoutReply == "" {
+		p.config.TimeoutReply = defaultTimeoutReply
+	}
+	if p.config.Concurrency <= 0 {
+		p.config.Concurrency = defaultConcurrency
+	}
+
+	if p.config.MinDigits < 0 || p.config.MinDigits > maxMinDigits {
+		plugger.Logf("Invalid minimum number of bug digits %d, using the default of %d", p.config.MinDigits, defaultMinDigits)
+	} else if p.config.MinDigits > 0 && p.config.MinDigits != defaultMinDigits {
+		p.bugChat = bugChatPattern(p.config.MinDigits)
+	}
+	if p.config.BugPattern != "" {
+		re, err := regexp.Compile(p.config.BugPattern)
+		if err == nil && re.NumSubexp() == 0 {
+			err = fmt.Errorf("pattern has no groups")
+		}
+		if err != nil {
+			plugger.Logf("Invalid bug pattern %q, using the default one: %v", p.config.BugPattern, err)
+		} else {
+			p.bugChat = re
+		}
+	}
 
 	if p.mode == bugData {
 		targets := plugger.Targets()
@@ -220,7 +275,7 @@ func (p *lpPlugin) HandleMessage(msg *mup.Message) {
 	if p.mode != bugData || msg.BotText != "" || !p.overhear[p.plugger.Target(msg)] {
 		return
 	}
-	bugs := parseBugChat(msg.Text)
+	bugs := parseBugChat(p.bugChat, msg.Text)
 	if len(bugs) == 0 {
 		return
 	}
@@ -248,17 +303,13 @@ func (p *lpPlugin) handleMessage(lpmsg *lpMessage, reportError bool) {
 	default:
 		p.plugger.Logf("Message queue is full. Dropping message: %s", lpmsg.msg.String())
 		if reportError {
-			p.plugger.Sendf(lpmsg.msg, "The Launchpad server seems a bit sluggish right now. Please try again soon.")
+			p.plugger.Sendf(lpmsg.msg, "%s", mup.Translate(lpmsg.msg.Locale, p.config.TimeoutReply))
 		}
 	}
 }
 
 func (p *lpPlugin) loop() error {
-	for {
-		lpmsg, ok := <-p.messages
-		if !ok {
-			break
-		}
+	for lpmsg := range p.messages {
 		p.handle(lpmsg)
 	}
 	return nil
@@ -268,11 +319,27 @@ func (p *lpPlugin) handle(lpmsg *lpMessage) {
 	if p.mode == bugData {
 		overheard := lpmsg.msg.BotText == ""
 		addr := lpmsg.msg.Address()
+		var ids []int
 		for _, id := range lpmsg.bugs {
-			if overheard && p.justShown(addr, id) {
+			if !overheard || !p.justShown(addr, id) {
+				ids = append(ids, id)
+			}
+		}
+		// Fetch bugs in parallel, but report them in the order mentioned.
+		// Only bugs actually fetched are reported.
+		bugs := make([]lpBugData, len(ids))
+		fetched := make([]bool, len(ids))
+		p.plugger.Parallel(p.config.Concurrency, len(ids), func(i int) {
+			bugs[i] = p.fetchBug(ids[i])
+			fetched[i] = true
+		})
+		for i, id := range ids {
+			if !fetched[i] {
 				continue
 			}
-			p.showBug(lpmsg.msg, id, "")
+			if err := p.reportBug(lpmsg.msg, id, "", &bugs[i]); err != nil && err != errNotFound {
+				p.plugger.Logf("Error talking to Launchpad while handling bug #%d (of %v): %v", id, lpmsg.bugs, err)
+			}
 		}
 	} else {
 		var args struct{ Text string }
@@ -307,11 +374,36 @@ type lpBugEntry struct {
 	AssigneeLink string `json:"assignee_link"`
 }
 
-func (p *lpPlugin) showBug(msg *mup.Message, bugId int, prefix string) {
-	var bug lpBug
-	var tasks lpBugTasks
-	err := p.request("/bugs/"+strconv.Itoa(bugId), &bug)
-	if err != nil {
+// lpBugData holds the outcome of fetching a bug and its tasks.
+type lpBugData struct {
+	bug      lpBug
+	tasks    lpBugTasks
+	bugErr   error
+	tasksErr error
+}
+
+// showBug shows the details of the provided bug. The returned error
+// reports why the details could not be obtained, if that's the case.
+func (p *lpPlugin) showBug(msg *mup.Message, bugId int, prefix string) error {
+	data := p.fetchBug(bugId)
+	return p.reportBug(msg, bugId, prefix, &data)
+}
+
+// fetchBug fetches the provided bug and its tasks without reporting them.
+func (p *lpPlugin) fetchBug(bugId int) lpBugData {
+	var data lpBugData
+	data.bugErr = p.request("/bugs/"+strconv.Itoa(bugId), &data.bug)
+	if data.bugErr == nil && data.bug.TasksLink != "" {
+		data.tasksErr = p.request(data.bug.TasksLink, &data.tasks)
+	}
+	return data
+}
+
+// reportBug shows the details of a bug previously obtained via fetchBug.
+// The returned error reports why the details could not be obtained.
+func (p *lpPlugin) reportBug(msg *mup.Message, bugId int, prefix string, data *lpBugData) error {
+	bug, tasks := &data.bug, &data.tasks
+	if err := data.bugErr; err != nil {
 		if msg != nil && msg.BotText != "" {
 			if err == errNotFound {
 				p.plugger.Sendf(msg, "Bug not found.")
@@ -319,22 +411,19 @@ func (p *lpPlugin) showBug(msg *mup.Message, bugId int, prefix string) {
 				p.plugger.Sendf(msg, "Oops: %v", err)
 			}
 		}
-		return
+		return err
 	}
-	if bug.TasksLink != "" {
-		err = p.request(bug.TasksLink, &tasks)
-		if err != nil {
-			if msg != nil && msg.BotText != "" {
-				p.plugger.Sendf(msg, "Oops: %v", err)
-			}
-			return
+	if err := data.tasksErr; err != nil {
+		if msg != nil && msg.BotText != "" {
+			p.plugger.Sendf(msg, "Oops: %v", err)
 		}
+		return err
 	}
 	if !strings.Contains(prefix, "%v") || strings.Count(prefix, "%") > 1 {
 		prefix = "Bug #%v"
 	}
 	format := prefix + ": %s%s <https://launchpad.net/bugs/%d>"
-	args := []interface{}{bugId, bug.Title, p.formatNotes(&bug, &tasks), bugId}
+	args := []interface{}{bugId, bug.Title, p.formatNotes(bug, tasks), bugId}
 	switch {
 	case msg == nil:
 		p.plugger.Broadcastf(format, args...)
@@ -349,6 +438,7 @@ func (p *lpPlugin) showBug(msg *mup.Message, bugId int, prefix string) {
 	default:
 		p.plugger.Sendf(msg, format, args...)
 	}
+	return nil
 }
 
 func (p *lpPlugin) showManyBugs(bugIds []int, prefix string) {
@@ -372,26 +462,43 @@ func (p *lpPlugin) formatNotes(bug *lpBug, tasks *lpBugTasks) string {
 		buf.WriteString(tag)
 		buf.WriteString(">")
 	}
+	// The same target may show up in several tasks, so tasks are
+	// collapsed per target and repeated statuses are dropped.
+	var targets []string
+	statuses := make(map[string][]string)
 	for _, entry := range tasks.Entries {
-		buf.WriteString(" <")
-		buf.WriteString(entry.Target)
-		buf.WriteString(":")
-		buf.WriteString(entry.Status)
+		status := entry.Status
 		if i := strings.Index(entry.AssigneeLink, "~"); i > 0 {
 			if entry.Status == "New" || entry.Status == "Confirmed" {
-				buf.WriteString(" for ")
+				status += " for "
 			} else {
-				buf.WriteString(" by ")
+				status += " by "
 			}
-			buf.WriteString(entry.AssigneeLink[i+1:])
+			status += entry.AssigneeLink[i+1:]
+		}
+		seen, ok := statuses[entry.Target]
+		if !ok {
+			targets = append(targets, entry.Target)
+		}
+		if !containsString(seen, status) {
+			statuses[entry.Target] = append(seen, status)
 		}
+	}
+	for _, target := range targets {
+		buf.WriteString(" <")
+		buf.WriteString(target)
+		buf.WriteString(":")
+		buf.WriteString(strings.Join(statuses[target], ", "))
 		buf.WriteString(">")
 	}
 	return buf.String()
 }
 
 func (p *lpPlugin) authHeader() string {
+	// Bugs may be fetched concurrently, and rand.Rand is not safe for that.
+	p.mu.Lock()
 	nonce := p.rand.Int63()
+	p.mu.Unlock()
 	timestamp := time.Now().Unix()
 	return fmt.Sprintf(``+
 		`OAuth realm="https://api.launchpad.net",`+
@@ -406,7 +513,64 @@ func (p *lpPlugin) authHeader() string {
 
 var errNotFound = fmt.Errorf("resource not found")
 
+// lpLimiter paces the requests sent to a single Launchpad server.
+type lpLimiter struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+var (
+	lpLimitersMu sync.Mutex
+	lpLimiters   = make(map[string]*lpLimiter)
+)
+
+// limiterFor returns the limiter shared by all plugin instances that
+// send requests to the Launchpad server at baseURL.
+func limiterFor(baseURL string) *lpLimiter {
+	lpLimitersMu.Lock()
+	defer lpLimitersMu.Unlock()
+	limiter, ok := lpLimiters[baseURL]
+	if !ok {
+		limiter = &lpLimiter{}
+		lpLimiters[baseURL] = limiter
+	}
+	return limiter
+}
+
+// wait blocks until a request may be sent without exceeding the rate of
+// one request per interval, or until abort is closed. It returns false
+// in the latter case.
+func (l *lpLimiter) wait(interval time.Duration, abort <-chan struct{}) bool {
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(interval)
+	l.mu.Unlock()
+	if at == now {
+		return true
+	}
+	select {
+	case <-time.After(at.Sub(now)):
+		return true
+	case <-abort:
+		return false
+	}
+}
+
 func (p *lpPlugin) request(url string, result interface{}) error {
+	return p.doRequest(url, result, false)
+}
+
+// pollRequest is like request, but returns mup.ErrNotModified without
+// decoding anything if the resource did not change since last polled.
+func (p *lpPlugin) pollRequest(url string, result interface{}) error {
+	return p.doRequest(url, result, true)
+}
+
+func (p *lpPlugin) doRequest(url string, result interface{}, conditional bool) error {
 	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
 		endpoint := p.config.Endpoint
 		if strings.Contains(url, "/+bugs-text") {
@@ -426,13 +590,27 @@ func (p *lpPlugin) request(url string, result interface{}) error {
 		p.plugger.Logf("Cannot perform Launchpad request: %v", err)
 		return fmt.Errorf("cannot perform Launchpad request: %v", err)
 	}
+	if p.config.RequestsPerMinute > 0 {
+		limiter := limiterFor(req.URL.Scheme + "://" + req.URL.Host)
+		if !limiter.wait(time.Minute/time.Duration(p.config.RequestsPerMinute), p.tomb.Dying()) {
+			return tomb.ErrDying
+		}
+	}
 	if p.config.OAuthAccessToken != "" {
 		req.Header.Add("Authorization", p.authHeader())
 	}
 	if p.config.AuthCookie != "" {
 		req.Header.Add("Cookie", "lp="+p.config.AuthCookie)
 	}
-	resp, err := httpClient.Do(req)
+	var resp *http.Response
+	if conditional {
+		resp, err = p.polls.Do(req)
+		if err == mup.ErrNotModified {
+			return err
+		}
+	} else {
+		resp, err = httpClient.Do(req)
+	}
 	if err == nil && resp.StatusCode == 404 {
 		resp.Body.Close()
 		return errNotFound
@@ -454,29 +632,44 @@ func (p *lpPlugin) request(url string, result interface{}) error {
 		}
 		list := parseBugList(string(data))
 		*(result.(*[]int)) = list
-		return nil
+	} else {
+		err = json.NewDecoder(resp.Body).Decode(result)
+		if err != nil {
+			p.plugger.Logf("Cannot decode Launchpad response: %v", err)
+			return fmt.Errorf("cannot decode Launchpad response: %v", err)
+		}
 	}
-	err = json.NewDecoder(resp.Body).Decode(result)
-	if err != nil {
-		p.plugger.Logf("Cannot decode Launchpad response: %v", err)
-		return fmt.Errorf("cannot decode Launchpad response: %v", err)
+	if conditional {
+		p.polls.Remember(resp)
 	}
 	return nil
 }
 
-var bugChat = regexp.MustCompile(`(?i)(?:bugs?[ /]#?([0-9]+)|(?:^|\W)#([0-9]{5,}))`)
+var bugChat = bugChatPattern(defaultMinDigits)
 var bugArg = regexp.MustCompile(`^(?i)(?:.*bugs?/)?#?([0-9]+)$`)
 
-func parseBugChat(text string) []int {
+// bugChatPattern returns the default expression for bugs mentioned in
+// conversations, which requires at least minDigits digits in bug numbers
+// that are not preceded by a bug prefix, such as "#12345".
+func bugChatPattern(minDigits int) *regexp.Regexp {
+	return regexp.MustCompile(fmt.Sprintf(`(?i)(?:bugs?[ /]#?([0-9]+)|(?:^|\W)#([0-9]{%d,}))`, minDigits))
+}
+
+// parseBugChat returns the bugs mentioned in text according to re. The bug
+// id is taken from the first non-empty group of each match.
+func parseBugChat(re *regexp.Regexp, text string) []int {
 	var bugs []int
-	for _, match := range bugChat.FindAllStringSubmatch(text, -1) {
-		s := match[1]
-		if s == "" {
-			s = match[2]
+	for _, match := range re.FindAllStringSubmatch(text, -1) {
+		var s string
+		for _, s = range match[1:] {
+			if s != "" {
+				break
+			}
 		}
 		id, err := strconv.Atoi(s)
 		if err != nil {
-			panic("bug id not an int, which must never happen (regexp is broken)")
+			// Custom patterns may capture text that isn't a bug id.
+			continue
 		}
 		if !containsInt(bugs, id) {
 			bugs = append(bugs, id)
@@ -485,6 +678,15 @@ func parseBugChat(text string) []int {
 	return bugs
 }
 
+func containsString(ss []string, s string) bool {
+	for _, item := range ss {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 func containsInt(ns []int, n int) bool {
 	for _, i := range ns {
 		if i == n {
@@ -537,7 +739,7 @@ func (p *lpPlugin) pollBugs() error {
 		}
 
 		var newBugs []int
-		err := p.request("/"+p.config.Project+"/+bugs-text", &newBugs)
+		err := p.pollRequest("/"+p.config.Project+"/+bugs-text", &newBugs)
 		if err != nil {
 			continue
 		}
@@ -580,7 +782,6 @@ func (p *lpPlugin) pollBugs() error {
 		}
 		oldBugs = newBugs
 	}
-	return nil
 }
 
 type lpMerges struct {
@@ -624,7 +825,7 @@ func (p *lpPlugin) pollMerges() error {
 		}
 
 		var newMerges lpMerges
-		err := p.request("/"+p.config.Project+"?ws.op=getMergeProposals", &newMerges)
+		err := p.pollRequest("/"+p.config.Project+"?ws.op=getMergeProposals", &newMerges)
 		if err != nil {
 			continue
 		}
@@ -643,7 +844,6 @@ func (p *lpPlugin) pollMerges() error {
 		}
 		first = false
 	}
-	return nil
 }
 
 func firstSentence(s string) string {
@@ -14,6 +14,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -46,6 +47,11 @@ var lpTests = []lpTest{
 		plugin: "lpbugdata",
 		send:   []string{"bug #123"},
 		recv:   []string{"PRIVMSG nick :Bug #123: Title of 123 <tag1> <tag2> <Some Project:New> <Other:Confirmed for joe> <https://launchpad.net/bugs/123>"},
+	}, {
+		// Redundant tasks are collapsed per target.
+		plugin: "lpbugdata",
+		send:   []string{"bug #124"},
+		recv:   []string{"PRIVMSG nick :Bug #124: Title of 124 <tag1> <tag2> <Some Project:New> <Other:Triaged by joe, Fix Released> <https://launchpad.net/bugs/124>"},
 	}, {
 		// The bug command reports errors.
 		plugin: "lpbugdata",
@@ -95,6 +101,27 @@ var lpTests = []lpTest{
 		},
 		send: []string{"[#chan] foo bug #111"},
 		recv: []string{"PRIVMSG #chan :Bug #111: Title of 111 <https://launchpad.net/bugs/111>"},
+	}, {
+		// The pattern used when overhearing may be customized.
+		plugin:  "lpbugdata",
+		config:  bson.M{"overhear": true, "bugpattern": `\bLP([0-9]+)`},
+		targets: []bson.M{{"account": ""}},
+		send:    []string{"[#chan] foo bug #222 LP111"},
+		recv:    []string{"PRIVMSG #chan :Bug #111: Title of 111 <https://launchpad.net/bugs/111>"},
+	}, {
+		// An invalid pattern falls back to the default one.
+		plugin:  "lpbugdata",
+		config:  bson.M{"overhear": true, "bugpattern": `LP([0-9]+`},
+		targets: []bson.M{{"account": ""}},
+		send:    []string{"[#chan] foo bug #111 LP222"},
+		recv:    []string{"PRIVMSG #chan :Bug #111: Title of 111 <https://launchpad.net/bugs/111>"},
+	}, {
+		// An out of range minimum of digits falls back to the default one.
+		plugin:  "lpbugdata",
+		config:  bson.M{"overhear": true, "mindigits": 5000},
+		targets: []bson.M{{"account": ""}},
+		send:    []string{"[#chan] foo #1000 #11111"},
+		recv:    []string{"PRIVMSG #chan :Bug #11111: Title of 11111 <https://launchpad.net/bugs/11111>"},
 	}, {
 		// First matching target wins.
 		plugin: "lpbugdata",
@@ -323,10 +350,125 @@ func (s *S) TestJustShown(c *C) {
 	})
 }
 
+func (s *S) TestErrorLogged(c *C) {
+	server := lpServer{status: 500}
+	server.Start()
+	tester := mup.NewPluginTester("lpbugdata")
+	tester.SetConfig(bson.M{"endpoint": server.URL()})
+	tester.Start()
+	tester.Sendf("bug 111 222")
+	tester.Stop()
+	server.Stop()
+
+	c.Assert(tester.RecvAll(), HasLen, 2)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Error talking to Launchpad while handling bug #111 \(of \[111 222\]\): cannot perform Launchpad request: 500 Internal Server Error.*`)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Error talking to Launchpad while handling bug #222 \(of \[111 222\]\): cannot perform Launchpad request: 500 Internal Server Error.*`)
+}
+
+func (s *S) TestStopPromptly(c *C) {
+	for _, plugin := range []string{"lpbugdata", "lpbugwatch", "lpmergewatch"} {
+		c.Logf("Testing plugin %s", plugin)
+		tester := mup.NewPluginTester(plugin)
+		tester.SetConfig(bson.M{"project": "some-project", "polldelay": "1h"})
+		tester.Start()
+		stopped := make(chan error)
+		go func() { stopped <- tester.Stop() }()
+		select {
+		case err := <-stopped:
+			c.Assert(err, IsNil)
+		case <-time.After(time.Second):
+			c.Fatalf("Plugin %s did not stop promptly", plugin)
+		}
+	}
+}
+
+func (s *S) TestTimeoutReply(c *C) {
+	server := lpServer{delay: 50 * time.Millisecond}
+	server.Start()
+	tester := mup.NewPluginTester("lpbugdata")
+	tester.SetConfig(bson.M{
+		"endpoint":     server.URL(),
+		"timeoutreply": "Launchpad is busy, sorry.",
+	})
+	tester.Start()
+	for i := 0; i < 15; i++ {
+		tester.Sendf("bug %d", 100+i)
+	}
+	tester.Stop()
+	server.Stop()
+
+	busy := 0
+	for _, reply := range tester.RecvAll() {
+		if reply == "PRIVMSG nick :Launchpad is busy, sorry." {
+			busy++
+		} else {
+			c.Assert(reply, Matches, `PRIVMSG nick :Bug #1[01][0-9]: .*`)
+		}
+	}
+	c.Assert(busy > 0, Equals, true)
+}
+
+func (s *S) TestNotModified(c *C) {
+	server := lpServer{bugsText: [][]int{{111}, {111, 222}}}
+	server.Start()
+	tester := mup.NewPluginTester("lpbugwatch")
+	tester.SetConfig(bson.M{
+		"endpoint":        server.URL(),
+		"buglistendpoint": server.URL(),
+		"project":         "some-project",
+		"polldelay":       "20ms",
+	})
+	tester.SetTargets([]bson.M{{"account": "test", "channel": "#chan"}})
+	tester.Start()
+	time.Sleep(250 * time.Millisecond)
+	tester.Stop()
+	server.Stop()
+
+	// Unchanged lists are neither reported as changes nor as missing bugs.
+	c.Assert(tester.RecvAll(), DeepEquals, []string{
+		"PRIVMSG #chan :Bug #222 opened: Title of 222 <https://launchpad.net/bugs/222>",
+	})
+	c.Assert(server.notModified > 0, Equals, true)
+}
+
+func (s *S) TestRequestsPerMinute(c *C) {
+	server := lpServer{bugsText: [][]int{{111}}}
+	server.Start()
+	var testers []*mup.PluginTester
+	for i := 0; i < 2; i++ {
+		tester := mup.NewPluginTester("lpbugwatch")
+		tester.SetConfig(bson.M{
+			"endpoint":          server.URL(),
+			"buglistendpoint":   server.URL(),
+			"project":           "some-project",
+			"polldelay":         "10ms",
+			"requestsperminute": 600,
+		})
+		tester.Start()
+		testers = append(testers, tester)
+	}
+	time.Sleep(550 * time.Millisecond)
+	for _, tester := range testers {
+		tester.Stop()
+	}
+	server.Stop()
+
+	// Without pacing the two instances would send about a hundred requests.
+	times := server.requestTimes()
+	c.Assert(len(times) >= 3, Equals, true, Commentf("Got %d requests", len(times)))
+	c.Assert(len(times) <= 7, Equals, true, Commentf("Got %d requests", len(times)))
+	for i := 1; i < len(times); i++ {
+		c.Assert(times[i].Sub(times[i-1]) > 90*time.Millisecond, Equals, true, Commentf("Requests %d and %d were %v apart", i-1, i, times[i].Sub(times[i-1])))
+	}
+}
+
 type lpServer struct {
 	server *httptest.Server
+	mu     sync.Mutex
+	times  []time.Time
 
 	status int
+	delay  time.Duration
 
 	bugForm url.Values
 
@@ -334,6 +476,8 @@ type lpServer struct {
 	bugsText [][]int
 	bugsResp int
 
+	notModified int
+
 	mergesResp int
 
 	headers map[string]http.Header
@@ -352,8 +496,18 @@ func (s *lpServer) URL() string {
 	return s.server.URL
 }
 
+func (s *lpServer) requestTimes() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.times...)
+}
+
 func (s *lpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.times = append(s.times, time.Now())
 	s.headers[req.URL.Path] = req.Header
+	time.Sleep(s.delay)
 	if s.status != 0 {
 		w.WriteHeader(s.status)
 		return
@@ -390,12 +544,20 @@ func (s *lpServer) serveBug(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	var res string
-	if tasks {
+	if tasks && id == 124 {
+		res = `{"entries": [
+			{"status": "New", "bug_target_display_name": "Some Project"},
+			{"status": "Triaged", "bug_target_display_name": "Other", "assignee_link": "foo/~joe"},
+			{"status": "New", "bug_target_display_name": "Some Project"},
+			{"status": "Fix Released", "bug_target_display_name": "Other"},
+			{"status": "Triaged", "bug_target_display_name": "Other", "assignee_link": "foo/~joe"}
+		]}`
+	} else if tasks {
 		res = fmt.Sprintf(`{"entries": [
 			{"status": "New", "bug_target_display_name": "Some Project"},
 			{"status": "Confirmed", "bug_target_display_name": "Other", "assignee_link": "foo/~joe"}
 		]}`)
-	} else if id == 123 {
+	} else if id == 123 || id == 124 {
 		res = fmt.Sprintf(`{
 			"title": "Title of %d",
 			"tags": ["tag1", "tag2"],
@@ -409,6 +571,13 @@ func (s *lpServer) serveBug(w http.ResponseWriter, req *http.Request) {
 
 func (s *lpServer) serveBugsText(w http.ResponseWriter, req *http.Request) {
 	s.bugsForm = req.Form
+	etag := fmt.Sprintf(`"bugs-%d"`, s.bugsResp)
+	if req.Header.Get("If-None-Match") == etag {
+		s.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
 	for _, bugId := range s.bugsText[s.bugsResp] {
 		w.Write([]byte(strconv.Itoa(bugId)))
 		w.Write([]byte{'\n'})
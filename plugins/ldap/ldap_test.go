@@ -114,6 +114,8 @@ func (l ldapConn) Search(s *ldap.Search) ([]ldap.Result, error) {
 
 func (l ldapConn) Close() error { return nil }
 
+func (l ldapConn) WhoAmI() (string, error) { return "", nil }
+
 func (s *LDAPSuite) SetUpSuite(c *C) {
 	mup.SetLogger(c)
 	mup.SetDebug(true)
@@ -1,7 +1,12 @@
 package log
 
 import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/mup.v0"
+	"gopkg.in/mup.v0/schema"
 )
 
 var Plugin = mup.PluginSpec{
@@ -10,21 +15,57 @@ var Plugin = mup.PluginSpec{
 	
 	Messages are stored in the collection "shared.log", either in
 	the main bot database, or in the database name defined via the
-	"database" configuration option.
+	"database" configuration option. Messages are written in batches,
+	shortly after they are observed.
+
+	Messages matching a plugin target that has the "nolog" option
+	set in its configuration are not stored.
+
+	On protocols that support them, such as telegram, the message id
+	and the ids of the thread and of the message replied to are stored
+	as well, so logged conversations preserve their thread structure.
+	Edits and deletions of earlier messages reported by such protocols
+	are stored too, with their event kind and the id of the message
+	changed.
 	`,
-	Start: start,
+	Start:    start,
+	Commands: Commands,
+	Events:   true,
 }
 
+var Commands = schema.Commands{{
+	Name: "redact",
+	Help: `Blanks the text of a stored message while preserving its metadata.
+
+	The message is identified by its id in the log collection. Only senders
+	matching one of the "nick!user@host" masks listed in the "admins"
+	configuration option may redact messages.
+	`,
+	Args: schema.Args{{
+		Name: "id",
+		Flag: schema.Required,
+	}},
+}}
+
 func init() {
 	mup.RegisterPlugin(&Plugin)
 }
 
 type logPlugin struct {
 	plugger *mup.Plugger
+	bulk    *mup.BulkCollection
+	config  struct {
+		Admins []string
+	}
 }
 
 func start(plugger *mup.Plugger) mup.Stopper {
-	return &logPlugin{plugger: plugger}
+	p := &logPlugin{
+		plugger: plugger,
+		bulk:    plugger.BulkCollection("", mup.Shared|mup.Bulk),
+	}
+	plugger.Config(&p.config)
+	return p
 }
 
 func (p *logPlugin) Stop() error {
@@ -32,14 +73,66 @@ func (p *logPlugin) Stop() error {
 }
 
 func (p *logPlugin) HandleMessage(msg *mup.Message) {
-	session, c := p.plugger.Collection("", mup.Shared|mup.Bulk)
-	defer session.Close()
-	err := c.Insert(msg)
+	if p.excluded(msg) {
+		return
+	}
+	err := p.bulk.Insert(msg)
 	if err != nil {
 		p.plugger.Logf("Error writing to log collection: %v", err)
 	}
 }
 
+func (p *logPlugin) excluded(msg *mup.Message) bool {
+	target := p.plugger.Target(msg)
+	if target == nil {
+		return false
+	}
+	var config struct {
+		NoLog bool
+	}
+	target.Config(&config)
+	return config.NoLog
+}
+
 func (p *logPlugin) HandleOutgoing(msg *mup.Message) {
 	p.HandleMessage(msg)
 }
+
+// redactedText replaces the text of redacted messages.
+const redactedText = "[redacted]"
+
+func (p *logPlugin) HandleCommand(cmd *mup.Command) {
+	var args struct{ Id string }
+	cmd.Args(&args)
+
+	if !mup.Match().Sender(p.config.Admins...).Matches(cmd.Message) {
+		p.plugger.Sendf(cmd, "Must be a log admin for that.")
+		return
+	}
+	if !bson.IsObjectIdHex(args.Id) {
+		p.plugger.Sendf(cmd, "Invalid message id: %q", args.Id)
+		return
+	}
+
+	// The message may still be buffered.
+	if err := p.bulk.Flush(); err != nil {
+		p.plugger.Logf("Error writing to log collection: %v", err)
+	}
+	session, c := p.plugger.Collection("", mup.Shared|mup.Bulk)
+	defer session.Close()
+	err := c.UpdateId(bson.ObjectIdHex(args.Id), bson.D{
+		{"$set", bson.D{{"text", redactedText}, {"redacted", time.Now().UTC()}}},
+		{"$unset", bson.D{{"bottext", 1}}},
+	})
+	if err == mgo.ErrNotFound {
+		p.plugger.Sendf(cmd, "Message not found.")
+		return
+	}
+	if err != nil {
+		p.plugger.Logf("Cannot redact message %s: %v", args.Id, err)
+		p.plugger.Sendf(cmd, "Oops: cannot redact message: %v", err)
+		return
+	}
+	p.plugger.Logf("Message %s redacted by %s at %s.", args.Id, cmd.Nick, cmd.Account)
+	p.plugger.Sendf(cmd, "Redacted.")
+}
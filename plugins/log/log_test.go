@@ -2,9 +2,11 @@ package log_test
 
 import (
 	"testing"
+	"time"
 
 	. "gopkg.in/check.v1"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/mgo.v2/dbtest"
 	"gopkg.in/mup.v0"
 	_ "gopkg.in/mup.v0/plugins/log"
@@ -75,3 +77,113 @@ func (s *HelpSuite) TestLog(c *C) {
 		s.dbserver.Wipe()
 	}
 }
+
+func (s *HelpSuite) TestThreadFields(c *C) {
+	session := s.dbserver.Session()
+	defer session.Close()
+	db := session.DB("")
+
+	tester := mup.NewPluginTester("log")
+	tester.SetDatabase(db)
+	tester.Start()
+	tester.SendMessage(&mup.Message{
+		Account:  "test",
+		Channel:  "#Group:-78",
+		Nick:     "nick",
+		Host:     "telegram",
+		Command:  "PRIVMSG",
+		Text:     "Reply.",
+		ProtoId:  "36",
+		ThreadId: "30",
+		ReplyTo:  "35",
+	})
+	tester.Sendf("[#chan] Plain.")
+	tester.Stop()
+
+	var msgs []mup.Message
+	coll := session.DB(db.Name + "_bulk").C("shared.log")
+	err := coll.Find(nil).Sort("$natural").All(&msgs)
+	c.Assert(err, IsNil)
+	c.Assert(msgs, HasLen, 2)
+	c.Assert(msgs[0].Text, Equals, "Reply.")
+	c.Assert(msgs[0].ProtoId, Equals, "36")
+	c.Assert(msgs[0].ThreadId, Equals, "30")
+	c.Assert(msgs[0].ReplyTo, Equals, "35")
+
+	// IRC messages have no such fields, and none are stored.
+	var plain bson.M
+	err = coll.Find(bson.M{"text": "Plain."}).One(&plain)
+	c.Assert(err, IsNil)
+	for _, field := range []string{"protoid", "threadid", "replyto"} {
+		_, ok := plain[field]
+		c.Assert(ok, Equals, false, Commentf("Field %q stored for IRC message", field))
+	}
+}
+
+func (s *HelpSuite) TestNoLog(c *C) {
+	session := s.dbserver.Session()
+	defer session.Close()
+	db := session.DB("")
+
+	tester := mup.NewPluginTester("log")
+	tester.SetDatabase(db)
+	tester.SetTargets([]bson.M{
+		{"account": "test", "channel": "#secret", "config": bson.M{"nolog": true}},
+		{"account": "test"},
+	})
+	tester.Start()
+	tester.Sendf("[#secret] Secret.")
+	tester.Sendf("[#chan] Public.")
+	tester.Plugger().Send(&mup.Message{Account: "test", Channel: "#secret", Text: "Secret reply."})
+	tester.Stop()
+
+	var msgs []mup.Message
+	coll := session.DB(db.Name + "_bulk").C("shared.log")
+	err := coll.Find(nil).All(&msgs)
+	c.Assert(err, IsNil)
+	c.Assert(msgs, HasLen, 1)
+	c.Assert(msgs[0].String(), Equals, ":nick!~user@host PRIVMSG #chan :Public.")
+}
+
+func (s *HelpSuite) TestRedact(c *C) {
+	session := s.dbserver.Session()
+	defer session.Close()
+	db := session.DB("")
+	coll := session.DB(db.Name + "_bulk").C("shared.log")
+
+	tester := mup.NewPluginTester("log")
+	tester.SetDatabase(db)
+	tester.SetConfig(bson.M{"admins": []string{"other", "nick!*@host"}})
+	tester.Start()
+	tester.Sendf("Secret.")
+	c.Assert(tester.Plugger().BulkCollection("", mup.Shared|mup.Bulk).Flush(), IsNil)
+
+	var stored struct {
+		Id bson.ObjectId `bson:"_id"`
+	}
+	err := coll.Find(bson.M{"text": "Secret."}).One(&stored)
+	c.Assert(err, IsNil)
+
+	tester.Sendf("[,raw] :other!~user@host PRIVMSG mup :redact %s", stored.Id.Hex())
+	tester.Sendf("[,raw] :nick!~user@elsewhere PRIVMSG mup :redact %s", stored.Id.Hex())
+	tester.Sendf("redact %s", bson.NewObjectId().Hex())
+	tester.Sendf("redact foo")
+	tester.Sendf("redact %s", stored.Id.Hex())
+	tester.Stop()
+
+	c.Assert(tester.RecvAll(), DeepEquals, []string{
+		"PRIVMSG other :Must be a log admin for that.",
+		"PRIVMSG nick :Must be a log admin for that.",
+		"PRIVMSG nick :Message not found.",
+		`PRIVMSG nick :Invalid message id: "foo"`,
+		"PRIVMSG nick :Redacted.",
+	})
+
+	var redacted bson.M
+	err = coll.FindId(stored.Id).One(&redacted)
+	c.Assert(err, IsNil)
+	c.Assert(redacted["text"], Equals, "[redacted]")
+	c.Assert(redacted["nick"], Equals, "nick")
+	c.Assert(redacted["bottext"], IsNil)
+	c.Assert(redacted["redacted"], FitsTypeOf, time.Time{})
+}
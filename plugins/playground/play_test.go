@@ -207,6 +207,8 @@ func (l ldapConn) Search(s *ldap.Search) ([]ldap.Result, error) {
 
 func (l ldapConn) Close() error { return nil }
 
+func (l ldapConn) WhoAmI() (string, error) { return "", nil }
+
 type playServer struct {
 	format      string
 	compile     string
@@ -350,6 +350,8 @@ func (l ldapConn) Search(s *ldap.Search) ([]ldap.Result, error) {
 
 func (l ldapConn) Close() error { return nil }
 
+func (l ldapConn) WhoAmI() (string, error) { return "", nil }
+
 type alphaServer struct {
 	result string
 	status int
@@ -0,0 +1,197 @@
+package mup
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseProxy parses the proxy URL provided in the server configuration.
+func parseProxy(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL %q: %v", proxy, err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported proxy URL scheme %q; must be socks5 or http", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", proxy)
+	}
+	return u, nil
+}
+
+// dialProxy connects to addr through the provided proxy, which may
+// be either a SOCKS5 proxy or an HTTP proxy supporting CONNECT.
+func dialProxy(proxy *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	proxyAddr := proxy.Host
+	if _, _, err := net.SplitHostPort(proxyAddr); err != nil {
+		if proxy.Scheme == "socks5" {
+			proxyAddr = net.JoinHostPort(proxyAddr, "1080")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyAddr, "80")
+		}
+	}
+	conn, err := net.DialTimeout("tcp", proxyAddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if proxy.Scheme == "socks5" {
+		err = socks5Connect(conn, proxy.User, addr)
+	} else {
+		err = httpConnect(conn, proxy.User, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot connect to %s via proxy %s: %v", addr, proxyAddr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port in address %q", addr)
+	}
+	if len(host) > 255 {
+		return fmt.Errorf("host name too long: %q", host)
+	}
+
+	// Negotiate the authentication method.
+	methods := []byte{0x00}
+	if user != nil {
+		methods = []byte{0x00, 0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if user == nil {
+			return fmt.Errorf("SOCKS proxy requires authentication")
+		}
+		username := user.Username()
+		password, _ := user.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("SOCKS username or password too long")
+		}
+		var buf bytes.Buffer
+		buf.WriteByte(0x01)
+		buf.WriteByte(byte(len(username)))
+		buf.WriteString(username)
+		buf.WriteByte(byte(len(password)))
+		buf.WriteString(password)
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return fmt.Errorf("SOCKS authentication failed")
+		}
+	default:
+		return fmt.Errorf("no acceptable SOCKS authentication method")
+	}
+
+	// Request the connection.
+	var buf bytes.Buffer
+	buf.Write([]byte{0x05, 0x01, 0x00})
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		buf.WriteByte(0x01)
+		buf.Write(ip.To4())
+	} else if ip != nil {
+		buf.WriteByte(0x04)
+		buf.Write(ip.To16())
+	} else {
+		buf.WriteByte(0x03)
+		buf.WriteByte(byte(len(host)))
+		buf.WriteString(host)
+	}
+	binary.Write(&buf, binary.BigEndian, uint16(port))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("SOCKS proxy refused connection (code %d)", header[1])
+	}
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		if _, err := io.ReadFull(conn, header[:1]); err != nil {
+			return err
+		}
+		skip = int(header[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) error {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		return err
+	}
+
+	// Read the response one byte at a time, so that nothing the IRC
+	// server sends right after it is consumed here.
+	var resp []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(resp, []byte("\r\n\r\n")) {
+		if len(resp) > 4096 {
+			return fmt.Errorf("HTTP proxy response too long")
+		}
+		if _, err := conn.Read(b); err != nil {
+			return err
+		}
+		resp = append(resp, b[0])
+	}
+	status := string(resp[:bytes.IndexByte(resp, '\r')])
+	fields := strings.Fields(status)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return fmt.Errorf("malformed HTTP proxy response: %q", status)
+	}
+	if fields[1] != "200" {
+		return fmt.Errorf("HTTP proxy replied: %s", strings.Join(fields[1:], " "))
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package mup_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mup.v0"
+)
+
+// testProxy is a minimal SOCKS5 or HTTP CONNECT proxy that records
+// the addresses it was asked to connect to.
+type testProxy struct {
+	l     net.Listener
+	http  bool
+	mu    sync.Mutex
+	addrs []string
+}
+
+func startTestProxy(c *C, http bool) *testProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	p := &testProxy{l: l, http: http}
+	go p.serve()
+	return p
+}
+
+func (p *testProxy) Stop() {
+	p.l.Close()
+}
+
+func (p *testProxy) URL() string {
+	if p.http {
+		return "http://" + p.l.Addr().String()
+	}
+	return "socks5://" + p.l.Addr().String()
+}
+
+func (p *testProxy) Addrs() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.addrs...)
+}
+
+func (p *testProxy) serve() {
+	for {
+		conn, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *testProxy) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var addr string
+	var err error
+	if p.http {
+		addr, err = p.httpHandshake(r, conn)
+	} else {
+		addr, err = p.socksHandshake(r, conn)
+	}
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.addrs = append(p.addrs, addr)
+	p.mu.Unlock()
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	go io.Copy(target, r)
+	io.Copy(conn, target)
+}
+
+func (p *testProxy) socksHandshake(r *bufio.Reader, conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, make([]byte, header[1])); err != nil {
+		return "", err
+	}
+	conn.Write([]byte{0x05, 0x00})
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(r, request); err != nil {
+		return "", err
+	}
+	var host string
+	switch request[3] {
+	case 0x01:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unsupported address type")
+	}
+	var port uint16
+	if err := binary.Read(r, binary.BigEndian, &port); err != nil {
+		return "", err
+	}
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, fmt.Sprint(port)), nil
+}
+
+func (p *testProxy) httpHandshake(r *bufio.Reader, conn net.Conn) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "CONNECT" {
+		return "", fmt.Errorf("unexpected request: %q", line)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return fields[1], nil
+}
+
+func (s *ServerSuite) testProxy(c *C, http bool) {
+	proxy := startTestProxy(c, http)
+	defer proxy.Stop()
+
+	s.StopServer(c)
+	s.config.Proxy = proxy.URL()
+	s.RestartServer(c)
+	s.SendWelcome(c)
+	s.Roundtrip(c)
+
+	c.Assert(proxy.Addrs(), DeepEquals, []string{s.Addr.String()})
+}
+
+func (s *ServerSuite) TestSOCKS5Proxy(c *C) {
+	s.testProxy(c, false)
+}
+
+func (s *ServerSuite) TestHTTPProxy(c *C) {
+	s.testProxy(c, true)
+}
+
+func (s *ServerSuite) TestInvalidProxy(c *C) {
+	s.StopServer(c)
+	s.config.Proxy = "ftp://localhost:21"
+	_, err := mup.Start(s.config)
+	c.Assert(err, ErrorMatches, `unsupported proxy URL scheme "ftp"; must be socks5 or http`)
+}
@@ -0,0 +1,145 @@
+package mup
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ScheduledTask describes a task scheduled by a plugin via Plugger.Schedule
+// that did not run yet.
+type ScheduledTask struct {
+	Id          string
+	Plugin      string
+	Description string
+	Due         time.Time
+}
+
+// scheduler holds the tasks scheduled by plugins. A single scheduler is
+// shared by all plugins run by a plugin manager, so that tasks of one
+// plugin may be listed and canceled by another, such as the admin plugin.
+type scheduler struct {
+	mu    sync.Mutex
+	seq   int
+	tasks map[string]*scheduledTask
+
+	// running tracks the tasks of each plugin that are running, so
+	// that cancelAll may wait for them.
+	running map[string]*sync.WaitGroup
+}
+
+type scheduledTask struct {
+	ScheduledTask
+	timer *time.Timer
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		tasks:   make(map[string]*scheduledTask),
+		running: make(map[string]*sync.WaitGroup),
+	}
+}
+
+// schedule arranges for f to run after delay, and returns the task id.
+func (s *scheduler) schedule(plugin, description string, delay time.Duration, f func()) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	id := strconv.Itoa(s.seq)
+	task := &scheduledTask{ScheduledTask: ScheduledTask{
+		Id:          id,
+		Plugin:      plugin,
+		Description: description,
+		Due:         time.Now().Add(delay),
+	}}
+	// Whoever removes the task from the map first, either the timer
+	// firing or a cancellation, decides whether f runs.
+	task.timer = time.AfterFunc(delay, func() {
+		s.mu.Lock()
+		_, ok := s.tasks[id]
+		delete(s.tasks, id)
+		var running *sync.WaitGroup
+		if ok {
+			running = s.runningGroup(plugin)
+			running.Add(1)
+		}
+		s.mu.Unlock()
+		if ok {
+			defer running.Done()
+			f()
+		}
+	})
+	s.tasks[id] = task
+	return id
+}
+
+// cancel cancels the task with the given id scheduled by plugin, and
+// returns whether the task was found before it ran.
+func (s *scheduler) cancel(plugin, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[id]
+	if !ok || task.Plugin != plugin {
+		return false
+	}
+	task.timer.Stop()
+	delete(s.tasks, id)
+	return true
+}
+
+// runningGroup returns the group tracking the running tasks of plugin.
+// It must be called with mu held.
+func (s *scheduler) runningGroup(plugin string) *sync.WaitGroup {
+	running, ok := s.running[plugin]
+	if !ok {
+		running = &sync.WaitGroup{}
+		s.running[plugin] = running
+	}
+	return running
+}
+
+// cancelAll cancels all pending tasks scheduled by plugin, and waits for
+// the ones already running to return.
+func (s *scheduler) cancelAll(plugin string) {
+	s.mu.Lock()
+	for id, task := range s.tasks {
+		if task.Plugin == plugin {
+			task.timer.Stop()
+			delete(s.tasks, id)
+		}
+	}
+	running := s.running[plugin]
+	delete(s.running, plugin)
+	s.mu.Unlock()
+	if running != nil {
+		running.Wait()
+	}
+}
+
+// list returns the pending tasks scheduled by plugin, soonest first.
+func (s *scheduler) list(plugin string) []ScheduledTask {
+	s.mu.Lock()
+	var tasks []ScheduledTask
+	for _, task := range s.tasks {
+		if task.Plugin == plugin {
+			tasks = append(tasks, task.ScheduledTask)
+		}
+	}
+	s.mu.Unlock()
+	sort.Sort(tasksByDue(tasks))
+	return tasks
+}
+
+type tasksByDue []ScheduledTask
+
+func (tasks tasksByDue) Len() int      { return len(tasks) }
+func (tasks tasksByDue) Swap(i, j int) { tasks[i], tasks[j] = tasks[j], tasks[i] }
+func (tasks tasksByDue) Less(i, j int) bool {
+	if !tasks[i].Due.Equal(tasks[j].Due) {
+		return tasks[i].Due.Before(tasks[j].Due)
+	}
+	ni, _ := strconv.Atoi(tasks[i].Id)
+	nj, _ := strconv.Atoi(tasks[j].Id)
+	return ni < nj
+}
@@ -1,6 +1,7 @@
 package schema
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"strconv"
@@ -15,8 +16,26 @@ type Command struct {
 	Help string
 	Args Args
 	Hide bool
+	Perm Perm
+
+	// Exempt marks essential commands that are never limited by the
+	// command cooldown, so they keep working for users being limited.
+	Exempt bool
+
+	// Private marks commands with lengthy or sensitive output, which is
+	// sent privately to the user running them even when run in a channel.
+	Private bool
 }
 
+// Perm defines the permission level required to run a command.
+type Perm string
+
+const (
+	Anyone    Perm = ""
+	ChannelOp Perm = "op"
+	BotAdmin  Perm = "admin"
+)
+
 type Args []Arg
 
 type Arg struct {
@@ -70,6 +89,11 @@ func parseArg(arg *Arg, s string) (interface{}, error) {
 
 var errInvalid = errors.New("invalid command")
 
+// MaxTokens is the maximum number of space-separated tokens that Parse
+// accepts in the command text. Longer texts are rejected upfront, so that
+// pathological input does not turn into an equally pathological reply.
+const MaxTokens = 256
+
 // CommandName returns the command name used in the provided text,
 // or the empty string if no command name could be parsed out of it.
 func CommandName(text string) string {
@@ -94,6 +118,44 @@ func (cs Commands) Command(name string) *Command {
 	return c
 }
 
+// Usage returns a one-line summary of how the command is used, built
+// from its arguments. Optional arguments are surrounded by brackets.
+// For example: "remind <duration> <text ...>".
+func (c *Command) Usage() string {
+	var buf bytes.Buffer
+	buf.WriteString(c.Name)
+	for i := range c.Args {
+		arg := &c.Args[i]
+		buf.WriteByte(' ')
+		if arg.Flag&Required == 0 {
+			buf.WriteByte('[')
+		}
+		if strings.HasPrefix(arg.Name, "-") {
+			buf.WriteString(arg.Name)
+			if t := valueType(arg); t != Bool {
+				buf.WriteString("=<")
+				if arg.Hint != "" {
+					buf.WriteString(arg.Hint)
+				} else {
+					buf.WriteString(string(t))
+				}
+				buf.WriteByte('>')
+			}
+		} else {
+			buf.WriteByte('<')
+			buf.WriteString(arg.Name)
+			if arg.Flag&Trailing != 0 {
+				buf.WriteString(" ...")
+			}
+			buf.WriteByte('>')
+		}
+		if arg.Flag&Required == 0 {
+			buf.WriteByte(']')
+		}
+	}
+	return buf.String()
+}
+
 func (c *Command) Parse(text string) (interface{}, error) {
 	p := parser{text, 0}
 
@@ -106,6 +168,9 @@ func (c *Command) Parse(text string) (interface{}, error) {
 	if name != c.Name {
 		return nil, fmt.Errorf("cannot parse with command %q text meant to %q: %s", c.Name, name, text)
 	}
+	if countTokens(text, MaxTokens+1) > MaxTokens {
+		return nil, fmt.Errorf("too many arguments for command %q (at most %d words are accepted)", c.Name, MaxTokens)
+	}
 
 	// TODO Must require the space here.
 	p.skipSpaces()
@@ -189,6 +254,21 @@ func (c *Command) Parse(text string) (interface{}, error) {
 	return opts, nil
 }
 
+// countTokens returns the number of space-separated tokens in text,
+// stopping the count once max is reached.
+func countTokens(text string, max int) int {
+	p := parser{text, 0}
+	n := 0
+	for n < max {
+		p.skipSpaces()
+		if !p.skipNonSpaces() {
+			break
+		}
+		n++
+	}
+	return n
+}
+
 func plural(n int, singular, plural string) string {
 	if n > 1 {
 		return plural
@@ -2,6 +2,7 @@ package schema_test
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"gopkg.in/mup.v0/schema"
@@ -200,6 +201,18 @@ var parseTests = []struct {
 		opts: map[string]interface{}{"boolB": true},
 	},
 
+	// Token limit handling.
+	{
+		text:  "cmd2 val0" + strings.Repeat(" val1", 10000),
+		error: `too many arguments for command "cmd2" \(at most 256 words are accepted\)`,
+	}, {
+		text:  "cmd3" + strings.Repeat(" -arg2", 10000),
+		error: `too many arguments for command "cmd3" \(at most 256 words are accepted\)`,
+	}, {
+		text: "cmd2 val0" + strings.Repeat(" val1", 254),
+		opts: map[string]interface{}{"arg0": "val0", "arg1": strings.TrimSpace(strings.Repeat(" val1", 254))},
+	},
+
 	// UTF-8 handling.
 	{
 		text: "çmd6 -árg0=vál0 vál1",
@@ -227,3 +240,21 @@ func (s *S) TestCommandParse(c *C) {
 		}
 	}
 }
+
+var usageTests = []struct {
+	name  string
+	usage string
+}{
+	{"cmd0", "cmd0"},
+	{"cmd1", "cmd1 <arg0> <arg1> [<arg2>]"},
+	{"cmd2", "cmd2 <arg0> <arg1 ...>"},
+	{"cmd3", "cmd3 -arg2 [-arg3] <arg0> [<arg1>]"},
+	{"cmd4", "cmd4 [<arg0>] [-arg1=<string>]"},
+	{"cmd5", "cmd5 [<stringA>] [<intA>] [<boolA>] [-stringB=<string>] [-intB=<int>] [-boolB]"},
+}
+
+func (s *S) TestCommandUsage(c *C) {
+	for _, test := range usageTests {
+		c.Assert(commands.Command(test.name).Usage(), Equals, test.usage)
+	}
+}
@@ -1,6 +1,7 @@
 package mup
 
 import (
+	"fmt"
 	"time"
 
 	"gopkg.in/mgo.v2"
@@ -16,6 +17,13 @@ type Config struct {
 	// Set to -1 to disable.
 	Refresh time.Duration
 
+	// RefreshSettle defines for how long changes to a running plugin must
+	// remain unchanged before regular refreshes act on them, so that a burst
+	// of quick changes restarts the plugin once. Explicit refreshes via
+	// Server.RefreshPlugins act on changes right away. Defaults to one
+	// second. Set to -1 to act on changes as soon as they are observed.
+	RefreshSettle time.Duration
+
 	// Accounts defines which of the IRC accounts defined in the
 	// database this server is responsible for. Defaults to all if nil.
 	// Set to an empty list for handling no accounts in this server.
@@ -25,6 +33,147 @@ type Config struct {
 	// this server is responsible for. Defaults to all if nil. Set to
 	// an empty list for handling no plugins in this server.
 	Plugins []string
+
+	// OrderedStop defines whether plugins are stopped one at a time when
+	// the server is stopped, in the reverse order they were started.
+	// By default all plugins are stopped concurrently.
+	OrderedStop bool
+
+	// IncomingMaxBytes and OutgoingMaxBytes define the size in bytes of
+	// the capped collections holding incoming and outgoing messages when
+	// these are created. Both default to 4MB. Busy deployments may need
+	// larger collections so that messages are not lost before handled.
+	IncomingMaxBytes int
+	OutgoingMaxBytes int
+
+	// DryRun defines whether plugins log the messages they send rather
+	// than sending them. Incoming messages are handled as usual, so the
+	// behavior of plugins may be verified against live traffic. Plugins
+	// may also be put in dry run mode via their "dryrun" config option.
+	DryRun bool
+
+	// SlowHandler defines the average time plugins may spend handling
+	// each message before they are reported as slow in the logs and in
+	// their stats, as slow plugins delay the delivery of messages to all
+	// other plugins. Defaults to no limit.
+	SlowHandler time.Duration
+
+	// HandlerTimeout defines how long plugins may spend handling each
+	// message before the context returned by Message.Context is
+	// cancelled. Handlers are not interrupted, but may select on the
+	// context to give up on slow operations. Defaults to no limit.
+	HandlerTimeout time.Duration
+
+	// IngestAddr defines the address to listen on for HTTP requests that
+	// inject messages from external systems, so plugins may react to them
+	// as if they were sent in the account informed. Requests are POSTs with
+	// a JSON document holding "account", "channel" (optional), "nick", and
+	// "text" fields, an X-Mup-Timestamp header with the signing time in
+	// seconds since the Unix epoch, and an X-Mup-Signature header with
+	// "sha256=" followed by the hex-encoded HMAC-SHA256 of the timestamp,
+	// a dot, and the body, keyed by IngestSecret. Requests signed more than
+	// five minutes away from the current time are rejected. The endpoint
+	// is disabled by default.
+	IngestAddr   string
+	IngestSecret string
+
+	// HTTPAddr defines the address to listen on for HTTP requests to the
+	// handlers registered by plugins via Plugger.HandleHTTP, such as web
+	// dashboards and OAuth callbacks. Each plugin has its handlers served
+	// under paths prefixed by "/<plugin name>/". The counters and timers
+	// updated via Plugger.Count and Plugger.Time are served at "/metrics".
+	// Disabled by default.
+	HTTPAddr string
+
+	// MirrorURL defines a URL that messages sent and received by accounts
+	// are POSTed to, as JSON documents with "direction" ("incoming" or
+	// "outgoing"), "time", "account", "channel", "nick", "command", and
+	// "text" fields, for integration with external systems. Requests carry
+	// an X-Mup-Signature header with "sha256=" followed by the hex-encoded
+	// HMAC-SHA256 of the body keyed by MirrorSecret. Failed requests are
+	// retried with an increasing delay, and messages are buffered so that
+	// a slow endpoint does not delay the bot, dropping the oldest ones if
+	// the buffer fills up. MirrorIncoming and MirrorOutgoing select the
+	// direction of mirrored messages, and both are mirrored if neither
+	// is set. Mirroring is disabled by default.
+	MirrorURL      string
+	MirrorSecret   string
+	MirrorIncoming bool
+	MirrorOutgoing bool
+
+	// Audit enables recording every line written to IRC servers by the
+	// accounts handled by the server in the audit collection, except for
+	// keep-alive pings and pongs. Each document holds the "time", "account",
+	// and "line" fields. The payload of lines that may carry credentials is
+	// redacted: PASS, AUTHENTICATE, and OPER parameters, messages sent to
+	// NickServ, and the OnRegister commands. Lines are recorded independently
+	// from plugins, and not at all by default.
+	//
+	// The audit collection is capped to AuditMaxBytes in size, 4MB by
+	// default, so the oldest lines are dropped as new ones are recorded.
+	Audit         bool
+	AuditMaxBytes int
+
+	// BusyDelay defines how long known commands addressed to the bot may
+	// wait for the plugins to be done with earlier messages before they are
+	// dropped, and the sender is told the bot is overloaded via the
+	// BusyReply text instead. The messages are still observed by plugins
+	// as usual, without running the command. Defaults to no limit.
+	BusyDelay time.Duration
+	BusyReply string
+
+	// CommandCooldown defines the minimum interval between commands run
+	// by the same nick in an account. Commands sent sooner than that are
+	// ignored, unless they are marked as Exempt in their schema. Text that
+	// does not name a known command does not count. The
+	// messages are still observed by plugins as usual, without running
+	// the command. Defaults to no limit.
+	CommandCooldown time.Duration
+
+	// PluginLogLines defines how many of the most recent messages logged
+	// by each plugin are kept in memory, so that they may be inspected
+	// from chat via the "logs" command of the admin plugin. Plugin logs
+	// are not kept by default.
+	PluginLogLines int
+
+	// UnknownCommands defines whether messages addressed to the bot with
+	// a command name not known by any plugin get a reply suggesting the
+	// help command. Messages with punctuation right after the first word,
+	// such as "thanks!", are taken as chat and get no reply. As the reply
+	// is sent by every server that has it set, it should be enabled in at
+	// most one server of a mup instance.
+	UnknownCommands bool
+
+	// PasteURL defines the URL of a paste service that long message texts
+	// are uploaded to when they would be broken into more than PasteLines
+	// lines, so that a link to the full text is sent instead. The text is
+	// POSTed as the request body with PasteToken as a bearer token, and the
+	// first line of the response must hold the URL of the uploaded text.
+	// PasteLines defaults to 5. Long texts are sent in full by default,
+	// and also when the upload fails or takes more than a few seconds.
+	PasteURL   string
+	PasteToken string
+	PasteLines int
+
+	// MoreLines defines how many lines of a long text sent to a nick in a
+	// channel are sent at once. The rest is held back, and the nick is told
+	// to say "more" in the channel to get the next lines, until MoreTimeout
+	// elapses (5 minutes by default). Long texts are sent in full by default.
+	MoreLines   int
+	MoreTimeout time.Duration
+
+	// Proxy defines the URL of a proxy to connect to IRC servers through,
+	// either a SOCKS5 proxy ("socks5://[user:pass@]host:port") or an HTTP
+	// proxy supporting the CONNECT method ("http://[user:pass@]host:port").
+	// By default IRC servers are connected to directly.
+	Proxy string
+
+	// StartupTimeout defines how long Start keeps retrying to reach the
+	// MongoDB database, with an increasing delay between attempts, before
+	// giving up. This allows the server to be started slightly before the
+	// database is ready, as common in orchestrated environments. By default
+	// Start fails right away if the database cannot be reached.
+	StartupTimeout time.Duration
 }
 
 // A Server handles some or all of the duties of a mup instance.
@@ -46,6 +195,7 @@ type Config struct {
 type Server struct {
 	accountManager *accountManager
 	pluginManager  *pluginManager
+	ingestServer   *ingestServer
 }
 
 // Start starts a mup server that handles some or all of the duties
@@ -57,6 +207,14 @@ func Start(config *Config) (*Server, error) {
 	if configCopy.Refresh == 0 {
 		configCopy.Refresh = 3 * time.Second
 	}
+	if configCopy.RefreshSettle == 0 {
+		configCopy.RefreshSettle = time.Second
+	}
+	if configCopy.StartupTimeout > 0 {
+		if err := waitDatabase(configCopy); err != nil {
+			return nil, err
+		}
+	}
 	st.accountManager, err = startAccountManager(configCopy)
 	if err != nil {
 		return nil, err
@@ -66,11 +224,59 @@ func Start(config *Config) (*Server, error) {
 		st.accountManager.Stop()
 		return nil, err
 	}
+	if configCopy.IngestAddr != "" {
+		st.ingestServer, err = startIngestServer(configCopy)
+		if err != nil {
+			st.pluginManager.Stop()
+			st.accountManager.Stop()
+			return nil, err
+		}
+	}
 	return &st, nil
 }
 
+// startupBackoff and startupMaxBackoff define the initial and maximum
+// delays between attempts to reach the database when starting a server.
+var (
+	startupBackoff    = 250 * time.Millisecond
+	startupMaxBackoff = 10 * time.Second
+)
+
+// waitDatabase pings the configured database until it replies or
+// the startup timeout is reached.
+func waitDatabase(config Config) error {
+	session := config.Database.Session.Copy()
+	defer session.Close()
+	deadline := time.Now().Add(config.StartupTimeout)
+	delay := startupBackoff
+	for {
+		err := session.Ping()
+		if err == nil {
+			return nil
+		}
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return fmt.Errorf("cannot reach MongoDB after %v: %v", config.StartupTimeout, err)
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+		logf("Cannot reach MongoDB (retrying in %v): %v", delay, err)
+		time.Sleep(delay)
+		session.Refresh()
+		if delay *= 2; delay > startupMaxBackoff {
+			delay = startupMaxBackoff
+		}
+	}
+}
+
 // Stop synchronously terminates all activities of the mup server.
 func (st *Server) Stop() error {
+	if st.ingestServer != nil {
+		if err := st.ingestServer.Stop(); err != nil {
+			logf("Ingest endpoint failure: %v", err)
+		}
+	}
 	err1 := st.pluginManager.Stop()
 	err2 := st.accountManager.Stop()
 	if err2 != nil {
@@ -90,6 +296,13 @@ func (st *Server) RefreshAccounts() {
 	st.accountManager.Refresh()
 }
 
+// IncomingOverruns returns how many times the incoming capped collection
+// wrapped around before plugins handled all of its messages, causing
+// some of them to be dropped. Each occurrence is also logged.
+func (st *Server) IncomingOverruns() int {
+	return st.pluginManager.Overruns()
+}
+
 // RefreshPlugins reloads from the database all information about
 // the plugins this server is responsible for.
 func (st *Server) RefreshPlugins() {
@@ -1,12 +1,36 @@
 package mup_test
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	. "gopkg.in/check.v1"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/mgo.v2/dbtest"
 	"gopkg.in/mup.v0"
 	"gopkg.in/mup.v0/ldap"
@@ -90,9 +114,13 @@ func (s *ServerSuite) RestartServer(c *C) {
 }
 
 func (s *ServerSuite) ReadUser(c *C) {
+	s.ReadUserAs(c, "mup", "Mup Pet")
+}
+
+func (s *ServerSuite) ReadUserAs(c *C, username, realname string) {
 	s.ReadLine(c, "PASS password")
 	s.ReadLine(c, "NICK mup")
-	s.ReadLine(c, "USER mup 0 0 :Mup Pet")
+	s.ReadLine(c, "USER "+username+" 0 0 :"+realname)
 }
 
 func (s *ServerSuite) SendWelcome(c *C) {
@@ -128,6 +156,25 @@ func (s *ServerSuite) TestConnect(c *C) {
 	// SetUpTest does it all.
 }
 
+func (s *ServerSuite) TestPasswordFile(c *C) {
+	s.StopServer(c)
+
+	path := filepath.Join(c.MkDir(), "password")
+	err := ioutil.WriteFile(path, []byte("filesecret\n"), 0600)
+	c.Assert(err, IsNil)
+
+	accounts := s.session.DB("").C("accounts")
+	err = accounts.UpdateId("one", M{"$set": M{"password": "${file:" + path + "}"}})
+	c.Assert(err, IsNil)
+
+	n := s.NextLineServer()
+	s.server, err = mup.Start(s.config)
+	c.Assert(err, IsNil)
+	s.lserver = s.LineServer(n)
+	s.ReadLine(c, "PASS filesecret")
+	s.ReadLine(c, "NICK mup")
+}
+
 func (s *ServerSuite) TestNickInUse(c *C) {
 	s.SendLine(c, ":n.net 433 * mup :Nickname is already in use.")
 	s.ReadLine(c, "NICK mup_")
@@ -140,6 +187,44 @@ func (s *ServerSuite) TestNickInUse(c *C) {
 	s.ReadLine(c, "NICK mup")
 }
 
+func (s *ServerSuite) TestNickRegain(c *C) {
+	s.StopServer(c)
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.UpdateId("one", M{"$set": M{"regainnick": true, "regainnickserv": "GHOST"}})
+	c.Assert(err, IsNil)
+	s.RestartServer(c)
+
+	s.SendLine(c, ":n.net 433 * mup :Nickname is already in use.")
+	s.ReadLine(c, "NICK mup_")
+	s.SendLine(c, ":n.net 001 mup_ :Welcome!")
+	s.ReadLine(c, "PRIVMSG NickServ :GHOST mup")
+	s.ReadLine(c, "NICK mup")
+	s.SendLine(c, ":n.net 433 mup_ mup :Nickname is already in use.")
+
+	// Others quitting do not matter.
+	s.SendLine(c, ":nick!~user@host QUIT :Bye.")
+	s.Roundtrip(c)
+
+	s.SendLine(c, ":mup!~user@host QUIT :Killed (GHOST command used by mup_)")
+	s.ReadLine(c, "NICK mup")
+	s.SendLine(c, ":mup_!~user@host NICK :mup")
+	s.Roundtrip(c)
+
+	s.StopServer(c)
+	err = accounts.UpdateId("one", M{"$set": M{"regainnickserv": ""}})
+	c.Assert(err, IsNil)
+	s.RestartServer(c)
+
+	s.SendLine(c, ":n.net 433 * mup :Nickname is already in use.")
+	s.ReadLine(c, "NICK mup_")
+	s.SendLine(c, ":n.net 001 mup_ :Welcome!")
+	s.ReadLine(c, "NICK mup")
+	s.SendLine(c, ":n.net 433 mup_ mup :Nickname is already in use.")
+
+	s.SendLine(c, ":mup!~user@host NICK :mup_away")
+	s.ReadLine(c, "NICK mup")
+}
+
 func (s *ServerSuite) TestNickChange(c *C) {
 	s.SendWelcome(c)
 
@@ -163,6 +248,29 @@ func (s *ServerSuite) TestNickChange(c *C) {
 	}
 }
 
+func (s *ServerSuite) TestForcedNickChange(c *C) {
+	s.SendWelcome(c)
+	s.Roundtrip(c)
+
+	// Server renames the bot after registration, with a different case.
+	s.SendLine(c, ":MUP!~user@host NICK :Guest42")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :Guest42: some command")
+	s.Roundtrip(c)
+	time.Sleep(50 * time.Millisecond)
+
+	var msg mup.Message
+	incoming := s.session.DB("").C("incoming")
+	err := incoming.Find(nil).Sort("-$natural").One(&msg)
+	c.Assert(err, IsNil)
+
+	c.Assert(msg.AsNick, Equals, "Guest42")
+	c.Assert(msg.BotText, Equals, "some command")
+
+	// The configured nick is regained on refreshes.
+	s.server.RefreshAccounts()
+	s.ReadLine(c, "NICK mup")
+}
+
 func (s *ServerSuite) TestPingPong(c *C) {
 	s.SendLine(c, "PING :foo")
 	s.ReadLine(c, "PONG :foo")
@@ -234,267 +342,2398 @@ func (s *ServerSuite) TestJoinChannel(c *C) {
 	s.ReadLine(c, "JOIN #c5")
 }
 
-func waitFor(condition func() bool) {
-	now := time.Now()
-	end := now.Add(1 * time.Second)
-	for now.Before(end) {
-		if condition() {
-			return
-		}
-		time.Sleep(50 * time.Millisecond)
-		now = time.Now()
-	}
-}
+func (s *ServerSuite) TestJoinReconnect(c *C) {
+	s.SendWelcome(c)
 
-func (s *ServerSuite) TestIncoming(c *C) {
-	before := time.Now().Add(-2 * time.Second)
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.UpdateId("one", M{"$set": M{"channels": []M{{"name": "#Chan1"}, {"name": "#c2"}, {"name": "#c3"}}}})
+	c.Assert(err, IsNil)
 
-	s.SendWelcome(c)
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :Hello mup!")
+	s.server.RefreshAccounts()
+	s.ReadLine(c, "JOIN #Chan1,#c2,#c3")
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #chan1")
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #c2")
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #c3")
 	s.Roundtrip(c)
-	time.Sleep(500 * time.Millisecond)
 
-	var msg mup.Message
-	incoming := s.session.DB("").C("incoming")
-	err := incoming.Find(nil).Sort("$natural").One(&msg)
-	c.Assert(err, IsNil)
+	// Mixed case channels are not parted and joined again.
+	s.server.RefreshAccounts()
+	s.Roundtrip(c)
 
-	after := time.Now().Add(2 * time.Second)
+	// Reconnect via a bouncer that is still in some of the channels.
+	n := s.NextLineServer()
+	s.lserver.Close()
+	waitFor(func() bool {
+		s.server.RefreshAccounts()
+		return s.NextLineServer() != n
+	})
+	s.lserver = s.LineServer(n)
+	s.ReadUser(c)
 
-	c.Logf("Message time: %s", msg.Time)
+	s.SendWelcome(c)
+	s.ReadLine(c, "JOIN #Chan1,#c2,#c3")
+	s.SendLine(c, ":n.net 353 mup = #chan1 :@mup other")
+	s.SendLine(c, ":n.net 366 mup #chan1 :End of /NAMES list.")
+	s.SendLine(c, ":n.net 353 mup = #c2 :other +mup")
+	s.SendLine(c, ":n.net 366 mup #c2 :End of /NAMES list.")
+	s.SendLine(c, ":n.net 353 mup = #c3 :other")
+	s.SendLine(c, ":n.net 366 mup #c3 :End of /NAMES list.")
+	s.Roundtrip(c)
 
-	c.Assert(msg.Time.After(before), Equals, true)
-	c.Assert(msg.Time.Before(after), Equals, true)
+	// Only the channel not reported as joined is retried, and nothing is parted.
+	s.server.RefreshAccounts()
+	s.ReadLine(c, "JOIN #c3")
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #c3")
+	s.Roundtrip(c)
 
-	msg.Time = time.Time{}
-	msg.Id = ""
-	c.Assert(msg, DeepEquals, mup.Message{
-		Account: "one",
-		Nick:    "nick",
-		User:    "~user",
-		Host:    "host",
-		Command: "PRIVMSG",
-		Text:    "Hello mup!",
-		BotText: "Hello mup!",
-		Bang:    "!",
-		AsNick:  "mup",
-	})
+	s.server.RefreshAccounts()
+	s.Roundtrip(c)
 }
 
-func (s *ServerSuite) TestOutgoing(c *C) {
-	// Stop default server to test the behavior of outgoing messages on start up.
+func (s *ServerSuite) TestJoinAfterMOTD(c *C) {
 	s.StopServer(c)
 
 	accounts := s.session.DB("").C("accounts")
-	err := accounts.UpdateId("one", M{"$set": M{"channels": []M{{"name": "#test"}}}})
-	c.Assert(err, IsNil)
-
-	outgoing := s.session.DB("").C("outgoing")
-	err = outgoing.Insert(
-		&mup.Message{Account: "one", Nick: "someone", Text: "Implicit PRIVMSG."},
-		&mup.Message{Account: "one", Nick: "someone", Text: "Explicit PRIVMSG.", Command: "PRIVMSG"},
-		&mup.Message{Account: "one", Nick: "someone", Text: "Explicit NOTICE.", Command: "NOTICE"},
-	)
+	err := accounts.UpdateId("one", M{"$set": M{
+		"channels":      []M{{"name": "#c1"}},
+		"onregister":    []string{"MODE mup +B"},
+		"joinaftermotd": true,
+	}})
 	c.Assert(err, IsNil)
 
 	s.RestartServer(c)
 	s.SendWelcome(c)
 
-	// The initial JOINs are sent before any messages.
-	s.ReadLine(c, "JOIN #test")
-
-	// Then the messages and their PINGs asking for confirmation, handled by ReadLine.
-	s.ReadLine(c, "PRIVMSG someone :Implicit PRIVMSG.")
-	s.ReadLine(c, "PRIVMSG someone :Explicit PRIVMSG.")
-	s.ReadLine(c, "NOTICE someone :Explicit NOTICE.")
-
-	// Ensure the confirmations are received before restarting.
+	// Nothing is sent until the MOTD is over.
 	s.Roundtrip(c)
+	s.SendLine(c, ":n.net 375 mup :- n.net Message of the Day -")
+	s.SendLine(c, ":n.net 376 mup :End of /MOTD command.")
+	s.ReadLine(c, "MODE mup +B")
+	s.ReadLine(c, "JOIN #c1")
+}
 
-	// This must be ignored. Different account.
-	err = outgoing.Insert(&mup.Message{
-		Account: "two",
-		Nick:    "someone",
-		Text:    "Ignore me.",
-	})
-	c.Assert(err, IsNil)
+func (s *ServerSuite) TestRegisterWithoutWelcome(c *C) {
+	s.StopServer(c)
 
-	// Send another message with the server running.
-	err = outgoing.Insert(&mup.Message{
-		Account: "one",
-		Nick:    "someone",
-		Text:    "Hello again!",
-	})
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.UpdateId("one", M{"$set": M{"channels": []M{{"name": "#c1"}}}})
+	c.Assert(err, IsNil)
+	plugins := s.session.DB("").C("plugins")
+	err = plugins.Insert(M{"_id": "echoA", "targets": []M{{"account": "one"}}})
 	c.Assert(err, IsNil)
 
-	// Do not use the s.ReadLine helper as the message won't be confirmed.
-	c.Assert(s.lserver.ReadLine(), Equals, "PRIVMSG someone :Hello again!")
-	c.Assert(s.lserver.ReadLine(), Matches, "PING :sent:[0-9a-f]+")
-	s.RestartServer(c)
-	s.SendWelcome(c)
+	for _, line := range []string{":n.net 376 mup :End of /MOTD command.", ":n.net 422 mup :MOTD File is missing"} {
+		s.RestartServer(c)
+		s.SendLine(c, line)
+		s.ReadLine(c, "JOIN #c1")
+		s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #c1")
 
-	// The unconfirmed message is resent.
-	c.Assert(s.lserver.ReadLine(), Equals, "JOIN #test")
-	c.Assert(s.lserver.ReadLine(), Equals, "PRIVMSG someone :Hello again!")
-	c.Assert(s.lserver.ReadLine(), Matches, "PING :sent:[0-9a-f]+")
+		// The accepted nick is known, so messages to it are commands.
+		s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A1")
+		s.ReadLine(c, "PRIVMSG nick :[cmd] A1")
+	}
 }
 
-func (s *ServerSuite) TestPlugin(c *C) {
+func (s *ServerSuite) TestAccountStatus(c *C) {
 	s.SendWelcome(c)
-
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A1")
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAmsg A1")
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBcmd B1")
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBmsg B1")
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #c1")
 	s.Roundtrip(c)
 
-	plugins := s.session.DB("").C("plugins")
-	err := plugins.Insert(M{"_id": "echoA", "config": M{"prefix": "A."}, "targets": []M{{"account": "one"}}})
+	type accountStatus struct {
+		State     string
+		Nick      string
+		Channels  []string
+		LastError string
+	}
+	var status accountStatus
+	statuses := s.session.DB("").C("accountstatus")
+	err := statuses.FindId("one").One(&status)
 	c.Assert(err, IsNil)
-	s.server.RefreshPlugins()
+	c.Assert(status, DeepEquals, accountStatus{State: "registered", Nick: "mup", Channels: []string{"#c1"}})
 
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A2")
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAmsg A2")
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBcmd B2")
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBmsg B2")
+	s.SendLine(c, "ERROR :Closing Link: mup (Banned)")
+	s.Roundtrip(c)
+	s.StopServer(c)
 
-	s.ReadLine(c, "PRIVMSG nick :[cmd] A.A1")
-	s.ReadLine(c, "PRIVMSG nick :[msg] A.A1")
-	s.ReadLine(c, "PRIVMSG nick :[cmd] A.A2")
-	s.ReadLine(c, "PRIVMSG nick :[msg] A.A2")
+	status = accountStatus{}
+	err = statuses.FindId("one").One(&status)
+	c.Assert(err, IsNil)
+	c.Assert(status.State, Equals, "disconnected")
+	c.Assert(status.LastError, Equals, "Closing Link: mup (Banned)")
+}
 
-	err = plugins.Insert(M{"_id": "echoB", "config": M{"prefix": "B."}, "targets": []M{{"account": "one"}}})
+func (s *ServerSuite) TestAutoMode(c *C) {
+	s.SendWelcome(c)
+
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.UpdateId("one", M{"$set": M{"channels": []M{{
+		"name":  "#c1",
+		"op":    []string{"Alice"},
+		"voice": []string{"*!~bob@*"},
+	}}}})
 	c.Assert(err, IsNil)
-	s.server.RefreshPlugins()
 
-	s.ReadLine(c, "PRIVMSG nick :[cmd] B.B1")
-	s.ReadLine(c, "PRIVMSG nick :[msg] B.B1")
-	s.ReadLine(c, "PRIVMSG nick :[cmd] B.B2")
-	s.ReadLine(c, "PRIVMSG nick :[msg] B.B2")
+	s.server.RefreshAccounts()
+	s.ReadLine(c, "JOIN #c1")
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #c1")
+	s.SendLine(c, ":n.net 353 mup = #c1 :mup @carol")
+	s.SendLine(c, ":n.net 366 mup #c1 :End of /NAMES list.")
+
+	// Not an operator, so nothing is done.
+	s.SendLine(c, ":alice!~alice@host JOIN #c1")
 	s.Roundtrip(c)
 
-	s.RestartServer(c)
-	s.SendWelcome(c)
+	s.SendLine(c, ":carol!~carol@host MODE #c1 +vo dave mup")
+	s.SendLine(c, ":alice!~alice@host JOIN #c1")
+	s.ReadLine(c, "MODE #c1 +o alice")
+	s.SendLine(c, ":bob!~bob@host JOIN #c1")
+	s.ReadLine(c, "MODE #c1 +v bob")
+	s.SendLine(c, ":eve!~eve@host JOIN #c1")
+	s.SendLine(c, ":bob!~bobby@host JOIN #c1")
+	s.Roundtrip(c)
 
-	s.lserver.SendLine(":nick!~user@host PRIVMSG mup :echoAcmd A3")
-	s.lserver.SendLine(":nick!~user@host PRIVMSG mup :echoAmsg A3")
-	s.lserver.SendLine(":nick!~user@host PRIVMSG mup :echoBcmd B3")
-	s.lserver.SendLine(":nick!~user@host PRIVMSG mup :echoBmsg B3")
+	// Operator status lost.
+	s.SendLine(c, ":carol!~carol@host MODE #c1 -o mup")
+	s.SendLine(c, ":alice!~alice@host JOIN #c1")
+	s.Roundtrip(c)
 
-	s.ReadLine(c, "PRIVMSG nick :[cmd] A.A3")
-	s.ReadLine(c, "PRIVMSG nick :[msg] A.A3")
-	s.ReadLine(c, "PRIVMSG nick :[cmd] B.B3")
-	s.ReadLine(c, "PRIVMSG nick :[msg] B.B3")
+	// Operator status found when listing names.
+	s.SendLine(c, ":n.net 353 mup = #c1 :@mup carol")
+	s.SendLine(c, ":n.net 366 mup #c1 :End of /NAMES list.")
+	s.SendLine(c, ":alice!~alice@host JOIN #c1")
+	s.ReadLine(c, "MODE #c1 +o alice")
+}
 
-	// Ensure the outgoing handler is being properly called.
-	log := c.GetTestLog()
-	c.Assert(log, Matches, `(?s).*\[echoA\] \[out\] \[cmd\] A\.A2\n.*`)
-	c.Assert(log, Matches, `(?s).*\[echoB\] \[out\] \[cmd\] A\.A2\n.*`)
+var testPermSpec = mup.PluginSpec{
+	Name:  "testperm",
+	Start: testPermStart,
+	Commands: schema.Commands{
+		{Name: "anyonecmd"},
+		{Name: "opcmd", Perm: schema.ChannelOp},
+		{Name: "admincmd", Perm: schema.BotAdmin},
+		{Name: "exemptcmd", Exempt: true},
+		{Name: "privatecmd", Private: true, Args: schema.Args{{Name: "arg", Flag: schema.Required}}},
+	},
 }
 
-func (s *ServerSuite) TestPluginTarget(c *C) {
+func init() {
+	mup.RegisterPlugin(&testPermSpec)
+}
+
+type testPermPlugin struct {
+	plugger *mup.Plugger
+}
+
+func testPermStart(plugger *mup.Plugger) mup.Stopper {
+	return &testPermPlugin{plugger}
+}
+
+func (p *testPermPlugin) Stop() error {
+	return nil
+}
+
+func (p *testPermPlugin) HandleCommand(cmd *mup.Command) {
+	p.plugger.Sendf(cmd, "Ran %s.", cmd.Name())
+}
+
+func (s *ServerSuite) TestCommandPerm(c *C) {
+	s.SendWelcome(c)
+
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.UpdateId("one", M{"$set": M{"admins": []string{"Root!*@host", "oper"}, "channels": []M{{"name": "#c1"}}}})
+	c.Assert(err, IsNil)
+	plugins := s.session.DB("").C("plugins")
+	err = plugins.Insert(M{"_id": "testperm", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+
+	s.server.RefreshAccounts()
+	s.server.RefreshPlugins()
+	s.ReadLine(c, "JOIN #c1")
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #c1")
+	s.SendLine(c, ":n.net 353 mup = #c1 :mup @oper user root")
+	s.SendLine(c, ":n.net 366 mup #c1 :End of /NAMES list.")
+
+	s.SendLine(c, ":user!~user@host PRIVMSG #c1 :mup: anyonecmd")
+	s.ReadLine(c, "PRIVMSG #c1 :user: Ran anyonecmd.")
+	s.SendLine(c, ":user!~user@host PRIVMSG #c1 :mup: opcmd")
+	s.ReadLine(c, "PRIVMSG #c1 :user: Must be a channel operator for that.")
+	s.SendLine(c, ":user!~user@host PRIVMSG mup :opcmd")
+	s.ReadLine(c, "PRIVMSG user :Must be a channel operator for that.")
+	s.SendLine(c, ":user!~user@host PRIVMSG #c1 :mup: admincmd")
+	s.ReadLine(c, "PRIVMSG #c1 :user: Must be a bot admin for that.")
+
+	s.SendLine(c, ":oper!~oper@host PRIVMSG #c1 :mup: opcmd")
+	s.ReadLine(c, "PRIVMSG #c1 :oper: Ran opcmd.")
+	s.SendLine(c, ":oper!~oper@host PRIVMSG #c1 :mup: admincmd")
+	s.ReadLine(c, "PRIVMSG #c1 :oper: Must be a bot admin for that.")
+
+	s.SendLine(c, ":root!~root@host PRIVMSG #c1 :mup: opcmd")
+	s.ReadLine(c, "PRIVMSG #c1 :root: Ran opcmd.")
+	s.SendLine(c, ":root!~root@host PRIVMSG mup :admincmd")
+	s.ReadLine(c, "PRIVMSG root :Ran admincmd.")
+	s.SendLine(c, ":root!~root@elsewhere PRIVMSG mup :admincmd")
+	s.ReadLine(c, "PRIVMSG root :Must be a bot admin for that.")
+
+	// Operator status taken away.
+	s.SendLine(c, ":root!~root@host MODE #c1 -o oper")
+	s.SendLine(c, ":oper!~oper@host PRIVMSG #c1 :mup: opcmd")
+	s.ReadLine(c, "PRIVMSG #c1 :oper: Must be a channel operator for that.")
+}
+
+func (s *ServerSuite) TestCommandPrivate(c *C) {
 	s.SendWelcome(c)
 
 	plugins := s.session.DB("").C("plugins")
-	err := plugins.Insert(
-		M{"_id": "echoA", "config": M{"prefix": "A."}, "targets": []M{{"account": "one", "channel": "#chan1"}}},
-		M{"_id": "echoB", "config": M{"prefix": "B."}, "targets": []M{{"account": "one", "channel": "#chan2"}}},
-		M{"_id": "echoC", "config": M{"prefix": "C."}, "targets": []M{{"account": "one"}}},
-	)
+	err := plugins.Insert(M{"_id": "testperm", "targets": []M{{"account": "one"}}})
 	c.Assert(err, IsNil)
 	s.server.RefreshPlugins()
 
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan1 :mup: echoAcmd A1")
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan2 :mup: echoAcmd A2")
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan1 :mup: echoBcmd B1")
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan2 :mup: echoBcmd B2")
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan1 :mup: echoCcmd C1")
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan2 :mup: echoCcmd C2")
+	s.SendLine(c, ":user!~user@host PRIVMSG #c1 :mup: privatecmd arg")
+	s.ReadLine(c, "PRIVMSG user :Ran privatecmd.")
+	s.SendLine(c, ":user!~user@host PRIVMSG #c1 :mup: privatecmd")
+	s.ReadLine(c, "PRIVMSG user :Oops: missing input for argument: arg. Usage: privatecmd <arg>")
+	s.SendLine(c, ":user!~user@host PRIVMSG mup :privatecmd arg")
+	s.ReadLine(c, "PRIVMSG user :Ran privatecmd.")
 
-	s.ReadLine(c, "PRIVMSG #chan1 :nick: [cmd] A.A1")
-	s.ReadLine(c, "PRIVMSG #chan2 :nick: [cmd] B.B2")
-	s.ReadLine(c, "PRIVMSG #chan1 :nick: [cmd] C.C1")
-	s.ReadLine(c, "PRIVMSG #chan2 :nick: [cmd] C.C2")
+	// Other commands are still replied to in the channel.
+	s.SendLine(c, ":user!~user@host PRIVMSG #c1 :mup: anyonecmd")
+	s.ReadLine(c, "PRIVMSG #c1 :user: Ran anyonecmd.")
 }
 
-func (s *ServerSuite) TestPluginUpdates(c *C) {
+func (s *ServerSuite) TestCommandPermNames(c *C) {
 	s.SendWelcome(c)
 
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.UpdateId("one", M{"$set": M{"channels": []M{{"name": "#c1"}}}})
+	c.Assert(err, IsNil)
 	plugins := s.session.DB("").C("plugins")
-	err := plugins.Insert(
-		M{"_id": "echoA", "config": M{"prefix": "A."}, "targets": []M{{"account": "one"}}},
-		M{"_id": "echoB", "config": M{"prefix": "B."}, "targets": []M{{"account": "one", "target": "none"}}},
-		M{"_id": "echoC", "config": M{"prefix": "C."}, "targets": []M{{"account": "one", "target": "#chan"}}},
+	err = plugins.Insert(M{"_id": "testperm", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+
+	s.server.RefreshAccounts()
+	s.server.RefreshPlugins()
+	s.ReadLine(c, "JOIN #c1")
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #c1")
+
+	// Names replies may span multiple messages, and are only
+	// considered once complete.
+	s.SendLine(c, ":n.net 353 mup = #c1 :mup @oper")
+	s.SendLine(c, ":oper!~oper@host PRIVMSG #c1 :mup: opcmd")
+	s.ReadLine(c, "PRIVMSG #c1 :oper: Must be a channel operator for that.")
+	s.SendLine(c, ":n.net 353 mup = #c1 :@other user")
+	s.SendLine(c, ":n.net 366 mup #c1 :End of /NAMES list.")
+
+	s.SendLine(c, ":oper!~oper@host PRIVMSG #c1 :mup: opcmd")
+	s.ReadLine(c, "PRIVMSG #c1 :oper: Ran opcmd.")
+	s.SendLine(c, ":other!~other@host PRIVMSG #c1 :mup: opcmd")
+	s.ReadLine(c, "PRIVMSG #c1 :other: Ran opcmd.")
+
+	// A complete listing replaces the known operators, dropping
+	// those that left unnoticed.
+	s.SendLine(c, ":n.net 353 mup = #c1 :mup @oper")
+	s.SendLine(c, ":n.net 353 mup = #c1 :user")
+	s.SendLine(c, ":n.net 366 mup #c1 :End of /NAMES list.")
+
+	s.SendLine(c, ":oper!~oper@host PRIVMSG #c1 :mup: opcmd")
+	s.ReadLine(c, "PRIVMSG #c1 :oper: Ran opcmd.")
+	s.SendLine(c, ":other!~other@host PRIVMSG #c1 :mup: opcmd")
+	s.ReadLine(c, "PRIVMSG #c1 :other: Must be a channel operator for that.")
+}
+
+func (s *ServerSuite) TestCTCPReplies(c *C) {
+	s.SendWelcome(c)
+
+	// Disabled by default.
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :\x01VERSION\x01")
+	s.Roundtrip(c)
+
+	s.StopServer(c)
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.UpdateId("one", M{"$set": M{"ctcpreplies": true}})
+	c.Assert(err, IsNil)
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :\x01VERSION\x01")
+	s.ReadLine(c, "NOTICE nick :\x01VERSION mup\x01")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :\x01PING 1234\x01")
+	s.ReadLine(c, "NOTICE nick :\x01PING 1234\x01")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :\x01CLIENTINFO\x01")
+	s.ReadLine(c, "NOTICE nick :\x01CLIENTINFO ACTION CLIENTINFO PING TIME VERSION\x01")
+
+	// Neither actions nor replies are answered.
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :\x01ACTION waves\x01")
+	s.SendLine(c, ":nick!~user@host NOTICE mup :\x01VERSION other\x01")
+	s.Roundtrip(c)
+
+	s.StopServer(c)
+	err = accounts.UpdateId("one", M{"$set": M{"ctcpversion": "mup 1.0"}})
+	c.Assert(err, IsNil)
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :\x01version\x01")
+	s.ReadLine(c, "NOTICE nick :\x01VERSION mup 1.0\x01")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :\x01TIME\x01")
+	c.Assert(s.lserver.ReadLine(), Matches, "NOTICE nick :\x01TIME .* \\+0000\x01")
+
+	// Only a few requests from each sender are answered.
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :\x01PING 1\x01")
+	s.ReadLine(c, "NOTICE nick :\x01PING 1\x01")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :\x01PING 2\x01")
+	s.SendLine(c, ":other!~user@host PRIVMSG mup :\x01PING 3\x01")
+	s.ReadLine(c, "NOTICE other :\x01PING 3\x01")
+
+	// Replies go through the outgoing queue like any other message.
+	var msg Message
+	err = s.session.DB("").C("outgoing").Find(M{"nick": "other"}).One(&msg)
+	c.Assert(err, IsNil)
+	c.Assert(msg.Account, Equals, "one")
+	c.Assert(msg.Command, Equals, "NOTICE")
+	c.Assert(msg.Text, Equals, "\x01PING 3\x01")
+}
+
+func (s *ServerSuite) TestInvite(c *C) {
+	s.SendWelcome(c)
+
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.UpdateId("one", M{"$set": M{"admins": []string{"admin!*@host", "nick"}, "keepinvites": true, "channels": []M{{"name": "#c1"}}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshAccounts()
+	s.ReadLine(c, "JOIN #c1")
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #c1")
+
+	// Invitations from others are ignored by default, even if their
+	// nick alone is listed as an admin.
+	s.SendLine(c, ":nick!~user@host INVITE mup :#spam")
+	s.SendLine(c, ":admin!~user@elsewhere INVITE mup :#spam")
+	s.Roundtrip(c)
+
+	s.SendLine(c, ":Admin!~user@host INVITE mup :#new")
+	s.ReadLine(c, "JOIN #new")
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #new")
+	s.Roundtrip(c)
+
+	var info struct{ Channels []struct{ Name string } }
+	waitFor(func() bool {
+		err := accounts.FindId("one").One(&info)
+		return err == nil && len(info.Channels) == 2
+	})
+	c.Assert(info.Channels, HasLen, 2)
+	c.Assert(info.Channels[1].Name, Equals, "#new")
+
+	// Refreshing does not leave the channel.
+	s.server.RefreshAccounts()
+	s.Roundtrip(c)
+
+	// Accept invitations from anyone, without keeping them.
+	err = accounts.UpdateId("one", M{"$set": M{"invites": "any", "keepinvites": false}})
+	c.Assert(err, IsNil)
+	s.server.RefreshAccounts()
+	s.SendLine(c, ":nick!~user@host INVITE mup #other")
+	s.ReadLine(c, "JOIN #other")
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #other")
+	s.server.RefreshAccounts()
+	s.Roundtrip(c)
+
+	err = accounts.FindId("one").One(&info)
+	c.Assert(err, IsNil)
+	c.Assert(info.Channels, HasLen, 2)
+}
+
+func (s *ServerSuite) TestJoinChannelBatches(c *C) {
+	s.SendWelcome(c)
+
+	// Each channel name takes 100 bytes, so at most 5 fit in a 512 bytes line.
+	var channels []M
+	var names []string
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("#%s%02d", strings.Repeat("c", 97), i)
+		channels = append(channels, M{"name": name})
+		names = append(names, name)
+	}
+
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.UpdateId("one", M{"$set": M{"channels": channels, "joindelay": "10ms"}})
+	c.Assert(err, IsNil)
+
+	s.server.RefreshAccounts()
+	s.ReadLine(c, "JOIN "+strings.Join(names[0:5], ","))
+	s.ReadLine(c, "JOIN "+strings.Join(names[5:10], ","))
+	s.ReadLine(c, "JOIN "+strings.Join(names[10:12], ","))
+
+	// Confirm only some of them, forcing it to retry the others.
+	for _, name := range names[:4] {
+		s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN "+name)
+	}
+	s.Roundtrip(c)
+
+	s.server.RefreshAccounts()
+	s.ReadLine(c, "JOIN "+strings.Join(names[4:9], ","))
+	s.ReadLine(c, "JOIN "+strings.Join(names[9:12], ","))
+
+	// Respect the line length advertised by the server.
+	s.SendLine(c, ":n.net 005 mup CHANTYPES=# LINELEN=320 :are supported by this server")
+	s.Roundtrip(c)
+
+	s.server.RefreshAccounts()
+	s.ReadLine(c, "JOIN "+strings.Join(names[4:7], ","))
+	s.ReadLine(c, "JOIN "+strings.Join(names[7:10], ","))
+	s.ReadLine(c, "JOIN "+strings.Join(names[10:12], ","))
+}
+
+func (s *ServerSuite) TestJoinDelay(c *C) {
+	s.SendWelcome(c)
+
+	var channels []M
+	var names []string
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("#%s%02d", strings.Repeat("c", 97), i)
+		channels = append(channels, M{"name": name})
+		names = append(names, name)
+	}
+
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.UpdateId("one", M{"$set": M{"channels": channels, "joindelay": "100ms"}})
+	c.Assert(err, IsNil)
+
+	start := time.Now()
+	s.server.RefreshAccounts()
+	s.ReadLine(c, "JOIN "+strings.Join(names[0:5], ","))
+
+	// Outgoing messages are not held back while joins are pending.
+	err = s.session.DB("").C("outgoing").Insert(&mup.Message{Account: "one", Nick: "nick", Text: "Not blocked."})
+	c.Assert(err, IsNil)
+	s.ReadLine(c, "PRIVMSG nick :Not blocked.")
+	c.Assert(time.Since(start) < 100*time.Millisecond, Equals, true)
+
+	s.ReadLine(c, "JOIN "+strings.Join(names[5:10], ","))
+	c.Assert(time.Since(start) >= 100*time.Millisecond, Equals, true)
+	s.ReadLine(c, "JOIN "+strings.Join(names[10:12], ","))
+	c.Assert(time.Since(start) >= 200*time.Millisecond, Equals, true)
+}
+
+type testSigilPlugin struct {
+	plugger *mup.Plugger
+}
+
+func (p *testSigilPlugin) Stop() error {
+	return nil
+}
+
+func (p *testSigilPlugin) HandleCommand(cmd *mup.Command) {
+	var args struct{ Word string }
+	cmd.Args(&args)
+	p.plugger.Sendf(cmd, "[%s] %s", p.plugger.Name(), args.Word)
+}
+
+func sigilPluginSpec(name, prefix string) *mup.PluginSpec {
+	return &mup.PluginSpec{
+		Name:     name,
+		Prefixes: []string{prefix},
+		Start: func(plugger *mup.Plugger) mup.Stopper {
+			return &testSigilPlugin{plugger}
+		},
+		Commands: schema.Commands{{
+			Name: "define",
+			Args: schema.Args{{Name: "word", Flag: schema.Required}},
+		}},
+	}
+}
+
+func init() {
+	mup.RegisterPlugin(sigilPluginSpec("sigilA", "?"))
+	mup.RegisterPlugin(sigilPluginSpec("sigilB", "%%"))
+}
+
+func (s *ServerSuite) TestCommandPrefixes(c *C) {
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	for _, name := range []string{"sigilA", "sigilB"} {
+		err := plugins.Insert(M{"_id": name, "targets": []M{{"account": "one"}}})
+		c.Assert(err, IsNil)
+	}
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :?define foo")
+	s.ReadLine(c, "PRIVMSG #chan :nick: [sigilA] foo")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :%%define bar")
+	s.ReadLine(c, "PRIVMSG #chan :nick: [sigilB] bar")
+
+	// Prefixes must be followed by the command name.
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :? define foo")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :%define foo")
+	s.Roundtrip(c)
+
+	// Both plugins handle the command when addressed directly.
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :define baz")
+	line1 := s.lserver.ReadLine()
+	s.lserver.ReadLine()
+	line2 := s.lserver.ReadLine()
+	s.lserver.ReadLine()
+	lines := []string{line1, line2}
+	sort.Strings(lines)
+	c.Assert(lines, DeepEquals, []string{"PRIVMSG nick :[sigilA] baz", "PRIVMSG nick :[sigilB] baz"})
+}
+
+func (s *ServerSuite) TestCommandPrefixClash(c *C) {
+	defer mup.SaveRegistry()()
+
+	spec := sigilPluginSpec("sigilC", "?")
+	c.Assert(func() { mup.RegisterPlugin(spec) }, PanicMatches, `plugin sigilC cannot register command prefix "\?" already registered by plugin sigilA`)
+
+	// The plugin was not registered.
+	spec.Prefixes = []string{"!?"}
+	mup.RegisterPlugin(spec)
+}
+
+func (s *ServerSuite) TestRegisterPluginTwice(c *C) {
+	defer mup.SaveRegistry()()
+
+	spec := sigilPluginSpec("sigilA", "?!")
+	c.Assert(func() { mup.RegisterPlugin(spec) }, PanicMatches, `plugin sigilA registered at .*/server_test\.go:[0-9]+ was already registered at .*/server_test\.go:[0-9]+ \(is its package imported via multiple paths\?\)`)
+}
+
+var testGreetSpec = mup.PluginSpec{
+	Name:  "testgreet",
+	Start: testGreetStart,
+}
+
+func init() {
+	mup.RegisterPlugin(&testGreetSpec)
+}
+
+type testGreetPlugin struct {
+	plugger *mup.Plugger
+}
+
+func testGreetStart(plugger *mup.Plugger) mup.Stopper {
+	return &testGreetPlugin{plugger}
+}
+
+func (p *testGreetPlugin) Stop() error {
+	return nil
+}
+
+func (p *testGreetPlugin) HandleMembership(msg *mup.Message) {
+	switch msg.Command {
+	case "JOIN":
+		p.plugger.SendChannelf(msg, "Welcome to %s, %s!", msg.Channel, msg.Nick)
+	case "PART":
+		p.plugger.SendChannelf(msg, "Farewell, %s.", msg.Nick)
+	case "QUIT":
+		p.plugger.Sendf(mup.Address{Account: msg.Account, Nick: "admin"}, "%s quit.", msg.Nick)
+	}
+}
+
+func (s *ServerSuite) TestMembershipHandler(c *C) {
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "testgreet", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	// The bot joining isn't reported.
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #c1")
+	s.Roundtrip(c)
+
+	s.SendLine(c, ":alice!~alice@host JOIN #c1")
+	s.ReadLine(c, "PRIVMSG #c1 :Welcome to #c1, alice!")
+	s.SendLine(c, ":bob!~bob@host JOIN :#c1")
+	s.ReadLine(c, "PRIVMSG #c1 :Welcome to #c1, bob!")
+	s.SendLine(c, ":alice!~alice@host PART #c1 :Later")
+	s.ReadLine(c, "PRIVMSG #c1 :Farewell, alice.")
+	s.SendLine(c, ":bob!~bob@host QUIT :Bye")
+	s.ReadLine(c, "PRIVMSG admin :bob quit.")
+}
+
+var testWallopsSpec = mup.PluginSpec{
+	Name:  "testwallops",
+	Start: testWallopsStart,
+}
+
+func init() {
+	mup.RegisterPlugin(&testWallopsSpec)
+}
+
+type testWallopsPlugin struct {
+	plugger *mup.Plugger
+}
+
+func testWallopsStart(plugger *mup.Plugger) mup.Stopper {
+	return &testWallopsPlugin{plugger}
+}
+
+func (p *testWallopsPlugin) Stop() error {
+	return nil
+}
+
+func (p *testWallopsPlugin) HandleMessage(msg *mup.Message) {
+	if msg.Command == "WALLOPS" {
+		p.plugger.Sendf(mup.Address{Account: msg.Account, Nick: "admin"}, "%s says: %s", msg.Nick, msg.Text)
+	}
+}
+
+func (s *ServerSuite) TestWallops(c *C) {
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "testwallops", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	accounts := s.session.DB("").C("accounts")
+	err = accounts.UpdateId("one", M{"$set": M{"wallops": true}})
+	c.Assert(err, IsNil)
+	s.server.RefreshAccounts()
+	s.ReadLine(c, "MODE mup +w")
+
+	s.SendLine(c, ":oper!~oper@host WALLOPS :Server going down.")
+	s.ReadLine(c, "PRIVMSG admin :oper says: Server going down.")
+
+	// Further refreshes do not repeat the mode change.
+	s.server.RefreshAccounts()
+	s.Roundtrip(c)
+
+	err = accounts.UpdateId("one", M{"$set": M{"wallops": false}})
+	c.Assert(err, IsNil)
+	s.server.RefreshAccounts()
+	s.ReadLine(c, "MODE mup -w")
+}
+
+var testTimeSpec = mup.PluginSpec{
+	Name:  "testtime",
+	Start: testTimeStart,
+}
+
+func init() {
+	mup.RegisterPlugin(&testTimeSpec)
+}
+
+type testTimePlugin struct {
+	plugger *mup.Plugger
+}
+
+func testTimeStart(plugger *mup.Plugger) mup.Stopper {
+	return &testTimePlugin{plugger}
+}
+
+func (p *testTimePlugin) Stop() error {
+	return nil
+}
+
+func (p *testTimePlugin) HandleMessage(msg *mup.Message) {
+	if msg.BotText == "time" {
+		p.plugger.Sendf(msg, "Incoming time in UTC: %v", msg.Time.Location() == time.UTC)
+	}
+}
+
+func (p *testTimePlugin) HandleOutgoing(msg *mup.Message) {
+	if strings.HasPrefix(msg.Text, "Incoming time") {
+		p.plugger.Sendf(mup.Address{Account: msg.Account, Nick: msg.Nick}, "Outgoing time in UTC: %v", msg.Time.Location() == time.UTC)
+	}
+}
+
+func (s *ServerSuite) TestMessageTimeUTC(c *C) {
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "testtime", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	// Times are read back from the incoming and outgoing collections
+	// in the local timezone, and must be handed to plugins in UTC.
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :time")
+	s.ReadLine(c, "PRIVMSG nick :Incoming time in UTC: true")
+	s.ReadLine(c, "PRIVMSG nick :Outgoing time in UTC: true")
+}
+
+// stopsPromptly asserts that stop returns without errors well before
+// any network timeouts, as loops must return as soon as they're stopped.
+func stopsPromptly(c *C, stop func() error) {
+	stopped := make(chan error, 1)
+	go func() { stopped <- stop() }()
+	select {
+	case err := <-stopped:
+		c.Assert(err, IsNil)
+	case <-time.After(time.Second):
+		c.Fatalf("Did not stop promptly")
+	}
+}
+
+func (s *ServerSuite) TestStopPromptly(c *C) {
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "echoA", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A1")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A1")
+
+	// With the connection gone, both the account manager and the
+	// plugin manager loops must return right away.
+	s.lserver.Close()
+	s.lserver = nil
+	stopsPromptly(c, s.server.Stop)
+	s.server = nil
+}
+
+func waitFor(condition func() bool) {
+	now := time.Now()
+	end := now.Add(1 * time.Second)
+	for now.Before(end) {
+		if condition() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		now = time.Now()
+	}
+}
+
+func (s *ServerSuite) TestUsernameRealname(c *C) {
+	s.StopServer(c)
+
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.UpdateId("one", M{"$set": M{"username": "bot", "realname": "The Friendly Bot"}})
+	c.Assert(err, IsNil)
+
+	n := s.NextLineServer()
+	s.server, err = mup.Start(s.config)
+	c.Assert(err, IsNil)
+	s.lserver = s.LineServer(n)
+	s.ReadUserAs(c, "bot", "The Friendly Bot")
+	s.SendWelcome(c)
+	s.Roundtrip(c)
+}
+
+func (s *ServerSuite) TestDialIRC(c *C) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	var addrs []string
+	mup.TestDialIRC = func(addr string) (net.Conn, error) {
+		addrs = append(addrs, addr)
+		return client, nil
+	}
+	defer func() {
+		mup.TestDialIRC = nil
+	}()
+
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.Insert(M{"_id": "two", "host": "irc.example.com:6667", "nick": "other"})
+	c.Assert(err, IsNil)
+	s.server.RefreshAccounts()
+
+	r := bufio.NewReader(server)
+	readLine := func() string {
+		line, err := r.ReadString('\n')
+		c.Assert(err, IsNil)
+		return strings.TrimSuffix(line, "\r\n")
+	}
+	c.Assert(readLine(), Equals, "NICK other")
+	c.Assert(readLine(), Equals, "USER mup 0 0 :Mup Pet")
+	fmt.Fprintf(server, ":n.net 001 other :Welcome!\r\nPING :pipe\r\n")
+	c.Assert(readLine(), Equals, "PONG :pipe")
+
+	c.Assert(addrs, DeepEquals, []string{"irc.example.com:6667"})
+}
+
+// testCertificate returns a new self-signed certificate and its key, in PEM format.
+func testCertificate(c *C, name string) (certPEM, keyPEM string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return certPEM, keyPEM
+}
+
+// startSASL adds an account that authenticates via SASL EXTERNAL over TLS,
+// with any extra settings provided, and returns the server side of its
+// connection after the TLS handshake plus a function to read lines from it.
+// The returned function must be called to clean up once done.
+func (s *ServerSuite) startSASL(c *C, extra M) (conn *tls.Conn, readLine func() string, done func()) {
+	client, server := net.Pipe()
+	mup.TestDialIRC = func(addr string) (net.Conn, error) {
+		return client, nil
+	}
+	done = func() {
+		mup.TestDialIRC = nil
+		server.Close()
+	}
+
+	serverCert, serverKey := testCertificate(c, "irc.example.com")
+	clientCert, clientKey := testCertificate(c, "other")
+
+	pair, err := tls.X509KeyPair([]byte(serverCert), []byte(serverKey))
+	c.Assert(err, IsNil)
+	conn = tls.Server(server, &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+
+	info := M{
+		"_id":         "two",
+		"host":        "irc.example.com:6697",
+		"nick":        "other",
+		"tls":         true,
+		"tlsinsecure": true,
+		"tlscert":     clientCert,
+		"tlskey":      clientKey,
+		"sasl":        "external",
+	}
+	for k, v := range extra {
+		info[k] = v
+	}
+	err = s.session.DB("").C("accounts").Insert(info)
+	c.Assert(err, IsNil)
+	s.server.RefreshAccounts()
+
+	c.Assert(conn.Handshake(), IsNil)
+	peerCerts := conn.ConnectionState().PeerCertificates
+	c.Assert(peerCerts, HasLen, 1)
+	c.Assert(peerCerts[0].Subject.CommonName, Equals, "other")
+
+	r := bufio.NewReader(conn)
+	readLine = func() string {
+		line, err := r.ReadString('\n')
+		c.Assert(err, IsNil)
+		return strings.TrimSuffix(line, "\r\n")
+	}
+	c.Assert(readLine(), Equals, "CAP REQ :sasl")
+	c.Assert(readLine(), Equals, "NICK other")
+	c.Assert(readLine(), Equals, "USER mup 0 0 :Mup Pet")
+	fmt.Fprintf(conn, ":n.net CAP * ACK :sasl\r\n")
+	c.Assert(readLine(), Equals, "AUTHENTICATE EXTERNAL")
+	return conn, readLine, done
+}
+
+func (s *ServerSuite) TestSASLExternal(c *C) {
+	conn, readLine, done := s.startSASL(c, nil)
+	defer done()
+
+	fmt.Fprintf(conn, ":n.net NOTICE * :*** Checking Ident\r\n")
+	fmt.Fprintf(conn, "AUTHENTICATE +\r\n")
+	c.Assert(readLine(), Equals, "AUTHENTICATE +")
+	fmt.Fprintf(conn, ":n.net 900 other other!mup@host other :You are now logged in as other\r\n")
+	fmt.Fprintf(conn, ":n.net NOTICE * :*** Found your hostname\r\n")
+	fmt.Fprintf(conn, ":n.net 903 other :SASL authentication successful\r\n")
+	c.Assert(readLine(), Equals, "CAP END")
+	fmt.Fprintf(conn, ":n.net 001 other :Welcome!\r\nPING :pipe\r\n")
+	c.Assert(readLine(), Equals, "PONG :pipe")
+	c.Assert(c.GetTestLog(), Matches, `(?s).*\[two\] SASL authentication succeeded\..*`)
+}
+
+func (s *ServerSuite) TestSASLFailure(c *C) {
+	conn, readLine, done := s.startSASL(c, nil)
+	defer done()
+
+	fmt.Fprintf(conn, "AUTHENTICATE +\r\n")
+	c.Assert(readLine(), Equals, "AUTHENTICATE +")
+	fmt.Fprintf(conn, ":n.net 904 other :SASL authentication failed\r\n")
+	c.Assert(readLine(), Equals, "CAP END")
+
+	// Late numerics are ignored.
+	fmt.Fprintf(conn, ":n.net 906 other :SASL authentication aborted\r\n")
+	fmt.Fprintf(conn, ":n.net 001 other :Welcome!\r\nPING :pipe\r\n")
+	c.Assert(readLine(), Equals, "PONG :pipe")
+	c.Assert(c.GetTestLog(), Matches, `(?s).*\[two\] SASL authentication failed: SASL authentication failed\n.*\[two\] Proceeding without SASL authentication\..*`)
+}
+
+func (s *ServerSuite) TestSASLRequired(c *C) {
+	conn, readLine, done := s.startSASL(c, M{"saslrequire": true})
+	defer done()
+
+	fmt.Fprintf(conn, "AUTHENTICATE +\r\n")
+	c.Assert(readLine(), Equals, "AUTHENTICATE +")
+	fmt.Fprintf(conn, ":n.net 904 other :SASL authentication failed\r\n")
+
+	// The connection is dropped rather than registering unauthenticated.
+	_, err := bufio.NewReader(conn).ReadString('\n')
+	c.Assert(err, NotNil)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*\[two\] While authenticating on IRC server: SASL authentication failed: SASL authentication failed.*`)
+}
+
+func (s *ServerSuite) TestSASLTimeout(c *C) {
+	defer mup.SetSASLTimeout(100 * time.Millisecond)()
+
+	conn, readLine, done := s.startSASL(c, nil)
+	defer done()
+
+	// The server never replies to the authentication request.
+	c.Assert(readLine(), Equals, "AUTHENTICATE *")
+	c.Assert(readLine(), Equals, "CAP END")
+	fmt.Fprintf(conn, ":n.net 001 other :Welcome!\r\nPING :pipe\r\n")
+	c.Assert(readLine(), Equals, "PONG :pipe")
+	c.Assert(c.GetTestLog(), Matches, `(?s).*\[two\] SASL authentication failed: timed out.*`)
+}
+
+func (s *ServerSuite) TestIncoming(c *C) {
+	before := time.Now().Add(-2 * time.Second)
+
+	s.SendWelcome(c)
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :Hello mup!")
+	s.Roundtrip(c)
+	time.Sleep(500 * time.Millisecond)
+
+	var msg mup.Message
+	incoming := s.session.DB("").C("incoming")
+	err := incoming.Find(nil).Sort("$natural").One(&msg)
+	c.Assert(err, IsNil)
+
+	after := time.Now().Add(2 * time.Second)
+
+	c.Logf("Message time: %s", msg.Time)
+
+	c.Assert(msg.Time.After(before), Equals, true)
+	c.Assert(msg.Time.Before(after), Equals, true)
+
+	msg.Time = time.Time{}
+	msg.Id = ""
+	c.Assert(msg, DeepEquals, mup.Message{
+		Account: "one",
+		Nick:    "nick",
+		User:    "~user",
+		Host:    "host",
+		Command: "PRIVMSG",
+		Text:    "Hello mup!",
+		BotText: "Hello mup!",
+		Bang:    "!",
+		AsNick:  "mup",
+	})
+}
+
+func (s *ServerSuite) ingestPost(c *C, secret string, payload M) int {
+	return s.ingestPostAt(c, secret, time.Now(), payload)
+}
+
+func (s *ServerSuite) ingestPostAt(c *C, secret string, signed time.Time, payload M) int {
+	body, err := json.Marshal(payload)
+	c.Assert(err, IsNil)
+	timestamp := strconv.FormatInt(signed.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	req, err := http.NewRequest("POST", "http://"+s.server.IngestAddr(), bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	req.Header.Set("X-Mup-Timestamp", timestamp)
+	req.Header.Set("X-Mup-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (s *ServerSuite) TestIngest(c *C) {
+	s.config.IngestAddr = "127.0.0.1:0"
+	s.config.IngestSecret = "secret"
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "echoA", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	code := s.ingestPost(c, "secret", M{"account": "one", "nick": "ext", "text": "echoAcmd Hello from outside."})
+	c.Assert(code, Equals, http.StatusAccepted)
+	s.ReadLine(c, "PRIVMSG ext :[cmd] Hello from outside.")
+
+	code = s.ingestPost(c, "secret", M{"account": "one", "channel": "#chan", "nick": "ext", "text": "mup: echoAcmd In a channel."})
+	c.Assert(code, Equals, http.StatusAccepted)
+	s.ReadLine(c, "PRIVMSG #chan :ext: [cmd] In a channel.")
+
+	// Requests signed with a different secret are rejected.
+	code = s.ingestPost(c, "wrong", M{"account": "one", "nick": "ext", "text": "echoAcmd Rejected."})
+	c.Assert(code, Equals, http.StatusUnauthorized)
+
+	// And so are requests signed too long ago, as they may be replayed.
+	code = s.ingestPostAt(c, "secret", time.Now().Add(-10*time.Minute), M{"account": "one", "nick": "ext", "text": "echoAcmd Rejected."})
+	c.Assert(code, Equals, http.StatusUnauthorized)
+
+	// Nicks cannot smuggle a different user or host into the prefix.
+	code = s.ingestPost(c, "secret", M{"account": "one", "nick": "root!root@host", "text": "echoAcmd Rejected."})
+	c.Assert(code, Equals, http.StatusBadRequest)
+
+	// Messages for unknown accounts are rejected as well.
+	code = s.ingestPost(c, "secret", M{"account": "unknown", "nick": "ext", "text": "echoAcmd Rejected."})
+	c.Assert(code, Equals, http.StatusNotFound)
+
+	s.Roundtrip(c)
+}
+
+func (s *ServerSuite) TestAudit(c *C) {
+	err := s.session.DB("").C("accounts").UpdateId("one", M{"$set": M{"onregister": []string{"OPER mup s3cret"}}})
+	c.Assert(err, IsNil)
+	s.config.Audit = true
+	s.RestartServer(c)
+	s.SendWelcome(c)
+	s.ReadLine(c, "OPER mup s3cret")
+
+	err = s.session.DB("").C("outgoing").Insert(&mup.Message{Account: "one", Nick: "NickServ", Text: "IDENTIFY s3cret"})
+	c.Assert(err, IsNil)
+	s.ReadLine(c, "PRIVMSG NickServ :IDENTIFY s3cret")
+	err = s.session.DB("").C("outgoing").Insert(&mup.Message{Account: "one", Channel: "#chan", Text: "Hello channel!"})
+	c.Assert(err, IsNil)
+	s.ReadLine(c, "PRIVMSG #chan :Hello channel!")
+	s.Roundtrip(c)
+
+	// Pending lines are recorded before the server stops.
+	s.StopServer(c)
+
+	var records []struct {
+		Time    time.Time
+		Account string
+		Line    string
+	}
+	err = s.session.DB("").C("audit").Find(nil).Sort("$natural").All(&records)
+	c.Assert(err, IsNil)
+	var lines []string
+	for _, record := range records {
+		c.Assert(record.Account, Equals, "one")
+		c.Assert(record.Time.IsZero(), Equals, false)
+		lines = append(lines, record.Line)
+	}
+	c.Assert(len(lines) >= 6, Equals, true)
+	c.Assert(lines[:6], DeepEquals, []string{
+		"PASS <redacted>",
+		"NICK mup",
+		"USER mup 0 0 :Mup Pet",
+		"OPER <redacted>",
+		"PRIVMSG NickServ :<redacted>",
+		"PRIVMSG #chan :Hello channel!",
+	})
+}
+
+func (s *ServerSuite) TestMirror(c *C) {
+	defer mup.SetMirrorRetry(3, 10*time.Millisecond)()
+
+	var mu sync.Mutex
+	var posted []M
+	failures := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		c.Check(err, IsNil)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		c.Check(req.Header.Get("X-Mup-Signature"), Equals, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload M
+		c.Check(json.Unmarshal(body, &payload), IsNil)
+		delete(payload, "time")
+		posted = append(posted, payload)
+	}))
+	defer srv.Close()
+
+	s.config.MirrorURL = srv.URL
+	s.config.MirrorSecret = "secret"
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :Hello mup!")
+	s.Roundtrip(c)
+
+	err := s.session.DB("").C("outgoing").Insert(&mup.Message{Account: "one", Channel: "#chan", Text: "Hello channel!"})
+	c.Assert(err, IsNil)
+	s.ReadLine(c, "PRIVMSG #chan :Hello channel!")
+
+	waitFor(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(posted) == 2
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(posted, DeepEquals, []M{{
+		"direction": "incoming",
+		"account":   "one",
+		"nick":      "nick",
+		"command":   "PRIVMSG",
+		"text":      "Hello mup!",
+	}, {
+		"direction": "outgoing",
+		"account":   "one",
+		"channel":   "#chan",
+		"command":   "PRIVMSG",
+		"text":      "Hello channel!",
+	}})
+}
+
+func (s *ServerSuite) TestCharset(c *C) {
+	s.StopServer(c)
+
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.UpdateId("one", M{"$set": M{"charset": "cp1252"}})
+	c.Assert(err, IsNil)
+
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :Ol\xe1, a\xe7\xe3o \x80!")
+	s.Roundtrip(c)
+	time.Sleep(50 * time.Millisecond)
+
+	var msg mup.Message
+	incoming := s.session.DB("").C("incoming")
+	err = incoming.Find(M{"command": "PRIVMSG"}).Sort("-$natural").One(&msg)
+	c.Assert(err, IsNil)
+	c.Assert(msg.Text, Equals, "Olá, ação €!")
+
+	outgoing := s.session.DB("").C("outgoing")
+	err = outgoing.Insert(&mup.Message{Account: "one", Nick: "nick", Text: "Olá, ação € →!"})
+	c.Assert(err, IsNil)
+	s.ReadLine(c, "PRIVMSG nick :Ol\xe1, a\xe7\xe3o \x80 ?!")
+}
+
+func (s *ServerSuite) TestOutgoingBatchedConfirmation(c *C) {
+	s.StopServer(c)
+
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.UpdateId("one", M{"$set": M{"confirmevery": 3, "confirmdelay": "100ms"}})
+	c.Assert(err, IsNil)
+
+	outgoing := s.session.DB("").C("outgoing")
+	for i := 1; i <= 4; i++ {
+		err = outgoing.Insert(&mup.Message{Account: "one", Nick: "someone", Text: fmt.Sprintf("Message %d.", i)})
+		c.Assert(err, IsNil)
+	}
+	var msgs []mup.Message
+	err = outgoing.Find(nil).Sort("$natural").All(&msgs)
+	c.Assert(err, IsNil)
+	c.Assert(msgs, HasLen, 4)
+
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	lastId := func() bson.ObjectId {
+		var info struct{ LastId bson.ObjectId }
+		err := accounts.FindId("one").One(&info)
+		c.Assert(err, IsNil)
+		return info.LastId
+	}
+
+	// A single PING confirms the first three messages.
+	c.Assert(s.lserver.ReadLine(), Equals, "PRIVMSG someone :Message 1.")
+	c.Assert(s.lserver.ReadLine(), Equals, "PRIVMSG someone :Message 2.")
+	c.Assert(s.lserver.ReadLine(), Equals, "PRIVMSG someone :Message 3.")
+	c.Assert(s.lserver.ReadLine(), Equals, "PING :sent:"+msgs[2].Id.Hex())
+	s.SendLine(c, "PONG :sent:"+msgs[2].Id.Hex())
+	waitFor(func() bool { return lastId() == msgs[2].Id })
+	c.Assert(lastId(), Equals, msgs[2].Id)
+
+	// The last one is confirmed once the delay elapses.
+	c.Assert(s.lserver.ReadLine(), Equals, "PRIVMSG someone :Message 4.")
+	c.Assert(s.lserver.ReadLine(), Equals, "PING :sent:"+msgs[3].Id.Hex())
+	s.SendLine(c, "PONG :sent:"+msgs[3].Id.Hex())
+	waitFor(func() bool { return lastId() == msgs[3].Id })
+	c.Assert(lastId(), Equals, msgs[3].Id)
+}
+
+func (s *ServerSuite) TestOutgoingExpires(c *C) {
+	s.StopServer(c)
+
+	// Messages queued while the account was offline.
+	outgoing := s.session.DB("").C("outgoing")
+	err := outgoing.Insert(
+		&mup.Message{Account: "one", Nick: "someone", Text: "No expiry."},
+		&mup.Message{Account: "one", Nick: "someone", Text: "Expired.", Expires: time.Now().Add(-time.Hour)},
+		&mup.Message{Account: "one", Nick: "someone", Text: "Not expired yet.", Expires: time.Now().Add(time.Hour)},
+	)
+	c.Assert(err, IsNil)
+
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	s.ReadLine(c, "PRIVMSG someone :No expiry.")
+	s.ReadLine(c, "PRIVMSG someone :Not expired yet.")
+	s.Roundtrip(c)
+
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Dropping outgoing message that expired before being sent: PRIVMSG someone :Expired\..*`)
+}
+
+func (s *ServerSuite) TestOutgoing(c *C) {
+	// Stop default server to test the behavior of outgoing messages on start up.
+	s.StopServer(c)
+
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.UpdateId("one", M{"$set": M{"channels": []M{{"name": "#test"}}}})
+	c.Assert(err, IsNil)
+
+	outgoing := s.session.DB("").C("outgoing")
+	err = outgoing.Insert(
+		&mup.Message{Account: "one", Nick: "someone", Text: "Implicit PRIVMSG."},
+		&mup.Message{Account: "one", Nick: "someone", Text: "Explicit PRIVMSG.", Command: "PRIVMSG"},
+		&mup.Message{Account: "one", Nick: "someone", Text: "Explicit NOTICE.", Command: "NOTICE"},
+	)
+	c.Assert(err, IsNil)
+
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	// The initial JOINs are sent before any messages.
+	s.ReadLine(c, "JOIN #test")
+
+	// Then the messages and their PINGs asking for confirmation, handled by ReadLine.
+	s.ReadLine(c, "PRIVMSG someone :Implicit PRIVMSG.")
+	s.ReadLine(c, "PRIVMSG someone :Explicit PRIVMSG.")
+	s.ReadLine(c, "NOTICE someone :Explicit NOTICE.")
+
+	// Ensure the confirmations are received before restarting.
+	s.Roundtrip(c)
+
+	// This must be ignored. Different account.
+	err = outgoing.Insert(&mup.Message{
+		Account: "two",
+		Nick:    "someone",
+		Text:    "Ignore me.",
+	})
+	c.Assert(err, IsNil)
+
+	// Send another message with the server running.
+	err = outgoing.Insert(&mup.Message{
+		Account: "one",
+		Nick:    "someone",
+		Text:    "Hello again!",
+	})
+	c.Assert(err, IsNil)
+
+	// Do not use the s.ReadLine helper as the message won't be confirmed.
+	c.Assert(s.lserver.ReadLine(), Equals, "PRIVMSG someone :Hello again!")
+	c.Assert(s.lserver.ReadLine(), Matches, "PING :sent:[0-9a-f]+")
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	// The unconfirmed message is resent.
+	c.Assert(s.lserver.ReadLine(), Equals, "JOIN #test")
+	c.Assert(s.lserver.ReadLine(), Equals, "PRIVMSG someone :Hello again!")
+	c.Assert(s.lserver.ReadLine(), Matches, "PING :sent:[0-9a-f]+")
+}
+
+func (s *ServerSuite) TestOutgoingMultipleAccounts(c *C) {
+	s.StopServer(c)
+
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.Insert(M{"_id": "two", "host": s.Addr.String(), "nick": "other"})
+	c.Assert(err, IsNil)
+
+	// start starts the server and returns the connections of each account,
+	// told apart by the nick they register with.
+	start := func() (one, two *LineServer) {
+		n := s.NextLineServer()
+		var err error
+		s.server, err = mup.Start(s.config)
+		c.Assert(err, IsNil)
+		lservers := make(map[string]*LineServer)
+		for i := 0; i < 2; i++ {
+			lserver := s.LineServer(n + i)
+			line := lserver.ReadLine()
+			if line == "PASS password" {
+				line = lserver.ReadLine()
+			}
+			c.Assert(lserver.ReadLine(), Matches, "USER .*")
+			lservers[line] = lserver
+		}
+		one, two = lservers["NICK mup"], lservers["NICK other"]
+		c.Assert(one, NotNil)
+		c.Assert(two, NotNil)
+		one.SendLine(":n.net 001 mup :Welcome!")
+		two.SendLine(":n.net 001 other :Welcome!")
+		return one, two
+	}
+
+	outgoing := s.session.DB("").C("outgoing")
+	send := func(lserver *LineServer, account string) bson.ObjectId {
+		id := bson.NewObjectId()
+		err := outgoing.Insert(&mup.Message{Id: id, Account: account, Nick: "someone", Text: "Hello from " + account + "."})
+		c.Assert(err, IsNil)
+		c.Assert(lserver.ReadLine(), Equals, "PRIVMSG someone :Hello from "+account+".")
+		c.Assert(lserver.ReadLine(), Equals, "PING :sent:"+id.Hex())
+		return id
+	}
+	lastId := func(account string) bson.ObjectId {
+		var info struct{ LastId bson.ObjectId }
+		err := accounts.FindId(account).One(&info)
+		c.Assert(err, IsNil)
+		return info.LastId
+	}
+	roundtrip := func(lserver *LineServer) {
+		lserver.SendLine("PING :roundtrip")
+		c.Assert(lserver.ReadLine(), Equals, "PONG :roundtrip")
+	}
+
+	one, two := start()
+
+	id1 := send(one, "one")
+	id2 := send(two, "two")
+	one.SendLine("PONG :sent:" + id1.Hex())
+	waitFor(func() bool { return lastId("one") == id1 })
+	c.Assert(lastId("one"), Equals, id1)
+	c.Assert(lastId("two"), Equals, bson.ObjectId(""))
+
+	// Confirmations of messages from other accounts are not misattributed,
+	// and malformed ones are ignored.
+	one.SendLine("PONG :sent:" + id2.Hex())
+	one.SendLine("PONG :sent:bogus")
+	roundtrip(one)
+	two.SendLine("PONG :sent:" + id2.Hex())
+	waitFor(func() bool { return lastId("two") == id2 })
+	c.Assert(lastId("two"), Equals, id2)
+	c.Assert(lastId("one"), Equals, id1)
+
+	// Stale confirmations do not move the last id backwards.
+	id3 := send(one, "one")
+	one.SendLine("PONG :sent:" + id3.Hex())
+	waitFor(func() bool { return lastId("one") == id3 })
+	one.SendLine("PONG :sent:" + id1.Hex())
+	roundtrip(one)
+	two.SendLine("PONG :sent:" + id2.Hex())
+	roundtrip(two)
+	c.Assert(lastId("one"), Equals, id3)
+
+	// Leave a message unconfirmed in the second account only.
+	id4 := send(two, "two")
+
+	s.StopServer(c)
+	one, two = start()
+
+	// Each account resumes after its own last confirmed message.
+	c.Assert(two.ReadLine(), Equals, "PRIVMSG someone :Hello from two.")
+	c.Assert(two.ReadLine(), Equals, "PING :sent:"+id4.Hex())
+	id5 := send(one, "one")
+	one.SendLine("PONG :sent:" + id5.Hex())
+	two.SendLine("PONG :sent:" + id4.Hex())
+	waitFor(func() bool { return lastId("one") == id5 && lastId("two") == id4 })
+	c.Assert(lastId("one"), Equals, id5)
+	c.Assert(lastId("two"), Equals, id4)
+}
+
+func (s *ServerSuite) TestOutgoingPriority(c *C) {
+	s.StopServer(c)
+
+	// The messages wait for the account to register, and are delivered
+	// in order except for the one with a higher priority.
+	outgoing := s.session.DB("").C("outgoing")
+	err := mup.InsertOutgoing(outgoing,
+		&mup.Message{Account: "one", Nick: "someone", Text: "Low 1."},
+		&mup.Message{Account: "one", Nick: "someone", Text: "Low 2."},
+		&mup.Message{Account: "one", Nick: "someone", Text: "High.", Priority: 1},
+		&mup.Message{Account: "one", Nick: "someone", Text: "Low 3."},
+	)
+	c.Assert(err, IsNil)
+
+	s.RestartServer(c)
+	time.Sleep(200 * time.Millisecond)
+	s.SendWelcome(c)
+
+	// Messages delivered ahead of their turn are not confirmed,
+	// so that confirming them does not skip the ones before.
+	c.Assert(s.lserver.ReadLine(), Equals, "PRIVMSG someone :High.")
+	s.ReadLine(c, "PRIVMSG someone :Low 1.")
+	s.ReadLine(c, "PRIVMSG someone :Low 2.")
+	s.ReadLine(c, "PRIVMSG someone :Low 3.")
+	s.Roundtrip(c)
+
+	// The message is marked so that it's not delivered again when
+	// the account is restarted before its turn.
+	var doc struct{ Early bool }
+	err = outgoing.Find(M{"text": "High."}).One(&doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc.Early, Equals, true)
+}
+
+func (s *ServerSuite) TestPlugin(c *C) {
+	s.SendWelcome(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A1")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAmsg A1")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBcmd B1")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBmsg B1")
+	s.Roundtrip(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "echoA", "config": M{"prefix": "A."}, "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A2")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAmsg A2")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBcmd B2")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBmsg B2")
+
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A.A1")
+	s.ReadLine(c, "PRIVMSG nick :[msg] A.A1")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A.A2")
+	s.ReadLine(c, "PRIVMSG nick :[msg] A.A2")
+
+	err = plugins.Insert(M{"_id": "echoB", "config": M{"prefix": "B."}, "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	s.ReadLine(c, "PRIVMSG nick :[cmd] B.B1")
+	s.ReadLine(c, "PRIVMSG nick :[msg] B.B1")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] B.B2")
+	s.ReadLine(c, "PRIVMSG nick :[msg] B.B2")
+	s.Roundtrip(c)
+
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	s.lserver.SendLine(":nick!~user@host PRIVMSG mup :echoAcmd A3")
+	s.lserver.SendLine(":nick!~user@host PRIVMSG mup :echoAmsg A3")
+	s.lserver.SendLine(":nick!~user@host PRIVMSG mup :echoBcmd B3")
+	s.lserver.SendLine(":nick!~user@host PRIVMSG mup :echoBmsg B3")
+
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A.A3")
+	s.ReadLine(c, "PRIVMSG nick :[msg] A.A3")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] B.B3")
+	s.ReadLine(c, "PRIVMSG nick :[msg] B.B3")
+
+	// Ensure the outgoing handler is being properly called.
+	log := c.GetTestLog()
+	c.Assert(log, Matches, `(?s).*\[echoA\] \[out\] \[cmd\] A\.A2\n.*`)
+	c.Assert(log, Matches, `(?s).*\[echoB\] \[out\] \[cmd\] A\.A2\n.*`)
+}
+
+func (s *ServerSuite) TestMoreLines(c *C) {
+	s.config.MoreLines = 1
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "echoA", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	text := strings.Repeat("123456789 ", 40)
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoAcmd "+text)
+	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] "+strings.TrimSpace(strings.Repeat("123456789 ", 28)))
+	s.ReadLine(c, "PRIVMSG #chan :Say \"more\" for the rest.")
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :more")
+	s.ReadLine(c, "PRIVMSG #chan :"+strings.TrimSpace(strings.Repeat("123456789 ", 12)))
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :more")
+	s.Roundtrip(c)
+}
+
+func (s *ServerSuite) TestPluginTarget(c *C) {
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(
+		M{"_id": "echoA", "config": M{"prefix": "A."}, "targets": []M{{"account": "one", "channel": "#chan1"}}},
+		M{"_id": "echoB", "config": M{"prefix": "B."}, "targets": []M{{"account": "one", "channel": "#chan2"}}},
+		M{"_id": "echoC", "config": M{"prefix": "C."}, "targets": []M{{"account": "one"}}},
+	)
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan1 :mup: echoAcmd A1")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan2 :mup: echoAcmd A2")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan1 :mup: echoBcmd B1")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan2 :mup: echoBcmd B2")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan1 :mup: echoCcmd C1")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan2 :mup: echoCcmd C2")
+
+	s.ReadLine(c, "PRIVMSG #chan1 :nick: [cmd] A.A1")
+	s.ReadLine(c, "PRIVMSG #chan2 :nick: [cmd] B.B2")
+	s.ReadLine(c, "PRIVMSG #chan1 :nick: [cmd] C.C1")
+	s.ReadLine(c, "PRIVMSG #chan2 :nick: [cmd] C.C2")
+}
+
+func (s *ServerSuite) TestPluginMalformed(c *C) {
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(
+		M{"_id": "echoA", "config": M{"prefix": "A."}, "targets": []M{{"account": "one"}}},
+		M{"_id": 42, "config": M{"prefix": "X."}, "targets": []M{{"account": "one"}}},
+		M{"_id": "echoB", "config": M{"prefix": "B."}, "targets": []M{{"account": "one"}}},
+		M{"_id": "echoC", "accounts": "one", "targets": []M{{"account": "one"}}},
+	)
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+	s.server.RefreshPlugins()
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBcmd B")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A.A")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] B.B")
+
+	// Each malformed document is only reported once per change.
+	badId := "Cannot unmarshal plugin document with _id 42: _id must be a non-empty string"
+	badAccounts := `Cannot unmarshal plugin document with _id "echoC": accounts must be a list of account names`
+	c.Assert(strings.Count(c.GetTestLog(), badId), Equals, 1)
+	c.Assert(strings.Count(c.GetTestLog(), badAccounts), Equals, 1)
+
+	err = plugins.UpdateId("echoC", M{"$set": M{"accounts": []interface{}{"one", 1}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	c.Assert(strings.Count(c.GetTestLog(), badAccounts), Equals, 2)
+}
+
+func (s *ServerSuite) TestPluginUpdates(c *C) {
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(
+		M{"_id": "echoA", "config": M{"prefix": "A."}, "targets": []M{{"account": "one"}}},
+		M{"_id": "echoB", "config": M{"prefix": "B."}, "targets": []M{{"account": "one", "target": "none"}}},
+		M{"_id": "echoC", "config": M{"prefix": "C."}, "targets": []M{{"account": "one", "target": "#chan"}}},
 		M{"_id": "echoD", "config": M{"prefix": "D."}, "targets": []M{{"account": "one", "target": "#chan"}}},
 	)
 	c.Assert(err, IsNil)
 	s.server.RefreshPlugins()
 	s.Roundtrip(c)
 
-	err = plugins.Remove(M{"_id": "echoA"})
-	c.Assert(err, IsNil)
-	err = plugins.UpdateId("echoB", M{"$set": M{"targets.0.target": "#chan"}})
-	c.Assert(err, IsNil)
-	err = plugins.UpdateId("echoD", M{"$set": M{"config.prefix": "E."}})
+	err = plugins.Remove(M{"_id": "echoA"})
+	c.Assert(err, IsNil)
+	err = plugins.UpdateId("echoB", M{"$set": M{"targets.0.target": "#chan"}})
+	c.Assert(err, IsNil)
+	err = plugins.UpdateId("echoD", M{"$set": M{"config.prefix": "E."}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	time.Sleep(500 * time.Millisecond)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoAcmd A")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoBcmd B")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoCcmd C")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoDcmd D")
+
+	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] B.B")
+	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] C.C")
+	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] E.D")
+}
+
+func (s *ServerSuite) TestPluginReplay(c *C) {
+	s.SendWelcome(c)
+
+	// Handled before the plugin exists, so it's replayed once it starts.
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A1")
+	s.Roundtrip(c)
+	time.Sleep(100 * time.Millisecond)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "echoA", "config": M{"showreplay": true}, "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+	s.ReadLine(c, "PRIVMSG nick :[cmd] [replay] A1")
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A2")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A2")
+}
+
+var testReloadSpec = mup.PluginSpec{
+	Name:     "testreload",
+	Start:    testReloadStart,
+	Commands: schema.Commands{{Name: "reloaded"}},
+}
+
+func init() {
+	mup.RegisterPlugin(&testReloadSpec)
+}
+
+type testReloadPlugin struct {
+	plugger *mup.Plugger
+	reloads int
+	config  struct{ Value string }
+}
+
+func testReloadStart(plugger *mup.Plugger) mup.Stopper {
+	p := &testReloadPlugin{plugger: plugger}
+	plugger.Config(&p.config)
+	return p
+}
+
+func (p *testReloadPlugin) Stop() error {
+	return nil
+}
+
+func (p *testReloadPlugin) Reload(config bson.Raw) error {
+	p.reloads++
+	if err := config.Unmarshal(&p.config); err != nil {
+		return err
+	}
+	if p.config.Value == "fail" {
+		return fmt.Errorf("cannot reload")
+	}
+	return nil
+}
+
+func (p *testReloadPlugin) HandleCommand(cmd *mup.Command) {
+	p.plugger.Sendf(cmd, "Value: %s, reloads: %d, restarts: %d", p.config.Value, p.reloads, p.plugger.Stats().Restarts)
+}
+
+func (s *ServerSuite) TestPluginReload(c *C) {
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "testreload", "config": M{"value": "one"}, "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :reloaded")
+	s.ReadLine(c, "PRIVMSG nick :Value: one, reloads: 0, restarts: 0")
+
+	// Config changes are applied via Reload.
+	err = plugins.UpdateId("testreload", M{"$set": M{"config.value": "two"}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :reloaded")
+	s.ReadLine(c, "PRIVMSG nick :Value: two, reloads: 1, restarts: 0")
+
+	// A failed reload restarts the plugin.
+	err = plugins.UpdateId("testreload", M{"$set": M{"config.value": "fail"}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :reloaded")
+	s.ReadLine(c, "PRIVMSG nick :Value: fail, reloads: 0, restarts: 1")
+
+	// Target changes always restart the plugin.
+	err = plugins.UpdateId("testreload", M{"$set": M{"config.value": "three", "targets.0.channel": ""}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :reloaded")
+	s.ReadLine(c, "PRIVMSG nick :Value: three, reloads: 0, restarts: 2")
+}
+
+var testHTTPSpec = mup.PluginSpec{
+	Name:  "testhttp",
+	Start: testHTTPStart,
+}
+
+func init() {
+	mup.RegisterPlugin(&testHTTPSpec)
+}
+
+type testHTTPPlugin struct{}
+
+func testHTTPStart(plugger *mup.Plugger) mup.Stopper {
+	err := plugger.HandleHTTP("hello/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Record metrics before replying, so they are seen by later requests.
+		done := plugger.Time("hello")
+		plugger.Count("hello")
+		done()
+		fmt.Fprintf(w, "Hello from %s at %s.", plugger.Name(), req.URL.Path)
+	}))
+	if err != nil {
+		plugger.Logf("Cannot handle HTTP requests: %v", err)
+	}
+	return testHTTPPlugin{}
+}
+
+func (testHTTPPlugin) Stop() error {
+	return nil
+}
+
+func (s *ServerSuite) TestPluginHTTP(c *C) {
+	s.StopServer(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "testhttp/label"})
+	c.Assert(err, IsNil)
+
+	s.config.HTTPAddr = "127.0.0.1:0"
+	s.RestartServer(c)
+	s.server.RefreshPlugins()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get("http://" + s.server.HTTPAddr() + path)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return resp.StatusCode, string(data)
+	}
+
+	code, body := get("/testhttp/label/hello/world")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, "Hello from testhttp/label at /testhttp/label/hello/world.")
+
+	code, _ = get("/testhttp/label/other")
+	c.Assert(code, Equals, http.StatusNotFound)
+
+	// Handlers are dropped with the plugin.
+	err = plugins.RemoveId("testhttp/label")
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	code, _ = get("/testhttp/label/hello/world")
+	c.Assert(code, Equals, http.StatusNotFound)
+}
+
+func (s *ServerSuite) TestPluginMetrics(c *C) {
+	s.StopServer(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "testhttp/label"})
+	c.Assert(err, IsNil)
+
+	s.config.HTTPAddr = "127.0.0.1:0"
+	s.RestartServer(c)
+	s.server.RefreshPlugins()
+
+	get := func(path string) string {
+		resp, err := http.Get("http://" + s.server.HTTPAddr() + path)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		data, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return string(data)
+	}
+
+	c.Assert(get("/metrics"), Equals, "")
+
+	get("/testhttp/label/hello/one")
+	get("/testhttp/label/hello/two")
+
+	c.Assert(get("/metrics"), Matches, ``+
+		`mup_plugin_count{plugin="testhttp/label",name="hello"} 2\n`+
+		`mup_plugin_time_count{plugin="testhttp/label",name="hello"} 2\n`+
+		`mup_plugin_time_seconds_total{plugin="testhttp/label",name="hello"} [0-9.e-]+\n`)
+}
+
+var testStatsSpec = mup.PluginSpec{
+	Name:       "teststats",
+	Start:      testStatsStart,
+	Privileged: true,
+	Commands: schema.Commands{{Name: "stats"}, {Name: "slow"}, {
+		Name: "restart",
+		Args: schema.Args{{Name: "plugin", Flag: schema.Required}},
+	}},
+}
+
+func init() {
+	mup.RegisterPlugin(&testStatsSpec)
+}
+
+type testStatsPlugin struct {
+	plugger *mup.Plugger
+}
+
+func testStatsStart(plugger *mup.Plugger) mup.Stopper {
+	return &testStatsPlugin{plugger}
+}
+
+func (p *testStatsPlugin) Stop() error {
+	return nil
+}
+
+func (p *testStatsPlugin) HandleMessage(msg *mup.Message) {
+	if msg.BotText == "sleep" {
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (p *testStatsPlugin) HandleCommand(cmd *mup.Command) {
+	if cmd.Name() == "restart" {
+		var args struct{ Plugin string }
+		cmd.Args(&args)
+		go func() {
+			if err := p.plugger.RestartPlugin(args.Plugin); err != nil {
+				p.plugger.Sendf(cmd, "Cannot restart: %v", err)
+			} else {
+				p.plugger.Sendf(cmd, "Restarted %s.", args.Plugin)
+			}
+		}()
+		return
+	}
+	stats := p.plugger.Stats()
+	if cmd.Name() == "slow" {
+		p.plugger.Sendf(cmd, "Slow: %v, average above limit: %v", stats.Slow, stats.HandleTime > 20*time.Millisecond)
+		return
+	}
+	p.plugger.Sendf(cmd, "Restarts: %d, started recently: %v", stats.Restarts, time.Since(stats.Started) < time.Minute)
+}
+
+func (s *ServerSuite) TestPluginStats(c *C) {
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "teststats", "config": M{"n": 0}, "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :stats")
+	s.ReadLine(c, "PRIVMSG nick :Restarts: 0, started recently: true")
+
+	for i := 1; i <= 2; i++ {
+		err = plugins.UpdateId("teststats", M{"$set": M{"config.n": i}})
+		c.Assert(err, IsNil)
+		s.server.RefreshPlugins()
+
+		s.SendLine(c, ":nick!~user@host PRIVMSG mup :stats")
+		s.ReadLine(c, fmt.Sprintf("PRIVMSG nick :Restarts: %d, started recently: true", i))
+	}
+
+	// Refreshing without changes does not restart it.
+	s.server.RefreshPlugins()
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :stats")
+	s.ReadLine(c, "PRIVMSG nick :Restarts: 2, started recently: true")
+}
+
+func (s *ServerSuite) TestPluginRestart(c *C) {
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "teststats", "targets": []M{{"account": "one", "channel": "#a"}}})
+	c.Assert(err, IsNil)
+	err = plugins.Insert(M{"_id": "teststats/other", "targets": []M{{"account": "one", "channel": "#b"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG #a :mup: restart teststats/other")
+	s.ReadLine(c, "PRIVMSG #a :nick: Restarted teststats/other.")
+
+	// Only the named plugin was restarted.
+	s.SendLine(c, ":nick!~user@host PRIVMSG #a :mup: stats")
+	s.ReadLine(c, "PRIVMSG #a :nick: Restarts: 0, started recently: true")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #b :mup: stats")
+	s.ReadLine(c, "PRIVMSG #b :nick: Restarts: 1, started recently: true")
+
+	// Its targets are reloaded from the database.
+	err = plugins.UpdateId("teststats/other", M{"$set": M{"targets.0.channel": "#c"}})
+	c.Assert(err, IsNil)
+	s.SendLine(c, ":nick!~user@host PRIVMSG #a :mup: restart teststats/other")
+	s.ReadLine(c, "PRIVMSG #a :nick: Restarted teststats/other.")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #c :mup: stats")
+	s.ReadLine(c, "PRIVMSG #c :nick: Restarts: 2, started recently: true")
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG #a :mup: restart unknown")
+	s.ReadLine(c, `PRIVMSG #a :nick: Cannot restart: plugin "unknown" is not running`)
+}
+
+func (s *ServerSuite) TestPluginRefreshSettle(c *C) {
+	s.StopServer(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "teststats", "config": M{"value": 0}, "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+
+	s.config.Refresh = 50 * time.Millisecond
+	s.config.RefreshSettle = 200 * time.Millisecond
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	// A burst of changes restarts the plugin once.
+	for i := 1; i <= 5; i++ {
+		err = plugins.UpdateId("teststats", M{"$set": M{"config.value": i}})
+		c.Assert(err, IsNil)
+		time.Sleep(30 * time.Millisecond)
+	}
+	time.Sleep(700 * time.Millisecond)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :stats")
+	s.ReadLine(c, "PRIVMSG nick :Restarts: 1, started recently: true")
+
+	// Explicit refreshes act on changes right away.
+	err = plugins.UpdateId("teststats", M{"$set": M{"config.value": 6}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :stats")
+	s.ReadLine(c, "PRIVMSG nick :Restarts: 2, started recently: true")
+}
+
+func (s *ServerSuite) TestPluginSlowHandler(c *C) {
+	s.config.SlowHandler = 20 * time.Millisecond
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "teststats", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :slow")
+	s.ReadLine(c, "PRIVMSG nick :Slow: false, average above limit: false")
+
+	for i := 0; i < 3; i++ {
+		s.SendLine(c, ":nick!~user@host PRIVMSG mup :sleep")
+	}
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :slow")
+	s.ReadLine(c, "PRIVMSG nick :Slow: true, average above limit: true")
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Plugin "teststats" is slow: it takes [0-9.]+ms on average to handle each message \(limit is 20ms\)\..*`)
+}
+
+var testLDAPSpec = mup.PluginSpec{
+	Name:  "testldap",
+	Start: testLdapStart,
+	Commands: schema.Commands{{
+		Name: "testldap",
+		Args: schema.Args{{
+			Name: "ldapname",
+			Flag: schema.Required,
+		}},
+	}},
+}
+
+func init() {
+	mup.RegisterPlugin(&testLDAPSpec)
+}
+
+type testLdapPlugin struct {
+	plugger *mup.Plugger
+}
+
+func testLdapStart(plugger *mup.Plugger) mup.Stopper {
+	return &testLdapPlugin{plugger}
+}
+
+func (p *testLdapPlugin) Stop() error {
+	return nil
+}
+
+func (p *testLdapPlugin) HandleCommand(cmd *mup.Command) {
+	var args struct{ LDAPName string }
+	cmd.Args(&args)
+	conn, err := p.plugger.LDAP(args.LDAPName)
+	if err != nil {
+		p.plugger.Sendf(cmd, "LDAP method error: %v", err)
+		return
+	}
+	defer conn.Close()
+	results, err := conn.Search(&ldap.Search{})
+	if len(results) != 1 || results[0].DN != "test-dn" || err != nil {
+		p.plugger.Sendf(cmd, "Search method results=%#v err=%v", results, err)
+		return
+	}
+	p.plugger.Sendf(cmd, "LDAP works fine.")
+}
+
+func (s *ServerSuite) TestCappedSizes(c *C) {
+	s.StopServer(c)
+
+	db := s.session.DB("")
+	c.Assert(db.C("incoming").DropCollection(), IsNil)
+	c.Assert(db.C("outgoing").DropCollection(), IsNil)
+
+	s.config.IncomingMaxBytes = 1024 * 1024
+	s.config.OutgoingMaxBytes = 2 * 1024 * 1024
+	s.RestartServer(c)
+
+	sizes := map[string]int{
+		"incoming": 1024 * 1024,
+		"outgoing": 2 * 1024 * 1024,
+	}
+	for name, size := range sizes {
+		var ns struct {
+			Options struct {
+				Capped bool
+				Size   int
+			}
+		}
+		err := db.C("system.namespaces").Find(M{"name": db.Name + "." + name}).One(&ns)
+		c.Assert(err, IsNil)
+		c.Assert(ns.Options.Capped, Equals, true)
+		c.Assert(ns.Options.Size, Equals, size)
+	}
+
+	// Existing collections are not changed, but a warning is logged.
+	s.StopServer(c)
+	s.config.IncomingMaxBytes = 0
+	s.RestartServer(c)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*MongoDB collection "test.incoming" already exists with 1048576 bytes rather than the configured 4194304 bytes.*`)
+}
+
+var testConnSpec = mup.PluginSpec{
+	Name:  "testconn",
+	Start: testConnStart,
+}
+
+func init() {
+	mup.RegisterPlugin(&testConnSpec)
+}
+
+type testConnPlugin struct {
+	plugger *mup.Plugger
+}
+
+func testConnStart(plugger *mup.Plugger) mup.Stopper {
+	return &testConnPlugin{plugger}
+}
+
+func (p *testConnPlugin) Stop() error {
+	return nil
+}
+
+func (p *testConnPlugin) HandleMessage(msg *mup.Message) {
+	args := strings.Fields(msg.BotText)
+	if len(args) != 2 || args[0] != "testconn" {
+		return
+	}
+	if args[1] == "expired" {
+		p.plugger.Send(&mup.Message{Account: msg.Account, Nick: msg.Nick, Command: "PRIVMSG", Text: "Expired.", Expires: time.Now().Add(-time.Second)})
+		p.plugger.Sendf(msg, "Not expired.")
+		return
+	}
+	p.plugger.Sendf(msg, "%s connected: %v", args[1], p.plugger.Connected(args[1]))
+}
+
+func (s *ServerSuite) TestConnected(c *C) {
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "testconn", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :testconn one")
+	s.ReadLine(c, "PRIVMSG nick :one connected: true")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :testconn other")
+	s.ReadLine(c, "PRIVMSG nick :other connected: false")
+
+	// Drop the connection and see the account reported as disconnected.
+	accounts := s.session.DB("").C("accounts")
+	n := s.NextLineServer()
+	s.lserver.Close()
+	waitFor(func() bool {
+		s.server.RefreshAccounts()
+		return s.NextLineServer() != n
+	})
+	s.lserver = s.LineServer(n)
+	s.ReadUser(c)
+
+	var info struct{ Connected bool }
+	err = accounts.FindId("one").One(&info)
+	c.Assert(err, IsNil)
+	c.Assert(info.Connected, Equals, false)
+
+	s.SendWelcome(c)
+	waitFor(func() bool {
+		err = accounts.FindId("one").One(&info)
+		return err == nil && info.Connected
+	})
+	c.Assert(info.Connected, Equals, true)
+
+	s.server.Stop()
+	s.server = nil
+	err = accounts.FindId("one").One(&info)
+	c.Assert(err, IsNil)
+	c.Assert(info.Connected, Equals, false)
+}
+
+func (s *ServerSuite) TestDryRun(c *C) {
+	s.config.DryRun = true
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "testconn", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :testconn one")
+	waitFor(func() bool {
+		return strings.Contains(c.GetTestLog(), "Dry run.")
+	})
+	c.Assert(c.GetTestLog(), Matches, `(?s).*\[testconn\] Dry run. Not sending to account "one": PRIVMSG nick :one connected: true.*`)
+	s.Roundtrip(c)
+
+	n, err := s.session.DB("").C("outgoing").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+}
+
+func (s *ServerSuite) TestDryRunPlugin(c *C) {
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "testconn", "config": M{"dryrun": true}, "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :testconn one")
+	waitFor(func() bool {
+		return strings.Contains(c.GetTestLog(), "Dry run.")
+	})
+	c.Assert(c.GetTestLog(), Matches, `(?s).*\[testconn\] Dry run. Not sending to account "one": PRIVMSG nick :one connected: true.*`)
+
+	n, err := s.session.DB("").C("outgoing").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+}
+
+func (s *ServerSuite) TestSendExpired(c *C) {
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "testconn", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :testconn expired")
+	s.ReadLine(c, "PRIVMSG nick :Not expired.")
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Dropping outgoing message that expired before being sent: PRIVMSG nick :Expired\..*`)
+}
+
+var testConfigSpec = mup.PluginSpec{
+	Name:           "testconfig",
+	Start:          testConfigStart,
+	RequiredConfig: []string{"token"},
+	Validate:       testConfigValidate,
+}
+
+func init() {
+	mup.RegisterPlugin(&testConfigSpec)
+}
+
+type testConfigPlugin struct {
+	plugger *mup.Plugger
+}
+
+func testConfigStart(plugger *mup.Plugger) mup.Stopper {
+	return &testConfigPlugin{plugger}
+}
+
+func testConfigValidate(plugger *mup.Plugger) error {
+	var config struct{ Limit int }
+	plugger.Config(&config)
+	if config.Limit < 0 {
+		return fmt.Errorf("limit must not be negative")
+	}
+	return nil
+}
+
+func (p *testConfigPlugin) Stop() error {
+	return nil
+}
+
+func (p *testConfigPlugin) HandleMessage(msg *mup.Message) {
+	if msg.BotText == "testconfig" {
+		p.plugger.Sendf(msg, "Configured.")
+	}
+}
+
+func (s *ServerSuite) TestPluginRequiredConfig(c *C) {
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "testconfig", "config": M{"limit": 1}, "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	for i := 0; i < 3; i++ {
+		s.server.RefreshPlugins()
+	}
+	s.Roundtrip(c)
+
+	// The failure is only reported once while the document is unchanged.
+	const logged = `Plugin "testconfig" failed to start: invalid configuration: missing required fields: token`
+	c.Assert(strings.Count(c.GetTestLog(), logged), Equals, 1)
+	var info struct{ Error string }
+	err = plugins.FindId("testconfig").One(&info)
+	c.Assert(err, IsNil)
+	c.Assert(info.Error, Equals, "invalid configuration: missing required fields: token")
+
+	// The plugin isn't running, so nothing answers.
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :testconfig")
+	s.Roundtrip(c)
+
+	err = plugins.UpdateId("testconfig", M{"$set": M{"config.token": "secret", "config.limit": -1}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Plugin "testconfig" failed to start: invalid configuration: limit must not be negative.*`)
+
+	err = plugins.UpdateId("testconfig", M{"$set": M{"config.limit": 1}})
 	c.Assert(err, IsNil)
 	s.server.RefreshPlugins()
 	s.Roundtrip(c)
 
-	time.Sleep(500 * time.Millisecond)
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :testconfig")
+	s.ReadLine(c, "PRIVMSG nick :Configured.")
 
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoAcmd A")
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoBcmd B")
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoCcmd C")
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoDcmd D")
+	var started struct{ Error string }
+	err = plugins.FindId("testconfig").One(&started)
+	c.Assert(err, IsNil)
+	c.Assert(started.Error, Equals, "")
+}
 
-	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] B.B")
-	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] C.C")
-	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] E.D")
+func (s *ServerSuite) TestPluginNotRegistered(c *C) {
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "nonexistent/label"})
+	c.Assert(err, IsNil)
+	for i := 0; i < 3; i++ {
+		s.server.RefreshPlugins()
+	}
+
+	const logged = `Plugin "nonexistent/label" failed to start: plugin "nonexistent" not registered`
+	c.Assert(strings.Count(c.GetTestLog(), logged), Equals, 1)
+	var info struct{ Error string }
+	err = plugins.FindId("nonexistent/label").One(&info)
+	c.Assert(err, IsNil)
+	c.Assert(info.Error, Equals, `plugin "nonexistent" not registered`)
+
+	// Changing the document reports it again.
+	err = plugins.UpdateId("nonexistent/label", M{"$set": M{"config.key": "value"}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+	s.server.RefreshPlugins()
+	c.Assert(strings.Count(c.GetTestLog(), logged), Equals, 2)
 }
 
-var testLDAPSpec = mup.PluginSpec{
-	Name:  "testldap",
-	Start: testLdapStart,
-	Commands: schema.Commands{{
-		Name: "testldap",
-		Args: schema.Args{{
-			Name: "ldapname",
-			Flag: schema.Required,
-		}},
-	}},
+var testSlowSpec = mup.PluginSpec{
+	Name:  "testslow",
+	Start: testSlowStart,
 }
 
 func init() {
-	mup.RegisterPlugin(&testLDAPSpec)
+	mup.RegisterPlugin(&testSlowSpec)
 }
 
-type testLdapPlugin struct {
-	plugger *mup.Plugger
-}
+var (
+	testSlowBlocked = make(chan bool)
+	testSlowRelease = make(chan bool)
+)
 
-func testLdapStart(plugger *mup.Plugger) mup.Stopper {
-	return &testLdapPlugin{plugger}
+type testSlowPlugin struct{}
+
+func testSlowStart(plugger *mup.Plugger) mup.Stopper {
+	return &testSlowPlugin{}
 }
 
-func (p *testLdapPlugin) Stop() error {
+func (p *testSlowPlugin) Stop() error {
 	return nil
 }
 
-func (p *testLdapPlugin) HandleCommand(cmd *mup.Command) {
-	var args struct{ LDAPName string }
-	cmd.Args(&args)
-	conn, err := p.plugger.LDAP(args.LDAPName)
-	if err != nil {
-		p.plugger.Sendf(cmd, "LDAP method error: %v", err)
-		return
+func (p *testSlowPlugin) HandleMessage(msg *mup.Message) {
+	if msg.Text == "slow" {
+		testSlowBlocked <- true
+		<-testSlowRelease
 	}
-	defer conn.Close()
-	results, err := conn.Search(&ldap.Search{})
-	if len(results) != 1 || results[0].DN != "test-dn" || err != nil {
-		p.plugger.Sendf(cmd, "Search method results=%#v err=%v", results, err)
-		return
+}
+
+func (s *ServerSuite) TestIncomingOverrun(c *C) {
+	s.StopServer(c)
+
+	db := s.session.DB("")
+	c.Assert(db.C("incoming").DropCollection(), IsNil)
+
+	s.config.IncomingMaxBytes = 8192
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	plugins := db.C("plugins")
+	err := plugins.Insert(M{"_id": "testslow", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :slow")
+	<-testSlowBlocked
+
+	// Wrap the capped collection around while the plugin is blocked.
+	incoming := db.C("incoming")
+	for i := 0; i < 500; i++ {
+		msg := &mup.Message{Time: time.Now(), Account: "one", Nick: "nick", Command: "PRIVMSG", Text: fmt.Sprintf("message %d", i)}
+		c.Assert(incoming.Insert(msg), IsNil)
 	}
-	p.plugger.Sendf(cmd, "LDAP works fine.")
+	testSlowRelease <- true
+
+	for i := 0; i < 100 && s.server.IncomingOverruns() == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(s.server.IncomingOverruns(), Equals, 1)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Incoming collection wrapped before messages were handled\..*`)
+}
+
+func (s *ServerSuite) TestBusyReply(c *C) {
+	s.config.BusyDelay = 100 * time.Millisecond
+	s.config.BusyReply = "Too busy, try again."
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "testslow", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	err = plugins.Insert(M{"_id": "echoA", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :slow")
+	<-testSlowBlocked
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A1")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoAcmd A2")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :bogus")
+	time.Sleep(200 * time.Millisecond)
+	testSlowRelease <- true
+
+	s.ReadLine(c, "PRIVMSG nick :Too busy, try again.")
+	s.ReadLine(c, "PRIVMSG #chan :nick: Too busy, try again.")
+
+	// Unknown commands are not reported as delayed.
+	s.ReadLine(c, "PRIVMSG nick :Unknown command: bogus. Try 'help'.")
+
+	// Once the pipeline drains, commands run again.
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A3")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A3")
+}
+
+func (s *ServerSuite) TestCommandCooldown(c *C) {
+	s.config.CommandCooldown = time.Hour
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "testperm", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	// Chatting with the bot does not count as running commands.
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :hello there")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :anyonecmd")
+	s.ReadLine(c, "PRIVMSG nick :Ran anyonecmd.")
+
+	// Limited commands are dropped, while exempt ones always run.
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :anyonecmd")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :exemptcmd")
+	s.ReadLine(c, "PRIVMSG nick :Ran exemptcmd.")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :exemptcmd")
+	s.ReadLine(c, "PRIVMSG nick :Ran exemptcmd.")
+
+	// Other nicks are limited separately.
+	s.SendLine(c, ":other!~user@host PRIVMSG mup :anyonecmd")
+	s.ReadLine(c, "PRIVMSG other :Ran anyonecmd.")
 }
 
 func (s *ServerSuite) TestLDAP(c *C) {
@@ -594,6 +2833,110 @@ func (s *ServerSuite) TestDatabase(c *C) {
 	s.ReadLine(c, "PRIVMSG nick :Number of accounts found: 1 (err=<nil>)")
 }
 
+// dbProxy forwards connections to a database server while it's up,
+// and closes them right away otherwise.
+type dbProxy struct {
+	listener net.Listener
+	target   string
+
+	mu    sync.Mutex
+	down  bool
+	conns []net.Conn
+}
+
+func startDBProxy(c *C, target string) *dbProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	p := &dbProxy{listener: l, target: target}
+	go p.loop()
+	return p
+}
+
+func (p *dbProxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *dbProxy) Close() {
+	p.listener.Close()
+	p.SetDown(true)
+}
+
+func (p *dbProxy) SetDown(down bool) {
+	p.mu.Lock()
+	p.down = down
+	if down {
+		for _, conn := range p.conns {
+			conn.Close()
+		}
+		p.conns = nil
+	}
+	p.mu.Unlock()
+}
+
+func (p *dbProxy) loop() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		down := p.down
+		p.mu.Unlock()
+		if down {
+			conn.Close()
+			continue
+		}
+		server, err := net.Dial("tcp", p.target)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		p.mu.Lock()
+		p.conns = append(p.conns, conn, server)
+		p.mu.Unlock()
+		go io.Copy(conn, server)
+		go io.Copy(server, conn)
+	}
+}
+
+func (s *ServerSuite) startProxiedServer(c *C, timeout time.Duration, downFor time.Duration) (*mup.Server, error) {
+	proxy := startDBProxy(c, s.session.LiveServers()[0])
+	defer proxy.Close()
+
+	session, err := mgo.Dial(proxy.Addr() + "?connect=direct")
+	c.Assert(err, IsNil)
+	defer session.Close()
+	session.SetSyncTimeout(200 * time.Millisecond)
+
+	proxy.SetDown(true)
+	session.Refresh()
+	if downFor > 0 {
+		go func() {
+			time.Sleep(downFor)
+			proxy.SetDown(false)
+		}()
+	}
+
+	config := *s.config
+	config.Database = session.DB("")
+	config.Accounts = []string{}
+	config.Plugins = []string{}
+	config.StartupTimeout = timeout
+	return mup.Start(&config)
+}
+
+func (s *ServerSuite) TestStartupTimeout(c *C) {
+	server, err := s.startProxiedServer(c, 5*time.Second, 500*time.Millisecond)
+	c.Assert(err, IsNil)
+	c.Assert(server.Stop(), IsNil)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Cannot reach MongoDB \(retrying in .*\): .*`)
+}
+
+func (s *ServerSuite) TestStartupTimeoutExpired(c *C) {
+	_, err := s.startProxiedServer(c, 300*time.Millisecond, 0)
+	c.Assert(err, ErrorMatches, "cannot reach MongoDB after 300ms: .*")
+}
+
 func (s *ServerSuite) TestHelp(c *C) {
 	s.SendWelcome(c)
 
@@ -616,6 +2959,29 @@ func (s *ServerSuite) TestHelp(c *C) {
 	s.ReadLine(c, `PRIVMSG nick :Plugin "testdb" is not enabled here.`)
 }
 
+func (s *ServerSuite) TestKnownCommands(c *C) {
+	var known []mup.KnownPlugin
+	waitFor(func() bool {
+		var err error
+		known, err = mup.KnownCommands(s.session.DB(""))
+		c.Assert(err, IsNil)
+		return len(known) > 0
+	})
+
+	var echoA *mup.KnownPlugin
+	for i := 1; i < len(known); i++ {
+		c.Assert(known[i-1].Name < known[i].Name, Equals, true)
+	}
+	for i := range known {
+		if known[i].Name == "echoA" {
+			echoA = &known[i]
+		}
+	}
+	c.Assert(echoA, NotNil)
+	c.Assert(echoA.Commands, DeepEquals, pluginCommands("echoAcmd"))
+	c.Assert(echoA.Commands[0].Usage(), Equals, "echoAcmd <text ...>")
+}
+
 func (s *ServerSuite) TestPluginSelection(c *C) {
 	s.StopServer(c)
 
@@ -659,6 +3025,25 @@ func (s *ServerSuite) TestPluginSelection(c *C) {
 	s.ReadLine(c, `PRIVMSG nick :Command "testdb" not found.`)
 }
 
+func (s *ServerSuite) TestPluginAccounts(c *C) {
+	s.StopServer(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "echoA", "targets": []M{{"account": ""}, {"account": "one"}}, "accounts": []string{"two"}})
+	c.Assert(err, IsNil)
+	err = plugins.Insert(M{"_id": "echoB", "targets": []M{{"account": ""}}, "accounts": []string{"two", "one"}})
+	c.Assert(err, IsNil)
+
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	// Messages are handled in order, so echoA would reply first if it
+	// was acting on an account outside of its scope.
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A1")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBcmd B1")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] B1")
+}
+
 func (s *ServerSuite) TestAccountSelection(c *C) {
 	s.StopServer(c)
 
@@ -687,3 +3072,208 @@ func (s *ServerSuite) TestAccountSelection(c *C) {
 	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A2")
 	s.ReadLine(c, "PRIVMSG nick :[cmd] one:A2")
 }
+
+func (s *ServerSuite) TestNoReconnect(c *C) {
+	s.SendWelcome(c)
+
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.UpdateId("one", M{"$set": M{"noreconnect": []string{"k-lined"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshAccounts()
+	s.Roundtrip(c)
+
+	n := s.NextLineServer()
+	s.SendLine(c, "ERROR :Closing Link: mup[10.0.0.1] (K-Lined)")
+	s.lserver.Close()
+
+	var info struct{ Blocked string }
+	waitFor(func() bool {
+		s.server.RefreshAccounts()
+		err := accounts.FindId("one").One(&info)
+		return err == nil && info.Blocked != ""
+	})
+	c.Assert(info.Blocked, Equals, "Closing Link: mup[10.0.0.1] (K-Lined)")
+
+	// Further refreshes must not attempt to reconnect.
+	s.server.RefreshAccounts()
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(s.NextLineServer(), Equals, n)
+
+	// Unblocking the account brings it back up.
+	err = accounts.UpdateId("one", M{"$unset": M{"blocked": 1}})
+	c.Assert(err, IsNil)
+	s.server.RefreshAccounts()
+	s.lserver = s.LineServer(n)
+	s.ReadUser(c)
+}
+
+func (s *ServerSuite) TestLocale(c *C) {
+	mup.RegisterCatalog("pt", map[string]string{"Oops: %v. Usage: %s": "Opa: %v. Uso: %s"})
+
+	accounts := s.session.DB("").C("accounts")
+	err := accounts.UpdateId("one", M{"$set": M{"locale": "pt_BR"}})
+	c.Assert(err, IsNil)
+
+	plugins := s.session.DB("").C("plugins")
+	err = plugins.Insert(M{"_id": "echoA", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+
+	s.SendWelcome(c)
+	s.server.RefreshAccounts()
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd")
+	s.ReadLine(c, "PRIVMSG nick :Opa: missing input for argument: text. Uso: echoAcmd <text ...>")
+}
+
+func (s *ServerSuite) TestUnknownCommands(c *C) {
+	s.config.UnknownCommands = true
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "echoA", "targets": []M{{"account": "one"}}})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd hi")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] hi")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :bogus hi")
+	s.ReadLine(c, "PRIVMSG nick :Unknown command: bogus. Try 'help'.")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: bogus")
+	s.ReadLine(c, "PRIVMSG #chan :nick: Unknown command: bogus. Try 'help'.")
+
+	// Messages not addressed to the bot are left alone,
+	// and so is chat that does not look like a command.
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :bogus")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :thanks!")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: hi, how are you?")
+	s.Roundtrip(c)
+}
+
+var (
+	depStartedMutex sync.Mutex
+	depStarted      []string
+)
+
+func depPluginSpec(name string, requires ...string) *mup.PluginSpec {
+	return &mup.PluginSpec{
+		Name:     name,
+		Requires: requires,
+		Start: func(plugger *mup.Plugger) mup.Stopper {
+			depStartedMutex.Lock()
+			depStarted = append(depStarted, plugger.Name())
+			depStartedMutex.Unlock()
+			return depPlugin{}
+		},
+	}
+}
+
+type depPlugin struct{}
+
+func (depPlugin) Stop() error { return nil }
+
+func init() {
+	mup.RegisterPlugin(depPluginSpec("depA", "depB"))
+	mup.RegisterPlugin(depPluginSpec("depB", "depC"))
+	mup.RegisterPlugin(depPluginSpec("depC"))
+	mup.RegisterPlugin(depPluginSpec("depX", "depY"))
+	mup.RegisterPlugin(depPluginSpec("depY", "depX"))
+}
+
+var (
+	stoppedMutex sync.Mutex
+	stopped      []string
+)
+
+type stopPlugin struct {
+	name string
+}
+
+func (p *stopPlugin) Stop() error {
+	stoppedMutex.Lock()
+	stopped = append(stopped, p.name)
+	stoppedMutex.Unlock()
+	if strings.HasPrefix(p.name, "stopfail") {
+		return fmt.Errorf("cannot stop")
+	}
+	return nil
+}
+
+func stopPluginSpec(name string, requires ...string) *mup.PluginSpec {
+	return &mup.PluginSpec{
+		Name:     name,
+		Requires: requires,
+		Start: func(plugger *mup.Plugger) mup.Stopper {
+			return &stopPlugin{plugger.Name()}
+		},
+	}
+}
+
+func init() {
+	mup.RegisterPlugin(stopPluginSpec("stopA"))
+	mup.RegisterPlugin(stopPluginSpec("stopB", "stopA"))
+	mup.RegisterPlugin(stopPluginSpec("stopC", "stopB"))
+	mup.RegisterPlugin(stopPluginSpec("stopfail"))
+}
+
+func (s *ServerSuite) TestPluginStopError(c *C) {
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "stopfail/one"}, M{"_id": "stopA"}, M{"_id": "stopfail/two"})
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	err = s.server.Stop()
+	s.server = nil
+	c.Assert(err, ErrorMatches, "plugins stopped with errors: stopfail/one: cannot stop; stopfail/two: cannot stop")
+}
+
+func (s *ServerSuite) TestPluginOrderedStop(c *C) {
+	s.StopServer(c)
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(M{"_id": "stopC"}, M{"_id": "stopA"}, M{"_id": "stopB"})
+	c.Assert(err, IsNil)
+
+	s.config.OrderedStop = true
+	s.RestartServer(c)
+
+	stoppedMutex.Lock()
+	stopped = nil
+	stoppedMutex.Unlock()
+
+	s.StopServer(c)
+
+	stoppedMutex.Lock()
+	defer stoppedMutex.Unlock()
+	c.Assert(stopped, DeepEquals, []string{"stopC", "stopB", "stopA"})
+}
+
+func (s *ServerSuite) TestPluginRequires(c *C) {
+	depStartedMutex.Lock()
+	depStarted = nil
+	depStartedMutex.Unlock()
+
+	plugins := s.session.DB("").C("plugins")
+	err := plugins.Insert(
+		M{"_id": "depA"},
+		M{"_id": "depB/one"},
+		M{"_id": "depB/two"},
+		M{"_id": "depC"},
+		M{"_id": "depX"},
+		M{"_id": "depY"},
+	)
+	c.Assert(err, IsNil)
+	s.server.RefreshPlugins()
+
+	// The cycle is only reported once while the documents are unchanged.
+	s.server.RefreshPlugins()
+	s.server.RefreshPlugins()
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Plugin "depX" failed to start: cyclic dependencies \(requires depY\).*`)
+	c.Assert(strings.Count(c.GetTestLog(), `Plugin "depX" failed to start: cyclic dependencies`), Equals, 1)
+
+	depStartedMutex.Lock()
+	defer depStartedMutex.Unlock()
+	c.Assert(depStarted, DeepEquals, []string{"depC", "depB/one", "depB/two", "depA"})
+}
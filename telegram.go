@@ -3,6 +3,7 @@ package mup
 import (
 	"encoding/json"
 	"fmt"
+	"html"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -132,6 +133,7 @@ func (c *tgClient) run() error {
 	for {
 		select {
 		case inMsg = <-inRecv:
+			inMsg.Locale = c.info.Locale
 			inRecv = nil
 			inSend = c.incoming
 
@@ -173,7 +175,6 @@ func (c *tgClient) run() error {
 			return c.tgW.Err()
 		}
 	}
-	panic("unreachable")
 }
 
 // ---------------------------------------------------------------------------
@@ -270,12 +271,31 @@ loop:
 			continue
 		}
 
+		method := "sendMessage"
 		params := url.Values{
 			"chat_id": []string{strconv.FormatInt(chatId, 10)},
-			"text":    []string{msg.Text},
+			"text":    []string{StripFormatting(msg.Text)},
 			"disable_web_page_preview": []string{"true"},
 		}
-		resp, err := httpClient.PostForm(w.apiPrefix+w.apiKey+"/sendMessage", params)
+		if msg.Card != nil {
+			// The text holds the card rendered for IRC, possibly after a reply prefix.
+			var prefix string
+			if rendered := msg.Card.String(); strings.HasSuffix(msg.Text, rendered) {
+				prefix = html.EscapeString(StripFormatting(strings.TrimSuffix(msg.Text, rendered)))
+			}
+			params.Set("text", prefix+msg.Card.html())
+			params.Set("parse_mode", "HTML")
+		}
+		if msg.Event == ReactEvent {
+			reaction, _ := json.Marshal([]tgReaction{{Type: "emoji", Emoji: msg.Text}})
+			method = "setMessageReaction"
+			params = url.Values{
+				"chat_id":    []string{strconv.FormatInt(chatId, 10)},
+				"message_id": []string{msg.EventId},
+				"reaction":   []string{string(reaction)},
+			}
+		}
+		resp, err := httpClient.PostForm(w.apiPrefix+w.apiKey+"/"+method, params)
 		if err != nil {
 			w.tomb.Kill(err)
 			break
@@ -290,11 +310,14 @@ loop:
 			break
 		}
 		if err = result.err(); err != nil {
-			w.tomb.Killf("on sendMessage: %v", err)
+			w.tomb.Killf("on %s: %v", method, err)
 			break
 		}
 
 		// Notify the account manager that the message was delivered.
+		if msg.Id == "" {
+			continue
+		}
 		select {
 		case w.r.Incoming <- ParseIncoming(w.accountName, "mup", "/", "PONG :sent:"+msg.Id.Hex()):
 		case <-w.Dying:
@@ -306,6 +329,11 @@ loop:
 	return nil
 }
 
+type tgReaction struct {
+	Type  string `json:"type"`
+	Emoji string `json:"emoji"`
+}
+
 type tgResultStatus struct {
 	Ok          bool   `json:"ok"`
 	ErrorCode   int    `json:"error_code"`
@@ -375,8 +403,10 @@ type tgUpdate struct {
 }
 
 type tgUpdateResult struct {
-	UpdateId int64           `json:"update_id"`
-	Message  tgUpdateMessage `json:"message"`
+	UpdateId        int64              `json:"update_id"`
+	Message         tgUpdateMessage    `json:"message"`
+	EditedMessage   *tgUpdateMessage   `json:"edited_message"`
+	DeletedMessages *tgDeletedMessages `json:"deleted_business_messages"`
 }
 
 type tgUpdateMessage struct {
@@ -385,6 +415,17 @@ type tgUpdateMessage struct {
 	Chat      tgUpdateChat `json:"chat"`
 	Date      uint64       `json:"date"`
 	Text      string       `json:"text"`
+	ThreadId  int64        `json:"message_thread_id"`
+	ReplyTo   *tgReplyTo   `json:"reply_to_message"`
+}
+
+type tgReplyTo struct {
+	MessageId int64 `json:"message_id"`
+}
+
+type tgDeletedMessages struct {
+	Chat       tgUpdateChat `json:"chat"`
+	MessageIds []int64      `json:"message_ids"`
 }
 
 type tgUpdateFrom struct {
@@ -471,34 +512,76 @@ func (r *tgReader) loop() error {
 			break
 		}
 
-		for _, result := range update.Result {
+		for i := range update.Result {
+			result := &update.Result[i]
 			lastUpdateId = result.UpdateId
-			from := result.Message.From
-			chat := result.Message.Chat
-			channelPrefix := '#'
-			channelTitle := chat.Title
-			if chat.Username != "" {
-				channelPrefix = '@'
-				channelTitle = chat.Username
-			} else {
-				buf := make([]byte, 0, len(channelTitle))
-				for _, r := range chat.Title {
-					if unicode.IsLetter(r) || unicode.IsNumber(r) {
-						buf = append(buf, string(r)...)
-					} else {
-						buf = append(buf, '_')
-					}
+			for _, msg := range r.parseUpdate(result) {
+				select {
+				case r.Incoming <- msg:
+				case <-r.Dying:
 				}
-				channelTitle = string(buf)
-			}
-			line := fmt.Sprintf(":%s!~user@telegram PRIVMSG %c%s:%d :%s", from.Username, channelPrefix, channelTitle, chat.Id, result.Message.Text)
-			logf("[%s] Received: %s", r.accountName, line)
-			msg := ParseIncoming(r.accountName, r.activeNick, "/", line)
-			select {
-			case r.Incoming <- msg:
-			case <-r.Dying:
 			}
 		}
 	}
 	return nil
 }
+
+// parseUpdate returns the incoming messages that represent the update.
+// Edited and deleted messages are reported with the respective Event
+// set and the Telegram id of the changed message in EventId. Telegram
+// only reports deletions in chats of connected business accounts.
+func (r *tgReader) parseUpdate(result *tgUpdateResult) []*Message {
+	if result.EditedMessage != nil {
+		msg := r.parseMessage(result.EditedMessage)
+		msg.Event = EditEvent
+		msg.EventId = strconv.FormatInt(result.EditedMessage.MessageId, 10)
+		return []*Message{msg}
+	}
+	if deleted := result.DeletedMessages; deleted != nil {
+		msgs := make([]*Message, len(deleted.MessageIds))
+		for i, id := range deleted.MessageIds {
+			msg := r.parseMessage(&tgUpdateMessage{
+				MessageId: id,
+				From:      tgUpdateFrom{Username: deleted.Chat.Username},
+				Chat:      deleted.Chat,
+			})
+			msg.Event = DeleteEvent
+			msg.EventId = strconv.FormatInt(id, 10)
+			msgs[i] = msg
+		}
+		return msgs
+	}
+	return []*Message{r.parseMessage(&result.Message)}
+}
+
+func (r *tgReader) parseMessage(message *tgUpdateMessage) *Message {
+	from := message.From
+	chat := message.Chat
+	channelPrefix := '#'
+	channelTitle := chat.Title
+	if chat.Username != "" {
+		channelPrefix = '@'
+		channelTitle = chat.Username
+	} else {
+		buf := make([]byte, 0, len(channelTitle))
+		for _, r := range chat.Title {
+			if unicode.IsLetter(r) || unicode.IsNumber(r) {
+				buf = append(buf, string(r)...)
+			} else {
+				buf = append(buf, '_')
+			}
+		}
+		channelTitle = string(buf)
+	}
+	line := fmt.Sprintf(":%s!~user@telegram PRIVMSG %c%s:%d :%s", from.Username, channelPrefix, channelTitle, chat.Id, message.Text)
+	logf("[%s] Received: %s", r.accountName, line)
+	msg := ParseIncoming(r.accountName, r.activeNick, "/", line)
+	msg.ProtoId = strconv.FormatInt(message.MessageId, 10)
+	if message.ThreadId != 0 {
+		msg.ThreadId = strconv.FormatInt(message.ThreadId, 10)
+	}
+	if message.ReplyTo != nil {
+		msg.ReplyTo = strconv.FormatInt(message.ReplyTo.MessageId, 10)
+	}
+	return msg
+}
@@ -78,8 +78,7 @@ func (s *TelegramSuite) TestPasswordAsKey(c *C) {
 }
 
 func (s *TelegramSuite) TestQuit(c *C) {
-	err := s.server.Stop()
-	c.Assert(err, IsNil)
+	stopsPromptly(c, s.server.Stop)
 }
 
 func (s *TelegramSuite) SendUpdates(c *C, update ...string) {
@@ -124,6 +123,7 @@ var incomingTests = []struct {
 		BotText: "Hello mup!",
 		Bang:    "/",
 		AsNick:  "mupbot",
+		ProtoId: "34",
 	},
 }, {
 	`{
@@ -145,6 +145,80 @@ var incomingTests = []struct {
 		Text:    "Hello there!",
 		Bang:    "/",
 		AsNick:  "mupbot",
+		ProtoId: "34",
+	},
+}, {
+	`{
+		"update_id": 14,
+		"edited_message": {
+			"message_id": 34,
+			"from": {"id": 56, "username": "bob"},
+			"chat": {"id": 56, "username": "bob"},
+			"text": "Hello again mup!"
+		}
+	}`,
+	mup.Message{
+		Account: "one",
+		Nick:    "bob",
+		User:    "~user",
+		Host:    "telegram",
+		Command: "PRIVMSG",
+		Channel: "@bob:56",
+		Text:    "Hello again mup!",
+		BotText: "Hello again mup!",
+		Bang:    "/",
+		AsNick:  "mupbot",
+		Event:   "edit",
+		EventId: "34",
+		ProtoId: "34",
+	},
+}, {
+	`{
+		"update_id": 15,
+		"deleted_business_messages": {
+			"business_connection_id": "abc",
+			"chat": {"id": 56, "username": "bob"},
+			"message_ids": [34]
+		}
+	}`,
+	mup.Message{
+		Account: "one",
+		Nick:    "bob",
+		User:    "~user",
+		Host:    "telegram",
+		Command: "PRIVMSG",
+		Channel: "@bob:56",
+		Bang:    "/",
+		AsNick:  "mupbot",
+		Event:   "delete",
+		EventId: "34",
+		ProtoId: "34",
+	},
+}, {
+	`{
+		"update_id": 16,
+		"message": {
+			"message_id": 36,
+			"message_thread_id": 30,
+			"reply_to_message": {"message_id": 35},
+			"from": {"id": 56, "username": "bob"},
+			"chat": {"id": -78, "title": "Group Chat"},
+			"text": "Replying."
+		}
+	}`,
+	mup.Message{
+		Account:  "one",
+		Nick:     "bob",
+		User:     "~user",
+		Host:     "telegram",
+		Command:  "PRIVMSG",
+		Channel:  "#Group_Chat:-78",
+		Text:     "Replying.",
+		Bang:     "/",
+		AsNick:   "mupbot",
+		ProtoId:  "36",
+		ThreadId: "30",
+		ReplyTo:  "35",
 	},
 }}
 
@@ -200,6 +274,7 @@ func (s *TelegramSuite) TestOutgoing(c *C) {
 		&mup.Message{Account: "one", Channel: "#some_group:56", Nick: "nick", Text: "Group chat."},
 		&mup.Message{Account: "one", Channel: "@nick:-56", Nick: "nick", Text: "Negative chat id."},
 		&mup.Message{Account: "one", Channel: "#some_group:-56", Nick: "nick", Text: "Negative group chat id."},
+		&mup.Message{Account: "one", Channel: "@nick:56", Nick: "nick", Text: mup.Bold("Formatted") + " " + mup.Color("text.", mup.Red, mup.NoColor)},
 	)
 	c.Assert(err, IsNil)
 
@@ -209,6 +284,7 @@ func (s *TelegramSuite) TestOutgoing(c *C) {
 	s.RecvMessage(c, 56, "Group chat.")
 	s.RecvMessage(c, -56, "Negative chat id.")
 	s.RecvMessage(c, -56, "Negative group chat id.")
+	s.RecvMessage(c, 56, "Formatted text.")
 
 	s.tgserver.FailSend()
 
@@ -231,6 +307,51 @@ func (s *TelegramSuite) TestOutgoing(c *C) {
 	s.RecvMessage(c, 56, "Hello again!")
 }
 
+func (s *TelegramSuite) TestOutgoingCard(c *C) {
+	card := &mup.Card{
+		Title:  "Bug #1",
+		Fields: []mup.CardField{{Name: "Status", Value: "New & <shiny>"}, {Value: "tag"}},
+		Link:   "https://example.com/1",
+	}
+	outgoing := s.session.DB("").C("outgoing")
+	err := outgoing.Insert(
+		&mup.Message{Account: "one", Channel: "#some_group:56", Nick: "nick", Text: "@nick " + card.String(), Card: card},
+		&mup.Message{Account: "one", Channel: "@nick:56", Nick: "nick", Text: "After card."},
+	)
+	c.Assert(err, IsNil)
+
+	msg, err := s.tgserver.RecvMessage()
+	c.Assert(err, IsNil)
+	c.Assert(msg.chat_id, Equals, "56")
+	c.Assert(msg.parseMode, Equals, "HTML")
+	c.Assert(msg.text, Equals, "@nick <b>Bug #1</b>\n"+
+		"<b>Status:</b> New &amp; &lt;shiny&gt;\n"+
+		"tag\n"+
+		`<a href="https://example.com/1">https://example.com/1</a>`)
+
+	msg, err = s.tgserver.RecvMessage()
+	c.Assert(err, IsNil)
+	c.Assert(msg.parseMode, Equals, "")
+	c.Assert(msg.text, Equals, "After card.")
+}
+
+func (s *TelegramSuite) TestOutgoingReaction(c *C) {
+	outgoing := s.session.DB("").C("outgoing")
+	err := outgoing.Insert(
+		&mup.Message{Account: "one", Channel: "@nick:56", Nick: "nick", Text: "👍", Event: mup.ReactEvent, EventId: "34"},
+		&mup.Message{Account: "one", Channel: "@nick:56", Nick: "nick", Text: "After reaction."},
+	)
+	c.Assert(err, IsNil)
+
+	msg, err := s.tgserver.RecvMessage()
+	c.Assert(err, IsNil)
+	c.Assert(msg.chat_id, Equals, "56")
+	c.Assert(msg.messageId, Equals, "34")
+	c.Assert(msg.reaction, Equals, `[{"type":"emoji","emoji":"👍"}]`)
+
+	s.RecvMessage(c, 56, "After reaction.")
+}
+
 type tgServer struct {
 	server *httptest.Server
 
@@ -246,6 +367,9 @@ type tgServer struct {
 type tgMessage struct {
 	text, chat_id  string
 	disablePreview bool
+	parseMode      string
+
+	messageId, reaction string
 }
 
 func (s *tgServer) Start() {
@@ -351,6 +475,7 @@ func (s *tgServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			text:           req.Form.Get("text"),
 			chat_id:        req.Form.Get("chat_id"),
 			disablePreview: req.Form.Get("disable_web_page_preview") == "true",
+			parseMode:      req.Form.Get("parse_mode"),
 		}
 		select {
 		case s.messages <- msg:
@@ -359,6 +484,19 @@ func (s *tgServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			panic("Client is sending messages much faster than test suite is trying to receive them")
 		}
 
+	case "setMessageReaction":
+		msg := tgMessage{
+			chat_id:   req.Form.Get("chat_id"),
+			messageId: req.Form.Get("message_id"),
+			reaction:  req.Form.Get("reaction"),
+		}
+		select {
+		case s.messages <- msg:
+			fmt.Fprintf(w, `{"ok": true, "result": true}`)
+		case <-time.After(100 * time.Millisecond):
+			panic("Client is sending messages much faster than test suite is trying to receive them")
+		}
+
 	case "getMe":
 		fmt.Fprintf(w, `{"ok": true, "result": {"username": "mupbot"}}`)
 
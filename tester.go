@@ -2,6 +2,8 @@ package mup
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 
@@ -36,9 +38,325 @@ func NewPluginTester(pluginName string) *PluginTester {
 	t.ldaps = make(map[string]ldap.Conn)
 	t.state.spec = spec
 	t.state.plugger = newPlugger(pluginName, t.sendMessage, t.handleMessage, t.ldap)
+	t.state.plugger.setLDAPInfo(t.ldapStatus)
+	t.state.plugger.setPrivileged(spec.Privileged)
+	t.state.plugger.memState = &memoryState{}
+	t.state.plugger.memStore = &memoryStores{}
 	return t
 }
 
+// memoryState holds the plugin state saved via Plugger.SaveState in memory,
+// so that plugins may be tested without a database. It's used until the
+// tester is provided a database via SetDatabase.
+type memoryState struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+type memoryStateDoc struct {
+	State interface{}
+}
+
+func (s *memoryState) save(value interface{}) error {
+	data, err := bson.Marshal(memoryStateDoc{value})
+	if err != nil {
+		return fmt.Errorf("cannot save plugin state: %v", err)
+	}
+	s.mu.Lock()
+	s.data = data
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryState) load(result interface{}) error {
+	s.mu.Lock()
+	data := s.data
+	s.mu.Unlock()
+	if data == nil {
+		return nil
+	}
+	var doc struct{ State bson.Raw }
+	if err := bson.Unmarshal(data, &doc); err != nil || doc.State.Kind == 0 {
+		return err
+	}
+	if err := doc.State.Unmarshal(result); err != nil {
+		return fmt.Errorf("cannot unmarshal plugin state: %v", err)
+	}
+	return nil
+}
+
+// memoryStores holds the documents of the stores obtained via Plugger.Store
+// in memory, so that plugins may be tested without a database. As with
+// memoryState, it's used until the tester is provided a database.
+type memoryStores struct {
+	mu     sync.Mutex
+	stores map[string]*memoryStore
+}
+
+func (s *memoryStores) store(name string) Store {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stores == nil {
+		s.stores = make(map[string]*memoryStore)
+	}
+	store, ok := s.stores[name]
+	if !ok {
+		store = &memoryStore{}
+		s.stores[name] = store
+	}
+	return store
+}
+
+// memoryStore implements Store in memory. Queries only support matching
+// fields by equality, with dots selecting fields of embedded documents,
+// and updates only support the $set and $unset operators or replacing
+// the document entirely.
+type memoryStore struct {
+	mu   sync.Mutex
+	docs []bson.M
+}
+
+// toDoc returns value marshalled and unmarshalled as a document, so that
+// it's detached from value and holds the same types as documents read
+// from a database.
+func toDoc(value interface{}) (bson.M, error) {
+	doc := bson.M{}
+	if value == nil {
+		return doc, nil
+	}
+	data, err := bson.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	err = bson.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (s *memoryStore) Insert(docs ...interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, value := range docs {
+		doc, err := toDoc(value)
+		if err != nil {
+			return err
+		}
+		if _, ok := doc["_id"]; !ok {
+			doc["_id"] = bson.NewObjectId()
+		}
+		if s.findId(doc["_id"]) >= 0 {
+			return &mgo.LastError{Code: 11000, Err: fmt.Sprintf("E11000 duplicate key error: _id %v", doc["_id"])}
+		}
+		s.docs = append(s.docs, doc)
+	}
+	return nil
+}
+
+// findId returns the index of the document with the given id, or -1 if
+// there's none. It must be called with mu held.
+func (s *memoryStore) findId(id interface{}) int {
+	for i, doc := range s.docs {
+		if reflect.DeepEqual(doc["_id"], id) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryStore) Find(query interface{}) StoreQuery {
+	return &memoryQuery{store: s, query: query}
+}
+
+func (s *memoryStore) FindId(id interface{}) StoreQuery {
+	return &memoryQuery{store: s, query: bson.M{"_id": id}}
+}
+
+func (s *memoryStore) UpsertId(id interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	udoc, err := toDoc(update)
+	if err != nil {
+		return nil, err
+	}
+	iddoc, err := toDoc(bson.M{"_id": id})
+	if err != nil {
+		return nil, err
+	}
+	id = iddoc["_id"]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.findId(id)
+	doc := bson.M{"_id": id}
+	if i >= 0 {
+		doc = s.docs[i]
+	}
+	var operators, fields bool
+	for op, opfields := range udoc {
+		if !strings.HasPrefix(op, "$") {
+			fields = true
+			continue
+		}
+		operators = true
+		if op != "$set" && op != "$unset" {
+			return nil, fmt.Errorf("update operator %s not supported by in-memory store", op)
+		}
+		if _, ok := opfields.(bson.M); !ok {
+			return nil, fmt.Errorf("invalid %s update: %#v", op, opfields)
+		}
+	}
+	if operators && fields {
+		return nil, fmt.Errorf("cannot mix update operators and fields in update")
+	}
+	if operators {
+		for op, fields := range udoc {
+			for name, value := range fields.(bson.M) {
+				if op == "$set" {
+					setField(doc, name, value)
+				} else {
+					unsetField(doc, name)
+				}
+			}
+		}
+	} else {
+		udoc["_id"] = id
+		doc = udoc
+	}
+	if i >= 0 {
+		s.docs[i] = doc
+		return &mgo.ChangeInfo{Updated: 1, Matched: 1}, nil
+	}
+	s.docs = append(s.docs, doc)
+	return &mgo.ChangeInfo{UpsertedId: id}, nil
+}
+
+func (s *memoryStore) Close() {}
+
+// matches returns whether doc has all of the fields in query with equal
+// values.
+func (s *memoryStore) matches(doc, query bson.M) (bool, error) {
+	for name, want := range query {
+		if strings.HasPrefix(name, "$") {
+			return false, fmt.Errorf("query operator %s not supported by in-memory store", name)
+		}
+		if m, ok := want.(bson.M); ok {
+			for key := range m {
+				if strings.HasPrefix(key, "$") {
+					return false, fmt.Errorf("query operator %s not supported by in-memory store", key)
+				}
+			}
+		}
+		got, ok := getField(doc, name)
+		if !ok || !reflect.DeepEqual(got, want) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func getField(doc bson.M, name string) (interface{}, bool) {
+	parts := strings.Split(name, ".")
+	for _, part := range parts[:len(parts)-1] {
+		sub, ok := doc[part].(bson.M)
+		if !ok {
+			return nil, false
+		}
+		doc = sub
+	}
+	value, ok := doc[parts[len(parts)-1]]
+	return value, ok
+}
+
+func setField(doc bson.M, name string, value interface{}) {
+	parts := strings.Split(name, ".")
+	for _, part := range parts[:len(parts)-1] {
+		sub, ok := doc[part].(bson.M)
+		if !ok {
+			sub = bson.M{}
+			doc[part] = sub
+		}
+		doc = sub
+	}
+	doc[parts[len(parts)-1]] = value
+}
+
+func unsetField(doc bson.M, name string) {
+	parts := strings.Split(name, ".")
+	for _, part := range parts[:len(parts)-1] {
+		sub, ok := doc[part].(bson.M)
+		if !ok {
+			return
+		}
+		doc = sub
+	}
+	delete(doc, parts[len(parts)-1])
+}
+
+type memoryQuery struct {
+	store *memoryStore
+	query interface{}
+}
+
+// find returns copies of the documents matching the query.
+func (q *memoryQuery) find() ([]bson.M, error) {
+	query, err := toDoc(q.query)
+	if err != nil {
+		return nil, err
+	}
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	var found []bson.M
+	for _, doc := range q.store.docs {
+		ok, err := q.store.matches(doc, query)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = append(found, doc)
+		}
+	}
+	return found, nil
+}
+
+func (q *memoryQuery) One(result interface{}) error {
+	found, err := q.find()
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return mgo.ErrNotFound
+	}
+	data, err := bson.Marshal(found[0])
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, result)
+}
+
+func (q *memoryQuery) All(result interface{}) error {
+	found, err := q.find()
+	if err != nil {
+		return err
+	}
+	if found == nil {
+		found = []bson.M{}
+	}
+	data, err := bson.Marshal(bson.M{"all": found})
+	if err != nil {
+		return err
+	}
+	var doc struct{ All bson.Raw }
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	return doc.All.Unmarshal(result)
+}
+
+func (q *memoryQuery) Count() (int, error) {
+	found, err := q.find()
+	return len(found), err
+}
+
 func (t *PluginTester) sendMessage(msg *Message) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -80,6 +398,17 @@ func (t *PluginTester) ldap(name string) (ldap.Conn, error) {
 	return nil, fmt.Errorf("LDAP connection %q not found", name)
 }
 
+func (t *PluginTester) ldapStatus() []LDAPStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	statuses := make([]LDAPStatus, 0, len(t.ldaps))
+	for name, conn := range t.ldaps {
+		statuses = append(statuses, newLDAPStatus(name, conn))
+	}
+	sort.Sort(ldapStatuses(statuses))
+	return statuses
+}
+
 // Plugger returns the plugger that is provided to the plugin.
 func (t *PluginTester) Plugger() *Plugger {
 	return t.state.plugger
@@ -92,12 +421,23 @@ func (t *PluginTester) Start() error {
 	if t.state.plugin != nil {
 		panic("PluginTester.Start called more than once")
 	}
-	var err error
+	t.state.plugger.setStats(PluginStats{Started: time.Now().UTC()})
+	if err := t.state.plugger.resolveConfig(); err != nil {
+		return err
+	}
+	if err := t.state.spec.validate(t.state.plugger); err != nil {
+		return err
+	}
 	t.state.plugin = t.state.spec.Start(t.state.plugger)
-	return err
+	return nil
 }
 
 // SetDatabase sets the database to offer the plugin being tested.
+//
+// Without a database, plugins may still load and save their state via
+// Plugger.LoadState and Plugger.SaveState, and use stores obtained via
+// Plugger.Store, which are then kept in memory. Collections obtained via
+// Plugger.Collection always require a database.
 func (t *PluginTester) SetDatabase(db *mgo.Database) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -105,7 +445,7 @@ func (t *PluginTester) SetDatabase(db *mgo.Database) {
 		panic("PluginTester.SetDatabase called after Start")
 	}
 	// Ensure tests run with capped collections properly created.
-	err := createCollections(db)
+	err := createCollections(db, 0, 0)
 	if err != nil {
 		panic("PluginTester.SetDatabase cannot create default collections: " + err.Error())
 	}
@@ -141,12 +481,29 @@ func (t *PluginTester) SetTargets(value interface{}) {
 }
 
 // SetLDAP makes the provided LDAP connection available to the plugin.
+// The connection is reported as connected via Plugger.LDAPStatus unless
+// it has a Health method reporting otherwise, as *ldap.ManagedConn does.
 func (t *PluginTester) SetLDAP(name string, conn ldap.Conn) {
 	t.mu.Lock()
 	t.ldaps[name] = conn
 	t.mu.Unlock()
 }
 
+// SetPluginLogs sets the log lines the plugin being tested observes as
+// recently logged by the named plugin, and enables plugin log capture.
+func (t *PluginTester) SetPluginLogs(name string, lines []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	logs := t.state.plugger.logs
+	if logs == nil {
+		logs = newLogCapture(100)
+		t.state.plugger.setLogCapture(logs)
+	}
+	logs.mu.Lock()
+	logs.lines[name] = append([]string(nil), lines...)
+	logs.mu.Unlock()
+}
+
 func marshalRaw(value interface{}) bson.Raw {
 	if value == nil {
 		return emptyDoc
@@ -165,7 +522,10 @@ func marshalRaw(value interface{}) bson.Raw {
 
 // Stop stops the tester and the plugin being tested.
 func (t *PluginTester) Stop() error {
-	err := t.state.plugin.Stop()
+	var err error
+	if t.state.plugin != nil {
+		err = t.state.stop()
+	}
 	t.mu.Lock()
 	t.stopped = true
 	t.cond.Broadcast()
@@ -272,6 +632,9 @@ func (t *PluginTester) RecvAllIncoming() []string {
 func (t *PluginTester) Sendf(format string, args ...interface{}) {
 	account, message := parseSendfText(fmt.Sprintf(format, args...))
 	msg := ParseIncoming(account, "mup", "!", message)
+	if pmsg := t.state.prefixed(msg); pmsg != nil {
+		msg = pmsg
+	}
 	t.state.handle(msg, schema.CommandName(msg.BotText))
 }
 
@@ -321,6 +684,23 @@ func parseSendfText(text string) (account, message string) {
 	return account, ":nick!~user@host PRIVMSG " + target + " :" + text
 }
 
+// SendMessage delivers msg to the plugin being tested as an incoming
+// message, which allows testing fields that cannot be expressed in the
+// text provided to Sendf, such as the ones set by telegram accounts.
+// The message AsNick and Bang fields default to "mup" and "!".
+func (t *PluginTester) SendMessage(msg *Message) {
+	if msg.AsNick == "" {
+		msg.AsNick = "mup"
+	}
+	if msg.Bang == "" {
+		msg.Bang = "!"
+	}
+	if pmsg := t.state.prefixed(msg); pmsg != nil {
+		msg = pmsg
+	}
+	t.state.handle(msg, schema.CommandName(msg.BotText))
+}
+
 // SendAll sends each entry in text as an individual message to the bot.
 //
 // See Sendf for more details.
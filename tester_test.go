@@ -1,11 +1,14 @@
 package mup_test
 
 import (
+	"strings"
 	"testing"
 
 	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/mup.v0"
+	"gopkg.in/mup.v0/schema"
 )
 
 func Test(t *testing.T) { TestingT(t) }
@@ -46,6 +49,17 @@ func (s *TesterSuite) TestSendfRecv(c *C) {
 	c.Assert(log, Matches, `(?s).*\[echoA\] \[out\] \[cmd\] <repeat again>.*`)
 }
 
+func (s *TesterSuite) TestMatcher(c *C) {
+	tester := mup.NewPluginTester("echoA")
+	tester.Plugger().SetMatcher(mup.Match().Channel("#chan").TextContains("two"))
+	tester.Start()
+	tester.Sendf("echoAcmd two")
+	tester.Sendf("[#chan] mup: echoAcmd one")
+	tester.Sendf("[#chan] mup: echoAcmd two")
+	tester.Stop()
+	c.Check(tester.RecvAll(), DeepEquals, []string{"PRIVMSG #chan :nick: [cmd] two"})
+}
+
 func (s *TesterSuite) TestSendfTarget(c *C) {
 	tester := mup.NewPluginTester("echoA")
 	tester.Start()
@@ -158,6 +172,146 @@ func (s *TesterSuite) TestStop(c *C) {
 	c.Assert(c.GetTestLog(), Matches, "(?s).*testPlugin.Stop called.*")
 }
 
+var testNotesSpec = mup.PluginSpec{
+	Name:  "testnotes",
+	Start: testNotesStart,
+	Commands: schema.Commands{{
+		Name: "note",
+		Args: schema.Args{{Name: "text", Flag: schema.Trailing | schema.Required}},
+	}, {
+		Name: "notes",
+	}, {
+		Name: "last",
+	}},
+}
+
+func init() {
+	mup.RegisterPlugin(&testNotesSpec)
+}
+
+// testNotesPlugin takes notes from nicks via a mup.Store, and counts them
+// in its state, so that both may be tested without a database.
+type testNotesPlugin struct {
+	plugger *mup.Plugger
+	state   struct{ Count int }
+}
+
+type testNote struct {
+	Id   bson.ObjectId `bson:"_id,omitempty"`
+	Nick string
+	Text string
+}
+
+func testNotesStart(plugger *mup.Plugger) mup.Stopper {
+	p := &testNotesPlugin{plugger: plugger}
+	if err := plugger.LoadState(&p.state); err != nil {
+		plugger.Logf("Cannot load state: %v", err)
+	}
+	return p
+}
+
+func (p *testNotesPlugin) Stop() error {
+	return nil
+}
+
+func (p *testNotesPlugin) HandleCommand(cmd *mup.Command) {
+	notes := p.plugger.Store("notes", 0)
+	defer notes.Close()
+	authors := p.plugger.Store("authors", mup.Shared)
+	defer authors.Close()
+
+	var err error
+	switch cmd.Name() {
+	case "note":
+		var args struct{ Text string }
+		cmd.Args(&args)
+		err = notes.Insert(&testNote{Nick: cmd.Nick, Text: args.Text})
+		if err == nil {
+			_, err = authors.UpsertId(cmd.Nick, bson.M{"$set": bson.M{"last": args.Text}})
+		}
+		if err == nil {
+			p.state.Count++
+			err = p.plugger.SaveState(&p.state)
+		}
+		if err == nil {
+			p.plugger.Sendf(cmd, "Noted (%d so far).", p.state.Count)
+		}
+	case "notes":
+		var all []testNote
+		err = notes.Find(bson.M{"nick": cmd.Nick}).All(&all)
+		if err == nil {
+			var texts []string
+			for _, note := range all {
+				texts = append(texts, note.Text)
+			}
+			p.plugger.Sendf(cmd, "Notes: %s.", strings.Join(texts, ", "))
+		}
+	case "last":
+		var author struct{ Last string }
+		err = authors.FindId(cmd.Nick).One(&author)
+		if err == mgo.ErrNotFound {
+			p.plugger.Sendf(cmd, "No notes.")
+			return
+		}
+		if err == nil {
+			p.plugger.Sendf(cmd, "Last: %s.", author.Last)
+		}
+	}
+	if err != nil {
+		p.plugger.Sendf(cmd, "Oops: %v", err)
+	}
+}
+
+func (s *TesterSuite) TestMemoryStore(c *C) {
+	tester := mup.NewPluginTester("testnotes")
+	tester.Start()
+	tester.Sendf("last")
+	tester.Sendf("note one")
+	tester.Sendf("note two")
+	tester.Sendf("[,raw] :other!~user@host PRIVMSG mup :note three")
+	tester.Sendf("notes")
+	tester.Sendf("last")
+	tester.Sendf("[,raw] :other!~user@host PRIVMSG mup :last")
+	tester.Stop()
+
+	c.Assert(tester.RecvAll(), DeepEquals, []string{
+		"PRIVMSG nick :No notes.",
+		"PRIVMSG nick :Noted (1 so far).",
+		"PRIVMSG nick :Noted (2 so far).",
+		"PRIVMSG other :Noted (3 so far).",
+		"PRIVMSG nick :Notes: one, two.",
+		"PRIVMSG nick :Last: two.",
+		"PRIVMSG other :Last: three.",
+	})
+
+	p := tester.Plugger()
+	var state struct{ Count int }
+	c.Assert(p.LoadState(&state), IsNil)
+	c.Assert(state.Count, Equals, 3)
+
+	notes := p.Store("notes", 0)
+	defer notes.Close()
+	n, err := notes.Find(nil).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+
+	// Unsupported queries and updates fail rather than misbehave.
+	_, err = notes.Find(bson.M{"nick": bson.M{"$ne": "nick"}}).Count()
+	c.Assert(err, ErrorMatches, `query operator \$ne not supported by in-memory store`)
+	_, err = notes.UpsertId("id", bson.M{"$inc": bson.M{"n": 1}})
+	c.Assert(err, ErrorMatches, `update operator \$inc not supported by in-memory store`)
+
+	// Duplicated ids are rejected as by the database.
+	err = notes.Insert(bson.M{"_id": "id"}, bson.M{"_id": "id"})
+	c.Assert(mgo.IsDup(err), Equals, true)
+}
+
+func (s *TesterSuite) TestCollectionWithoutDatabase(c *C) {
+	tester := mup.NewPluginTester("echoA")
+	p := tester.Plugger()
+	c.Assert(func() { p.Collection("", 0) }, PanicMatches, "plugger has no database available")
+}
+
 func (s *TesterSuite) TestSetLDAP(c *C) {
 	conn := &ldapConn{}
 	tester := mup.NewPluginTester("echoA")
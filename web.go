@@ -0,0 +1,205 @@
+package mup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrNotModified is returned by ConditionalGetter.Do when the server
+// reports that the requested resource did not change since it was last
+// retrieved.
+var ErrNotModified = errors.New("resource not modified")
+
+// ConditionalGetter sends HTTP requests carrying the If-None-Match and
+// If-Modified-Since headers that match the ETag and Last-Modified headers
+// last remembered for the same URL, so that plugins polling web resources
+// may skip downloading and processing content that did not change.
+//
+// The zero value is ready to use, and sends requests via a client that
+// times out after NetworkTimeout. A ConditionalGetter may be used by
+// multiple goroutines simultaneously.
+type ConditionalGetter struct {
+	// Client, if set, is used to send requests.
+	Client *http.Client
+
+	mu         sync.Mutex
+	validators map[string]httpValidators
+}
+
+type httpValidators struct {
+	etag         string
+	lastModified string
+}
+
+// defaultClient is the HTTP client shared by the web helpers when
+// no other client is provided.
+var defaultClient = &http.Client{Timeout: NetworkTimeout}
+
+// Do sends req and returns the server response. If the server replies
+// with 304 Not Modified, the response body is closed and ErrNotModified
+// is returned instead. The validators of the response are only used in
+// further requests once Remember is called with it.
+func (g *ConditionalGetter) Do(req *http.Request) (*http.Response, error) {
+	key := req.URL.String()
+	g.mu.Lock()
+	v, ok := g.validators[key]
+	g.mu.Unlock()
+	if ok {
+		if v.etag != "" {
+			req.Header.Set("If-None-Match", v.etag)
+		}
+		if v.lastModified != "" {
+			req.Header.Set("If-Modified-Since", v.lastModified)
+		}
+	}
+	client := g.Client
+	if client == nil {
+		client = defaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return nil, ErrNotModified
+	}
+	return resp, nil
+}
+
+// Remember records the ETag and Last-Modified headers of resp, obtained
+// via Do, to be sent along with further requests for the same URL. It
+// must only be called once the response content was successfully
+// processed, so that content that failed to be processed is sent again
+// rather than reported as not modified.
+func (g *ConditionalGetter) Remember(resp *http.Response) {
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+	key := resp.Request.URL.String()
+	v := httpValidators{resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if v.etag == "" && v.lastModified == "" {
+		delete(g.validators, key)
+	} else {
+		if g.validators == nil {
+			g.validators = make(map[string]httpValidators)
+		}
+		g.validators[key] = v
+	}
+}
+
+// fetchMaxBytes is the maximum size of content retrieved via fetchCache.
+const fetchMaxBytes = 1024 * 1024
+
+// fetchRetries and fetchBackoff define how many times a request sent by
+// fetchCache is retried after a network error or a server failure, and
+// the initial delay between attempts, which doubles on every failure.
+var (
+	fetchRetries = 2
+	fetchBackoff = 500 * time.Millisecond
+)
+
+// fetchCache retrieves small remote files and caches their content per
+// URL for a while. The zero value is ready to use.
+type fetchCache struct {
+	mu      sync.Mutex
+	entries map[string]fetchEntry
+}
+
+type fetchEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// fetch unmarshals into result the JSON content found at url, either
+// from the cache or by sending a GET request when the cached content is
+// missing or older than ttl. Only content that is successfully decoded
+// is cached.
+func (fc *fetchCache) fetch(url string, result interface{}, ttl time.Duration) error {
+	now := time.Now()
+	fc.mu.Lock()
+	entry, ok := fc.entries[url]
+	fc.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return decodeFetched(url, entry.data, result)
+	}
+	data, err := fetchURL(url)
+	if err != nil {
+		return err
+	}
+	if err := decodeFetched(url, data, result); err != nil {
+		return err
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.entries == nil {
+		fc.entries = make(map[string]fetchEntry)
+	}
+	for key, old := range fc.entries {
+		if !now.Before(old.expires) {
+			delete(fc.entries, key)
+		}
+	}
+	if ttl > 0 {
+		fc.entries[url] = fetchEntry{data, now.Add(ttl)}
+	}
+	return nil
+}
+
+func decodeFetched(url string, data []byte, result interface{}) error {
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("cannot decode content from %s: %v", url, err)
+	}
+	return nil
+}
+
+// fetchURL returns the content found at url, retrying as defined by
+// fetchRetries and fetchBackoff.
+func fetchURL(url string) ([]byte, error) {
+	delay := fetchBackoff
+	for attempt := 0; ; attempt++ {
+		data, retry, err := fetchOnce(url)
+		if err == nil || !retry || attempt == fetchRetries {
+			return data, err
+		}
+		debugf("Cannot fetch %s (retrying in %v): %v", url, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// fetchOnce returns the content found at url. On errors, retry reports
+// whether a further attempt might succeed.
+func fetchOnce(url string) (data []byte, retry bool, err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("User-Agent", "mup")
+	req.Header.Set("Accept", "application/json")
+	resp, err := defaultClient.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("cannot fetch %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retry, fmt.Errorf("cannot fetch %s: %s", url, resp.Status)
+	}
+	data, err = ioutil.ReadAll(io.LimitReader(resp.Body, fetchMaxBytes+1))
+	if err != nil {
+		return nil, true, fmt.Errorf("cannot fetch %s: %v", url, err)
+	}
+	if len(data) > fetchMaxBytes {
+		return nil, false, fmt.Errorf("cannot fetch %s: content too large", url)
+	}
+	return data, false, nil
+}
@@ -0,0 +1,74 @@
+package mup_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mup.v0"
+)
+
+var _ = Suite(&WebSuite{})
+
+type WebSuite struct{}
+
+func (s *WebSuite) TestConditionalGetter(c *C) {
+	var conditions []string
+	etag := `"one"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conditions = append(conditions, req.Header.Get("If-None-Match")+" "+req.Header.Get("If-Modified-Since"))
+		if req.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Write([]byte("content " + etag))
+	}))
+	defer server.Close()
+
+	var getter mup.ConditionalGetter
+	remember := true
+	get := func() (string, error) {
+		req, err := http.NewRequest("GET", server.URL+"/path", nil)
+		c.Assert(err, IsNil)
+		resp, err := getter.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		if remember {
+			getter.Remember(resp)
+		}
+		return string(data), nil
+	}
+
+	// Content that failed to be processed is not remembered.
+	remember = false
+	content, err := get()
+	c.Assert(err, IsNil)
+	c.Assert(content, Equals, `content "one"`)
+
+	remember = true
+	content, err = get()
+	c.Assert(err, IsNil)
+	c.Assert(content, Equals, `content "one"`)
+
+	_, err = get()
+	c.Assert(err, Equals, mup.ErrNotModified)
+
+	etag = `"two"`
+	content, err = get()
+	c.Assert(err, IsNil)
+	c.Assert(content, Equals, `content "two"`)
+
+	c.Assert(conditions, DeepEquals, []string{
+		" ",
+		" ",
+		`"one" Mon, 02 Jan 2006 15:04:05 GMT`,
+		`"one" Mon, 02 Jan 2006 15:04:05 GMT`,
+	})
+}
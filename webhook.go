@@ -138,6 +138,7 @@ func (c *webhookClient) run() error {
 	for {
 		select {
 		case inMsg = <-inRecv:
+			inMsg.Locale = c.info.Locale
 			inRecv = nil
 			inSend = c.incoming
 
@@ -179,7 +180,6 @@ func (c *webhookClient) run() error {
 			return c.webhookW.Err()
 		}
 	}
-	panic("unreachable")
 }
 
 // ---------------------------------------------------------------------------
@@ -269,7 +269,7 @@ loop:
 
 		payload := webhookPayload{
 			Channel:   msg.Channel,
-			Text:      msg.Text,
+			Text:      StripFormatting(msg.Text),
 			Groupable: true,
 		}
 		if payload.Channel == "" {
@@ -305,6 +305,9 @@ loop:
 		}
 
 		// Notify the account manager that the message was delivered.
+		if msg.Id == "" {
+			continue
+		}
 		select {
 		case w.r.Incoming <- ParseIncoming(w.accountName, "mup", "/", "PONG :sent:"+msg.Id.Hex()):
 		case <-w.Dying:
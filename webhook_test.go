@@ -70,8 +70,7 @@ func (s *WebHookSuite) TearDownTest(c *C) {
 }
 
 func (s *WebHookSuite) TestQuit(c *C) {
-	err := s.server.Stop()
-	c.Assert(err, IsNil)
+	stopsPromptly(c, s.server.Stop)
 }
 
 func (s *WebHookSuite) SendUpdates(c *C, update ...string) {